@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aclCategories lists the commands in each ACL category, in the order ACL CAT
+// prints the categories. Commands with keys are also added to @read or
+// @write from their flags. An entry "CMD|SUB" gives a subcommand its own
+// categories in place of those of CMD.
+var aclCategories = []struct {
+	name     string
+	commands []string
+}{
+	{"keyspace", []string{"DEL", "UNLINK", "EXISTS", "TYPE", "RENAME", "RENAMENX", "COPY", "RANDOMKEY",
+		"TOUCH", "DBSIZE", "KEYS", "SCAN", "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT", "TTL", "PTTL",
+		"EXPIRETIME", "PEXPIRETIME", "PERSIST", "OBJECT", "MOVE", "SELECT", "SWAPDB", "FLUSHDB",
+		"FLUSHALL", "DUMPALL", "ANALYZE"}},
+	{"read", []string{"KEYS", "SCAN", "RANDOMKEY", "DBSIZE", "DUMPALL", "ANALYZE",
+		"TS.MRANGE", "TS.MREVRANGE", "TS.QUERYINDEX", "FT.SEARCH", "FT.INFO", "FT._LIST"}},
+	{"write", nil},
+	{"string", []string{"SET", "GET", "INCR", "DECR", "MSET", "MGET"}},
+	{"list", []string{"LPUSH", "RPOP", "LLEN"}},
+	{"set", []string{"SADD", "SREM", "SMEMBERS", "SSCAN"}},
+	{"hash", []string{"HSET", "HGET", "HDEL", "HGETALL", "HSCAN"}},
+	{"sortedset", []string{"ZADD", "ZREM", "ZRANGE", "ZSCORE", "ZSCAN"}},
+	{"json", nil}, {"bloom", nil}, {"cuckoo", nil}, {"cms", nil}, {"topk", nil},
+	{"timeseries", nil}, {"search", nil},
+	{"vectorset", []string{"VADD", "VSIM", "VREM", "VCARD", "VDIM", "VEMB", "VSETATTR", "VGETATTR", "VINFO"}},
+	{"connection", []string{"PING", "ECHO", "HELLO", "CLIENT", "AUTH", "ACL|WHOAMI", "ACL|CAT"}},
+	{"admin", []string{"ACL", "CONFIG", "DEBUG", "SHUTDOWN"}},
+	{"dangerous", []string{"ACL", "CONFIG", "DEBUG", "SHUTDOWN", "KEYS", "FLUSHDB", "FLUSHALL",
+		"SWAPDB", "DUMPALL", "ANALYZE", "INFO"}},
+}
+
+// aclModulePrefixes puts module commands in their module's category.
+var aclModulePrefixes = map[string]string{
+	"JSON.": "json", "BF.": "bloom", "CF.": "cuckoo", "CMS.": "cms",
+	"TOPK.": "topk", "TS.": "timeseries", "FT.": "search",
+}
+
+// aclSubcommands are the commands whose first argument is a subcommand that
+// rules can name, as in +config|get.
+var aclSubcommands = map[string]bool{
+	"ACL": true, "CLIENT": true, "CONFIG": true, "DEBUG": true, "MEMORY": true, "OBJECT": true,
+}
+
+// commandCategories maps "CMD" and "CMD|SUB" to their categories.
+var commandCategories = func() map[string][]string {
+	cats := make(map[string][]string)
+	for _, c := range aclCategories {
+		for _, name := range c.commands {
+			cats[name] = append(cats[name], c.name)
+		}
+	}
+	for name, spec := range commandTable {
+		for prefix, cat := range aclModulePrefixes {
+			if strings.HasPrefix(name, prefix) {
+				cats[name] = append(cats[name], cat)
+			}
+		}
+		if spec.flags&cmdWrite != 0 {
+			cats[name] = append(cats[name], "write")
+		} else if spec.step != 0 && !slices.Contains(cats[name], "read") {
+			cats[name] = append(cats[name], "read")
+		}
+	}
+	return cats
+}()
+
+// categoriesOf returns the categories of cmd, or of its subcommand sub.
+func categoriesOf(cmd, sub string) []string {
+	if sub != "" {
+		if cats, ok := commandCategories[cmd+"|"+sub]; ok {
+			return cats
+		}
+	}
+	return commandCategories[cmd]
+}
+
+// isACLCategory reports whether name is a category rules can name.
+func isACLCategory(name string) bool {
+	for _, c := range aclCategories {
+		if c.name == name {
+			return true
+		}
+	}
+	return name == "all"
+}
+
+// keyPerm is the access a key pattern grants.
+type keyPerm uint8
+
+const (
+	keyRead keyPerm = 1 << iota
+	keyWrite
+	keyReadWrite = keyRead | keyWrite
+)
+
+type keyPattern struct {
+	pattern string
+	perm    keyPerm
+}
+
+// String renders the pattern as a rule: ~p, %R~p or %W~p.
+func (k keyPattern) String() string {
+	switch k.perm {
+	case keyRead:
+		return "%R~" + k.pattern
+	case keyWrite:
+		return "%W~" + k.pattern
+	}
+	return "~" + k.pattern
+}
+
+// aclUser is an ACL user. Users are never changed once stored: ACL SETUSER
+// builds a new one, so a client may keep using the one it looked up.
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool     // any password, or none, authenticates
+	passwords []string // hex SHA-256 of each accepted password
+	commands  []string // +name, -name, +@category ... rules; the last that matches wins
+	keys      []keyPattern
+	channels  []string
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = slices.Clone(u.passwords)
+	c.commands = slices.Clone(u.commands)
+	c.keys = slices.Clone(u.keys)
+	c.channels = slices.Clone(u.channels)
+	return &c
+}
+
+// defaultACLUser is the user every connection starts as: enabled, without a
+// password and allowed everything.
+func defaultACLUser() *aclUser {
+	return &aclUser{
+		name:     "default",
+		enabled:  true,
+		nopass:   true,
+		commands: []string{"+@all"},
+		keys:     []keyPattern{{"*", keyReadWrite}},
+		channels: []string{"*"},
+	}
+}
+
+var (
+	errACLSyntax          = errors.New("Syntax error")
+	errACLUnknownCommand  = errors.New("Unknown command or category name in ACL")
+	errACLNoSuchPassword  = errors.New("The password you are trying to remove from the user does not exist")
+	errACLBadPasswordHash = errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+)
+
+// hashPassword returns the hex SHA-256 of password, as ACL users store it.
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func validPasswordHash(h string) bool {
+	if len(h) != sha256.Size*2 {
+		return false
+	}
+	for i := 0; i < len(h); i++ {
+		if !(h[i] >= '0' && h[i] <= '9' || h[i] >= 'a' && h[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// applyRule changes u by one ACL SETUSER rule.
+func (u *aclUser) applyRule(rule string) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass, u.passwords = true, nil
+		return nil
+	case "resetpass":
+		u.nopass, u.passwords = false, nil
+		return nil
+	case "allkeys":
+		u.keys = []keyPattern{{"*", keyReadWrite}}
+		return nil
+	case "resetkeys":
+		u.keys = nil
+		return nil
+	case "allchannels":
+		u.channels = []string{"*"}
+		return nil
+	case "resetchannels":
+		u.channels = nil
+		return nil
+	case "allcommands":
+		u.commands = []string{"+@all"}
+		return nil
+	case "nocommands":
+		u.commands = []string{"-@all"}
+		return nil
+	case "reset":
+		u.enabled, u.nopass, u.passwords = false, false, nil
+		u.keys, u.channels, u.commands = nil, nil, []string{"-@all"}
+		return nil
+	}
+	if rule == "" {
+		return errACLSyntax
+	}
+	switch rule[0] {
+	case '>', '#':
+		h := rule[1:]
+		if rule[0] == '>' {
+			h = hashPassword(h)
+		} else if !validPasswordHash(h) {
+			return errACLBadPasswordHash
+		}
+		if !slices.Contains(u.passwords, h) {
+			u.passwords = append(u.passwords, h)
+		}
+		u.nopass = false
+	case '<', '!':
+		h := rule[1:]
+		if rule[0] == '<' {
+			h = hashPassword(h)
+		} else if !validPasswordHash(h) {
+			return errACLBadPasswordHash
+		}
+		i := slices.Index(u.passwords, h)
+		if i < 0 {
+			return errACLNoSuchPassword
+		}
+		u.passwords = slices.Delete(u.passwords, i, i+1)
+	case '~':
+		u.keys = append(u.keys, keyPattern{rule[1:], keyReadWrite})
+	case '%':
+		flags, pattern, ok := strings.Cut(rule[1:], "~")
+		if !ok || flags == "" {
+			return errACLSyntax
+		}
+		var perm keyPerm
+		for _, f := range strings.ToUpper(flags) {
+			switch f {
+			case 'R':
+				perm |= keyRead
+			case 'W':
+				perm |= keyWrite
+			default:
+				return errACLSyntax
+			}
+		}
+		u.keys = append(u.keys, keyPattern{pattern, perm})
+	case '&':
+		u.channels = append(u.channels, rule[1:])
+	case '+', '-':
+		target := strings.ToLower(rule[1:])
+		if cat, ok := strings.CutPrefix(target, "@"); ok {
+			if !isACLCategory(cat) {
+				return errACLUnknownCommand
+			}
+			if cat == "all" {
+				u.commands = []string{rule[:1] + target}
+				return nil
+			}
+		} else {
+			cmd, sub, hasSub := strings.Cut(strings.ToUpper(target), "|")
+			if _, ok := commandTable[cmd]; !ok || hasSub && (sub == "" || !aclSubcommands[cmd]) {
+				return errACLUnknownCommand
+			}
+		}
+		// An earlier rule for the same target can no longer matter.
+		u.commands = slices.DeleteFunc(u.commands, func(r string) bool { return r[1:] == target })
+		u.commands = append(u.commands, rule[:1]+target)
+	default:
+		return errACLSyntax
+	}
+	return nil
+}
+
+// canRun reports whether u may run cmd, or its subcommand sub.
+func (u *aclUser) canRun(cmd, sub string) bool {
+	cats := categoriesOf(cmd, sub)
+	cmd, sub = strings.ToLower(cmd), strings.ToLower(sub)
+	allowed := false
+	for _, r := range u.commands {
+		target := r[1:]
+		var match bool
+		if cat, ok := strings.CutPrefix(target, "@"); ok {
+			match = cat == "all" || slices.Contains(cats, cat)
+		} else {
+			match = target == cmd || sub != "" && target == cmd+"|"+sub
+		}
+		if match {
+			allowed = r[0] == '+'
+		}
+	}
+	return allowed
+}
+
+// canAccessKey reports whether u may access key with perm.
+func (u *aclUser) canAccessKey(key string, perm keyPerm) bool {
+	for _, k := range u.keys {
+		if k.perm&perm == perm && globMatch(k.pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessAllKeys reports whether u may access every key with perm, as
+// commands that reach keys without naming them require.
+func (u *aclUser) canAccessAllKeys(perm keyPerm) bool {
+	for _, k := range u.keys {
+		if k.perm&perm == perm && k.pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPassword reports whether password authenticates u.
+func (u *aclUser) checkPassword(password string) bool {
+	if !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	h := []byte(hashPassword(password))
+	ok := false
+	for _, p := range u.passwords {
+		if subtle.ConstantTimeCompare(h, []byte(p)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// flags lists the user's flags as ACL GETUSER reports them.
+func (u *aclUser) flags() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+// commandRules describes the command rules, starting from -@all unless they
+// start from +@all.
+func (u *aclUser) commandRules() string {
+	if len(u.commands) == 0 {
+		return "-@all"
+	}
+	if u.commands[0] == "+@all" || u.commands[0] == "-@all" {
+		return strings.Join(u.commands, " ")
+	}
+	return "-@all " + strings.Join(u.commands, " ")
+}
+
+func (u *aclUser) keyRules() string {
+	rules := make([]string, len(u.keys))
+	for i, k := range u.keys {
+		rules[i] = k.String()
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *aclUser) channelRules() string {
+	rules := make([]string, len(u.channels))
+	for i, c := range u.channels {
+		rules[i] = "&" + c
+	}
+	return strings.Join(rules, " ")
+}
+
+// rules describes u as the ACL SETUSER rules that would recreate it, as in
+// ACL LIST and the ACL file.
+func (u *aclUser) rules() string {
+	parts := u.flags()
+	for _, p := range u.passwords {
+		parts = append(parts, "#"+p)
+	}
+	if len(u.keys) > 0 {
+		parts = append(parts, u.keyRules())
+	}
+	if len(u.channels) > 0 {
+		parts = append(parts, u.channelRules())
+	} else {
+		parts = append(parts, "resetchannels")
+	}
+	return strings.Join(append(parts, u.commandRules()), " ")
+}
+
+// aclLogEntry is a denied command, key or authentication. Entries that only
+// differ in time are counted together.
+type aclLogEntry struct {
+	id         int64
+	count      int
+	reason     string // command, key or auth
+	object     string // the command, the key or "AUTH"
+	username   string
+	clientInfo string
+	created    time.Time
+	updated    time.Time
+}
+
+// aclLogGroupTime is how recent an entry must be for a repeat to count
+// against it rather than start a new one.
+const aclLogGroupTime = time.Minute
+
+// ACL holds the users and the log of what they were denied.
+type ACL struct {
+	mu        sync.RWMutex
+	users     map[string]*aclUser
+	log       []*aclLogEntry // newest first
+	nextLogID int64
+}
+
+func newACL() *ACL {
+	return &ACL{users: map[string]*aclUser{"default": defaultACLUser()}}
+}
+
+// user returns the named user, or nil.
+func (a *ACL) user(name string) *aclUser {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.users[name]
+}
+
+// usernames returns the users' names in order.
+func (a *ACL) usernames() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// authRequired reports whether new connections must authenticate, which is
+// when the default user has a password or is disabled.
+func (a *ACL) authRequired() bool {
+	u := a.user("default")
+	return !u.enabled || !u.nopass
+}
+
+// setUser applies rules to the named user, creating it disabled and allowed
+// nothing if it does not exist. Either every rule applies or none does.
+func (a *ACL) setUser(name string, rules []string) error {
+	if name == "" || !validClientName(name) {
+		return &Error{"ERR", "Usernames can't contain spaces or null characters"}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u := &aclUser{name: name}
+	if old, ok := a.users[name]; ok {
+		u = old.clone()
+	}
+	for _, rule := range rules {
+		if err := u.applyRule(rule); err != nil {
+			return &Error{"ERR", "Error in ACL SETUSER modifier '" + rule + "': " + err.Error()}
+		}
+	}
+	a.users[name] = u
+	return nil
+}
+
+// deleteUsers removes the named users and returns how many existed. The
+// default user cannot be removed.
+func (a *ACL) deleteUsers(names []string) (int, error) {
+	if slices.Contains(names, "default") {
+		return 0, &Error{"ERR", "The 'default' user cannot be removed"}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	deleted := 0
+	for _, name := range names {
+		if _, ok := a.users[name]; ok {
+			delete(a.users, name)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// setRequirePass gives the default user password as its only one, or no
+// password at all if it is empty, as the requirepass parameter does.
+func (a *ACL) setRequirePass(password string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u := a.users["default"].clone()
+	u.nopass, u.passwords = password == "", nil
+	if password != "" {
+		u.passwords = []string{hashPassword(password)}
+	}
+	a.users["default"] = u
+}
+
+// logDenial records a denial, adding to a recent entry for the same thing
+// when there is one, and keeps at most maxLen entries.
+func (a *ACL) logDenial(reason, object, username, clientInfo string, maxLen int) {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, e := range a.log {
+		if e.reason == reason && e.object == object && e.username == username &&
+			now.Sub(e.updated) < aclLogGroupTime {
+			e.count++
+			e.updated, e.clientInfo = now, clientInfo
+			copy(a.log[1:i+1], a.log[:i])
+			a.log[0] = e
+			return
+		}
+	}
+	e := &aclLogEntry{
+		id: a.nextLogID, count: 1, reason: reason, object: object, username: username,
+		clientInfo: clientInfo, created: now, updated: now,
+	}
+	a.nextLogID++
+	a.log = append([]*aclLogEntry{e}, a.log...)
+	if len(a.log) > maxLen {
+		a.log = a.log[:maxLen]
+	}
+}
+
+// logEntries returns copies of the n newest log entries.
+func (a *ACL) logEntries(n int) []aclLogEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	n = min(n, len(a.log))
+	entries := make([]aclLogEntry, n)
+	for i := range entries {
+		entries[i] = *a.log[i]
+	}
+	return entries
+}
+
+func (a *ACL) resetLog() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.log = nil
+}
+
+// LoadFile replaces the users with those in an ACL file, one
+// "user name rule ..." per line as ACL LIST prints them. If the file does not
+// declare the default user, the current one is kept. On error nothing
+// changes.
+func (a *ACL) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users := make(map[string]*aclUser)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		args, err := splitInlineArgs(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if len(args) == 0 || strings.HasPrefix(args[0], "#") {
+			continue
+		}
+		if strings.ToLower(args[0]) != "user" || len(args) < 2 {
+			return fmt.Errorf("%s:%d: should start with user keyword", path, n)
+		}
+		name := args[1]
+		if !validClientName(name) {
+			return fmt.Errorf("%s:%d: usernames can't contain spaces or null characters", path, n)
+		}
+		if _, ok := users[name]; ok {
+			return fmt.Errorf("%s:%d: duplicate user '%s' found", path, n, name)
+		}
+		u := &aclUser{name: name}
+		for _, rule := range args[2:] {
+			if err := u.applyRule(rule); err != nil {
+				return fmt.Errorf("%s:%d: error in user declaration '%s': %v", path, n, rule, err)
+			}
+		}
+		users[name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := users["default"]; !ok {
+		users["default"] = a.users["default"]
+	}
+	a.users = users
+	return nil
+}
+
+// SaveFile writes every user to an ACL file that LoadFile reads back.
+// Passwords are written as their hashes.
+func (a *ACL) SaveFile(path string) error {
+	var b strings.Builder
+	for _, name := range a.usernames() {
+		if u := a.user(name); u != nil {
+			b.WriteString("user " + quoteConfigValue(name) + " " + u.rules() + "\n")
+		}
+	}
+	return writeFileAtomic(path, b.String())
+}
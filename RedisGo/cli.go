@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+)
+
+// runAnalyzeCLI asks the server at addr for an ANALYZE report and prints it.
+// If REDISCLI_AUTH is set it first authenticates with that password, as user
+// if one is given, like redis-cli does.
+func runAnalyzeCLI(w io.Writer, addr, user, match string, top int) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if password := os.Getenv("REDISCLI_AUTH"); password != "" {
+		auth := []string{"AUTH", password}
+		if user != "" {
+			auth = []string{"AUTH", user, password}
+		}
+		if _, err := cliCommand(conn, reader, auth...); err != nil {
+			return err
+		}
+	}
+	args := []string{"ANALYZE", "TOP", strconv.Itoa(top)}
+	if match != "" {
+		args = append(args, "MATCH", match)
+	}
+	r, err := cliCommand(conn, reader, args...)
+	if err != nil {
+		return err
+	}
+	var report string
+	switch r := r.(type) {
+	case bulkReply:
+		report = string(r)
+	case verbatimReply:
+		report = r.text
+	default:
+		return fmt.Errorf("unexpected reply %q", encodeReply(r, 3))
+	}
+	_, err = io.WriteString(w, report)
+	return err
+}
+
+// cliCommand sends args to the server and reads its reply, turning an error
+// reply into an error.
+func cliCommand(conn net.Conn, reader *bufio.Reader, args ...string) (Reply, error) {
+	if _, err := conn.Write(encodeReply(respArray(args), 2)); err != nil {
+		return nil, err
+	}
+	r, err := parseReply(reader)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := r.(errorReply); ok {
+		return nil, errors.New(string(e))
+	}
+	return r, nil
+}
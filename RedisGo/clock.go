@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// Clock is the Store's source of time. Every expiry and TTL calculation reads
+// it, so tests can substitute a FakeClock instead of sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+// AdjustableClock is a Clock that can be moved forward, as DEBUG
+// ADVANCE-CLOCK does.
+type AdjustableClock interface {
+	Clock
+	Advance(d time.Duration) error
+}
+
+var errClockRange = errors.New("clock offset out of range")
+
+// systemClock is wall-clock time plus an offset that only ever grows.
+type systemClock struct {
+	mu     sync.Mutex
+	offset time.Duration
+}
+
+func newSystemClock() *systemClock { return &systemClock{} }
+
+func (c *systemClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Add(c.offset)
+}
+
+// Advance moves the clock by d, refusing to wrap the offset around, which
+// would send the clock back and expire every key with a TTL.
+func (c *systemClock) Advance(d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d > 0 && c.offset > math.MaxInt64-d || d < 0 && c.offset < math.MinInt64-d {
+		return errClockRange
+	}
+	c.offset += d
+	return nil
+}
+
+// FakeClock only moves when told to.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock returns a clock stopped at start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Advance(d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import "strconv"
+
+// commandFlags describe how a command treats the keyspace.
+type commandFlags uint8
+
+const (
+	cmdWrite   commandFlags = 1 << iota // may modify the keys it names
+	cmdDenyOOM                          // may grow memory, so refused over maxmemory
+	cmdNoTouch                          // does not count as an access to its keys
+	cmdAnyKey                           // reaches keys it does not name, such as all keys matching a filter
+)
+
+// commandSpec describes a command: its flags and where its keys are. Keys
+// are the arguments firstKey, firstKey+step, ... up to lastKey, counted from
+// the first argument after the command name; a negative lastKey counts from
+// the end. A zero step means the command takes no keys. firstPerm, if set,
+// is the access the first key needs when it differs from the others, as for
+// the source of COPY and RENAME. numKeys, if set, is the argument giving how
+// many source keys follow it, as for CMS.MERGE; those keys are only read.
+type commandSpec struct {
+	flags     commandFlags
+	firstKey  int
+	lastKey   int
+	step      int
+	firstPerm keyPerm
+	numKeys   int
+}
+
+// keys returns the key arguments of a call to the command.
+func (c commandSpec) keys(args []string) []string {
+	keys, _ := c.access(args)
+	return keys
+}
+
+// access returns the key arguments of a call to the command along with the
+// access each of them needs.
+func (c commandSpec) access(args []string) ([]string, []keyPerm) {
+	if c.step == 0 {
+		return nil, nil
+	}
+	perm := keyRead
+	if c.flags&cmdWrite != 0 {
+		perm = keyWrite
+	}
+	last := c.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	var keys []string
+	var perms []keyPerm
+	for i := c.firstKey; i <= last && i < len(args); i += c.step {
+		need := perm
+		if len(keys) == 0 && c.firstPerm != 0 {
+			need = c.firstPerm
+		}
+		keys = append(keys, args[i])
+		perms = append(perms, need)
+	}
+	if c.numKeys > 0 && c.numKeys < len(args) {
+		n, _ := strconv.Atoi(args[c.numKeys])
+		for i := c.numKeys + 1; i <= c.numKeys+n && i < len(args); i++ {
+			keys = append(keys, args[i])
+			perms = append(perms, keyRead)
+		}
+	}
+	return keys, perms
+}
+
+var (
+	readKey    = commandSpec{firstKey: 0, lastKey: 0, step: 1}
+	writeKey   = commandSpec{flags: cmdWrite | cmdDenyOOM, firstKey: 0, lastKey: 0, step: 1}
+	modifyKey  = commandSpec{flags: cmdWrite, firstKey: 0, lastKey: 0, step: 1}
+	noKeys     = commandSpec{}
+	anyKey     = commandSpec{flags: cmdAnyKey}
+	allKeys    = commandSpec{firstKey: 0, lastKey: -1, step: 1}
+	modifyKeys = commandSpec{flags: cmdWrite, firstKey: 0, lastKey: -1, step: 1}
+)
+
+// commandTable lists every command the server knows. Commands missing from it
+// are treated as taking no keys.
+var commandTable = map[string]commandSpec{
+	"PING": noKeys, "ECHO": noKeys, "COMMANDS": noKeys, "HELP": noKeys,
+	"INFO": noKeys, "DEBUG": noKeys, "DUMPALL": anyKey, "KEYS": noKeys,
+	"SCAN": noKeys, "RANDOMKEY": noKeys, "DBSIZE": noKeys, "ANALYZE": anyKey,
+	"HELLO": noKeys, "CLIENT": noKeys, "CONFIG": noKeys, "SHUTDOWN": noKeys,
+	"AUTH": noKeys, "ACL": noKeys,
+
+	"SET": writeKey, "GET": readKey, "INCR": writeKey, "DECR": writeKey,
+	"MSET":   {flags: cmdWrite | cmdDenyOOM, firstKey: 0, lastKey: -1, step: 2},
+	"MGET":   allKeys,
+	"DEL":    modifyKeys,
+	"UNLINK": modifyKeys,
+
+	"LPUSH": writeKey, "RPOP": modifyKey, "LLEN": readKey,
+	"SADD": writeKey, "SREM": modifyKey, "SMEMBERS": readKey, "SSCAN": readKey,
+	"HSET": writeKey, "HGET": readKey, "HDEL": modifyKey, "HGETALL": readKey, "HSCAN": readKey,
+	"ZADD": writeKey, "ZREM": modifyKey, "ZRANGE": readKey, "ZSCORE": readKey, "ZSCAN": readKey,
+
+	"JSON.SET": writeKey, "JSON.GET": readKey, "JSON.DEL": modifyKey, "JSON.FORGET": modifyKey,
+	"JSON.TYPE": readKey, "JSON.NUMINCRBY": writeKey, "JSON.ARRAPPEND": writeKey,
+	"JSON.ARRINSERT": writeKey, "JSON.ARRLEN": readKey, "JSON.ARRPOP": modifyKey, "JSON.OBJKEYS": readKey,
+
+	"BF.RESERVE": writeKey, "BF.ADD": writeKey, "BF.MADD": writeKey, "BF.EXISTS": readKey,
+	"BF.MEXISTS": readKey, "BF.INFO": readKey,
+	"CF.RESERVE": writeKey, "CF.ADD": writeKey, "CF.ADDNX": writeKey, "CF.EXISTS": readKey,
+	"CF.MEXISTS": readKey, "CF.DEL": modifyKey, "CF.COUNT": readKey, "CF.INFO": readKey,
+
+	"CMS.INITBYDIM": writeKey, "CMS.INITBYPROB": writeKey, "CMS.INCRBY": writeKey,
+	"CMS.QUERY": readKey, "CMS.INFO": readKey,
+	"CMS.MERGE":    {flags: cmdWrite | cmdDenyOOM, firstKey: 0, lastKey: 0, step: 1, numKeys: 1},
+	"TOPK.RESERVE": writeKey, "TOPK.ADD": writeKey, "TOPK.INCRBY": writeKey, "TOPK.QUERY": readKey,
+	"TOPK.COUNT": readKey, "TOPK.LIST": readKey, "TOPK.INFO": readKey,
+
+	"TS.CREATE": writeKey, "TS.ADD": writeKey, "TS.GET": readKey, "TS.RANGE": readKey,
+	"TS.REVRANGE": readKey, "TS.DEL": modifyKey, "TS.INFO": readKey,
+	"TS.MADD":       {flags: cmdWrite | cmdDenyOOM, firstKey: 0, lastKey: -1, step: 3},
+	"TS.CREATERULE": {flags: cmdWrite | cmdDenyOOM, firstKey: 0, lastKey: 1, step: 1},
+	"TS.DELETERULE": {flags: cmdWrite, firstKey: 0, lastKey: 1, step: 1},
+	"TS.MRANGE":     anyKey, "TS.MREVRANGE": anyKey, "TS.QUERYINDEX": anyKey,
+
+	// Index names are not keys; FT.SEARCH returns and FT.DROPINDEX DD
+	// deletes whichever documents the index holds.
+	"FT.CREATE":    {flags: cmdWrite | cmdDenyOOM},
+	"FT.DROPINDEX": {flags: cmdWrite | cmdAnyKey},
+	"FT.SEARCH":    anyKey, "FT.INFO": noKeys, "FT._LIST": noKeys,
+
+	"VADD": writeKey, "VSIM": readKey, "VREM": modifyKey, "VCARD": readKey, "VDIM": readKey,
+	"VEMB": readKey, "VSETATTR": writeKey, "VGETATTR": readKey, "VINFO": readKey,
+
+	"EXPIRE": modifyKey, "PEXPIRE": modifyKey, "EXPIREAT": modifyKey, "PEXPIREAT": modifyKey,
+	"TTL": readKey, "PTTL": readKey, "EXPIRETIME": readKey, "PEXPIRETIME": readKey, "PERSIST": modifyKey,
+
+	"EXISTS": allKeys, "TYPE": readKey, "TOUCH": allKeys,
+	"RENAME":   {flags: cmdWrite, firstKey: 0, lastKey: 1, step: 1, firstPerm: keyReadWrite},
+	"RENAMENX": {flags: cmdWrite, firstKey: 0, lastKey: 1, step: 1, firstPerm: keyReadWrite},
+	"OBJECT":   {flags: cmdNoTouch, firstKey: 1, lastKey: 1, step: 1},
+	"MOVE":     {flags: cmdWrite, firstKey: 0, lastKey: 0, step: 1},
+	"SELECT":   noKeys, "SWAPDB": {flags: cmdWrite}, "FLUSHDB": {flags: cmdWrite}, "FLUSHALL": {flags: cmdWrite},
+	"MEMORY": {flags: cmdNoTouch, firstKey: 1, lastKey: 1, step: 1},
+	"COPY":   {flags: cmdWrite | cmdDenyOOM, firstKey: 0, lastKey: 1, step: 1, firstPerm: keyRead},
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server's tunable parameters. It is read from a
+// redis.conf-style file and command-line flags, and CONFIG SET changes the
+// mutable ones at runtime.
+type Config struct {
+	Bind            string
+	Port            int
+	Databases       int
+	Timeout         time.Duration // idle clients are closed after this, 0 for never
+	MaxMemory       int64
+	MaxMemoryPolicy EvictionPolicy
+	ProtoMaxBulkLen int64
+	MaxMultibulkLen int64
+	Save            []SaveRule
+	RequirePass     string // the default user's password, empty for none
+	ACLFile         string // users are loaded from here and saved by ACL SAVE
+	ACLLogMaxLen    int
+	DebugCommand    string // enable-debug-command: yes, no, or local for loopback clients
+
+	// TLS clients connect on TLSPort, 0 for none. The files are reread when
+	// they change.
+	TLSPort        int
+	TLSCertFile    string
+	TLSKeyFile     string
+	TLSCACertFile  string
+	TLSAuthClients string // yes, no or optional
+	TLSProtocols   string // space-separated, such as "TLSv1.2 TLSv1.3"
+	TLSCiphers     string // colon-separated IANA names, for TLS 1.2 and below
+}
+
+// SaveRule asks for a snapshot after Changes writes within Seconds. Rules are
+// kept so configs written for Redis load and round-trip, but nothing reads
+// them until snapshotting exists.
+type SaveRule struct {
+	Seconds int
+	Changes int
+}
+
+// DefaultConfig returns the configuration used when nothing is set.
+func DefaultConfig() Config {
+	return Config{
+		Port:            6379,
+		Databases:       16,
+		Timeout:         10 * time.Minute,
+		MaxMemoryPolicy: NoEviction,
+		ProtoMaxBulkLen: defaultProtoLimits.maxBulkLen,
+		MaxMultibulkLen: defaultProtoLimits.maxMultibulk,
+		Save:            []SaveRule{{3600, 1}, {300, 100}, {60, 10000}},
+		ACLLogMaxLen:    128,
+		DebugCommand:    "no",
+		TLSAuthClients:  "yes",
+	}
+}
+
+// Addr is the address the server listens on.
+func (c Config) Addr() string {
+	return c.Bind + ":" + strconv.Itoa(c.Port)
+}
+
+// TLSAddr is the address the server listens on for TLS clients.
+func (c Config) TLSAddr() string {
+	return c.Bind + ":" + strconv.Itoa(c.TLSPort)
+}
+
+func (c Config) protoLimits() protoLimits {
+	return protoLimits{maxBulkLen: c.ProtoMaxBulkLen, maxMultibulk: c.MaxMultibulkLen}
+}
+
+// configParam is a parameter as named in config files, flags and CONFIG.
+type configParam struct {
+	name    string
+	mutable bool // may be changed by CONFIG SET
+	get     func(c *Config) string
+	set     func(c *Config, v string) error
+}
+
+var (
+	errConfigNotPositive = errors.New("argument must be greater than 0")
+	errConfigOutOfRange  = errors.New("argument out of range")
+)
+
+var configParams = []configParam{
+	{
+		name: "bind",
+		get:  func(c *Config) string { return c.Bind },
+		set:  func(c *Config, v string) error { c.Bind = v; return nil },
+	},
+	{
+		name: "port",
+		get:  func(c *Config) string { return strconv.Itoa(c.Port) },
+		set:  func(c *Config, v string) error { return setPort(&c.Port, v) },
+	},
+	{
+		name: "databases",
+		get:  func(c *Config) string { return strconv.Itoa(c.Databases) },
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return errConfigNotPositive
+			}
+			c.Databases = n
+			return nil
+		},
+	},
+	{
+		name:    "timeout",
+		mutable: true,
+		get:     func(c *Config) string { return strconv.Itoa(int(c.Timeout / time.Second)) },
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return errors.New("argument must be a number of seconds")
+			}
+			c.Timeout = time.Duration(n) * time.Second
+			return nil
+		},
+	},
+	{
+		name:    "maxmemory",
+		mutable: true,
+		get:     func(c *Config) string { return strconv.FormatInt(c.MaxMemory, 10) },
+		set: func(c *Config, v string) error {
+			n, err := parseMemorySize(v)
+			if err == errConfigOutOfRange {
+				return err
+			}
+			if err != nil {
+				return errors.New("argument must be a memory value")
+			}
+			c.MaxMemory = n
+			return nil
+		},
+	},
+	{
+		name:    "maxmemory-policy",
+		mutable: true,
+		get:     func(c *Config) string { return c.MaxMemoryPolicy.String() },
+		set: func(c *Config, v string) error {
+			p, ok := ParseEvictionPolicy(strings.ToLower(v))
+			if !ok {
+				return errors.New("argument must be one of the eviction policies")
+			}
+			c.MaxMemoryPolicy = p
+			return nil
+		},
+	},
+	{
+		name:    "proto-max-bulk-len",
+		mutable: true,
+		get:     func(c *Config) string { return strconv.FormatInt(c.ProtoMaxBulkLen, 10) },
+		set: func(c *Config, v string) error {
+			n, err := parseMemorySize(v)
+			if err == errConfigOutOfRange {
+				return err
+			}
+			if err != nil || n == 0 {
+				return errConfigNotPositive
+			}
+			c.ProtoMaxBulkLen = n
+			return nil
+		},
+	},
+	{
+		name:    "max-multibulk-len",
+		mutable: true,
+		get:     func(c *Config) string { return strconv.FormatInt(c.MaxMultibulkLen, 10) },
+		set: func(c *Config, v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 1 {
+				return errConfigNotPositive
+			}
+			c.MaxMultibulkLen = n
+			return nil
+		},
+	},
+	{
+		name:    "save",
+		mutable: true,
+		get: func(c *Config) string {
+			parts := make([]string, 0, 2*len(c.Save))
+			for _, r := range c.Save {
+				parts = append(parts, strconv.Itoa(r.Seconds), strconv.Itoa(r.Changes))
+			}
+			return strings.Join(parts, " ")
+		},
+		set: func(c *Config, v string) error {
+			fields := strings.Fields(v)
+			if len(fields)%2 != 0 {
+				return errors.New("argument must be pairs of seconds and changes")
+			}
+			rules := make([]SaveRule, 0, len(fields)/2)
+			for i := 0; i < len(fields); i += 2 {
+				secs, err1 := strconv.Atoi(fields[i])
+				changes, err2 := strconv.Atoi(fields[i+1])
+				if err1 != nil || err2 != nil || secs < 1 || changes < 0 {
+					return errors.New("argument must be pairs of seconds and changes")
+				}
+				rules = append(rules, SaveRule{secs, changes})
+			}
+			c.Save = rules
+			return nil
+		},
+	},
+	{
+		name:    "requirepass",
+		mutable: true,
+		get:     func(c *Config) string { return c.RequirePass },
+		set:     func(c *Config, v string) error { c.RequirePass = v; return nil },
+	},
+	{
+		name: "aclfile",
+		get:  func(c *Config) string { return c.ACLFile },
+		set:  func(c *Config, v string) error { c.ACLFile = v; return nil },
+	},
+	{
+		name:    "acllog-max-len",
+		mutable: true,
+		get:     func(c *Config) string { return strconv.Itoa(c.ACLLogMaxLen) },
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return errors.New("argument must be a non-negative number")
+			}
+			c.ACLLogMaxLen = n
+			return nil
+		},
+	},
+	{
+		name: "enable-debug-command",
+		get:  func(c *Config) string { return c.DebugCommand },
+		set: func(c *Config, v string) error {
+			switch v = strings.ToLower(v); v {
+			case "yes", "no", "local":
+				c.DebugCommand = v
+				return nil
+			}
+			return errors.New("argument must be 'yes', 'no' or 'local'")
+		},
+	},
+	{
+		name: "tls-port",
+		get:  func(c *Config) string { return strconv.Itoa(c.TLSPort) },
+		set:  func(c *Config, v string) error { return setPort(&c.TLSPort, v) },
+	},
+	{
+		name:    "tls-cert-file",
+		mutable: true,
+		get:     func(c *Config) string { return c.TLSCertFile },
+		set:     func(c *Config, v string) error { c.TLSCertFile = v; return nil },
+	},
+	{
+		name:    "tls-key-file",
+		mutable: true,
+		get:     func(c *Config) string { return c.TLSKeyFile },
+		set:     func(c *Config, v string) error { c.TLSKeyFile = v; return nil },
+	},
+	{
+		name:    "tls-ca-cert-file",
+		mutable: true,
+		get:     func(c *Config) string { return c.TLSCACertFile },
+		set:     func(c *Config, v string) error { c.TLSCACertFile = v; return nil },
+	},
+	{
+		name:    "tls-auth-clients",
+		mutable: true,
+		get:     func(c *Config) string { return c.TLSAuthClients },
+		set: func(c *Config, v string) error {
+			switch v = strings.ToLower(v); v {
+			case "yes", "no", "optional":
+				c.TLSAuthClients = v
+				return nil
+			}
+			return errors.New("argument must be 'yes', 'no' or 'optional'")
+		},
+	},
+	{
+		name:    "tls-protocols",
+		mutable: true,
+		get:     func(c *Config) string { return c.TLSProtocols },
+		set: func(c *Config, v string) error {
+			if _, _, err := parseTLSProtocols(v); err != nil {
+				return err
+			}
+			c.TLSProtocols = v
+			return nil
+		},
+	},
+	{
+		name:    "tls-ciphers",
+		mutable: true,
+		get:     func(c *Config) string { return c.TLSCiphers },
+		set: func(c *Config, v string) error {
+			if _, err := parseTLSCiphers(v); err != nil {
+				return err
+			}
+			c.TLSCiphers = v
+			return nil
+		},
+	},
+}
+
+// setPort parses a port number into *port; 0 means none.
+func setPort(port *int, v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > 65535 {
+		return errors.New("argument must be a port number")
+	}
+	*port = n
+	return nil
+}
+
+// lookupConfigParam finds a parameter by its case-insensitive name.
+func lookupConfigParam(name string) (configParam, bool) {
+	name = strings.ToLower(name)
+	for _, p := range configParams {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return configParam{}, false
+}
+
+// setConfigParam sets one parameter of c by name.
+func setConfigParam(c *Config, name, value string) error {
+	p, ok := lookupConfigParam(name)
+	if !ok {
+		return fmt.Errorf("unknown parameter '%s'", name)
+	}
+	return p.set(c, value)
+}
+
+// LoadConfigFile applies the parameters in a redis.conf-style file to c: one
+// "name value ..." per line, split like inline commands, with # comments. A
+// later line overrides an earlier one, except that save lines add up.
+func LoadConfigFile(path string, c *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	saves := []string(nil)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		args, err := splitInlineArgs(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if len(args) == 0 || strings.HasPrefix(args[0], "#") {
+			continue
+		}
+		name, value := strings.ToLower(args[0]), strings.Join(args[1:], " ")
+		if name == "save" {
+			saves = append(saves, value)
+			value = strings.Join(saves, " ")
+		}
+		if err := setConfigParam(c, name, value); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// configRewriteMarker heads the parameters CONFIG REWRITE had to append.
+const configRewriteMarker = "# Generated by CONFIG REWRITE"
+
+// RewriteConfigFile writes c back to the file at path, keeping its comments
+// and layout. Each parameter replaces its first line in the file and any
+// repeats are dropped; parameters missing from the file are appended when
+// they differ from the default. The file is replaced atomically.
+func RewriteConfigFile(path string, c Config) error {
+	var lines []string
+	if data, err := os.ReadFile(path); err == nil {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	written := make(map[string]bool)
+	var out []string
+	for _, line := range lines {
+		args, err := splitInlineArgs(line)
+		if err != nil || len(args) == 0 || strings.HasPrefix(args[0], "#") {
+			out = append(out, line)
+			continue
+		}
+		p, ok := lookupConfigParam(args[0])
+		if !ok {
+			out = append(out, line)
+			continue
+		}
+		if !written[p.name] {
+			out = append(out, configLines(p, &c)...)
+			written[p.name] = true
+		}
+	}
+
+	defaults := DefaultConfig()
+	appended := false
+	for _, p := range configParams {
+		if written[p.name] || p.get(&c) == p.get(&defaults) {
+			continue
+		}
+		if !appended && (len(out) == 0 || out[len(out)-1] != configRewriteMarker) {
+			out = append(out, configRewriteMarker)
+		}
+		appended = true
+		out = append(out, configLines(p, &c)...)
+	}
+
+	return writeFileAtomic(path, strings.Join(out, "\n")+"\n")
+}
+
+// writeFileAtomic replaces the file at path with data, so that readers see
+// either the old file or the new one in full.
+func writeFileAtomic(path, data string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".redisgo-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// configLines renders p as config file lines. Save rules get a line each, as
+// Redis writes them.
+func configLines(p configParam, c *Config) []string {
+	if p.name == "save" && len(c.Save) > 0 {
+		lines := make([]string, len(c.Save))
+		for i, r := range c.Save {
+			lines[i] = fmt.Sprintf("save %d %d", r.Seconds, r.Changes)
+		}
+		return lines
+	}
+	return []string{p.name + " " + quoteConfigValue(p.get(c))}
+}
+
+// quoteConfigValue quotes v if it would not read back as one argument.
+func quoteConfigValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \t\r\n\"'\\#") {
+		return v
+	}
+	return strconv.Quote(v)
+}
+
+// parseMemorySize parses a byte count with an optional kb, mb or gb suffix,
+// returning errConfigOutOfRange for counts that do not fit in an int64.
+func parseMemorySize(s string) (int64, error) {
+	s = strings.ToLower(s)
+	unit := int64(1)
+	for suffix, mult := range map[string]int64{"kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30} {
+		if strings.HasSuffix(s, suffix) {
+			s, unit = strings.TrimSuffix(s, suffix), mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if errors.Is(err, strconv.ErrRange) || err == nil && n > math.MaxInt64/unit {
+		return 0, errConfigOutOfRange
+	}
+	if err != nil || n < 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return n * unit, nil
+}
@@ -0,0 +1,20 @@
+package main
+
+// Error is an error whose reply carries a Redis error code, such as
+// WRONGTYPE, in place of the generic ERR. Client libraries match on the code.
+type Error struct {
+	Code string
+	Msg  string
+}
+
+func (e *Error) Error() string { return e.Code + " " + e.Msg }
+
+var (
+	// ErrWrongType is returned by operations on a key holding another type.
+	// They never replace the existing value.
+	ErrWrongType  = &Error{"WRONGTYPE", "Operation against a key holding the wrong kind of value"}
+	ErrNotInteger = &Error{"ERR", "value is not an integer or out of range"}
+	ErrNoProto    = &Error{"NOPROTO", "unsupported protocol version"}
+	ErrWrongPass  = &Error{"WRONGPASS", "invalid username-password pair or user is disabled."}
+	ErrNoAuth     = &Error{"NOAUTH", "Authentication required."}
+)
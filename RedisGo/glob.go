@@ -0,0 +1,123 @@
+package main
+
+// globMatch reports whether s matches a Redis glob pattern:
+//
+//	h*llo     '*' matches any sequence of characters, including none
+//	h?llo     '?' matches exactly one character
+//	h[ae]llo  one of the listed characters; [^e] negates, [a-z] is a range
+//	h\*llo    a backslash makes the next character literal
+//
+// It follows Redis' stringmatchlen and, like it, works on bytes. Rather than
+// recursing on every '*' it only backtracks to the most recent one, which
+// keeps matching O(len(pattern)*len(s)) even for patterns like "*a*a*a*b".
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch c := pattern[p]; c {
+			case '*':
+				star, starI = p, i
+				p++
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if matched, rest := globClass(pattern[p+1:], s[i]); matched {
+					p = len(pattern) - len(rest)
+					i++
+					continue
+				}
+			case '\\':
+				lit, next := c, p+1
+				if p+1 < len(pattern) {
+					lit, next = pattern[p+1], p+2
+				}
+				if lit == s[i] {
+					p = next
+					i++
+					continue
+				}
+			default:
+				if c == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// Let the last '*' swallow one more character and retry.
+		starI++
+		p, i = star+1, starI
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// globClass matches c against the bracket expression at the start of p (just
+// after '['). It returns whether c matched and the pattern after the closing
+// ']'. An unterminated class extends to the end of the pattern.
+func globClass(p string, c byte) (bool, string) {
+	not := len(p) > 0 && p[0] == '^'
+	if not {
+		p = p[1:]
+	}
+	matched := false
+	for len(p) > 0 && p[0] != ']' {
+		switch {
+		case p[0] == '\\' && len(p) >= 2:
+			if p[1] == c {
+				matched = true
+			}
+			p = p[2:]
+		case len(p) >= 3 && p[1] == '-':
+			lo, hi := p[0], p[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if c >= lo && c <= hi {
+				matched = true
+			}
+			p = p[3:]
+		default:
+			if p[0] == c {
+				matched = true
+			}
+			p = p[1:]
+		}
+	}
+	if len(p) > 0 {
+		p = p[1:] // ']'
+	}
+	if not {
+		matched = !matched
+	}
+	return matched, p
+}
+
+// globPrefix returns the literal text every match of pattern must start with,
+// and whether the pattern is entirely literal.
+func globPrefix(pattern string) (string, bool) {
+	prefix := make([]byte, 0, len(pattern))
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*', '?', '[':
+			return string(prefix), false
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			prefix = append(prefix, pattern[i])
+		default:
+			prefix = append(prefix, c)
+		}
+	}
+	return string(prefix), true
+}
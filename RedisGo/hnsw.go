@@ -0,0 +1,252 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// hnswGraph is a Hierarchical Navigable Small World index: a stack of
+// proximity graphs where each layer holds an exponentially thinning subset of
+// the nodes. Searches descend greedily from the sparse top layer and then
+// widen into a best-first search of layer 0.
+type hnswGraph struct {
+	m              int // max links per node above layer 0; layer 0 allows 2*m
+	efConstruction int
+	levelMult      float64
+	dist           func(a, b []float32) float32
+	nodes          map[string]*hnswNode
+	entry          *hnswNode
+}
+
+type hnswNode struct {
+	id    string
+	vec   []float32
+	links [][]*hnswNode // links[layer]
+}
+
+// hnswCandidate is a node with its distance to the current query.
+type hnswCandidate struct {
+	node *hnswNode
+	dist float32
+}
+
+// candidateHeap is a min-heap on distance, or a max-heap when max is set.
+type candidateHeap struct {
+	items []hnswCandidate
+	max   bool
+}
+
+func (h candidateHeap) Len() int { return len(h.items) }
+func (h candidateHeap) Less(i, j int) bool {
+	if h.max {
+		return h.items[i].dist > h.items[j].dist
+	}
+	return h.items[i].dist < h.items[j].dist
+}
+func (h candidateHeap) Swap(i, j int)       { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *candidateHeap) Push(x interface{}) { h.items = append(h.items, x.(hnswCandidate)) }
+func (h *candidateHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+func newHNSWGraph(m, efConstruction int, dist func(a, b []float32) float32) *hnswGraph {
+	return &hnswGraph{
+		m:              m,
+		efConstruction: efConstruction,
+		levelMult:      1 / math.Log(float64(m)),
+		dist:           dist,
+		nodes:          make(map[string]*hnswNode),
+	}
+}
+
+func (g *hnswGraph) maxLinks(layer int) int {
+	if layer == 0 {
+		return 2 * g.m
+	}
+	return g.m
+}
+
+func (g *hnswGraph) randomLevel() int {
+	return int(math.Floor(-math.Log(1-rand.Float64()) * g.levelMult))
+}
+
+// Insert adds id to the graph. An existing node with the same id is replaced.
+func (g *hnswGraph) Insert(id string, vec []float32) {
+	if _, ok := g.nodes[id]; ok {
+		g.Remove(id)
+	}
+	level := g.randomLevel()
+	n := &hnswNode{id: id, vec: vec, links: make([][]*hnswNode, level+1)}
+	g.nodes[id] = n
+	if g.entry == nil {
+		g.entry = n
+		return
+	}
+
+	ep := g.entry
+	top := len(ep.links) - 1
+	for layer := top; layer > level; layer-- {
+		ep = g.greedyClosest(ep, vec, layer)
+	}
+	eps := []hnswCandidate{{ep, g.dist(vec, ep.vec)}}
+	for layer := min(level, top); layer >= 0; layer-- {
+		found := g.searchLayer(eps, vec, g.efConstruction, layer, nil)
+		neighbours := found
+		if len(neighbours) > g.m {
+			neighbours = neighbours[:g.m]
+		}
+		for _, c := range neighbours {
+			n.links[layer] = append(n.links[layer], c.node)
+			c.node.links[layer] = append(c.node.links[layer], n)
+			g.shrink(c.node, layer)
+		}
+		eps = found
+	}
+	if level > top {
+		g.entry = n
+	}
+}
+
+// shrink trims n's links on layer to the closest maxLinks.
+func (g *hnswGraph) shrink(n *hnswNode, layer int) {
+	limit := g.maxLinks(layer)
+	if len(n.links[layer]) <= limit {
+		return
+	}
+	cands := make([]hnswCandidate, len(n.links[layer]))
+	for i, nb := range n.links[layer] {
+		cands[i] = hnswCandidate{nb, g.dist(n.vec, nb.vec)}
+	}
+	sort.Slice(cands, func(i, j int) bool { return cands[i].dist < cands[j].dist })
+	links := n.links[layer][:0]
+	for _, c := range cands[:limit] {
+		links = append(links, c.node)
+	}
+	n.links[layer] = links
+}
+
+// Remove deletes id and reconnects its former neighbours to each other so the
+// graph stays navigable.
+func (g *hnswGraph) Remove(id string) {
+	n, ok := g.nodes[id]
+	if !ok {
+		return
+	}
+	delete(g.nodes, id)
+	for layer, links := range n.links {
+		for _, nb := range links {
+			nb.links[layer] = removeHNSWLink(nb.links[layer], n)
+		}
+		for _, nb := range links {
+			for _, other := range links {
+				if other == nb || len(nb.links[layer]) >= g.maxLinks(layer) || hasHNSWLink(nb.links[layer], other) {
+					continue
+				}
+				nb.links[layer] = append(nb.links[layer], other)
+			}
+		}
+	}
+	if g.entry == n {
+		g.entry = nil
+		for _, other := range g.nodes {
+			if g.entry == nil || len(other.links) > len(g.entry.links) {
+				g.entry = other
+			}
+		}
+	}
+}
+
+func removeHNSWLink(links []*hnswNode, n *hnswNode) []*hnswNode {
+	for i, l := range links {
+		if l == n {
+			return append(links[:i], links[i+1:]...)
+		}
+	}
+	return links
+}
+
+func hasHNSWLink(links []*hnswNode, n *hnswNode) bool {
+	for _, l := range links {
+		if l == n {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *hnswGraph) greedyClosest(ep *hnswNode, vec []float32, layer int) *hnswNode {
+	best := g.dist(vec, ep.vec)
+	for changed := true; changed; {
+		changed = false
+		for _, nb := range ep.links[layer] {
+			if d := g.dist(vec, nb.vec); d < best {
+				best, ep, changed = d, nb, true
+			}
+		}
+	}
+	return ep
+}
+
+// searchLayer is the best-first search from the HNSW paper. It returns up to
+// ef nodes sorted by distance. If accept is non-nil only accepted nodes are
+// collected as results, though every node is still used for navigation.
+func (g *hnswGraph) searchLayer(eps []hnswCandidate, vec []float32, ef, layer int, accept func(*hnswNode) bool) []hnswCandidate {
+	visited := make(map[*hnswNode]bool)
+	candidates := &candidateHeap{}
+	results := &candidateHeap{max: true}
+	for _, ep := range eps {
+		visited[ep.node] = true
+		heap.Push(candidates, ep)
+		if accept == nil || accept(ep.node) {
+			heap.Push(results, ep)
+		}
+	}
+	for candidates.Len() > 0 {
+		c := heap.Pop(candidates).(hnswCandidate)
+		if results.Len() >= ef && c.dist > results.items[0].dist {
+			break
+		}
+		for _, nb := range c.node.links[layer] {
+			if visited[nb] {
+				continue
+			}
+			visited[nb] = true
+			d := g.dist(vec, nb.vec)
+			if results.Len() < ef || d < results.items[0].dist {
+				heap.Push(candidates, hnswCandidate{nb, d})
+				if accept == nil || accept(nb) {
+					heap.Push(results, hnswCandidate{nb, d})
+					if results.Len() > ef {
+						heap.Pop(results)
+					}
+				}
+			}
+		}
+	}
+	out := results.items
+	sort.Slice(out, func(i, j int) bool { return out[i].dist < out[j].dist })
+	return out
+}
+
+// Search returns up to k nodes closest to vec, exploring ef candidates.
+func (g *hnswGraph) Search(vec []float32, k, ef int, accept func(*hnswNode) bool) []hnswCandidate {
+	if g.entry == nil {
+		return nil
+	}
+	if ef < k {
+		ef = k
+	}
+	ep := g.entry
+	for layer := len(ep.links) - 1; layer > 0; layer-- {
+		ep = g.greedyClosest(ep, vec, layer)
+	}
+	found := g.searchLayer([]hnswCandidate{{ep, g.dist(vec, ep.vec)}}, vec, ef, 0, accept)
+	if len(found) > k {
+		found = found[:k]
+	}
+	return found
+}
@@ -1,13 +1,64 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	store := NewStore()
-	server := NewServer(store)
-	if err := server.Listen(":6379"); err != nil {
+	configFile := flag.String("config", "", "redis.conf-style file to load, and to save with CONFIG REWRITE")
+	analyze := flag.String("analyze", "", "print a big-key and hot-key report for the server at this address and exit")
+	analyzeTop := flag.Int("analyze-top", analyzeDefaultTop, "keys listed per category by -analyze")
+	analyzeMatch := flag.String("analyze-match", "", "only analyze keys matching this glob")
+	analyzeUser := flag.String("analyze-user", "", "ACL user -analyze authenticates as, with the password in REDISCLI_AUTH")
+
+	// Every config parameter is also a flag, which overrides the file.
+	defaults := DefaultConfig()
+	var overrides [][2]string
+	for _, p := range configParams {
+		name := p.name
+		usage := "config parameter " + name + " (default " + quoteConfigValue(p.get(&defaults)) + ")"
+		flag.Func(name, usage, func(v string) error {
+			overrides = append(overrides, [2]string{name, v})
+			return nil
+		})
+	}
+	flag.Parse()
+
+	if *analyze != "" {
+		if err := runAnalyzeCLI(os.Stdout, *analyze, *analyzeUser, *analyzeMatch, *analyzeTop); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg := DefaultConfig()
+	if *configFile != "" {
+		if err := LoadConfigFile(*configFile, &cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, o := range overrides {
+		if err := setConfigParam(&cfg, o[0], o[1]); err != nil {
+			log.Fatalf("invalid -%s %q: %v", o[0], o[1], err)
+		}
+	}
+
+	server := NewServer(NewStore(), cfg)
+	server.configFile = *configFile
+	if cfg.ACLFile != "" {
+		if err := server.acl.LoadFile(cfg.ACLFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// Ctrl-C and SIGTERM (as sent by docker stop) shut down gracefully.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := server.Listen(ctx); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -2,69 +2,550 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"slices"
 	"strconv"
 	"strings"
+	"unsafe"
 )
 
-// Parse a RESP (REdis Serialization Protocol) array and return a slice of strings.
-func parseRESP(reader *bufio.Reader) ([]string, error) {
-	b, err := reader.ReadByte()
+// protoLimits bound what a client may declare in a request, so a claimed
+// length cannot make the server allocate more than it is willing to.
+type protoLimits struct {
+	maxBulkLen   int64 // proto-max-bulk-len
+	maxMultibulk int64 // arguments per command
+}
+
+var defaultProtoLimits = protoLimits{maxBulkLen: 512 << 20, maxMultibulk: 1 << 20}
+
+// multibulkPrealloc caps how many arguments are allocated up front, since
+// the declared count may be far more than the client ever sends; bulkPrealloc
+// does the same for the bytes of one argument, which then grows as they
+// arrive.
+const (
+	multibulkPrealloc = 1024
+	bulkPrealloc      = 64 << 10
+)
+
+var (
+	errInvalidMultibulk = errors.New("invalid multibulk length")
+	errInvalidBulk      = errors.New("invalid bulk length")
+	errMissingCRLF      = errors.New("expected '\\r\\n'")
+)
+
+// Parse a RESP (REdis Serialization Protocol) array and return a slice of
+// strings. Lengths must be canonical integers within limits and every line
+// must end in \r\n. An empty or null array yields no arguments. Each
+// argument up to bulkPrealloc bytes costs one allocation and is copied once,
+// from the reader's buffer into the string's own bytes.
+func parseRESP(reader *bufio.Reader, limits protoLimits) ([]string, error) {
+	line, err := readLine(reader)
 	if err != nil {
 		return nil, err
 	}
-	if b != '*' {
+	if len(line) == 0 || line[0] != '*' {
 		return nil, errors.New("expected '*' for RESP array")
 	}
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, err
+	count, ok := parseLength(line[1:])
+	if !ok || count > limits.maxMultibulk {
+		return nil, errInvalidMultibulk
 	}
-	count, err := strconv.Atoi(strings.TrimSpace(line))
-	if err != nil {
-		return nil, err
+	if count <= 0 {
+		return nil, nil
 	}
-	parts := make([]string, count)
-	for i := 0; i < count; i++ {
-		prefix, err := reader.ReadByte()
+	parts := make([]string, 0, min(count, multibulkPrealloc))
+	for i := int64(0); i < count; i++ {
+		line, err := readLine(reader)
 		if err != nil {
 			return nil, err
 		}
-		if prefix != '$' {
+		if len(line) == 0 || line[0] != '$' {
 			return nil, errors.New("expected '$' for RESP bulk string")
 		}
-		slen, err := reader.ReadString('\n')
+		n, ok := parseLength(line[1:])
+		if !ok || n < 0 || n > limits.maxBulkLen {
+			return nil, errInvalidBulk
+		}
+		arg, err := readBulk(reader, n)
 		if err != nil {
 			return nil, err
 		}
-		strlen, err := strconv.Atoi(strings.TrimSpace(slen))
+		if err := readCRLF(reader); err != nil {
+			return nil, err
+		}
+		parts = append(parts, arg)
+	}
+	return parts, nil
+}
+
+// readBulk reads the n bytes of a bulk string. The buffer starts at no more
+// than bulkPrealloc bytes and doubles as the bytes arrive, so a claimed
+// length is only allocated once it is sent. The string shares the buffer,
+// which is never written again.
+func readBulk(reader *bufio.Reader, n int64) (string, error) {
+	buf := make([]byte, 0, min(n, bulkPrealloc))
+	for int64(len(buf)) < n {
+		if len(buf) == cap(buf) {
+			buf = slices.Grow(buf, int(min(n-int64(len(buf)), int64(len(buf)))))
+		}
+		end := int(min(n, int64(cap(buf))))
+		read, err := io.ReadFull(reader, buf[len(buf):end])
+		buf = buf[:len(buf)+read]
+		if err != nil {
+			return "", err
+		}
+	}
+	return unsafe.String(unsafe.SliceData(buf), len(buf)), nil
+}
+
+// readLine returns the next line without its \r\n. The slice points into the
+// reader's buffer and is only valid until the next read; lines longer than
+// the buffer are an error.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errors.New("line too long")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errMissingCRLF
+	}
+	return line[:len(line)-2], nil
+}
+
+// readCRLF consumes the \r\n that ends a bulk string.
+func readCRLF(reader *bufio.Reader) error {
+	cr, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	lf, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if cr != '\r' || lf != '\n' {
+		return errMissingCRLF
+	}
+	return nil
+}
+
+// parseLength parses a decimal length as written by a well-behaved client:
+// digits with an optional leading minus and no leading zeros or sign on zero.
+func parseLength(b []byte) (int64, bool) {
+	neg := len(b) > 0 && b[0] == '-'
+	if neg {
+		b = b[1:]
+	}
+	if len(b) == 0 || len(b) > 18 || (b[0] == '0' && (len(b) > 1 || neg)) {
+		return 0, false
+	}
+	var n int64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
+	}
+	if neg {
+		n = -n
+	}
+	return n, true
+}
+
+var errUnbalancedQuotes = errors.New("unbalanced quotes in request")
+
+// splitInlineArgs splits an inline command line into arguments the way
+// redis-cli does. Arguments are separated by whitespace and may be quoted:
+// inside double quotes \n, \r, \t, \b, \a and \xHH are escapes and a
+// backslash makes any other character literal; inside single quotes only \'
+// is an escape. A closing quote must end the argument.
+func splitInlineArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isInlineSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		var arg []byte
+		inDouble, inSingle := false, false
+		for done := false; !done; {
+			if i == len(line) {
+				if inDouble || inSingle {
+					return nil, errUnbalancedQuotes
+				}
+				break
+			}
+			c := line[i]
+			switch {
+			case inDouble:
+				switch {
+				case c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]):
+					arg = append(arg, hexValue(line[i+2])<<4|hexValue(line[i+3]))
+					i += 3
+				case c == '\\' && i+1 < len(line):
+					i++
+					switch line[i] {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, line[i])
+					}
+				case c == '"':
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+			case inSingle:
+				switch {
+				case c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					arg = append(arg, '\'')
+					i++
+				case c == '\'':
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+			default:
+				switch {
+				case isInlineSpace(c):
+					done = true
+				case c == '"':
+					inDouble = true
+				case c == '\'':
+					inSingle = true
+				default:
+					arg = append(arg, c)
+				}
+			}
+			i++
+		}
+		args = append(args, string(arg))
+	}
+}
+
+func isInlineSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func hexValue(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	}
+	return c - 'a' + 10
+}
+
+// parseReply reads one reply of any RESP2 or RESP3 type, as a client does.
+func parseReply(reader *bufio.Reader) (Reply, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply line")
+	}
+	prefix, rest := line[0], line[1:]
+	switch prefix {
+	case '+':
+		return simpleReply(rest), nil
+	case '-':
+		return errorReply(rest), nil
+	case ':':
+		n, err := strconv.ParseInt(rest, 10, 64)
+		return intReply(n), err
+	case '_':
+		return nullReply{}, nil
+	case '#':
+		return boolReply(rest == "t"), nil
+	case ',':
+		f, err := strconv.ParseFloat(rest, 64)
+		return doubleReply(f), err
+	case '(':
+		return bigNumberReply(rest), nil
+	case '$', '=':
+		n, err := strconv.Atoi(rest)
 		if err != nil {
 			return nil, err
 		}
-		buf := make([]byte, strlen+2) // +2 for \r\n
-		_, err = io.ReadFull(reader, buf)
+		if n < 0 {
+			return nullReply{}, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		text := string(buf[:n])
+		if prefix == '$' {
+			return bulkReply(text), nil
+		}
+		if len(text) < 4 || text[3] != ':' {
+			return nil, errors.New("invalid verbatim string")
+		}
+		return verbatimReply{text[:3], text[4:]}, nil
+	case '*', '%', '~', '>':
+		n, err := strconv.Atoi(rest)
 		if err != nil {
 			return nil, err
 		}
-		parts[i] = string(buf[:strlen])
+		if n < 0 {
+			return nullReply{}, nil
+		}
+		if prefix == '%' {
+			n *= 2
+		}
+		items := make([]Reply, n)
+		for i := range items {
+			if items[i], err = parseReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		switch prefix {
+		case '%':
+			return mapReply(items), nil
+		case '~':
+			return setReply(items), nil
+		case '>':
+			return pushReply(items), nil
+		}
+		return arrayReply(items), nil
 	}
-	return parts, nil
+	return nil, fmt.Errorf("unknown reply type %q", prefix)
+}
+
+// Reply is a typed reply, encoded when written for the protocol version the
+// connection negotiated with HELLO. RESP2 has no maps, sets, doubles,
+// booleans, big numbers, verbatim strings or pushes, so those fall back to the
+// RESP2 types Redis uses for them.
+type Reply interface {
+	appendRESP(buf []byte, proto int) []byte
+}
+
+type (
+	simpleReply    string
+	errorReply     string // including the code, as in "ERR message"
+	intReply       int64
+	bulkReply      string
+	nullReply      struct{}
+	arrayReply     []Reply
+	mapReply       []Reply // alternating keys and values
+	setReply       []Reply
+	pushReply      []Reply
+	doubleReply    float64
+	boolReply      bool
+	bigNumberReply string
+	verbatimReply  struct{ format, text string } // format is three letters, such as "txt"
+)
+
+func (r simpleReply) appendRESP(buf []byte, proto int) []byte {
+	return appendLine(append(buf, '+'), string(r))
+}
+
+func (r errorReply) appendRESP(buf []byte, proto int) []byte {
+	return appendLine(append(buf, '-'), string(r))
+}
+
+func (r intReply) appendRESP(buf []byte, proto int) []byte {
+	return appendInt(append(buf, ':'), int64(r))
+}
+
+func (r bulkReply) appendRESP(buf []byte, proto int) []byte {
+	return appendBlob(buf, '$', string(r))
+}
+
+func (nullReply) appendRESP(buf []byte, proto int) []byte {
+	if proto >= 3 {
+		return append(buf, "_\r\n"...)
+	}
+	return append(buf, "$-1\r\n"...)
+}
+
+func (r arrayReply) appendRESP(buf []byte, proto int) []byte {
+	return appendAggregate(buf, '*', len(r), r, proto)
+}
+
+func (r mapReply) appendRESP(buf []byte, proto int) []byte {
+	if proto >= 3 {
+		return appendAggregate(buf, '%', len(r)/2, r, proto)
+	}
+	return appendAggregate(buf, '*', len(r), r, proto)
+}
+
+func (r setReply) appendRESP(buf []byte, proto int) []byte {
+	if proto >= 3 {
+		return appendAggregate(buf, '~', len(r), r, proto)
+	}
+	return appendAggregate(buf, '*', len(r), r, proto)
+}
+
+func (r pushReply) appendRESP(buf []byte, proto int) []byte {
+	if proto >= 3 {
+		return appendAggregate(buf, '>', len(r), r, proto)
+	}
+	return appendAggregate(buf, '*', len(r), r, proto)
+}
+
+func (r doubleReply) appendRESP(buf []byte, proto int) []byte {
+	var tmp [32]byte
+	f := float64(r)
+	var text []byte
+	switch {
+	case math.IsInf(f, 1):
+		text = append(tmp[:0], "inf"...)
+	case math.IsInf(f, -1):
+		text = append(tmp[:0], "-inf"...)
+	case math.IsNaN(f):
+		text = append(tmp[:0], "nan"...)
+	default:
+		text = strconv.AppendFloat(tmp[:0], f, 'f', -1, 64)
+	}
+	if proto >= 3 {
+		buf = append(buf, ',')
+	} else {
+		buf = appendInt(append(buf, '$'), int64(len(text)))
+	}
+	return append(append(buf, text...), "\r\n"...)
+}
+
+func (r boolReply) appendRESP(buf []byte, proto int) []byte {
+	if proto >= 3 {
+		if r {
+			return append(buf, "#t\r\n"...)
+		}
+		return append(buf, "#f\r\n"...)
+	}
+	return intReply(boolToInt(bool(r))).appendRESP(buf, proto)
+}
+
+func (r bigNumberReply) appendRESP(buf []byte, proto int) []byte {
+	if proto >= 3 {
+		return appendLine(append(buf, '('), string(r))
+	}
+	return appendBlob(buf, '$', string(r))
+}
+
+func (r verbatimReply) appendRESP(buf []byte, proto int) []byte {
+	if proto >= 3 {
+		buf = appendInt(append(buf, '='), int64(len(r.format)+1+len(r.text)))
+		buf = append(append(buf, r.format...), ':')
+		return appendLine(buf, r.text)
+	}
+	return appendBlob(buf, '$', r.text)
+}
+
+func appendLine(buf []byte, s string) []byte {
+	return append(append(buf, s...), "\r\n"...)
+}
+
+// appendInt appends n and a line ending without allocating.
+func appendInt(buf []byte, n int64) []byte {
+	return append(strconv.AppendInt(buf, n, 10), "\r\n"...)
+}
+
+func appendBlob(buf []byte, prefix byte, s string) []byte {
+	buf = appendInt(append(buf, prefix), int64(len(s)))
+	return appendLine(buf, s)
+}
+
+func appendAggregate(buf []byte, prefix byte, n int, items []Reply, proto int) []byte {
+	buf = appendInt(append(buf, prefix), int64(n))
+	for _, item := range items {
+		buf = item.appendRESP(buf, proto)
+	}
+	return buf
+}
+
+// encodeReply renders r in the given protocol version.
+func encodeReply(r Reply, proto int) []byte {
+	return r.appendRESP(nil, proto)
 }
 
 // RESP response helpers
-func respSimple(msg string) string { return "+" + msg + "\r\n" }
-func respError(msg string) string  { return "-ERR " + msg + "\r\n" }
-func respInt(n int) string         { return ":" + strconv.Itoa(n) + "\r\n" }
-func respBulk(msg string) string   { return fmt.Sprintf("$%d\r\n%s\r\n", len(msg), msg) }
-func respNullBulk() string         { return "$-1\r\n" }
-func respArray(arr []string) string {
-	var buf bytes.Buffer
-	buf.WriteString(fmt.Sprintf("*%d\r\n", len(arr)))
-	for _, item := range arr {
-		buf.WriteString(respBulk(item))
-	}
-	return buf.String()
+func respSimple(msg string) Reply { return simpleReply(msg) }
+func respError(msg string) Reply  { return errorReply("ERR " + msg) }
+func respInt(n int) Reply         { return intReply(n) }
+func respBulk(msg string) Reply   { return bulkReply(msg) }
+func respNullBulk() Reply         { return nullReply{} }
+func respIntOrNil(n *int) Reply {
+	if n == nil {
+		return respNullBulk()
+	}
+	return respInt(*n)
+}
+
+// respErrorCode is an error reply with a code other than ERR, such as OOM.
+func respErrorCode(code, msg string) Reply { return errorReply(code + " " + msg) }
+
+// respErrorFrom is the error reply for err: its own code for an *Error and
+// ERR for anything else.
+func respErrorFrom(err error) Reply {
+	var e *Error
+	if errors.As(err, &e) {
+		return respErrorCode(e.Code, e.Msg)
+	}
+	return respError(err.Error())
 }
+
+// respRawArray wraps replies into an array.
+func respRawArray(items []Reply) Reply {
+	return arrayReply(items)
+}
+
+func respArray(arr []string) Reply {
+	items := make([]Reply, len(arr))
+	for i, item := range arr {
+		items[i] = respBulk(item)
+	}
+	return arrayReply(items)
+}
+
+// respMap is a map reply of alternating keys and values; RESP2 clients get a
+// flat array.
+func respMap(pairs []Reply) Reply { return mapReply(pairs) }
+
+// respSet is a set reply; RESP2 clients get an array.
+func respSet(members []string) Reply {
+	items := make([]Reply, len(members))
+	for i, m := range members {
+		items[i] = respBulk(m)
+	}
+	return setReply(items)
+}
+
+// respDouble is a double reply; RESP2 clients get a bulk string.
+func respDouble(f float64) Reply { return doubleReply(f) }
+
+// respBool is a boolean reply; RESP2 clients get 1 or 0.
+func respBool(b bool) Reply { return boolReply(b) }
+
+// respVerbatim is verbatim text, such as INFO output; RESP2 clients get a bulk
+// string.
+func respVerbatim(text string) Reply { return verbatimReply{"txt", text} }
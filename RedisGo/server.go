@@ -2,26 +2,142 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"io"
 	"log"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
-	store *Store
+	// mu guards dbs, which SWAPDB reorders.
+	mu  sync.RWMutex
+	dbs []*Store
+
+	// cfgMu guards cfg, which CONFIG SET changes. configFile is where
+	// CONFIG REWRITE saves it, empty if the server was started without one.
+	cfgMu      sync.RWMutex
+	cfg        Config
+	configFile string
+
+	nextClientID atomic.Int64
+	acl          *ACL
+	tlsConfig    tlsReloader
+
+	// Shutdown: stop is closed to begin it, closing is set once it has, and
+	// clients lists the connections it must wait for.
+	stop         chan struct{}
+	stopOnce     sync.Once
+	stopMode     shutdownMode
+	closing      atomic.Bool
+	clientsMu    sync.Mutex
+	clients      map[*client]struct{}
+	clientsGroup sync.WaitGroup
+}
+
+// NewServer creates a server with cfg.Databases databases, the first of
+// which is store. The other databases share its clock and memory limit.
+func NewServer(store *Store, cfg Config) *Server {
+	s := &Server{
+		dbs:     []*Store{store},
+		cfg:     cfg,
+		acl:     newACL(),
+		stop:    make(chan struct{}),
+		clients: make(map[*client]struct{}),
+	}
+	for len(s.dbs) < cfg.Databases {
+		s.dbs = append(s.dbs, store.newSibling())
+	}
+	store.SetMaxMemory(cfg.MaxMemory, cfg.MaxMemoryPolicy)
+	if cfg.RequirePass != "" {
+		s.acl.setRequirePass(cfg.RequirePass)
+	}
+	return s
+}
+
+// config returns a copy of the current configuration.
+func (s *Server) config() Config {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.cfg
+}
+
+// client is the state of one connection. Replies are buffered in out and
+// flushed once the commands already received have all been answered, so a
+// pipelined batch costs one write.
+type client struct {
+	net.Conn
+	out     *bufio.Writer
+	scratch []byte // encoding buffer, reused between replies
+	id      int64
+	name    string
+	proto   int // RESP version, 2 until HELLO 3
+	dbIndex int
+	db      *Store // database dbIndex, looked up again for every command
+
+	// user is the ACL user commands run as. Until the client authenticates
+	// it is the default user, which only counts while that needs no password.
+	user          string
+	authenticated bool
 }
 
-func NewServer(store *Store) *Server {
-	return &Server{store: store}
+// reply queues r in the protocol version the client negotiated.
+func (c *client) reply(r Reply) {
+	c.scratch = r.appendRESP(c.scratch[:0], c.proto)
+	c.out.Write(c.scratch)
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
+// database returns database i.
+func (s *Server) database(i int) *Store {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.dbs[i]
+}
+
+// databases returns all databases in index order.
+func (s *Server) databases() []*Store {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*Store(nil), s.dbs...)
+}
+
+func (s *Server) handleConnection(nc net.Conn) {
+	conn := &client{Conn: nc, id: s.nextClientID.Add(1), proto: 2, user: "default"}
 	defer conn.Close()
+	s.clientsMu.Lock()
+	s.clients[conn] = struct{}{}
+	s.clientsMu.Unlock()
+	defer func() {
+		s.clientsMu.Lock()
+		delete(s.clients, conn)
+		s.clientsMu.Unlock()
+	}()
 	reader := bufio.NewReader(conn)
+	conn.out = bufio.NewWriter(conn)
 	for {
-		conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
+		if reader.Buffered() == 0 {
+			// Nothing more is pipelined, so the client may be waiting.
+			if err := conn.out.Flush(); err != nil {
+				return
+			}
+		}
+		cfg := s.config()
+		if cfg.Timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(cfg.Timeout))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		// Checked after the deadline is set, so that a shutdown either
+		// sees the new deadline and expires it or is seen here.
+		if s.closing.Load() {
+			conn.out.Flush()
+			return
+		}
 		peek, err := reader.Peek(1)
 		if err != nil {
 			return
@@ -29,9 +145,18 @@ func (s *Server) handleConnection(conn net.Conn) {
 		var parts []string
 		if peek[0] == '*' {
 			// RESP
-			parts, err = parseRESP(reader)
+			parts, err = parseRESP(reader, cfg.protoLimits())
+			if isConnError(err) {
+				return
+			}
 			if err != nil {
-				conn.Write([]byte(respError("Protocol error: " + err.Error())))
+				// The stream can no longer be trusted to be in sync, so
+				// report the error and drop the client, as Redis does.
+				conn.reply(respError("Protocol error: " + err.Error()))
+				conn.out.Flush()
+				return
+			}
+			if len(parts) == 0 {
 				continue
 			}
 		} else {
@@ -40,7 +165,12 @@ func (s *Server) handleConnection(conn net.Conn) {
 			if err != nil {
 				return
 			}
-			parts = strings.Fields(strings.TrimSpace(line))
+			parts, err = splitInlineArgs(line)
+			if err != nil {
+				conn.reply(respError("Protocol error: " + err.Error()))
+				conn.out.Flush()
+				return
+			}
 			if len(parts) == 0 {
 				continue
 			}
@@ -48,93 +178,120 @@ func (s *Server) handleConnection(conn net.Conn) {
 
 		cmd := strings.ToUpper(parts[0])
 		args := parts[1:]
+		if !s.authorize(conn, cmd, args) {
+			continue
+		}
+
+		conn.db = s.database(conn.dbIndex)
+		spec := commandTable[cmd]
+		if spec.flags&cmdDenyOOM != 0 {
+			if err := s.freeMemory(); err != nil {
+				conn.reply(respErrorFrom(err))
+				continue
+			}
+		}
 
 		switch cmd {
 		// ---------- Meta ----------
+		case "SHUTDOWN":
+			if s.handleShutdown(conn, args) {
+				conn.out.Flush()
+				return
+			}
+		case "AUTH":
+			s.handleAuth(conn, args)
+		case "HELLO":
+			s.handleHello(conn, args)
+		case "ACL":
+			s.handleACL(conn, args)
+		case "CLIENT":
+			s.handleClient(conn, args)
 		case "PING":
 			if len(args) == 0 {
-				conn.Write([]byte(respSimple("PONG")))
+				conn.reply(respSimple("PONG"))
 			} else {
-				conn.Write([]byte(respBulk(args[0])))
+				conn.reply(respBulk(args[0]))
 			}
 		case "ECHO":
 			if len(args) != 1 {
-				conn.Write([]byte(respError("Wrong number of arguments for 'ECHO'")))
+				conn.reply(respError("Wrong number of arguments for 'ECHO'"))
 			} else {
-				conn.Write([]byte(respBulk(args[0])))
+				conn.reply(respBulk(args[0]))
 			}
 		// ---------- String Commands ----------
 		case "SET":
 			if len(args) != 2 {
-				conn.Write([]byte(respError("Wrong number of arguments for 'SET'")))
+				conn.reply(respError("Wrong number of arguments for 'SET'"))
 				continue
 			}
-			s.store.Set(args[0], args[1])
-			conn.Write([]byte(respSimple("OK")))
+			conn.db.Set(args[0], args[1])
+			conn.reply(respSimple("OK"))
 		case "GET":
 			if len(args) != 1 {
-				conn.Write([]byte(respError("Wrong number of arguments for 'GET'")))
+				conn.reply(respError("Wrong number of arguments for 'GET'"))
 				continue
 			}
-			val, ok := s.store.Get(args[0])
-			if !ok {
-				conn.Write([]byte(respNullBulk()))
+			val, ok, err := conn.db.Get(args[0])
+			if err != nil {
+				conn.reply(respErrorFrom(err))
+			} else if !ok {
+				conn.reply(respNullBulk())
 			} else {
-				conn.Write([]byte(respBulk(val)))
+				conn.reply(respBulk(val))
 			}
 		case "DEL":
 			if len(args) < 1 {
-				conn.Write([]byte(respError("Wrong number of arguments for 'DEL'")))
+				conn.reply(respError("Wrong number of arguments for 'DEL'"))
 				continue
 			}
 			deleted := 0
 			for _, k := range args {
-				if s.store.Del(k) {
+				if conn.db.Del(k) {
 					deleted++
 				}
 			}
-			conn.Write([]byte(respInt(deleted)))
+			conn.reply(respInt(deleted))
 		case "INCR":
 			if len(args) != 1 {
-				conn.Write([]byte(respError("Wrong number of arguments for 'INCR'")))
+				conn.reply(respError("Wrong number of arguments for 'INCR'"))
 				continue
 			}
-			val, err := s.store.Incr(args[0])
+			val, err := conn.db.Incr(args[0])
 			if err != nil {
-				conn.Write([]byte(respError(err.Error())))
+				conn.reply(respErrorFrom(err))
 				continue
 			}
-			conn.Write([]byte(respInt(val)))
+			conn.reply(respInt(val))
 		case "DECR":
 			if len(args) != 1 {
-				conn.Write([]byte(respError("Wrong number of arguments for 'DECR'")))
+				conn.reply(respError("Wrong number of arguments for 'DECR'"))
 				continue
 			}
-			val, err := s.store.Decr(args[0])
+			val, err := conn.db.Decr(args[0])
 			if err != nil {
-				conn.Write([]byte(respError(err.Error())))
+				conn.reply(respErrorFrom(err))
 				continue
 			}
-			conn.Write([]byte(respInt(val)))
+			conn.reply(respInt(val))
 		case "MSET":
 			if len(args) < 2 || len(args)%2 != 0 {
-				conn.Write([]byte(respError("MSET requires an even number of arguments (key value ...)")))
+				conn.reply(respError("MSET requires an even number of arguments (key value ...)"))
 				continue
 			}
-			err := s.store.MSet(args...)
+			err := conn.db.MSet(args...)
 			if err != nil {
-				conn.Write([]byte(respError(err.Error())))
+				conn.reply(respErrorFrom(err))
 			} else {
-				conn.Write([]byte(respSimple("OK")))
+				conn.reply(respSimple("OK"))
 			}
 		case "MGET":
 			if len(args) < 1 {
-				conn.Write([]byte(respError("Wrong number of arguments for 'MGET'")))
+				conn.reply(respError("Wrong number of arguments for 'MGET'"))
 				continue
 			}
-			vals := s.store.MGet(args...)
+			vals := conn.db.MGet(args...)
 			// Convert to RESP array, treating empty string as nil
-			items := make([]string, len(vals))
+			items := make([]Reply, len(vals))
 			for i, v := range vals {
 				if v == "" {
 					items[i] = respNullBulk()
@@ -142,203 +299,409 @@ func (s *Server) handleConnection(conn net.Conn) {
 					items[i] = respBulk(v)
 				}
 			}
-			// Merge as a prebuilt RESP array:
-			resp := "*" + strconv.Itoa(len(items)) + "\r\n" + strings.Join(items, "")
-			conn.Write([]byte(resp))
+			conn.reply(respRawArray(items))
 		// ---------- List Commands ----------
 		case "LPUSH":
 			if len(args) < 2 {
-				conn.Write([]byte(respError("LPUSH requires a key and at least one value")))
+				conn.reply(respError("LPUSH requires a key and at least one value"))
+				continue
+			}
+			newLen, err := conn.db.LPush(args[0], args[1:]...)
+			if err != nil {
+				conn.reply(respErrorFrom(err))
 				continue
 			}
-			newLen := s.store.LPush(args[0], args[1:]...)
-			conn.Write([]byte(respInt(newLen)))
+			conn.reply(respInt(newLen))
 		case "RPOP":
 			if len(args) != 1 {
-				conn.Write([]byte(respError("RPOP requires a key")))
+				conn.reply(respError("RPOP requires a key"))
 				continue
 			}
-			val, err := s.store.RPop(args[0])
+			val, ok, err := conn.db.RPop(args[0])
 			if err != nil {
-				conn.Write([]byte(respNullBulk()))
+				conn.reply(respErrorFrom(err))
+			} else if !ok {
+				conn.reply(respNullBulk())
 			} else {
-				conn.Write([]byte(respBulk(val)))
+				conn.reply(respBulk(val))
 			}
 		case "LLEN":
 			if len(args) != 1 {
-				conn.Write([]byte(respError("LLEN requires a key")))
+				conn.reply(respError("LLEN requires a key"))
+				continue
+			}
+			length, err := conn.db.LLen(args[0])
+			if err != nil {
+				conn.reply(respErrorFrom(err))
 				continue
 			}
-			length := s.store.LLen(args[0])
-			conn.Write([]byte(respInt(length)))
+			conn.reply(respInt(length))
 		// ---------- Set Commands ----------
 		case "SADD":
 			if len(args) < 2 {
-				conn.Write([]byte(respError("SADD requires a key and at least one value")))
+				conn.reply(respError("SADD requires a key and at least one value"))
+				continue
+			}
+			n, err := conn.db.SAdd(args[0], args[1:]...)
+			if err != nil {
+				conn.reply(respErrorFrom(err))
 				continue
 			}
-			n := s.store.SAdd(args[0], args[1:]...)
-			conn.Write([]byte(respInt(n)))
+			conn.reply(respInt(n))
 		case "SREM":
 			if len(args) < 2 {
-				conn.Write([]byte(respError("SREM requires a key and at least one value")))
+				conn.reply(respError("SREM requires a key and at least one value"))
+				continue
+			}
+			n, err := conn.db.SRem(args[0], args[1:]...)
+			if err != nil {
+				conn.reply(respErrorFrom(err))
 				continue
 			}
-			n := s.store.SRem(args[0], args[1:]...)
-			conn.Write([]byte(respInt(n)))
+			conn.reply(respInt(n))
 		case "SMEMBERS":
 			if len(args) != 1 {
-				conn.Write([]byte(respError("SMEMBERS requires a key")))
+				conn.reply(respError("SMEMBERS requires a key"))
 				continue
 			}
-			members, err := s.store.SMembers(args[0])
-			if err != nil || len(members) == 0 {
-				conn.Write([]byte("*0\r\n"))
+			members, err := conn.db.SMembers(args[0])
+			if err != nil {
+				conn.reply(respErrorFrom(err))
+			} else if len(members) == 0 {
+				conn.reply(respSet(nil))
 			} else {
-				conn.Write([]byte(respArray(members)))
+				conn.reply(respSet(members))
 			}
 		// ---------- Hash Commands ----------
 		case "HSET":
 			if len(args) != 3 {
-				conn.Write([]byte(respError("HSET requires a key, field, value")))
+				conn.reply(respError("HSET requires a key, field, value"))
 				continue
 			}
-			added := s.store.HSet(args[0], args[1], args[2])
-			conn.Write([]byte(respInt(added)))
+			added, err := conn.db.HSet(args[0], args[1], args[2])
+			if err != nil {
+				conn.reply(respErrorFrom(err))
+				continue
+			}
+			conn.reply(respInt(added))
 		case "HGET":
 			if len(args) != 2 {
-				conn.Write([]byte(respError("HGET requires a key and field")))
+				conn.reply(respError("HGET requires a key and field"))
 				continue
 			}
-			val, ok := s.store.HGet(args[0], args[1])
-			if !ok {
-				conn.Write([]byte(respNullBulk()))
+			val, ok, err := conn.db.HGet(args[0], args[1])
+			if err != nil {
+				conn.reply(respErrorFrom(err))
+			} else if !ok {
+				conn.reply(respNullBulk())
 			} else {
-				conn.Write([]byte(respBulk(val)))
+				conn.reply(respBulk(val))
 			}
 		case "HDEL":
 			if len(args) < 2 {
-				conn.Write([]byte(respError("HDEL requires a key and at least one field")))
+				conn.reply(respError("HDEL requires a key and at least one field"))
 				continue
 			}
-			num := s.store.HDel(args[0], args[1:]...)
-			conn.Write([]byte(respInt(num)))
+			num, err := conn.db.HDel(args[0], args[1:]...)
+			if err != nil {
+				conn.reply(respErrorFrom(err))
+				continue
+			}
+			conn.reply(respInt(num))
 		case "HGETALL":
 			if len(args) != 1 {
-				conn.Write([]byte(respError("HGETALL requires a key")))
+				conn.reply(respError("HGETALL requires a key"))
 				continue
 			}
-			m, err := s.store.HGetAll(args[0])
-			if err != nil || len(m) == 0 {
-				conn.Write([]byte("*0\r\n"))
+			m, err := conn.db.HGetAll(args[0])
+			if err != nil {
+				conn.reply(respErrorFrom(err))
+			} else if len(m) == 0 {
+				conn.reply(respMap(nil))
 			} else {
-				arr := []string{}
+				pairs := []Reply{}
 				for k, v := range m {
-					arr = append(arr, k, v)
+					pairs = append(pairs, respBulk(k), respBulk(v))
 				}
-				conn.Write([]byte(respArray(arr)))
+				conn.reply(respMap(pairs))
 			}
 		// ---------- ZSet Commands ----------
 		case "ZADD":
 			if len(args) != 3 {
-				conn.Write([]byte(respError("ZADD requires a key, score, member")))
+				conn.reply(respError("ZADD requires a key, score, member"))
 				continue
 			}
 			score, err := strconv.ParseFloat(args[1], 64)
 			if err != nil {
-				conn.Write([]byte(respError("Invalid score for ZADD")))
+				conn.reply(respError("Invalid score for ZADD"))
+				continue
+			}
+			n, err := conn.db.ZAdd(args[0], score, args[2])
+			if err != nil {
+				conn.reply(respErrorFrom(err))
 				continue
 			}
-			n := s.store.ZAdd(args[0], score, args[2])
-			conn.Write([]byte(respInt(n)))
+			conn.reply(respInt(n))
 		case "ZREM":
 			if len(args) != 2 {
-				conn.Write([]byte(respError("ZREM requires a key and member")))
+				conn.reply(respError("ZREM requires a key and member"))
+				continue
+			}
+			n, err := conn.db.ZRem(args[0], args[1])
+			if err != nil {
+				conn.reply(respErrorFrom(err))
 				continue
 			}
-			n := s.store.ZRem(args[0], args[1])
-			conn.Write([]byte(respInt(n)))
+			conn.reply(respInt(n))
 		case "ZRANGE":
 			if len(args) != 3 {
-				conn.Write([]byte(respError("ZRANGE requires key start stop")))
+				conn.reply(respError("ZRANGE requires key start stop"))
 				continue
 			}
 			start, err1 := strconv.Atoi(args[1])
 			stop, err2 := strconv.Atoi(args[2])
 			if err1 != nil || err2 != nil {
-				conn.Write([]byte(respError("invalid integer range for ZRANGE")))
+				conn.reply(respError("invalid integer range for ZRANGE"))
 				continue
 			}
-			members, err := s.store.ZRange(args[0], start, stop)
-			if err != nil || len(members) == 0 {
-				conn.Write([]byte("*0\r\n"))
+			members, err := conn.db.ZRange(args[0], start, stop)
+			if err != nil {
+				conn.reply(respErrorFrom(err))
+			} else if len(members) == 0 {
+				conn.reply(respArray(nil))
 			} else {
-				conn.Write([]byte(respArray(members)))
+				conn.reply(respArray(members))
 			}
-		// ---------- Key Management ----------
-		case "EXPIRE":
+		case "ZSCORE":
 			if len(args) != 2 {
-				conn.Write([]byte(respError("Wrong number of arguments for 'EXPIRE'")))
+				conn.reply(respError("ZSCORE requires a key and member"))
 				continue
 			}
-			secs, err := strconv.Atoi(args[1])
+			score, ok, err := conn.db.ZScore(args[0], args[1])
 			if err != nil {
-				conn.Write([]byte(respError("Invalid seconds for 'EXPIRE'")))
-				continue
-			}
-			ok := s.store.Expire(args[0], secs)
-			if ok {
-				conn.Write([]byte(respInt(1)))
+				conn.reply(respErrorFrom(err))
+			} else if !ok {
+				conn.reply(respNullBulk())
 			} else {
-				conn.Write([]byte(respInt(0)))
-			}
-		case "TTL":
-			if len(args) != 1 {
-				conn.Write([]byte(respError("Wrong number of arguments for 'TTL'")))
-				continue
-			}
-			ttl := s.store.TTL(args[0])
-			conn.Write([]byte(respInt(ttl)))
+				conn.reply(respDouble(score))
+			}
+		// ---------- JSON Commands ----------
+		case "JSON.SET", "JSON.GET", "JSON.DEL", "JSON.FORGET", "JSON.TYPE", "JSON.NUMINCRBY",
+			"JSON.ARRAPPEND", "JSON.ARRINSERT", "JSON.ARRLEN", "JSON.ARRPOP", "JSON.OBJKEYS":
+			s.handleJSON(conn, cmd, args)
+		// ---------- Probabilistic Filters ----------
+		case "BF.RESERVE", "BF.ADD", "BF.MADD", "BF.EXISTS", "BF.MEXISTS", "BF.INFO",
+			"CF.RESERVE", "CF.ADD", "CF.ADDNX", "CF.EXISTS", "CF.MEXISTS", "CF.DEL", "CF.COUNT", "CF.INFO":
+			s.handleBloom(conn, cmd, args)
+		// ---------- Sketches ----------
+		case "CMS.INITBYDIM", "CMS.INITBYPROB", "CMS.INCRBY", "CMS.QUERY", "CMS.MERGE", "CMS.INFO",
+			"TOPK.RESERVE", "TOPK.ADD", "TOPK.INCRBY", "TOPK.QUERY", "TOPK.COUNT", "TOPK.LIST", "TOPK.INFO":
+			s.handleSketch(conn, cmd, args)
+		// ---------- Time Series ----------
+		case "TS.CREATE", "TS.ADD", "TS.MADD", "TS.GET", "TS.RANGE", "TS.REVRANGE", "TS.MRANGE", "TS.MREVRANGE",
+			"TS.QUERYINDEX", "TS.DEL", "TS.CREATERULE", "TS.DELETERULE", "TS.INFO":
+			s.handleTimeSeries(conn, cmd, args)
+		// ---------- Search ----------
+		case "FT.CREATE", "FT.SEARCH", "FT.DROPINDEX", "FT.INFO", "FT._LIST":
+			s.handleSearch(conn, cmd, args)
+		// ---------- Vector Sets ----------
+		case "VADD", "VSIM", "VREM", "VCARD", "VDIM", "VEMB", "VSETATTR", "VGETATTR", "VINFO":
+			s.handleVector(conn, cmd, args)
+		// ---------- Key Management ----------
+		case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT", "TTL", "PTTL", "EXPIRETIME", "PEXPIRETIME", "PERSIST":
+			s.handleExpire(conn, cmd, args)
 		case "KEYS":
-			keys := s.store.Keys()
-			conn.Write([]byte(respArray(keys)))
+			// A bare KEYS is kept as "KEYS *" for older clients.
+			pattern := "*"
+			if len(args) > 1 {
+				conn.reply(respError("Wrong number of arguments for 'KEYS'"))
+				continue
+			} else if len(args) == 1 {
+				pattern = args[0]
+			}
+			keys := conn.db.Keys(pattern)
+			conn.reply(respArray(keys))
+		case "EXISTS", "TYPE", "RENAME", "RENAMENX", "COPY", "RANDOMKEY", "TOUCH", "DBSIZE", "UNLINK":
+			s.handleKeyspace(conn, cmd, args)
+		case "SELECT", "SWAPDB", "MOVE", "FLUSHDB", "FLUSHALL":
+			s.handleDatabases(conn, cmd, args)
+		case "ANALYZE":
+			s.handleAnalyze(conn, args)
+		case "MEMORY":
+			s.handleMemory(conn, args)
+		case "OBJECT":
+			s.handleObject(conn, args)
+		case "CONFIG":
+			s.handleConfig(conn, args)
+		case "INFO":
+			s.handleInfo(conn, args)
+		case "DEBUG":
+			s.handleDebug(conn, args)
+		case "SCAN", "SSCAN", "HSCAN", "ZSCAN":
+			s.handleScan(conn, cmd, args)
 		case "DUMPALL":
-			kv := s.store.DumpAll()
+			kv := conn.db.DumpAll()
 			arr := []string{}
 			for k, v := range kv {
 				arr = append(arr, k, v)
 			}
-			conn.Write([]byte(respArray(arr)))
+			conn.reply(respArray(arr))
 		// ---------- HELP / COMMANDS ----------
 		case "COMMANDS", "HELP":
 			commands := []string{
-				"PING", "ECHO message", "SET key value", "GET key", "DEL key [key ...]", "EXPIRE key seconds", "TTL key",
+				"PING", "ECHO message", "SET key value", "GET key", "DEL key [key ...]", "EXPIRE key seconds [NX|XX|GT|LT]", "TTL key",
 				"INCR key", "DECR key", "MSET key value [key value ...]", "MGET key [key ...]",
 				"LPUSH key value [value ...]", "RPOP key", "LLEN key",
 				"SADD key member [member ...]", "SREM key member [member ...]", "SMEMBERS key",
 				"HSET key field value", "HGET key field", "HDEL key field [field ...]", "HGETALL key",
-				"ZADD key score member", "ZREM key member", "ZRANGE key start stop",
-				"DUMPALL", "KEYS",
-			}
-			conn.Write([]byte(respArray(commands)))
+				"ZADD key score member", "ZREM key member", "ZRANGE key start stop", "ZSCORE key member",
+				"JSON.SET key path value [NX|XX]", "JSON.GET key [path ...]", "JSON.DEL key [path]",
+				"JSON.TYPE key [path]", "JSON.NUMINCRBY key path value", "JSON.ARRAPPEND key path value [value ...]",
+				"JSON.ARRINSERT key path index value [value ...]", "JSON.ARRLEN key [path]",
+				"JSON.ARRPOP key [path [index]]", "JSON.OBJKEYS key [path]",
+				"BF.RESERVE key error_rate capacity [EXPANSION n] [NONSCALING]", "BF.ADD key item", "BF.MADD key item [item ...]",
+				"BF.EXISTS key item", "BF.MEXISTS key item [item ...]", "BF.INFO key",
+				"CF.RESERVE key capacity [BUCKETSIZE n] [MAXITERATIONS n] [EXPANSION n]", "CF.ADD key item", "CF.ADDNX key item",
+				"CF.EXISTS key item", "CF.MEXISTS key item [item ...]", "CF.DEL key item", "CF.COUNT key item", "CF.INFO key",
+				"CMS.INITBYDIM key width depth", "CMS.INITBYPROB key error probability", "CMS.INCRBY key item increment [item increment ...]",
+				"CMS.QUERY key item [item ...]", "CMS.MERGE dest numkeys src [src ...] [WEIGHTS weight [weight ...]]", "CMS.INFO key",
+				"TOPK.RESERVE key k [width depth decay]", "TOPK.ADD key item [item ...]", "TOPK.INCRBY key item increment [item increment ...]",
+				"TOPK.QUERY key item [item ...]", "TOPK.COUNT key item [item ...]", "TOPK.LIST key [WITHCOUNT]", "TOPK.INFO key",
+				"TS.CREATE key [RETENTION ms] [DUPLICATE_POLICY policy] [LABELS label value ...]",
+				"TS.ADD key timestamp|* value [RETENTION ms] [ON_DUPLICATE policy] [LABELS label value ...]",
+				"TS.MADD key timestamp value [key timestamp value ...]", "TS.GET key",
+				"TS.RANGE key from to [COUNT n] [AGGREGATION type bucket]", "TS.REVRANGE key from to [COUNT n] [AGGREGATION type bucket]",
+				"TS.MRANGE from to [COUNT n] [AGGREGATION type bucket] [WITHLABELS] FILTER expr ...",
+				"TS.MREVRANGE from to [COUNT n] [AGGREGATION type bucket] [WITHLABELS] FILTER expr ...",
+				"TS.QUERYINDEX expr ...", "TS.DEL key from to", "TS.CREATERULE src dest AGGREGATION type bucket",
+				"TS.DELETERULE src dest", "TS.INFO key",
+				"FT.CREATE index [ON HASH] [PREFIX count prefix ...] SCHEMA field TEXT|TAG|NUMERIC [SORTABLE] ...",
+				"FT.SEARCH index query [NOCONTENT] [RETURN n field ...] [SORTBY field [ASC|DESC]] [LIMIT offset num]",
+				"FT.DROPINDEX index [DD]", "FT.INFO index", "FT._LIST",
+				"VADD key (FP32 blob | VALUES n v ...) element [METRIC COSINE|L2|IP] [M n] [EF n] [SETATTR json]",
+				"VSIM key (ELE element | FP32 blob | VALUES n v ...) [WITHSCORES] [COUNT n] [EF n] [FILTER expr] [TRUTH]",
+				"VREM key element", "VCARD key", "VDIM key", "VEMB key element",
+				"VSETATTR key element json", "VGETATTR key element", "VINFO key",
+				"PEXPIRE key milliseconds [NX|XX|GT|LT]", "EXPIREAT key unix-seconds [NX|XX|GT|LT]",
+				"PEXPIREAT key unix-ms [NX|XX|GT|LT]", "PTTL key", "PERSIST key", "EXPIRETIME key", "PEXPIRETIME key",
+				"EXISTS key [key ...]", "TYPE key", "RENAME key newkey", "RENAMENX key newkey", "COPY source destination [REPLACE]",
+				"RANDOMKEY", "TOUCH key [key ...]", "DBSIZE", "UNLINK key [key ...]",
+				"SCAN cursor [MATCH pattern] [COUNT n] [TYPE type]", "SSCAN key cursor [MATCH pattern] [COUNT n]",
+				"HSCAN key cursor [MATCH pattern] [COUNT n]", "ZSCAN key cursor [MATCH pattern] [COUNT n]",
+				"MEMORY USAGE key [SAMPLES count]", "MEMORY STATS",
+				"SELECT index", "SWAPDB index index", "MOVE key db", "FLUSHDB [ASYNC|SYNC]", "FLUSHALL [ASYNC|SYNC]",
+				"OBJECT ENCODING|IDLETIME|FREQ|REFCOUNT key", "ANALYZE [MATCH pattern] [TOP n]",
+				"HELLO [protover [AUTH username password] [SETNAME name]]", "AUTH [username] password",
+				"ACL SETUSER username [rule ...]", "ACL GETUSER username", "ACL DELUSER username [username ...]",
+				"ACL LIST", "ACL USERS", "ACL WHOAMI", "ACL CAT [category]", "ACL LOG [count|RESET]", "ACL LOAD", "ACL SAVE",
+				"CLIENT ID|GETNAME|SETNAME [name]",
+				"CONFIG GET pattern [pattern ...]", "CONFIG SET parameter value [parameter value ...]",
+				"CONFIG REWRITE", "CONFIG RESETSTAT", "SHUTDOWN [NOSAVE|SAVE|ABORT]", "INFO [section ...]", "DEBUG ADVANCE-CLOCK ms", "DEBUG NOW", "DUMPALL", "KEYS pattern",
+			}
+			conn.reply(respArray(commands))
 		default:
-			conn.Write([]byte(respError("unknown command `" + cmd + "`")))
+			conn.reply(respError("unknown command `" + cmd + "`"))
+		}
+		if spec.flags&cmdNoTouch == 0 {
+			conn.db.RecordAccess(spec.flags&cmdWrite != 0, spec.keys(args)...)
 		}
 	}
 }
 
-func (s *Server) Listen(addr string) error {
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+// isConnError reports whether err came from the connection, such as a
+// timeout or the client going away, rather than from what it sent.
+func isConnError(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Listen serves clients on the configured port, and with TLS on tls-port if
+// one is set, until ctx is cancelled or SHUTDOWN is run. A port of 0 is not
+// listened on.
+func (s *Server) Listen(ctx context.Context) error {
+	cfg := s.config()
+	var listeners []net.Listener
+	if cfg.Port != 0 {
+		ln, err := net.Listen("tcp", cfg.Addr())
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+	if cfg.TLSPort != 0 {
+		ln, err := s.listenTLS(cfg)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+	if len(listeners) == 0 {
+		return errors.New("port and tls-port are both 0, so there is nothing to listen on")
+	}
+	if cfg.Port != 0 {
+		log.Println("RedisGo server started on", cfg.Addr())
 	}
-	log.Println("RedisGo server started on", addr)
+	if cfg.TLSPort != 0 {
+		log.Println("RedisGo server started with TLS on", cfg.TLSAddr())
+	}
+	return s.Serve(ctx, listeners...)
+}
+
+// Serve accepts clients from listeners until ctx is cancelled or SHUTDOWN is
+// run. It then stops accepting, lets commands already running finish and
+// flush their replies, closes every client and returns once they are gone.
+func (s *Server) Serve(ctx context.Context, listeners ...net.Listener) error {
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Shutdown(shutdownDefault)
+		case <-s.stop:
+		}
+		s.closing.Store(true)
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+	var accepting sync.WaitGroup
+	for _, ln := range listeners {
+		accepting.Add(1)
+		go func() {
+			defer accepting.Done()
+			s.accept(ln)
+		}()
+	}
+	accepting.Wait()
+
+	s.clientsMu.Lock()
+	for c := range s.clients {
+		c.SetReadDeadline(time.Now()) // wakes clients waiting for input
+	}
+	s.clientsMu.Unlock()
+	s.clientsGroup.Wait()
+	s.finishShutdown()
+	log.Println("RedisGo server stopped")
+	return nil
+}
+
+// accept serves each client listener accepts on its own goroutine until the
+// server is closing.
+func (s *Server) accept(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if s.closing.Load() {
+				return
+			}
 			log.Println("Accept error:", err)
 			continue
 		}
-		go s.handleConnection(conn)
+		s.clientsGroup.Add(1)
+		go func() {
+			defer s.clientsGroup.Done()
+			s.handleConnection(conn)
+		}()
 	}
 }
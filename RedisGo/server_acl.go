@@ -0,0 +1,246 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authorize reports whether conn may run cmd with args, replying with the
+// error and logging the denial if not. A client whose user has been deleted
+// is disconnected.
+func (s *Server) authorize(conn *client, cmd string, args []string) bool {
+	if cmd == "AUTH" || cmd == "HELLO" {
+		// They authenticate, so anyone may call them.
+		return true
+	}
+	if !conn.authenticated && s.acl.authRequired() {
+		conn.reply(respErrorFrom(ErrNoAuth))
+		return false
+	}
+	spec, known := commandTable[cmd]
+	if !known {
+		return true // answered as an unknown command
+	}
+	user := s.acl.user(conn.user)
+	if user == nil {
+		conn.Close()
+		return false
+	}
+	sub := ""
+	if aclSubcommands[cmd] && len(args) > 0 {
+		sub = strings.ToUpper(args[0])
+	}
+	if !user.canRun(cmd, sub) {
+		name := strings.ToLower(cmd)
+		if sub != "" {
+			name += "|" + strings.ToLower(sub)
+		}
+		s.acl.logDenial("command", name, user.name, conn.info(), s.config().ACLLogMaxLen)
+		conn.reply(respErrorCode("NOPERM", "User "+user.name+" has no permissions to run the '"+name+"' command"))
+		return false
+	}
+	perm := keyRead
+	if spec.flags&cmdWrite != 0 {
+		perm = keyWrite
+	}
+	if spec.flags&cmdAnyKey != 0 && !user.canAccessAllKeys(perm) {
+		s.acl.logDenial("key", "*", user.name, conn.info(), s.config().ACLLogMaxLen)
+		conn.reply(respErrorCode("NOPERM", "No permissions to access a key"))
+		return false
+	}
+	keys, perms := spec.access(args)
+	for i, key := range keys {
+		if !user.canAccessKey(key, perms[i]) {
+			s.acl.logDenial("key", key, user.name, conn.info(), s.config().ACLLogMaxLen)
+			conn.reply(respErrorCode("NOPERM", "No permissions to access a key"))
+			return false
+		}
+	}
+	return true
+}
+
+// authenticate logs conn in as the named user, recording a failure in the
+// ACL log.
+func (s *Server) authenticate(conn *client, name, password string) error {
+	if u := s.acl.user(name); u == nil || !u.checkPassword(password) {
+		s.acl.logDenial("auth", "AUTH", name, conn.info(), s.config().ACLLogMaxLen)
+		return ErrWrongPass
+	}
+	conn.user, conn.authenticated = name, true
+	return nil
+}
+
+// handleAuth serves AUTH [username] password. Without a username it logs in
+// as the default user.
+func (s *Server) handleAuth(conn *client, args []string) {
+	var name, password string
+	switch len(args) {
+	case 1:
+		if !s.acl.authRequired() {
+			conn.reply(respError("AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"))
+			return
+		}
+		name, password = "default", args[0]
+	case 2:
+		name, password = args[0], args[1]
+	default:
+		conn.reply(respError("Wrong number of arguments for 'AUTH'"))
+		return
+	}
+	if err := s.authenticate(conn, name, password); err != nil {
+		conn.reply(respErrorFrom(err))
+		return
+	}
+	conn.reply(respSimple("OK"))
+}
+
+// handleACL serves the ACL subcommands.
+func (s *Server) handleACL(conn *client, args []string) {
+	if len(args) < 1 {
+		conn.reply(respError("Wrong number of arguments for 'ACL'"))
+		return
+	}
+	sub, args := strings.ToUpper(args[0]), args[1:]
+	switch sub {
+	case "SETUSER":
+		if len(args) < 1 {
+			conn.reply(respError("Wrong number of arguments for 'ACL SETUSER'"))
+			return
+		}
+		if err := s.acl.setUser(args[0], args[1:]); err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respSimple("OK"))
+	case "GETUSER":
+		if len(args) != 1 {
+			conn.reply(respError("Wrong number of arguments for 'ACL GETUSER'"))
+			return
+		}
+		u := s.acl.user(args[0])
+		if u == nil {
+			conn.reply(respNullBulk())
+			return
+		}
+		conn.reply(respMap([]Reply{
+			respBulk("flags"), respArray(u.flags()),
+			respBulk("passwords"), respArray(u.passwords),
+			respBulk("commands"), respBulk(u.commandRules()),
+			respBulk("keys"), respBulk(u.keyRules()),
+			respBulk("channels"), respBulk(u.channelRules()),
+			respBulk("selectors"), respArray(nil),
+		}))
+	case "DELUSER":
+		if len(args) < 1 {
+			conn.reply(respError("Wrong number of arguments for 'ACL DELUSER'"))
+			return
+		}
+		n, err := s.acl.deleteUsers(args)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respInt(n))
+	case "LIST", "USERS":
+		var lines []string
+		for _, name := range s.acl.usernames() {
+			if sub == "USERS" {
+				lines = append(lines, name)
+			} else if u := s.acl.user(name); u != nil {
+				lines = append(lines, "user "+name+" "+u.rules())
+			}
+		}
+		conn.reply(respArray(lines))
+	case "WHOAMI":
+		conn.reply(respBulk(conn.user))
+	case "CAT":
+		switch len(args) {
+		case 0:
+			names := make([]string, len(aclCategories))
+			for i, c := range aclCategories {
+				names[i] = c.name
+			}
+			conn.reply(respArray(names))
+		case 1:
+			cat := strings.ToLower(args[0])
+			if cat == "all" || !isACLCategory(cat) {
+				conn.reply(respError("Unknown category '" + args[0] + "'"))
+				return
+			}
+			var names []string
+			for name, cats := range commandCategories {
+				for _, c := range cats {
+					if c == cat {
+						names = append(names, strings.ToLower(name))
+						break
+					}
+				}
+			}
+			sort.Strings(names)
+			conn.reply(respArray(names))
+		default:
+			conn.reply(respError("Wrong number of arguments for 'ACL CAT'"))
+		}
+	case "LOG":
+		s.aclLog(conn, args)
+	case "LOAD", "SAVE":
+		path := s.config().ACLFile
+		if path == "" {
+			conn.reply(respError("This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration."))
+			return
+		}
+		var err error
+		if sub == "LOAD" {
+			err = s.acl.LoadFile(path)
+		} else {
+			err = s.acl.SaveFile(path)
+		}
+		if err != nil {
+			conn.reply(respError(err.Error()))
+			return
+		}
+		conn.reply(respSimple("OK"))
+	default:
+		conn.reply(respError("unknown ACL subcommand '" + sub + "'"))
+	}
+}
+
+// aclLog serves ACL LOG [count | RESET].
+func (s *Server) aclLog(conn *client, args []string) {
+	count := 10
+	if len(args) == 1 {
+		if strings.EqualFold(args[0], "RESET") {
+			s.acl.resetLog()
+			conn.reply(respSimple("OK"))
+			return
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			conn.reply(respErrorFrom(ErrNotInteger))
+			return
+		}
+		count = n
+	} else if len(args) > 1 {
+		conn.reply(respError("Wrong number of arguments for 'ACL LOG'"))
+		return
+	}
+	now := time.Now()
+	var entries []Reply
+	for _, e := range s.acl.logEntries(count) {
+		entries = append(entries, respMap([]Reply{
+			respBulk("count"), respInt(e.count),
+			respBulk("reason"), respBulk(e.reason),
+			respBulk("context"), respBulk("toplevel"),
+			respBulk("object"), respBulk(e.object),
+			respBulk("username"), respBulk(e.username),
+			respBulk("age-seconds"), respDouble(now.Sub(e.created).Seconds()),
+			respBulk("client-info"), respBulk(e.clientInfo),
+			respBulk("entry-id"), respInt(int(e.id)),
+			respBulk("timestamp-created"), respInt(int(e.created.UnixMilli())),
+			respBulk("timestamp-last-updated"), respInt(int(e.updated.UnixMilli())),
+		}))
+	}
+	conn.reply(respRawArray(entries))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// handleAnalyze serves ANALYZE [MATCH pattern] [TOP n], which walks the
+// keyspace and replies with a big-key and hot-key report.
+func (s *Server) handleAnalyze(conn *client, args []string) {
+	match, top := "", analyzeDefaultTop
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			conn.reply(respError("syntax error"))
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			match = args[i+1]
+		case "TOP":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n <= 0 {
+				conn.reply(respError("value is not an integer or out of range"))
+				return
+			}
+			top = n
+		default:
+			conn.reply(respError("syntax error"))
+			return
+		}
+	}
+	conn.reply(respBulk(formatKeyAnalysis(conn.db.AnalyzeKeys(match, top))))
+}
+
+// formatKeyAnalysis renders an analysis as the text ANALYZE replies with and
+// the -analyze CLI mode prints.
+func formatKeyAnalysis(a KeyAnalysis) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Scanned %d keys\n", a.Scanned)
+	for _, t := range a.Types {
+		fmt.Fprintf(&b, "\n%s: %d keys, %d elements, %d bytes\n", t.Type, t.Keys, t.Elements, t.Bytes)
+		b.WriteString("  biggest by elements:\n")
+		for _, k := range t.Biggest {
+			fmt.Fprintf(&b, "    %-30s %d\n", k.Key, k.Elements)
+		}
+		b.WriteString("  biggest by memory:\n")
+		for _, k := range t.Heaviest {
+			fmt.Fprintf(&b, "    %-30s %d bytes\n", k.Key, k.Bytes)
+		}
+	}
+	if len(a.Hottest) > 0 {
+		b.WriteString("\nhottest keys (LFU counter):\n")
+		for _, k := range a.Hottest {
+			fmt.Fprintf(&b, "  %-32s %d\n", k.Key, k.Frequency)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// respBools renders a slice of flags as an array of 0/1 integers.
+func respBools(flags []bool) Reply {
+	items := make([]Reply, len(flags))
+	for i, f := range flags {
+		items[i] = respInt(boolToInt(f))
+	}
+	return respRawArray(items)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// handleBloom serves the BF.* (Bloom filter) and CF.* (Cuckoo filter) command families.
+func (s *Server) handleBloom(conn *client, cmd string, args []string) {
+	switch cmd {
+	case "BF.RESERVE":
+		if len(args) < 3 {
+			conn.reply(respError("Wrong number of arguments for 'BF.RESERVE'"))
+			return
+		}
+		errorRate, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			conn.reply(respError("bad error rate"))
+			return
+		}
+		capacity, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			conn.reply(respError("bad capacity"))
+			return
+		}
+		expansion, nonScaling := bloomDefaultExpansion, false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NONSCALING":
+				nonScaling = true
+			case "EXPANSION":
+				if i+1 >= len(args) {
+					conn.reply(respError("syntax error"))
+					return
+				}
+				i++
+				if expansion, err = strconv.Atoi(args[i]); err != nil {
+					conn.reply(respError("bad expansion"))
+					return
+				}
+			default:
+				conn.reply(respError("syntax error"))
+				return
+			}
+		}
+		if err := conn.db.BFReserve(args[0], errorRate, capacity, expansion, nonScaling); err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respSimple("OK"))
+	case "BF.ADD", "BF.MADD":
+		if len(args) < 2 || (cmd == "BF.ADD" && len(args) != 2) {
+			conn.reply(respError("Wrong number of arguments for '" + cmd + "'"))
+			return
+		}
+		added, err := conn.db.BFAdd(args[0], args[1:]...)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+		} else if cmd == "BF.ADD" {
+			conn.reply(respInt(boolToInt(added[0])))
+		} else {
+			conn.reply(respBools(added))
+		}
+	case "BF.EXISTS", "BF.MEXISTS":
+		if len(args) < 2 || (cmd == "BF.EXISTS" && len(args) != 2) {
+			conn.reply(respError("Wrong number of arguments for '" + cmd + "'"))
+			return
+		}
+		found, err := conn.db.BFExists(args[0], args[1:]...)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+		} else if cmd == "BF.EXISTS" {
+			conn.reply(respInt(boolToInt(found[0])))
+		} else {
+			conn.reply(respBools(found))
+		}
+	case "BF.INFO":
+		if len(args) != 1 {
+			conn.reply(respError("Wrong number of arguments for 'BF.INFO'"))
+			return
+		}
+		info, err := conn.db.BFInfo(args[0])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respMap([]Reply{
+			respBulk("Capacity"), respInt(int(info.Capacity)),
+			respBulk("Size"), respInt(info.Size),
+			respBulk("Number of filters"), respInt(info.Filters),
+			respBulk("Number of items inserted"), respInt(int(info.Items)),
+			respBulk("Expansion rate"), respInt(info.Expansion),
+			respBulk("Fill ratio"), respBulk(strconv.FormatFloat(info.FillRatio, 'f', 4, 64)),
+		}))
+	case "CF.RESERVE":
+		if len(args) < 2 {
+			conn.reply(respError("Wrong number of arguments for 'CF.RESERVE'"))
+			return
+		}
+		capacity, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			conn.reply(respError("bad capacity"))
+			return
+		}
+		bucketSize, maxIterations, expansion := cuckooDefaultBucketSize, cuckooDefaultMaxIterations, cuckooDefaultExpansion
+		for i := 2; i < len(args); i += 2 {
+			if i+1 >= len(args) {
+				conn.reply(respError("syntax error"))
+				return
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				conn.reply(respError("bad " + strings.ToLower(args[i])))
+				return
+			}
+			switch strings.ToUpper(args[i]) {
+			case "BUCKETSIZE":
+				bucketSize = n
+			case "MAXITERATIONS":
+				maxIterations = n
+			case "EXPANSION":
+				expansion = n
+			default:
+				conn.reply(respError("syntax error"))
+				return
+			}
+		}
+		if err := conn.db.CFReserve(args[0], capacity, bucketSize, maxIterations, expansion); err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respSimple("OK"))
+	case "CF.ADD", "CF.ADDNX":
+		if len(args) != 2 {
+			conn.reply(respError("Wrong number of arguments for '" + cmd + "'"))
+			return
+		}
+		added, err := conn.db.CFAdd(args[0], args[1], cmd == "CF.ADDNX")
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respInt(boolToInt(added)))
+	case "CF.EXISTS", "CF.MEXISTS":
+		if len(args) < 2 || (cmd == "CF.EXISTS" && len(args) != 2) {
+			conn.reply(respError("Wrong number of arguments for '" + cmd + "'"))
+			return
+		}
+		found, err := conn.db.CFExists(args[0], args[1:]...)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+		} else if cmd == "CF.EXISTS" {
+			conn.reply(respInt(boolToInt(found[0])))
+		} else {
+			conn.reply(respBools(found))
+		}
+	case "CF.DEL":
+		if len(args) != 2 {
+			conn.reply(respError("Wrong number of arguments for 'CF.DEL'"))
+			return
+		}
+		deleted, err := conn.db.CFDel(args[0], args[1])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respInt(boolToInt(deleted)))
+	case "CF.COUNT":
+		if len(args) != 2 {
+			conn.reply(respError("Wrong number of arguments for 'CF.COUNT'"))
+			return
+		}
+		n, err := conn.db.CFCount(args[0], args[1])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respInt(n))
+	case "CF.INFO":
+		if len(args) != 1 {
+			conn.reply(respError("Wrong number of arguments for 'CF.INFO'"))
+			return
+		}
+		info, err := conn.db.CFInfo(args[0])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respMap([]Reply{
+			respBulk("Size"), respInt(info.Size),
+			respBulk("Number of buckets"), respInt(int(info.Buckets)),
+			respBulk("Number of filters"), respInt(info.Filters),
+			respBulk("Number of items inserted"), respInt(int(info.Inserted)),
+			respBulk("Number of items deleted"), respInt(int(info.Deleted)),
+			respBulk("Bucket size"), respInt(info.BucketSize),
+			respBulk("Expansion rate"), respInt(info.Expansion),
+			respBulk("Max iterations"), respInt(info.MaxIterations),
+		}))
+	default:
+		conn.reply(respError("unknown command `" + cmd + "`"))
+	}
+}
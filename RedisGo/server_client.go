@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Server identity reported by HELLO.
+const (
+	serverName    = "redisgo"
+	serverVersion = "7.2.0"
+)
+
+// handleHello serves HELLO [protover [AUTH username password] [SETNAME name]],
+// switching the connection's protocol and describing the server in it.
+func (s *Server) handleHello(conn *client, args []string) {
+	proto := conn.proto
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil {
+			conn.reply(respError("Protocol version is not an integer or out of range"))
+			return
+		}
+		if v != 2 && v != 3 {
+			conn.reply(respErrorFrom(ErrNoProto))
+			return
+		}
+		proto = v
+	}
+	name, setName := conn.name, false
+	var auth []string // username and password
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				conn.reply(respError("syntax error"))
+				return
+			}
+			auth = args[i+1 : i+3]
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				conn.reply(respError("syntax error"))
+				return
+			}
+			if !validClientName(args[i+1]) {
+				conn.reply(respError("Client names cannot contain spaces, newlines or special characters."))
+				return
+			}
+			name, setName = args[i+1], true
+			i++
+		default:
+			conn.reply(respError("syntax error"))
+			return
+		}
+	}
+	if auth != nil {
+		if err := s.authenticate(conn, auth[0], auth[1]); err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+	} else if !conn.authenticated && s.acl.authRequired() {
+		conn.reply(respErrorCode("NOAUTH", "HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"))
+		return
+	}
+	conn.proto = proto
+	if setName {
+		conn.name = name
+	}
+	conn.reply(respMap([]Reply{
+		respBulk("server"), respBulk(serverName),
+		respBulk("version"), respBulk(serverVersion),
+		respBulk("proto"), respInt(conn.proto),
+		respBulk("id"), respInt(int(conn.id)),
+		respBulk("mode"), respBulk("standalone"),
+		respBulk("role"), respBulk("master"),
+		respBulk("modules"), respArray(nil),
+	}))
+}
+
+// handleClient serves CLIENT ID, CLIENT GETNAME and CLIENT SETNAME.
+func (s *Server) handleClient(conn *client, args []string) {
+	if len(args) < 1 {
+		conn.reply(respError("Wrong number of arguments for 'CLIENT'"))
+		return
+	}
+	switch strings.ToUpper(args[0]) {
+	case "ID":
+		conn.reply(respInt(int(conn.id)))
+	case "GETNAME":
+		if conn.name == "" {
+			conn.reply(respNullBulk())
+		} else {
+			conn.reply(respBulk(conn.name))
+		}
+	case "SETNAME":
+		if len(args) != 2 {
+			conn.reply(respError("Wrong number of arguments for 'CLIENT SETNAME'"))
+			return
+		}
+		if !validClientName(args[1]) {
+			conn.reply(respError("Client names cannot contain spaces, newlines or special characters."))
+			return
+		}
+		conn.name = args[1]
+		conn.reply(respSimple("OK"))
+	default:
+		conn.reply(respError("unknown CLIENT subcommand '" + args[0] + "'"))
+	}
+}
+
+// validClientName reports whether name is printable ASCII without spaces.
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// info describes the client for ACL LOG, like a line of CLIENT LIST.
+func (c *client) info() string {
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s db=%d user=%s resp=%d",
+		c.id, c.RemoteAddr(), c.LocalAddr(), c.name, c.dbIndex, c.user, c.proto)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+)
+
+// handleConfig serves CONFIG GET, SET, REWRITE and RESETSTAT.
+func (s *Server) handleConfig(conn *client, args []string) {
+	if len(args) < 1 {
+		conn.reply(respError("Wrong number of arguments for 'CONFIG'"))
+		return
+	}
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if len(args) < 2 {
+			conn.reply(respError("Wrong number of arguments for 'CONFIG GET'"))
+			return
+		}
+		cfg := s.config()
+		var pairs []Reply
+		for _, p := range configParams {
+			for _, pattern := range args[1:] {
+				if globMatch(strings.ToLower(pattern), p.name) {
+					pairs = append(pairs, respBulk(p.name), respBulk(p.get(&cfg)))
+					break
+				}
+			}
+		}
+		conn.reply(respMap(pairs))
+	case "SET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			conn.reply(respError("Wrong number of arguments for 'CONFIG SET'"))
+			return
+		}
+		if err := s.setConfig(args[1:]); err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respSimple("OK"))
+	case "REWRITE":
+		if s.configFile == "" {
+			conn.reply(respError("The server is running without a config file"))
+			return
+		}
+		if err := RewriteConfigFile(s.configFile, s.config()); err != nil {
+			conn.reply(respError("Rewriting config file: " + err.Error()))
+			return
+		}
+		conn.reply(respSimple("OK"))
+	case "RESETSTAT":
+		for _, db := range s.databases() {
+			db.ResetStats()
+		}
+		conn.reply(respSimple("OK"))
+	default:
+		conn.reply(respError("unknown CONFIG subcommand '" + args[0] + "'"))
+	}
+}
+
+// setConfig applies name, value pairs all together or, if any is unknown,
+// immutable or invalid, not at all.
+func (s *Server) setConfig(pairs []string) error {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+	cfg := s.cfg
+	for i := 0; i < len(pairs); i += 2 {
+		name := pairs[i]
+		p, ok := lookupConfigParam(name)
+		if !ok {
+			return &Error{"ERR", "Unknown option or number of arguments for CONFIG SET - '" + name + "'"}
+		}
+		if !p.mutable {
+			return &Error{"ERR", "CONFIG SET failed (possibly related to argument '" + p.name + "') - can't set immutable config"}
+		}
+		if err := p.set(&cfg, pairs[i+1]); err != nil {
+			return &Error{"ERR", "CONFIG SET failed (possibly related to argument '" + p.name + "') - " + err.Error()}
+		}
+	}
+	// Setting a TLS parameter, even to its current value, reloads the
+	// certificates, and a config that does not load is refused.
+	if cfg.TLSPort != 0 && setsTLSParam(pairs) {
+		if err := s.tlsConfig.reload(cfg); err != nil {
+			return &Error{"ERR", "CONFIG SET failed - Unable to update TLS configuration: " + err.Error()}
+		}
+	}
+	if cfg.RequirePass != s.cfg.RequirePass {
+		s.acl.setRequirePass(cfg.RequirePass)
+	}
+	s.cfg = cfg
+	s.database(0).SetMaxMemory(cfg.MaxMemory, cfg.MaxMemoryPolicy)
+	return nil
+}
+
+// setsTLSParam reports whether name, value pairs set a tls-* parameter.
+func setsTLSParam(pairs []string) bool {
+	for i := 0; i < len(pairs); i += 2 {
+		if strings.HasPrefix(strings.ToLower(pairs[i]), "tls-") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// handleDatabases serves SELECT, SWAPDB, MOVE, FLUSHDB and FLUSHALL.
+func (s *Server) handleDatabases(conn *client, cmd string, args []string) {
+	switch cmd {
+	case "SELECT":
+		if len(args) != 1 {
+			conn.reply(respError("Wrong number of arguments for 'SELECT'"))
+			return
+		}
+		i, ok := s.parseDBIndex(conn, args[0])
+		if !ok {
+			return
+		}
+		conn.dbIndex = i
+		conn.reply(respSimple("OK"))
+	case "SWAPDB":
+		if len(args) != 2 {
+			conn.reply(respError("Wrong number of arguments for 'SWAPDB'"))
+			return
+		}
+		i, ok := s.parseDBIndex(conn, args[0])
+		if !ok {
+			return
+		}
+		j, ok := s.parseDBIndex(conn, args[1])
+		if !ok {
+			return
+		}
+		// Clients pick up their database for each command, so connections
+		// that selected i see j's data from their next command on.
+		s.mu.Lock()
+		s.dbs[i], s.dbs[j] = s.dbs[j], s.dbs[i]
+		s.mu.Unlock()
+		conn.reply(respSimple("OK"))
+	case "MOVE":
+		if len(args) != 2 {
+			conn.reply(respError("Wrong number of arguments for 'MOVE'"))
+			return
+		}
+		i, ok := s.parseDBIndex(conn, args[1])
+		if !ok {
+			return
+		}
+		moved, err := conn.db.Move(args[0], s.database(i))
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respInt(boolToInt(moved)))
+	case "FLUSHDB", "FLUSHALL":
+		async := false
+		if len(args) > 1 {
+			conn.reply(respError("Wrong number of arguments for '" + cmd + "'"))
+			return
+		}
+		if len(args) == 1 {
+			switch strings.ToUpper(args[0]) {
+			case "ASYNC":
+				async = true
+			case "SYNC":
+			default:
+				conn.reply(respError("syntax error"))
+				return
+			}
+		}
+		dbs := []*Store{conn.db}
+		if cmd == "FLUSHALL" {
+			dbs = s.databases()
+		}
+		// Drop every database first, then collect once: SYNC waits for the
+		// memory to be reclaimed, ASYNC leaves it to the background collector.
+		for _, db := range dbs {
+			db.Flush()
+		}
+		if !async {
+			runtime.GC()
+		}
+		conn.reply(respSimple("OK"))
+	}
+}
+
+// parseDBIndex parses a database number, replying with an error if it is
+// invalid.
+func (s *Server) parseDBIndex(conn *client, arg string) (int, bool) {
+	i, err := strconv.Atoi(arg)
+	if err != nil {
+		conn.reply(respError("value is not an integer or out of range"))
+		return 0, false
+	}
+	if i < 0 || i >= len(s.databases()) {
+		conn.reply(respError("DB index is out of range"))
+		return 0, false
+	}
+	return i, true
+}
+
+// freeMemory evicts keys until memory use is within maxmemory, taking them
+// from the largest databases first.
+func (s *Server) freeMemory() error {
+	// The databases share one account, so this is cheap to check first.
+	if _, over := s.database(0).memory.overLimit(); !over {
+		return nil
+	}
+	dbs := s.databases()
+	used := make(map[*Store]int64, len(dbs))
+	for _, db := range dbs {
+		used[db] = db.MemoryStats().DBUsed
+	}
+	sort.SliceStable(dbs, func(i, j int) bool { return used[dbs[i]] > used[dbs[j]] })
+	var err error = ErrOOM
+	for _, db := range dbs {
+		if err = db.FreeMemory(); err == nil {
+			break
+		}
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleDebug serves DEBUG subcommands used for testing.
+func (s *Server) handleDebug(conn *client, args []string) {
+	if len(args) < 1 {
+		conn.reply(respError("Wrong number of arguments for 'DEBUG'"))
+		return
+	}
+	switch strings.ToUpper(args[0]) {
+	case "ADVANCE-CLOCK":
+		// DEBUG ADVANCE-CLOCK ms moves the store's clock forward, expiring keys
+		// as if that much time had passed.
+		if len(args) != 2 {
+			conn.reply(respError("Wrong number of arguments for 'DEBUG ADVANCE-CLOCK'"))
+			return
+		}
+		if !s.debugAllowed(conn) {
+			conn.reply(respError("DEBUG ADVANCE-CLOCK not allowed. If the enable-debug-command option is set to \"local\", you can run it from a local connection, otherwise you need to set this option in the configuration file, and then restart the server."))
+			return
+		}
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || ms < 0 || ms > math.MaxInt64/int64(time.Millisecond) {
+			conn.reply(respError("value is not an integer or out of range"))
+			return
+		}
+		clock, ok := conn.db.clock.(AdjustableClock)
+		if !ok {
+			conn.reply(respError("the store clock cannot be adjusted"))
+			return
+		}
+		if err := clock.Advance(time.Duration(ms) * time.Millisecond); err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respSimple("OK"))
+	case "NOW":
+		conn.reply(respInt(int(conn.db.Now().UnixMilli())))
+	default:
+		conn.reply(respError("unknown DEBUG subcommand '" + args[0] + "'"))
+	}
+}
+
+// debugAllowed reports whether conn may move the clock: always when the store
+// runs on a FakeClock, otherwise as enable-debug-command says.
+func (s *Server) debugAllowed(conn *client) bool {
+	if _, fake := conn.db.clock.(*FakeClock); fake {
+		return true
+	}
+	switch s.config().DebugCommand {
+	case "yes":
+		return true
+	case "local":
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		return ok && addr.IP.IsLoopback()
+	}
+	return false
+}
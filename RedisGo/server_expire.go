@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// parseExpireCond parses the optional NX|XX|GT|LT flags of the EXPIRE family.
+func parseExpireCond(args []string) (ExpireCond, string) {
+	var cond ExpireCond
+	for _, a := range args {
+		switch strings.ToUpper(a) {
+		case "NX":
+			cond |= ExpireNX
+		case "XX":
+			cond |= ExpireXX
+		case "GT":
+			cond |= ExpireGT
+		case "LT":
+			cond |= ExpireLT
+		default:
+			return 0, "Unsupported option " + a
+		}
+	}
+	if cond&ExpireNX != 0 && cond&^ExpireNX != 0 {
+		return 0, "NX and XX, GT or LT options at the same time are not compatible"
+	}
+	if cond&ExpireGT != 0 && cond&ExpireLT != 0 {
+		return 0, "GT and LT options at the same time are not compatible"
+	}
+	return cond, ""
+}
+
+// handleExpire serves the EXPIRE, TTL and PERSIST command families.
+func (s *Server) handleExpire(conn *client, cmd string, args []string) {
+	switch cmd {
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT":
+		if len(args) < 2 {
+			conn.reply(respError("Wrong number of arguments for '" + cmd + "'"))
+			return
+		}
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			conn.reply(respError("value is not an integer or out of range"))
+			return
+		}
+		cond, msg := parseExpireCond(args[2:])
+		if msg != "" {
+			conn.reply(respError(msg))
+			return
+		}
+		// Convert everything to an absolute Unix time in milliseconds.
+		var atMs int64
+		invalid := false
+		switch cmd {
+		case "EXPIRE", "EXPIREAT":
+			if n > math.MaxInt64/1000 || n < math.MinInt64/1000 {
+				invalid = true
+				break
+			}
+			atMs = n * 1000
+		case "PEXPIRE", "PEXPIREAT":
+			atMs = n
+		}
+		if cmd == "EXPIRE" || cmd == "PEXPIRE" {
+			now := conn.db.Now().UnixMilli()
+			if atMs > 0 && atMs > math.MaxInt64-now {
+				invalid = true
+			}
+			atMs += now
+		}
+		if invalid {
+			conn.reply(respError("invalid expire time in '" + strings.ToLower(cmd) + "' command"))
+			return
+		}
+		conn.reply(respInt(boolToInt(conn.db.PExpireAt(args[0], atMs, cond))))
+	case "TTL", "PTTL", "EXPIRETIME", "PEXPIRETIME", "PERSIST":
+		if len(args) != 1 {
+			conn.reply(respError("Wrong number of arguments for '" + cmd + "'"))
+			return
+		}
+		switch cmd {
+		case "TTL":
+			conn.reply(respInt(conn.db.TTL(args[0])))
+		case "PTTL":
+			conn.reply(respInt(int(conn.db.PTTL(args[0]))))
+		case "EXPIRETIME":
+			at := conn.db.PExpireTime(args[0])
+			if at > 0 {
+				at /= 1000
+			}
+			conn.reply(respInt(int(at)))
+		case "PEXPIRETIME":
+			conn.reply(respInt(int(conn.db.PExpireTime(args[0]))))
+		case "PERSIST":
+			conn.reply(respInt(boolToInt(conn.db.Persist(args[0]))))
+		}
+	default:
+		conn.reply(respError("unknown command `" + cmd + "`"))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// infoSections lists the INFO sections in the order they are printed.
+var infoSections = []string{"memory", "stats", "keyspace"}
+
+// infoSection renders one INFO section, or "" for an unknown name.
+func (s *Server) infoSection(name string) string {
+	var b strings.Builder
+	dbs := s.databases()
+	switch name {
+	case "memory":
+		mem := dbs[0].MemoryStats()
+		b.WriteString("# Memory\r\n")
+		fmt.Fprintf(&b, "used_memory:%d\r\n", mem.Used)
+		fmt.Fprintf(&b, "maxmemory:%d\r\n", mem.Max)
+		fmt.Fprintf(&b, "maxmemory_policy:%s\r\n", mem.Policy)
+	case "stats":
+		// Sum the databases, weighting the stale estimate by volatile keys.
+		var st ExpiryStats
+		for _, db := range dbs {
+			dbStats := db.ExpiryStats()
+			st.ExpiredKeys += dbStats.ExpiredKeys
+			st.TimeCapReached += dbStats.TimeCapReached
+			st.CycleTime += dbStats.CycleTime
+			st.StalePerc += dbStats.StalePerc * float64(dbStats.VolatileKeys)
+			st.VolatileKeys += dbStats.VolatileKeys
+		}
+		if st.VolatileKeys > 0 {
+			st.StalePerc /= float64(st.VolatileKeys)
+		}
+		b.WriteString("# Stats\r\n")
+		fmt.Fprintf(&b, "expired_keys:%d\r\n", st.ExpiredKeys)
+		fmt.Fprintf(&b, "evicted_keys:%d\r\n", dbs[0].MemoryStats().EvictedKeys)
+		fmt.Fprintf(&b, "expired_stale_perc:%.2f\r\n", st.StalePerc*100)
+		fmt.Fprintf(&b, "expired_time_cap_reached_count:%d\r\n", st.TimeCapReached)
+		fmt.Fprintf(&b, "expire_cycle_cpu_milliseconds:%d\r\n", st.CycleTime.Milliseconds())
+	case "keyspace":
+		b.WriteString("# Keyspace\r\n")
+		for i, db := range dbs {
+			if n := db.DBSize(); n > 0 {
+				fmt.Fprintf(&b, "db%d:keys=%d,expires=%d\r\n", i, n, db.ExpiryStats().VolatileKeys)
+			}
+		}
+	}
+	return b.String()
+}
+
+// handleInfo serves INFO [section ...].
+func (s *Server) handleInfo(conn *client, args []string) {
+	sections := infoSections
+	if len(args) > 0 {
+		sections = nil
+		for _, a := range args {
+			switch a = strings.ToLower(a); a {
+			case "all", "default", "everything":
+				sections = infoSections
+			default:
+				sections = append(sections, a)
+			}
+		}
+	}
+	var parts []string
+	for _, name := range sections {
+		if text := s.infoSection(name); text != "" {
+			parts = append(parts, text)
+		}
+	}
+	conn.reply(respVerbatim(strings.Join(parts, "\r\n")))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// isLegacyJSONPath reports whether a reply for path should be a single value
+// rather than one entry per JSONPath match.
+func isLegacyJSONPath(path string) bool {
+	return !strings.HasPrefix(path, "$")
+}
+
+// handleJSON serves the JSON.* command family.
+func (s *Server) handleJSON(conn *client, cmd string, args []string) {
+	switch cmd {
+	case "JSON.SET":
+		if len(args) < 3 || len(args) > 4 {
+			conn.reply(respError("Wrong number of arguments for 'JSON.SET'"))
+			return
+		}
+		nx, xx := false, false
+		if len(args) == 4 {
+			switch strings.ToUpper(args[3]) {
+			case "NX":
+				nx = true
+			case "XX":
+				xx = true
+			default:
+				conn.reply(respError("syntax error"))
+				return
+			}
+		}
+		ok, err := conn.db.JSONSet(args[0], args[1], args[2], nx, xx)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+		} else if !ok {
+			conn.reply(respNullBulk())
+		} else {
+			conn.reply(respSimple("OK"))
+		}
+	case "JSON.GET":
+		if len(args) < 1 {
+			conn.reply(respError("Wrong number of arguments for 'JSON.GET'"))
+			return
+		}
+		doc, ok, err := conn.db.JSONGet(args[0], args[1:]...)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+		} else if !ok {
+			conn.reply(respNullBulk())
+		} else {
+			conn.reply(respBulk(doc))
+		}
+	case "JSON.DEL", "JSON.FORGET":
+		if len(args) < 1 || len(args) > 2 {
+			conn.reply(respError("Wrong number of arguments for '" + cmd + "'"))
+			return
+		}
+		n, err := conn.db.JSONDel(args[0], jsonPathArg(args, 1))
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respInt(n))
+	case "JSON.TYPE":
+		if len(args) < 1 || len(args) > 2 {
+			conn.reply(respError("Wrong number of arguments for 'JSON.TYPE'"))
+			return
+		}
+		path := jsonPathArg(args, 1)
+		types, err := conn.db.JSONPathType(args[0], path)
+		if errors.Is(err, errJSONNoKey) {
+			conn.reply(respNullBulk())
+		} else if err != nil {
+			conn.reply(respErrorFrom(err))
+		} else if isLegacyJSONPath(path) {
+			conn.reply(respSimple(types[0]))
+		} else {
+			conn.reply(respArray(types))
+		}
+	case "JSON.NUMINCRBY":
+		if len(args) != 3 {
+			conn.reply(respError("Wrong number of arguments for 'JSON.NUMINCRBY'"))
+			return
+		}
+		results, err := conn.db.JSONNumIncrBy(args[0], args[1], args[2])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+		} else if isLegacyJSONPath(args[1]) {
+			conn.reply(respBulk(string(results[0].(json.Number))))
+		} else {
+			conn.reply(respBulk(marshalJSON(results)))
+		}
+	case "JSON.ARRAPPEND":
+		if len(args) < 3 {
+			conn.reply(respError("Wrong number of arguments for 'JSON.ARRAPPEND'"))
+			return
+		}
+		lens, err := conn.db.JSONArrAppend(args[0], args[1], args[2:]...)
+		s.writeJSONLengths(conn, args[1], lens, err)
+	case "JSON.ARRINSERT":
+		if len(args) < 4 {
+			conn.reply(respError("Wrong number of arguments for 'JSON.ARRINSERT'"))
+			return
+		}
+		index, err := strconv.Atoi(args[2])
+		if err != nil {
+			conn.reply(respError("index is not an integer"))
+			return
+		}
+		lens, err := conn.db.JSONArrInsert(args[0], args[1], index, args[3:]...)
+		s.writeJSONLengths(conn, args[1], lens, err)
+	case "JSON.ARRLEN":
+		if len(args) < 1 || len(args) > 2 {
+			conn.reply(respError("Wrong number of arguments for 'JSON.ARRLEN'"))
+			return
+		}
+		path := jsonPathArg(args, 1)
+		lens, err := conn.db.JSONArrLen(args[0], path)
+		if errors.Is(err, errJSONNoKey) {
+			conn.reply(respNullBulk())
+			return
+		}
+		s.writeJSONLengths(conn, path, lens, err)
+	case "JSON.ARRPOP":
+		if len(args) < 1 || len(args) > 3 {
+			conn.reply(respError("Wrong number of arguments for 'JSON.ARRPOP'"))
+			return
+		}
+		path := jsonPathArg(args, 1)
+		index := -1
+		if len(args) == 3 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil {
+				conn.reply(respError("index is not an integer"))
+				return
+			}
+			index = n
+		}
+		popped, err := conn.db.JSONArrPop(args[0], path, index)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		items := make([]Reply, len(popped))
+		for i, p := range popped {
+			if p == nil {
+				items[i] = respNullBulk()
+			} else {
+				items[i] = respBulk(*p)
+			}
+		}
+		if isLegacyJSONPath(path) {
+			conn.reply(items[0])
+		} else {
+			conn.reply(respRawArray(items))
+		}
+	case "JSON.OBJKEYS":
+		if len(args) < 1 || len(args) > 2 {
+			conn.reply(respError("Wrong number of arguments for 'JSON.OBJKEYS'"))
+			return
+		}
+		path := jsonPathArg(args, 1)
+		keys, err := conn.db.JSONObjKeys(args[0], path)
+		if errors.Is(err, errJSONNoKey) {
+			conn.reply(respNullBulk())
+			return
+		}
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		if isLegacyJSONPath(path) {
+			conn.reply(respArray(keys[0]))
+			return
+		}
+		items := make([]Reply, len(keys))
+		for i, k := range keys {
+			if k == nil {
+				items[i] = respNullBulk()
+			} else {
+				items[i] = respArray(k)
+			}
+		}
+		conn.reply(respRawArray(items))
+	default:
+		conn.reply(respError("unknown command `" + cmd + "`"))
+	}
+}
+
+// jsonPathArg returns the optional path argument at i, defaulting to the root.
+func jsonPathArg(args []string, i int) string {
+	if len(args) > i {
+		return args[i]
+	}
+	return "."
+}
+
+// writeJSONLengths replies with one length (legacy path) or an array of lengths.
+func (s *Server) writeJSONLengths(conn *client, path string, lens []*int, err error) {
+	if err != nil {
+		conn.reply(respErrorFrom(err))
+		return
+	}
+	if isLegacyJSONPath(path) {
+		conn.reply(respIntOrNil(lens[0]))
+		return
+	}
+	items := make([]Reply, len(lens))
+	for i, n := range lens {
+		items[i] = respIntOrNil(n)
+	}
+	conn.reply(respRawArray(items))
+}
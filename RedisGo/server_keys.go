@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+)
+
+// handleKeyspace serves the generic commands that work on keys of any type.
+func (s *Server) handleKeyspace(conn *client, cmd string, args []string) {
+	switch cmd {
+	case "EXISTS", "TOUCH", "UNLINK":
+		if len(args) < 1 {
+			conn.reply(respError("Wrong number of arguments for '" + cmd + "'"))
+			return
+		}
+		switch cmd {
+		case "EXISTS":
+			conn.reply(respInt(conn.db.Exists(args...)))
+		case "TOUCH":
+			conn.reply(respInt(conn.db.Touch(args...)))
+		case "UNLINK":
+			deleted := 0
+			for _, k := range args {
+				if conn.db.Del(k) {
+					deleted++
+				}
+			}
+			conn.reply(respInt(deleted))
+		}
+	case "TYPE":
+		if len(args) != 1 {
+			conn.reply(respError("Wrong number of arguments for 'TYPE'"))
+			return
+		}
+		conn.reply(respSimple(conn.db.Type(args[0])))
+	case "RENAME", "RENAMENX":
+		if len(args) != 2 {
+			conn.reply(respError("Wrong number of arguments for '" + cmd + "'"))
+			return
+		}
+		renamed, err := conn.db.Rename(args[0], args[1], cmd == "RENAMENX")
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		if cmd == "RENAME" {
+			conn.reply(respSimple("OK"))
+			return
+		}
+		conn.reply(respInt(boolToInt(renamed)))
+	case "COPY":
+		if len(args) < 2 || len(args) > 3 {
+			conn.reply(respError("Wrong number of arguments for 'COPY'"))
+			return
+		}
+		replace := false
+		if len(args) == 3 {
+			if strings.ToUpper(args[2]) != "REPLACE" {
+				conn.reply(respError("syntax error"))
+				return
+			}
+			replace = true
+		}
+		copied, err := conn.db.Copy(args[0], args[1], replace)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respInt(boolToInt(copied)))
+	case "RANDOMKEY":
+		if len(args) != 0 {
+			conn.reply(respError("Wrong number of arguments for 'RANDOMKEY'"))
+			return
+		}
+		key, ok := conn.db.RandomKey()
+		if !ok {
+			conn.reply(respNullBulk())
+			return
+		}
+		conn.reply(respBulk(key))
+	case "DBSIZE":
+		if len(args) != 0 {
+			conn.reply(respError("Wrong number of arguments for 'DBSIZE'"))
+			return
+		}
+		conn.reply(respInt(conn.db.DBSize()))
+	default:
+		conn.reply(respError("unknown command `" + cmd + "`"))
+	}
+}
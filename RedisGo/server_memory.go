@@ -0,0 +1,111 @@
+package main
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// handleMemory serves MEMORY USAGE and MEMORY STATS.
+func (s *Server) handleMemory(conn *client, args []string) {
+	if len(args) < 1 {
+		conn.reply(respError("Wrong number of arguments for 'MEMORY'"))
+		return
+	}
+	switch strings.ToUpper(args[0]) {
+	case "USAGE":
+		if len(args) != 2 && len(args) != 4 {
+			conn.reply(respError("Wrong number of arguments for 'MEMORY USAGE'"))
+			return
+		}
+		samples := memoryUsageSamples
+		if len(args) == 4 {
+			n, err := strconv.Atoi(args[3])
+			if strings.ToUpper(args[2]) != "SAMPLES" {
+				conn.reply(respError("syntax error"))
+				return
+			}
+			if err != nil || n < 0 {
+				conn.reply(respError("value is not an integer or out of range"))
+				return
+			}
+			samples = n
+		}
+		size, ok := conn.db.MemoryUsage(args[1], samples)
+		if !ok {
+			conn.reply(respNullBulk())
+			return
+		}
+		conn.reply(respInt(int(size)))
+	case "STATS":
+		if len(args) != 1 {
+			conn.reply(respError("Wrong number of arguments for 'MEMORY STATS'"))
+			return
+		}
+		// The totals are shared; key counts are summed over the databases.
+		mem := conn.db.MemoryStats()
+		mem.Keys, mem.KeysBytes = 0, 0
+		for _, db := range s.databases() {
+			dbMem := db.MemoryStats()
+			mem.Keys += dbMem.Keys
+			mem.KeysBytes += dbMem.KeysBytes
+		}
+		var rt runtime.MemStats
+		runtime.ReadMemStats(&rt)
+		dataset := mem.Used - mem.KeysBytes
+		var perKey int64
+		var datasetPerc float64
+		if mem.Keys > 0 {
+			perKey = mem.Used / int64(mem.Keys)
+		}
+		if mem.Used > 0 {
+			datasetPerc = float64(dataset) * 100 / float64(mem.Used)
+		}
+		conn.reply(respMap([]Reply{
+			respBulk("peak.allocated"), respInt(int(mem.Peak)),
+			respBulk("total.allocated"), respInt(int(mem.Used)),
+			respBulk("overhead.total"), respInt(int(mem.KeysBytes)),
+			respBulk("keys.count"), respInt(mem.Keys),
+			respBulk("keys.bytes-per-key"), respInt(int(perKey)),
+			respBulk("dataset.bytes"), respInt(int(dataset)),
+			respBulk("dataset.percentage"), respBulk(strconv.FormatFloat(datasetPerc, 'f', 2, 64)),
+			respBulk("maxmemory"), respInt(int(mem.Max)),
+			respBulk("evicted.keys"), respInt(int(mem.EvictedKeys)),
+			respBulk("runtime.heap.allocated"), respInt(int(rt.HeapAlloc)),
+			respBulk("runtime.sys"), respInt(int(rt.Sys)),
+		}))
+	default:
+		conn.reply(respError("unknown MEMORY subcommand '" + args[0] + "'"))
+	}
+}
+
+// handleObject serves OBJECT ENCODING, IDLETIME, FREQ and REFCOUNT. Reading a
+// key's access data does not count as an access.
+func (s *Server) handleObject(conn *client, args []string) {
+	if len(args) != 2 {
+		conn.reply(respError("Wrong number of arguments for 'OBJECT'"))
+		return
+	}
+	sub := strings.ToUpper(args[0])
+	switch sub {
+	case "ENCODING", "IDLETIME", "FREQ", "REFCOUNT":
+	default:
+		conn.reply(respError("unknown OBJECT subcommand '" + args[0] + "'"))
+		return
+	}
+	info, ok := conn.db.Object(args[1])
+	if !ok {
+		conn.reply(respNullBulk())
+		return
+	}
+	switch sub {
+	case "ENCODING":
+		conn.reply(respBulk(info.Encoding))
+	case "IDLETIME":
+		conn.reply(respInt(int(info.Idle.Seconds())))
+	case "FREQ":
+		conn.reply(respInt(int(info.Frequency)))
+	case "REFCOUNT":
+		conn.reply(respInt(info.RefCount))
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// scanArgs holds the options shared by the SCAN family.
+type scanArgs struct {
+	cursor uint64
+	match  string
+	count  int
+	typ    string
+}
+
+// parseScanArgs parses "cursor [MATCH pattern] [COUNT n] [TYPE type]". TYPE is
+// only accepted when allowType is set.
+func parseScanArgs(args []string, allowType bool) (scanArgs, string) {
+	var sa scanArgs
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return sa, "invalid cursor"
+	}
+	sa.cursor = cursor
+	for i := 1; i < len(args); i += 2 {
+		opt := strings.ToUpper(args[i])
+		if i+1 >= len(args) || (opt == "TYPE" && !allowType) {
+			return sa, "syntax error"
+		}
+		switch opt {
+		case "MATCH":
+			sa.match = args[i+1]
+		case "COUNT":
+			if sa.count, err = strconv.Atoi(args[i+1]); err != nil || sa.count < 1 {
+				return sa, "syntax error"
+			}
+		case "TYPE":
+			sa.typ = strings.ToLower(args[i+1])
+		default:
+			return sa, "syntax error"
+		}
+	}
+	return sa, ""
+}
+
+// respScan renders a SCAN-style reply: the next cursor and a batch of items.
+func respScan(cursor uint64, items []string) Reply {
+	return respRawArray([]Reply{respBulk(strconv.FormatUint(cursor, 10)), respArray(items)})
+}
+
+// handleScan serves SCAN, SSCAN, HSCAN and ZSCAN.
+func (s *Server) handleScan(conn *client, cmd string, args []string) {
+	if cmd == "SCAN" {
+		if len(args) < 1 {
+			conn.reply(respError("Wrong number of arguments for 'SCAN'"))
+			return
+		}
+		sa, msg := parseScanArgs(args, true)
+		if msg != "" {
+			conn.reply(respError(msg))
+			return
+		}
+		next, keys := conn.db.Scan(sa.cursor, sa.match, sa.count, sa.typ)
+		conn.reply(respScan(next, keys))
+		return
+	}
+
+	if len(args) < 2 {
+		conn.reply(respError("Wrong number of arguments for '" + cmd + "'"))
+		return
+	}
+	sa, msg := parseScanArgs(args[1:], false)
+	if msg != "" {
+		conn.reply(respError(msg))
+		return
+	}
+	var next uint64
+	var items []string
+	var err error
+	switch cmd {
+	case "SSCAN":
+		next, items, err = conn.db.SScan(args[0], sa.cursor, sa.match, sa.count)
+	case "HSCAN":
+		next, items, err = conn.db.HScan(args[0], sa.cursor, sa.match, sa.count)
+	case "ZSCAN":
+		next, items, err = conn.db.ZScan(args[0], sa.cursor, sa.match, sa.count)
+	}
+	if err != nil {
+		conn.reply(respErrorFrom(err))
+		return
+	}
+	conn.reply(respScan(next, items))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// parseSearchSchema parses the field list after SCHEMA:
+// name TEXT|TAG [SEPARATOR sep]|NUMERIC [SORTABLE] ...
+func parseSearchSchema(args []string) ([]SearchField, string) {
+	var fields []SearchField
+	for i := 0; i < len(args); {
+		if i+1 >= len(args) {
+			return nil, "Missing type for field " + args[i]
+		}
+		f := SearchField{Name: args[i], Type: strings.ToUpper(args[i+1])}
+		switch f.Type {
+		case searchText, searchTag, searchNumeric:
+		default:
+			return nil, "Invalid field type for field `" + f.Name + "`"
+		}
+		i += 2
+		for i < len(args) {
+			opt := strings.ToUpper(args[i])
+			if opt == "SORTABLE" {
+				f.Sortable = true
+				i++
+			} else if opt == "SEPARATOR" && f.Type == searchTag && i+1 < len(args) {
+				if len(args[i+1]) != 1 {
+					return nil, "Tag separator must be a single character"
+				}
+				f.Separator = args[i+1]
+				i += 2
+			} else {
+				break
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields, ""
+}
+
+// handleSearch serves the FT.* secondary index commands.
+func (s *Server) handleSearch(conn *client, cmd string, args []string) {
+	switch cmd {
+	case "FT.CREATE":
+		// FT.CREATE index [ON HASH] [PREFIX count prefix ...] SCHEMA field type [opts] ...
+		if len(args) < 4 {
+			conn.reply(respError("Wrong number of arguments for 'FT.CREATE'"))
+			return
+		}
+		var prefixes []string
+		i := 1
+		for i < len(args) && strings.ToUpper(args[i]) != "SCHEMA" {
+			switch strings.ToUpper(args[i]) {
+			case "ON":
+				if i+1 >= len(args) || strings.ToUpper(args[i+1]) != "HASH" {
+					conn.reply(respError("Only HASH indexes are supported"))
+					return
+				}
+				i += 2
+			case "PREFIX":
+				if i+1 >= len(args) {
+					conn.reply(respError("Bad arguments for PREFIX"))
+					return
+				}
+				n, err := strconv.Atoi(args[i+1])
+				if err != nil || n < 1 || i+2+n > len(args) {
+					conn.reply(respError("Bad arguments for PREFIX"))
+					return
+				}
+				prefixes = append(prefixes, args[i+2:i+2+n]...)
+				i += 2 + n
+			default:
+				conn.reply(respError("Unknown argument `" + args[i] + "`"))
+				return
+			}
+		}
+		if i >= len(args) {
+			conn.reply(respError("No schema found"))
+			return
+		}
+		fields, msg := parseSearchSchema(args[i+1:])
+		if msg != "" {
+			conn.reply(respError(msg))
+			return
+		}
+		if err := conn.db.FTCreate(args[0], prefixes, fields); err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respSimple("OK"))
+	case "FT.SEARCH":
+		// FT.SEARCH index query [NOCONTENT] [RETURN n field ...] [SORTBY field [ASC|DESC]] [LIMIT offset num]
+		if len(args) < 2 {
+			conn.reply(respError("Wrong number of arguments for 'FT.SEARCH'"))
+			return
+		}
+		q := SearchQuery{Query: args[1], Limit: 10}
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NOCONTENT":
+				q.NoContent = true
+			case "RETURN":
+				n := -1
+				if i+1 < len(args) {
+					n, _ = strconv.Atoi(args[i+1])
+				}
+				if n < 0 || i+2+n > len(args) {
+					conn.reply(respError("Bad arguments for RETURN"))
+					return
+				}
+				q.Return = args[i+2 : i+2+n]
+				i += 1 + n
+			case "SORTBY":
+				if i+1 >= len(args) {
+					conn.reply(respError("Bad arguments for SORTBY"))
+					return
+				}
+				q.SortBy = args[i+1]
+				i++
+				if i+1 < len(args) {
+					switch strings.ToUpper(args[i+1]) {
+					case "ASC":
+						i++
+					case "DESC":
+						q.Desc = true
+						i++
+					}
+				}
+			case "LIMIT":
+				if i+2 >= len(args) {
+					conn.reply(respError("Bad arguments for LIMIT"))
+					return
+				}
+				offset, err1 := strconv.Atoi(args[i+1])
+				num, err2 := strconv.Atoi(args[i+2])
+				if err1 != nil || err2 != nil || offset < 0 || num < 0 {
+					conn.reply(respError("Bad arguments for LIMIT"))
+					return
+				}
+				q.Offset, q.Limit = offset, num
+				i += 2
+			default:
+				conn.reply(respError("Unknown argument `" + args[i] + "`"))
+				return
+			}
+		}
+		total, docs, err := conn.db.FTSearch(args[0], q)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		out := []Reply{respInt(total)}
+		for _, d := range docs {
+			out = append(out, respBulk(d.Key))
+			if !q.NoContent {
+				out = append(out, respArray(d.Fields))
+			}
+		}
+		conn.reply(respRawArray(out))
+	case "FT.DROPINDEX":
+		if len(args) < 1 || len(args) > 2 {
+			conn.reply(respError("Wrong number of arguments for 'FT.DROPINDEX'"))
+			return
+		}
+		dd := false
+		if len(args) == 2 {
+			if strings.ToUpper(args[1]) != "DD" {
+				conn.reply(respError("Unknown argument `" + args[1] + "`"))
+				return
+			}
+			dd = true
+		}
+		if err := conn.db.FTDropIndex(args[0], dd); err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respSimple("OK"))
+	case "FT.INFO":
+		if len(args) != 1 {
+			conn.reply(respError("Wrong number of arguments for 'FT.INFO'"))
+			return
+		}
+		info, err := conn.db.FTInfo(args[0])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		attrs := make([]Reply, len(info.Fields))
+		for i, f := range info.Fields {
+			attr := []Reply{respBulk("identifier"), respBulk(f.Name), respBulk("type"), respBulk(f.Type)}
+			if f.Type == searchTag {
+				attr = append(attr, respBulk("SEPARATOR"), respBulk(f.Separator))
+			}
+			if f.Sortable {
+				attr = append(attr, respBulk("SORTABLE"))
+			}
+			attrs[i] = respRawArray(attr)
+		}
+		conn.reply(respMap([]Reply{
+			respBulk("index_name"), respBulk(info.Name),
+			respBulk("prefixes"), respArray(info.Prefixes),
+			respBulk("attributes"), respRawArray(attrs),
+			respBulk("num_docs"), respInt(info.NumDocs),
+		}))
+	case "FT._LIST":
+		conn.reply(respArray(conn.db.FTList()))
+	default:
+		conn.reply(respError("unknown command `" + cmd + "`"))
+	}
+}
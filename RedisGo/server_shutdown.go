@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// shutdownMode says whether stopping the server takes a snapshot first.
+type shutdownMode int
+
+const (
+	shutdownDefault shutdownMode = iota // snapshot if save points are configured
+	shutdownSave
+	shutdownNoSave
+)
+
+// Shutdown asks Serve to stop. It returns at once; Serve returns when the
+// clients are gone. Only the first call's mode counts.
+func (s *Server) Shutdown(mode shutdownMode) {
+	s.stopOnce.Do(func() {
+		s.stopMode = mode
+		close(s.stop)
+	})
+}
+
+// handleShutdown serves SHUTDOWN [NOSAVE|SAVE] [ABORT]. It reports whether
+// the server is stopping, in which case the client gets no reply and its
+// connection is closed, as in Redis.
+func (s *Server) handleShutdown(conn *client, args []string) bool {
+	mode, abort := shutdownDefault, false
+	for _, arg := range args {
+		switch strings.ToUpper(arg) {
+		case "NOSAVE":
+			if mode == shutdownSave {
+				conn.reply(respError("syntax error"))
+				return false
+			}
+			mode = shutdownNoSave
+		case "SAVE":
+			if mode == shutdownNoSave {
+				conn.reply(respError("syntax error"))
+				return false
+			}
+			mode = shutdownSave
+		case "ABORT":
+			abort = true
+		default:
+			conn.reply(respError("syntax error"))
+			return false
+		}
+	}
+	if abort {
+		if mode != shutdownDefault {
+			conn.reply(respError("syntax error"))
+			return false
+		}
+		// Shutdown does not wait for anything that could be aborted.
+		conn.reply(respError("No shutdown in progress."))
+		return false
+	}
+	log.Println("User requested shutdown...")
+	s.Shutdown(mode)
+	return true
+}
+
+// finishShutdown runs once every client is gone.
+func (s *Server) finishShutdown() {
+	save := s.stopMode == shutdownSave ||
+		s.stopMode == shutdownDefault && len(s.config().Save) > 0
+	if save {
+		log.Println("No snapshot taken: RedisGo does not persist data yet")
+	}
+}
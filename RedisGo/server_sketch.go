@@ -0,0 +1,268 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// respUints renders counts as an array of integers.
+func respUints(counts []uint64) Reply {
+	items := make([]Reply, len(counts))
+	for i, n := range counts {
+		items[i] = respInt(int(n))
+	}
+	return respRawArray(items)
+}
+
+// parseItemCounts splits "item count [item count ...]" arguments, rejecting
+// counts above limit.
+func parseItemCounts(args []string, limit uint64) ([]string, []uint64, bool) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, nil, false
+	}
+	items := make([]string, 0, len(args)/2)
+	counts := make([]uint64, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		n, err := strconv.ParseUint(args[i+1], 10, 64)
+		if err != nil || n > limit {
+			return nil, nil, false
+		}
+		items = append(items, args[i])
+		counts = append(counts, n)
+	}
+	return items, counts, true
+}
+
+// handleSketch serves the CMS.* (Count-Min Sketch) and TOPK.* command families.
+func (s *Server) handleSketch(conn *client, cmd string, args []string) {
+	switch cmd {
+	case "CMS.INITBYDIM":
+		if len(args) != 3 {
+			conn.reply(respError("Wrong number of arguments for 'CMS.INITBYDIM'"))
+			return
+		}
+		width, err1 := strconv.Atoi(args[1])
+		depth, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			conn.reply(respError("CMS: invalid width/depth"))
+			return
+		}
+		if err := conn.db.CMSInitByDim(args[0], width, depth); err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respSimple("OK"))
+	case "CMS.INITBYPROB":
+		if len(args) != 3 {
+			conn.reply(respError("Wrong number of arguments for 'CMS.INITBYPROB'"))
+			return
+		}
+		errorRate, err1 := strconv.ParseFloat(args[1], 64)
+		prob, err2 := strconv.ParseFloat(args[2], 64)
+		if err1 != nil || err2 != nil {
+			conn.reply(respError("CMS: invalid prob value"))
+			return
+		}
+		if err := conn.db.CMSInitByProb(args[0], errorRate, prob); err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respSimple("OK"))
+	case "CMS.INCRBY":
+		if len(args) < 3 {
+			conn.reply(respError("Wrong number of arguments for 'CMS.INCRBY'"))
+			return
+		}
+		items, counts, ok := parseItemCounts(args[1:], math.MaxUint64)
+		if !ok {
+			conn.reply(respError("CMS: Cannot parse number"))
+			return
+		}
+		out, err := conn.db.CMSIncrBy(args[0], items, counts)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respUints(out))
+	case "CMS.QUERY":
+		if len(args) < 2 {
+			conn.reply(respError("Wrong number of arguments for 'CMS.QUERY'"))
+			return
+		}
+		out, err := conn.db.CMSQuery(args[0], args[1:]...)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respUints(out))
+	case "CMS.MERGE":
+		if len(args) < 3 {
+			conn.reply(respError("Wrong number of arguments for 'CMS.MERGE'"))
+			return
+		}
+		numKeys, err := strconv.Atoi(args[1])
+		if err != nil || numKeys < 1 || len(args) < 2+numKeys {
+			conn.reply(respError("CMS: invalid numkeys"))
+			return
+		}
+		sources := args[2 : 2+numKeys]
+		weights := make([]uint64, numKeys)
+		for i := range weights {
+			weights[i] = 1
+		}
+		rest := args[2+numKeys:]
+		if len(rest) > 0 {
+			if strings.ToUpper(rest[0]) != "WEIGHTS" || len(rest) != numKeys+1 {
+				conn.reply(respError("syntax error"))
+				return
+			}
+			for i, w := range rest[1:] {
+				if weights[i], err = strconv.ParseUint(w, 10, 64); err != nil {
+					conn.reply(respError("CMS: invalid weight value"))
+					return
+				}
+			}
+		}
+		if err := conn.db.CMSMerge(args[0], sources, weights); err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respSimple("OK"))
+	case "CMS.INFO":
+		if len(args) != 1 {
+			conn.reply(respError("Wrong number of arguments for 'CMS.INFO'"))
+			return
+		}
+		width, depth, count, err := conn.db.CMSInfo(args[0])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respMap([]Reply{
+			respBulk("width"), respInt(width),
+			respBulk("depth"), respInt(depth),
+			respBulk("count"), respInt(int(count)),
+		}))
+	case "TOPK.RESERVE":
+		if len(args) != 2 && len(args) != 5 {
+			conn.reply(respError("Wrong number of arguments for 'TOPK.RESERVE'"))
+			return
+		}
+		k, err := strconv.Atoi(args[1])
+		if err != nil {
+			conn.reply(respError("TopK: invalid k"))
+			return
+		}
+		width, depth, decay := topkDefaultWidth, topkDefaultDepth, topkDefaultDecay
+		if len(args) == 5 {
+			var err1, err2, err3 error
+			width, err1 = strconv.Atoi(args[2])
+			depth, err2 = strconv.Atoi(args[3])
+			decay, err3 = strconv.ParseFloat(args[4], 64)
+			if err1 != nil || err2 != nil || err3 != nil {
+				conn.reply(respError("TopK: invalid width, depth or decay"))
+				return
+			}
+		}
+		if err := conn.db.TopKReserve(args[0], k, width, depth, decay); err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respSimple("OK"))
+	case "TOPK.ADD", "TOPK.INCRBY":
+		if len(args) < 2 {
+			conn.reply(respError("Wrong number of arguments for '" + cmd + "'"))
+			return
+		}
+		items, counts := args[1:], make([]uint64, len(args)-1)
+		if cmd == "TOPK.ADD" {
+			for i := range counts {
+				counts[i] = 1
+			}
+		} else {
+			var ok bool
+			if items, counts, ok = parseItemCounts(args[1:], topkMaxIncrement); !ok {
+				conn.reply(respError("TopK: increment must be an integer less than or equal to 100000"))
+				return
+			}
+		}
+		expelled, err := conn.db.TopKIncrBy(args[0], items, counts)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		replies := make([]Reply, len(expelled))
+		for i, item := range expelled {
+			if item == nil {
+				replies[i] = respNullBulk()
+			} else {
+				replies[i] = respBulk(*item)
+			}
+		}
+		conn.reply(respRawArray(replies))
+	case "TOPK.QUERY":
+		if len(args) < 2 {
+			conn.reply(respError("Wrong number of arguments for 'TOPK.QUERY'"))
+			return
+		}
+		found, err := conn.db.TopKQuery(args[0], args[1:]...)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respBools(found))
+	case "TOPK.COUNT":
+		if len(args) < 2 {
+			conn.reply(respError("Wrong number of arguments for 'TOPK.COUNT'"))
+			return
+		}
+		counts, err := conn.db.TopKCount(args[0], args[1:]...)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respUints(counts))
+	case "TOPK.LIST":
+		if len(args) < 1 || len(args) > 2 {
+			conn.reply(respError("Wrong number of arguments for 'TOPK.LIST'"))
+			return
+		}
+		withCount := len(args) == 2 && strings.ToUpper(args[1]) == "WITHCOUNT"
+		if len(args) == 2 && !withCount {
+			conn.reply(respError("syntax error"))
+			return
+		}
+		list, err := conn.db.TopKList(args[0])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		replies := make([]Reply, 0, len(list)*2)
+		for _, it := range list {
+			replies = append(replies, respBulk(it.Item))
+			if withCount {
+				replies = append(replies, respInt(int(it.Count)))
+			}
+		}
+		conn.reply(respRawArray(replies))
+	case "TOPK.INFO":
+		if len(args) != 1 {
+			conn.reply(respError("Wrong number of arguments for 'TOPK.INFO'"))
+			return
+		}
+		info, err := conn.db.TopKInfo(args[0])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respMap([]Reply{
+			respBulk("k"), respInt(info.K),
+			respBulk("width"), respInt(info.Width),
+			respBulk("depth"), respInt(info.Depth),
+			respBulk("decay"), respBulk(strconv.FormatFloat(info.Decay, 'f', -1, 64)),
+		}))
+	default:
+		conn.reply(respError("unknown command `" + cmd + "`"))
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func respSample(smp Sample) Reply {
+	return respRawArray([]Reply{respInt(int(smp.Timestamp)), respDouble(smp.Value)})
+}
+
+func respSamples(samples []Sample) Reply {
+	items := make([]Reply, len(samples))
+	for i, smp := range samples {
+		items[i] = respSample(smp)
+	}
+	return respRawArray(items)
+}
+
+func respLabels(labels map[string]string) Reply {
+	names := make([]string, 0, len(labels))
+	for l := range labels {
+		names = append(names, l)
+	}
+	sort.Strings(names)
+	items := make([]Reply, len(names))
+	for i, l := range names {
+		items[i] = respArray([]string{l, labels[l]})
+	}
+	return respRawArray(items)
+}
+
+// parseTSTimestamp parses a range bound; "-" and "+" are the earliest and latest possible.
+func parseTSTimestamp(arg string) (int64, error) {
+	switch arg {
+	case "-":
+		return 0, nil
+	case "+":
+		return math.MaxInt64, nil
+	}
+	ts, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || ts < 0 {
+		return 0, errors.New("TSDB: invalid timestamp")
+	}
+	return ts, nil
+}
+
+// parseTSOptions parses RETENTION, DUPLICATE_POLICY/ON_DUPLICATE and a trailing
+// LABELS list. The policy keyword differs between TS.CREATE and TS.ADD.
+func parseTSOptions(args []string, policyKeyword string) (TSOptions, string, error) {
+	var opts TSOptions
+	policy := ""
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "RETENTION":
+			if i+1 >= len(args) {
+				return opts, "", errors.New("syntax error")
+			}
+			i++
+			r, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || r < 0 {
+				return opts, "", errors.New("TSDB: invalid RETENTION value")
+			}
+			opts.Retention = r
+		case policyKeyword:
+			if i+1 >= len(args) {
+				return opts, "", errors.New("syntax error")
+			}
+			i++
+			p, ok := validTSPolicy(args[i])
+			if !ok {
+				return opts, "", errors.New("TSDB: Unknown DUPLICATE_POLICY")
+			}
+			policy = p
+		case "LABELS":
+			rest := args[i+1:]
+			if len(rest)%2 != 0 {
+				return opts, "", errors.New("TSDB: Invalid labels")
+			}
+			opts.Labels = make(map[string]string, len(rest)/2)
+			for j := 0; j < len(rest); j += 2 {
+				opts.Labels[rest[j]] = rest[j+1]
+			}
+			i = len(args)
+		default:
+			return opts, "", errors.New("syntax error")
+		}
+	}
+	return opts, policy, nil
+}
+
+// tsRangeQuery holds the options shared by TS.RANGE and TS.MRANGE.
+type tsRangeQuery struct {
+	from, to   int64
+	count      int
+	agg        *TSAggregation
+	withLabels bool
+	filters    []TSFilter
+}
+
+// parseTSRange parses "from to [COUNT n] [AGGREGATION type bucket]" plus, for
+// multi-series queries, WITHLABELS and a trailing FILTER list.
+func parseTSRange(args []string, multi bool) (*tsRangeQuery, error) {
+	q := &tsRangeQuery{}
+	var err error
+	if q.from, err = parseTSTimestamp(args[0]); err != nil {
+		return nil, err
+	}
+	if q.to, err = parseTSTimestamp(args[1]); err != nil {
+		return nil, err
+	}
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				return nil, errors.New("syntax error")
+			}
+			i++
+			if q.count, err = strconv.Atoi(args[i]); err != nil || q.count < 0 {
+				return nil, errors.New("TSDB: Couldn't parse COUNT")
+			}
+		case "AGGREGATION":
+			if i+2 >= len(args) {
+				return nil, errors.New("syntax error")
+			}
+			agg, err := parseTSAggregation(args[i+1], args[i+2])
+			if err != nil {
+				return nil, err
+			}
+			q.agg = agg
+			i += 2
+		case "WITHLABELS":
+			if !multi {
+				return nil, errors.New("syntax error")
+			}
+			q.withLabels = true
+		case "FILTER":
+			if !multi || i+1 >= len(args) {
+				return nil, errors.New("syntax error")
+			}
+			for _, expr := range args[i+1:] {
+				f, err := ParseTSFilter(expr)
+				if err != nil {
+					return nil, err
+				}
+				q.filters = append(q.filters, f)
+			}
+			i = len(args)
+		default:
+			return nil, errors.New("syntax error")
+		}
+	}
+	if multi && len(q.filters) == 0 {
+		return nil, errors.New("TSDB: missing FILTER argument")
+	}
+	return q, nil
+}
+
+func parseTSAggregation(name, bucket string) (*TSAggregation, error) {
+	aggType, ok := validTSAggregation(name)
+	if !ok {
+		return nil, errors.New("TSDB: Unknown aggregation type")
+	}
+	d, err := strconv.ParseInt(bucket, 10, 64)
+	if err != nil || d <= 0 {
+		return nil, errors.New("TSDB: bucketDuration must be greater than zero")
+	}
+	return &TSAggregation{Type: aggType, BucketDuration: d}, nil
+}
+
+// handleTimeSeries serves the TS.* command family.
+func (s *Server) handleTimeSeries(conn *client, cmd string, args []string) {
+	switch cmd {
+	case "TS.CREATE":
+		if len(args) < 1 {
+			conn.reply(respError("Wrong number of arguments for 'TS.CREATE'"))
+			return
+		}
+		opts, policy, err := parseTSOptions(args[1:], "DUPLICATE_POLICY")
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		opts.DuplicatePolicy = policy
+		if err := conn.db.TSCreate(args[0], opts); err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respSimple("OK"))
+	case "TS.ADD":
+		if len(args) < 3 {
+			conn.reply(respError("Wrong number of arguments for 'TS.ADD'"))
+			return
+		}
+		timestamp := int64(-1)
+		if args[1] != "*" {
+			t, err := parseTSTimestamp(args[1])
+			if err != nil {
+				conn.reply(respErrorFrom(err))
+				return
+			}
+			timestamp = t
+		}
+		value, err := strconv.ParseFloat(args[2], 64)
+		if err != nil {
+			conn.reply(respError("TSDB: invalid value"))
+			return
+		}
+		opts, onDuplicate, err := parseTSOptions(args[3:], "ON_DUPLICATE")
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		stored, err := conn.db.TSAdd(args[0], timestamp, value, opts, onDuplicate)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respInt(int(stored)))
+	case "TS.MADD":
+		if len(args) < 3 || len(args)%3 != 0 {
+			conn.reply(respError("Wrong number of arguments for 'TS.MADD'"))
+			return
+		}
+		n := len(args) / 3
+		keys := make([]string, n)
+		samples := make([]Sample, n)
+		parseErrs := make([]error, n)
+		for i := 0; i < n; i++ {
+			keys[i] = args[i*3]
+			samples[i].Timestamp = -1
+			if args[i*3+1] != "*" {
+				if samples[i].Timestamp, parseErrs[i] = parseTSTimestamp(args[i*3+1]); parseErrs[i] != nil {
+					continue
+				}
+			}
+			var err error
+			if samples[i].Value, err = strconv.ParseFloat(args[i*3+2], 64); err != nil {
+				parseErrs[i] = errors.New("TSDB: invalid value")
+			}
+		}
+		for _, err := range parseErrs {
+			if err != nil {
+				conn.reply(respErrorFrom(err))
+				return
+			}
+		}
+		errs := conn.db.TSMAdd(keys, samples)
+		replies := make([]Reply, n)
+		for i, err := range errs {
+			if err != nil {
+				replies[i] = respErrorFrom(err)
+			} else {
+				replies[i] = respInt(int(samples[i].Timestamp))
+			}
+		}
+		conn.reply(respRawArray(replies))
+	case "TS.GET":
+		if len(args) != 1 {
+			conn.reply(respError("Wrong number of arguments for 'TS.GET'"))
+			return
+		}
+		smp, ok, err := conn.db.TSGet(args[0])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+		} else if !ok {
+			conn.reply(respArray(nil))
+		} else {
+			conn.reply(respSample(smp))
+		}
+	case "TS.RANGE", "TS.REVRANGE":
+		if len(args) < 3 {
+			conn.reply(respError("Wrong number of arguments for '" + cmd + "'"))
+			return
+		}
+		q, err := parseTSRange(args[1:], false)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		samples, err := conn.db.TSRange(args[0], q.from, q.to, q.agg, q.count, cmd == "TS.REVRANGE")
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respSamples(samples))
+	case "TS.MRANGE", "TS.MREVRANGE":
+		if len(args) < 4 {
+			conn.reply(respError("Wrong number of arguments for '" + cmd + "'"))
+			return
+		}
+		q, err := parseTSRange(args, true)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		results, err := conn.db.TSMRange(q.from, q.to, q.filters, q.agg, q.count, cmd == "TS.MREVRANGE")
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		items := make([]Reply, len(results))
+		for i, r := range results {
+			labels := respArray(nil)
+			if q.withLabels {
+				labels = respLabels(r.Labels)
+			}
+			items[i] = respRawArray([]Reply{respBulk(r.Key), labels, respSamples(r.Samples)})
+		}
+		conn.reply(respRawArray(items))
+	case "TS.QUERYINDEX":
+		if len(args) < 1 {
+			conn.reply(respError("Wrong number of arguments for 'TS.QUERYINDEX'"))
+			return
+		}
+		filters := make([]TSFilter, len(args))
+		for i, expr := range args {
+			f, err := ParseTSFilter(expr)
+			if err != nil {
+				conn.reply(respErrorFrom(err))
+				return
+			}
+			filters[i] = f
+		}
+		keys, err := conn.db.TSQueryIndex(filters)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respArray(keys))
+	case "TS.DEL":
+		if len(args) != 3 {
+			conn.reply(respError("Wrong number of arguments for 'TS.DEL'"))
+			return
+		}
+		from, err1 := parseTSTimestamp(args[1])
+		to, err2 := parseTSTimestamp(args[2])
+		if err1 != nil || err2 != nil {
+			conn.reply(respError("TSDB: invalid timestamp"))
+			return
+		}
+		n, err := conn.db.TSDel(args[0], from, to)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respInt(n))
+	case "TS.CREATERULE":
+		if len(args) != 5 || strings.ToUpper(args[2]) != "AGGREGATION" {
+			conn.reply(respError("Wrong number of arguments for 'TS.CREATERULE'"))
+			return
+		}
+		agg, err := parseTSAggregation(args[3], args[4])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		if err := conn.db.TSCreateRule(args[0], args[1], *agg); err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respSimple("OK"))
+	case "TS.DELETERULE":
+		if len(args) != 2 {
+			conn.reply(respError("Wrong number of arguments for 'TS.DELETERULE'"))
+			return
+		}
+		if err := conn.db.TSDeleteRule(args[0], args[1]); err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respSimple("OK"))
+	case "TS.INFO":
+		if len(args) != 1 {
+			conn.reply(respError("Wrong number of arguments for 'TS.INFO'"))
+			return
+		}
+		info, total, err := conn.db.TSInfo(args[0])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		first, last := 0, 0
+		if len(info.Samples) == 2 {
+			first, last = int(info.Samples[0].Timestamp), int(info.Samples[1].Timestamp)
+		}
+		rules := make([]Reply, len(info.Rules))
+		for i, r := range info.Rules {
+			rules[i] = respRawArray([]Reply{respBulk(r.DestKey), respInt(int(r.BucketDuration)), respBulk(r.Aggregation)})
+		}
+		source := respNullBulk()
+		if info.SourceKey != "" {
+			source = respBulk(info.SourceKey)
+		}
+		conn.reply(respMap([]Reply{
+			respBulk("totalSamples"), respInt(total),
+			respBulk("firstTimestamp"), respInt(first),
+			respBulk("lastTimestamp"), respInt(last),
+			respBulk("retentionTime"), respInt(int(info.Retention)),
+			respBulk("duplicatePolicy"), respBulk(strings.ToLower(info.DuplicatePolicy)),
+			respBulk("labels"), respLabels(info.Labels),
+			respBulk("sourceKey"), source,
+			respBulk("rules"), respRawArray(rules),
+		}))
+	default:
+		conn.reply(respError("unknown command `" + cmd + "`"))
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// parseVectorArg reads a vector given as "FP32 blob" (little-endian float32s)
+// or "VALUES n v1 ... vn" starting at args[0]. It returns the vector and the
+// number of arguments consumed.
+func parseVectorArg(args []string) ([]float32, int, string) {
+	if len(args) < 2 {
+		return nil, 0, "syntax error"
+	}
+	switch strings.ToUpper(args[0]) {
+	case "FP32":
+		blob := []byte(args[1])
+		if len(blob) == 0 || len(blob)%4 != 0 {
+			return nil, 0, "invalid FP32 blob size"
+		}
+		vec := make([]float32, len(blob)/4)
+		for i := range vec {
+			vec[i] = math.Float32frombits(binary.LittleEndian.Uint32(blob[i*4:]))
+		}
+		return vec, 2, ""
+	case "VALUES":
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 || 2+n > len(args) {
+			return nil, 0, "invalid vector specification"
+		}
+		vec := make([]float32, n)
+		for i := range vec {
+			f, err := strconv.ParseFloat(args[2+i], 32)
+			if err != nil {
+				return nil, 0, "invalid vector value: " + args[2+i]
+			}
+			vec[i] = float32(f)
+		}
+		return vec, 2 + n, ""
+	}
+	return nil, 0, "expected FP32 or VALUES"
+}
+
+func formatFloat32s(vec []float32) []string {
+	out := make([]string, len(vec))
+	for i, f := range vec {
+		out[i] = strconv.FormatFloat(float64(f), 'f', -1, 32)
+	}
+	return out
+}
+
+// handleVector serves the V* vector set commands.
+func (s *Server) handleVector(conn *client, cmd string, args []string) {
+	switch cmd {
+	case "VADD":
+		// VADD key (FP32 blob | VALUES n v ...) element [METRIC COSINE|L2|IP] [M n] [EF n] [SETATTR json]
+		if len(args) < 4 {
+			conn.reply(respError("Wrong number of arguments for 'VADD'"))
+			return
+		}
+		vec, used, msg := parseVectorArg(args[1:])
+		if msg != "" {
+			conn.reply(respError(msg))
+			return
+		}
+		rest := args[1+used:]
+		if len(rest) == 0 {
+			conn.reply(respError("Wrong number of arguments for 'VADD'"))
+			return
+		}
+		element := rest[0]
+		var metric, attrs string
+		var m, ef int
+		for i := 1; i < len(rest); i++ {
+			opt := strings.ToUpper(rest[i])
+			if i+1 >= len(rest) {
+				conn.reply(respError("syntax error"))
+				return
+			}
+			i++
+			var err error
+			switch opt {
+			case "METRIC":
+				metric = strings.ToUpper(rest[i])
+				if metric != vectorCosine && metric != vectorL2 && metric != vectorIP {
+					conn.reply(respError("unknown metric, expected COSINE, L2 or IP"))
+					return
+				}
+			case "M":
+				if m, err = strconv.Atoi(rest[i]); err != nil || m < 2 {
+					conn.reply(respError("invalid M"))
+					return
+				}
+			case "EF":
+				if ef, err = strconv.Atoi(rest[i]); err != nil || ef < 1 {
+					conn.reply(respError("invalid EF"))
+					return
+				}
+			case "SETATTR":
+				attrs = rest[i]
+			default:
+				conn.reply(respError("syntax error"))
+				return
+			}
+		}
+		added, err := conn.db.VAdd(args[0], element, vec, metric, m, ef, attrs)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respInt(boolToInt(added)))
+	case "VSIM":
+		// VSIM key (ELE element | FP32 blob | VALUES n v ...) [WITHSCORES] [COUNT n] [EF n] [FILTER expr] [TRUTH]
+		if len(args) < 3 {
+			conn.reply(respError("Wrong number of arguments for 'VSIM'"))
+			return
+		}
+		var opts VSimOptions
+		var used int
+		if strings.ToUpper(args[1]) == "ELE" {
+			opts.Element, used = args[2], 2
+		} else {
+			var msg string
+			if opts.Vector, used, msg = parseVectorArg(args[1:]); msg != "" {
+				conn.reply(respError(msg))
+				return
+			}
+		}
+		withScores := false
+		for i := 1 + used; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "WITHSCORES":
+				withScores = true
+			case "TRUTH":
+				opts.Exact = true
+			case "COUNT", "EF", "FILTER":
+				if i+1 >= len(args) {
+					conn.reply(respError("syntax error"))
+					return
+				}
+				opt := strings.ToUpper(args[i])
+				i++
+				if opt == "FILTER" {
+					opts.Filter = args[i]
+					continue
+				}
+				n, err := strconv.Atoi(args[i])
+				if err != nil || n < 1 {
+					conn.reply(respError("invalid " + opt))
+					return
+				}
+				if opt == "COUNT" {
+					opts.Count = n
+				} else {
+					opts.EF = n
+				}
+			default:
+				conn.reply(respError("syntax error"))
+				return
+			}
+		}
+		matches, err := conn.db.VSim(args[0], opts)
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		out := make([]string, 0, len(matches)*2)
+		for _, m := range matches {
+			out = append(out, m.Element)
+			if withScores {
+				out = append(out, strconv.FormatFloat(m.Score, 'f', -1, 32))
+			}
+		}
+		conn.reply(respArray(out))
+	case "VREM":
+		if len(args) != 2 {
+			conn.reply(respError("Wrong number of arguments for 'VREM'"))
+			return
+		}
+		removed, err := conn.db.VRem(args[0], args[1])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respInt(boolToInt(removed)))
+	case "VCARD":
+		if len(args) != 1 {
+			conn.reply(respError("Wrong number of arguments for 'VCARD'"))
+			return
+		}
+		n, err := conn.db.VCard(args[0])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respInt(n))
+	case "VDIM":
+		if len(args) != 1 {
+			conn.reply(respError("Wrong number of arguments for 'VDIM'"))
+			return
+		}
+		info, err := conn.db.VInfo(args[0])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respInt(info.Dim))
+	case "VEMB":
+		if len(args) != 2 {
+			conn.reply(respError("Wrong number of arguments for 'VEMB'"))
+			return
+		}
+		vec, err := conn.db.VEmb(args[0], args[1])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		if vec == nil {
+			conn.reply(respNullBulk())
+			return
+		}
+		conn.reply(respArray(formatFloat32s(vec)))
+	case "VSETATTR":
+		if len(args) != 3 {
+			conn.reply(respError("Wrong number of arguments for 'VSETATTR'"))
+			return
+		}
+		ok, err := conn.db.VSetAttr(args[0], args[1], args[2])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		conn.reply(respInt(boolToInt(ok)))
+	case "VGETATTR":
+		if len(args) != 2 {
+			conn.reply(respError("Wrong number of arguments for 'VGETATTR'"))
+			return
+		}
+		attrs, ok, err := conn.db.VGetAttr(args[0], args[1])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		if !ok {
+			conn.reply(respNullBulk())
+			return
+		}
+		conn.reply(respBulk(attrs))
+	case "VINFO":
+		if len(args) != 1 {
+			conn.reply(respError("Wrong number of arguments for 'VINFO'"))
+			return
+		}
+		info, err := conn.db.VInfo(args[0])
+		if err != nil {
+			conn.reply(respErrorFrom(err))
+			return
+		}
+		index := "brute-force"
+		if info.HNSW {
+			index = "hnsw"
+		}
+		conn.reply(respMap([]Reply{
+			respBulk("vector-dim"), respInt(info.Dim),
+			respBulk("metric"), respBulk(strings.ToLower(info.Metric)),
+			respBulk("size"), respInt(info.Size),
+			respBulk("index"), respBulk(index),
+			respBulk("hnsw-m"), respInt(info.M),
+			respBulk("max-level"), respInt(info.MaxLevel),
+		}))
+	default:
+		conn.reply(respError("unknown command `" + cmd + "`"))
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import "math/rand"
+
+const skiplistMaxLevel = 32
+
+// keySkiplist keeps the keyspace in lexicographic order so KEYS can jump
+// straight to the keys sharing a pattern's literal prefix.
+type keySkiplist struct {
+	head  *skipNode
+	level int
+	len   int
+}
+
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+func newKeySkiplist() *keySkiplist {
+	return &keySkiplist{head: &skipNode{next: make([]*skipNode, skiplistMaxLevel)}, level: 1}
+}
+
+func randomSkipLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+// findPrev fills update with the last node before key on every level.
+func (sl *keySkiplist) findPrev(key string, update []*skipNode) *skipNode {
+	x := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x
+}
+
+func (sl *keySkiplist) insert(key string) {
+	var update [skiplistMaxLevel]*skipNode
+	if x := sl.findPrev(key, update[:]).next[0]; x != nil && x.key == key {
+		return
+	}
+	level := randomSkipLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			update[i] = sl.head
+		}
+		sl.level = level
+	}
+	n := &skipNode{key: key, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	sl.len++
+}
+
+func (sl *keySkiplist) remove(key string) {
+	var update [skiplistMaxLevel]*skipNode
+	x := sl.findPrev(key, update[:]).next[0]
+	if x == nil || x.key != key {
+		return
+	}
+	for i := 0; i < len(x.next); i++ {
+		update[i].next[i] = x.next[i]
+	}
+	for sl.level > 1 && sl.head.next[sl.level-1] == nil {
+		sl.level--
+	}
+	sl.len--
+}
+
+// ascendFrom calls fn for each key >= from in order until fn returns false.
+func (sl *keySkiplist) ascendFrom(from string, fn func(key string) bool) {
+	for x := sl.findPrev(from, nil).next[0]; x != nil; x = x.next[0] {
+		if !fn(x.key) {
+			return
+		}
+	}
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"errors"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,28 +17,122 @@ const (
 	SetType
 	HashType
 	ZSetType
+	JSONType
+	BloomType
+	CuckooType
+	CMSType
+	TopKType
+	TimeSeriesType
+	VectorSetType
 )
 
+// typeNames are the names reported by TYPE and accepted by SCAN ... TYPE.
+var typeNames = map[ValueType]string{
+	StringType:     "string",
+	ListType:       "list",
+	SetType:        "set",
+	HashType:       "hash",
+	ZSetType:       "zset",
+	JSONType:       "ReJSON-RL",
+	BloomType:      "MBbloom--",
+	CuckooType:     "MBbloomCF",
+	CMSType:        "CMSk-TYPE",
+	TopKType:       "TopK-TYPE",
+	TimeSeriesType: "TSDB-TYPE",
+	VectorSetType:  "vectorset",
+}
+
+func (t ValueType) String() string {
+	return typeNames[t]
+}
+
 type Value struct {
-	Type    ValueType
-	Str     string
-	List    []string
-	Set     map[string]struct{}
-	Hash    map[string]string
-	ZSet    []ZSetEntry
-	ZSetMap map[string]*ZSetEntry
+	Type       ValueType
+	Str        string
+	List       []string
+	Set        map[string]struct{}
+	Hash       map[string]string
+	ZSet       []ZSetEntry
+	ZSetMap    map[string]*ZSetEntry
+	JSON       interface{}
+	Bloom      *BloomFilter
+	Cuckoo     *CuckooFilter
+	CMS        *CountMinSketch
+	TopK       *TopK
+	TimeSeries *TimeSeries
+	Vectors    *VectorSet
+
+	// size is the estimated memory held by the value, and access its LRU and
+	// LFU data; see store_memory.go.
+	size   int64
+	access accessInfo
+	// members indexes the members of a set, hash or sorted set for the
+	// SSCAN family; see store_scan.go.
+	members *keyBuckets
 }
 
 type Store struct {
 	mu      sync.RWMutex
+	clock   Clock
 	data    map[string]*Value
 	expires map[string]time.Time
+	indexes map[string]*searchIndex
+	// keyIndex mirrors the keys of data in hash order for SCAN, and
+	// sortedKeys in lexicographic order for prefix patterns in KEYS.
+	keyIndex   *keyBuckets
+	sortedKeys *keySkiplist
+	// volatile lists the keys in expires so active expiry can sample them at
+	// random; volatilePos maps each key to its index in volatile.
+	volatile    []string
+	volatilePos map[string]int
+	// lazyExpired carries keys that readers found expired to expiryLoop,
+	// which deletes them under the write lock.
+	lazyExpired chan string
+	expiryStats ExpiryStats
+	// indexedHashes remembers the field values each indexed hash had when it
+	// was last indexed, so updates can remove stale index entries.
+	indexedHashes map[string]map[string]string
+	// usedMemory is the estimated size of the keys and values, keysMemory the
+	// part of it spent on keys. memory holds the limit and totals, which may
+	// be shared with other databases.
+	usedMemory   int64
+	keysMemory   int64
+	memory       *memoryAccount
+	evictionPool []evictionEntry
+	// id orders the locks of two stores taken together, as by MOVE.
+	id uint64
 }
 
 func NewStore() *Store {
+	return NewStoreWithClock(newSystemClock())
+}
+
+// NewStoreWithClock creates a Store that reads time from clock.
+func NewStoreWithClock(clock Clock) *Store {
+	return newStore(clock, &memoryAccount{})
+}
+
+// newSibling creates another database sharing s's clock and memory limit.
+func (s *Store) newSibling() *Store {
+	return newStore(s.clock, s.memory)
+}
+
+// storeIDs numbers stores in creation order.
+var storeIDs atomic.Uint64
+
+func newStore(clock Clock, memory *memoryAccount) *Store {
 	s := &Store{
-		data:    make(map[string]*Value),
-		expires: make(map[string]time.Time),
+		id:            storeIDs.Add(1),
+		memory:        memory,
+		clock:         clock,
+		data:          make(map[string]*Value),
+		expires:       make(map[string]time.Time),
+		indexes:       make(map[string]*searchIndex),
+		indexedHashes: make(map[string]map[string]string),
+		keyIndex:      newKeyBuckets(),
+		sortedKeys:    newKeySkiplist(),
+		volatilePos:   make(map[string]int),
+		lazyExpired:   make(chan string, lazyExpireQueue),
 	}
 	go s.expiryLoop()
 	return s
@@ -46,22 +142,18 @@ func NewStore() *Store {
 func (s *Store) Set(key, value string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.data[key] = &Value{Type: StringType, Str: value}
-	delete(s.expires, key) // Remove expiry if value is updated
+	s.setValue(key, &Value{Type: StringType, Str: value})
 }
 
 // Get retrieves the string value for a given key and a boolean if it exists.
-func (s *Store) Get(key string) (string, bool) {
+func (s *Store) Get(key string) (string, bool, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	if exp, ok := s.expires[key]; ok && time.Now().After(exp) {
-		return "", false
+	val, err := s.typed(key, StringType)
+	if val == nil {
+		return "", false, err
 	}
-	val, ok := s.data[key]
-	if !ok || val.Type != StringType {
-		return "", false
-	}
-	return val.Str, true
+	return val.Str, true, nil
 }
 
 // Del removes a key from the store. Returns true if key was present.
@@ -69,51 +161,107 @@ func (s *Store) Del(key string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	_, existed := s.data[key]
-	delete(s.data, key)
-	delete(s.expires, key)
+	s.deleteKey(key)
 	return existed
 }
 
 // Expire sets an expiration for a key in seconds.
 func (s *Store) Expire(key string, seconds int) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	_, ok := s.data[key]
-	if !ok {
-		return false
+	return s.PExpire(key, int64(seconds)*1000, 0)
+}
+
+// setValue stores v at key, clearing any expiry, and keeps the key and search
+// indexes in sync. Callers must hold s.mu.
+func (s *Store) setValue(key string, v *Value) {
+	if old, ok := s.data[key]; ok {
+		s.accountKey(key, old, -1)
 	}
-	s.expires[key] = time.Now().Add(time.Duration(seconds) * time.Second)
-	return true
-}
-
-// expiryLoop runs in the background to remove expired keys.
-func (s *Store) expiryLoop() {
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
-	for range ticker.C {
-		now := time.Now()
-		s.mu.Lock()
-		for k, exp := range s.expires {
-			if now.After(exp) {
-				delete(s.data, k)
-				delete(s.expires, k)
-			}
+	s.data[key] = v
+	v.indexMembers()
+	v.access.init(s.clock.Now())
+	v.size = estimateValueSize(v, accountSamples)
+	s.accountKey(key, v, 1)
+	s.clearExpiry(key)
+	s.keyIndex.add(key)
+	s.sortedKeys.insert(key)
+	s.updateIndexes(key)
+}
+
+// deleteKey removes key together with its expiry and index entries.
+// Callers must hold s.mu.
+func (s *Store) deleteKey(key string) {
+	if old, ok := s.data[key]; ok {
+		s.accountKey(key, old, -1)
+	}
+	delete(s.data, key)
+	s.clearExpiry(key)
+	s.keyIndex.remove(key)
+	s.sortedKeys.remove(key)
+	s.updateIndexes(key)
+}
+
+// Now returns the current time according to the store's clock.
+func (s *Store) Now() time.Time {
+	return s.clock.Now()
+}
+
+// lookup returns the value at key, treating expired keys as missing. Expired
+// keys are queued for deletion since callers may only hold the read lock.
+// Callers must hold s.mu.
+func (s *Store) lookup(key string) (*Value, bool) {
+	if exp, ok := s.expires[key]; ok && s.clock.Now().After(exp) {
+		select {
+		case s.lazyExpired <- key:
+		default: // the active cycle will get to it
 		}
-		s.mu.Unlock()
+		return nil, false
 	}
+	val, ok := s.data[key]
+	return val, ok
 }
 
-// Keys returns a slice of all keys that are not expired.
-func (s *Store) Keys() []string {
+// typed returns the value at key if it holds type t, nil if the key doesn't
+// exist, or ErrWrongType. Callers must hold s.mu.
+func (s *Store) typed(key string, t ValueType) (*Value, error) {
+	val, ok := s.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	if val.Type != t {
+		return nil, ErrWrongType
+	}
+	return val, nil
+}
+
+// Keys returns the non-expired keys matching a glob pattern. Patterns with a
+// literal prefix such as "user:*" only visit keys sharing that prefix.
+func (s *Store) Keys(pattern string) []string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	var keys []string
-	now := time.Now()
-	for k := range s.data {
-		if exp, ok := s.expires[k]; ok && now.After(exp) {
-			continue
+	prefix, literal := globPrefix(pattern)
+	switch {
+	case literal:
+		if _, ok := s.lookup(prefix); ok {
+			keys = append(keys, prefix)
+		}
+	case prefix != "":
+		// Only keys sharing the literal prefix can match.
+		s.sortedKeys.ascendFrom(prefix, func(k string) bool {
+			if !strings.HasPrefix(k, prefix) {
+				return false
+			}
+			if _, ok := s.lookup(k); ok && globMatch(pattern, k) {
+				keys = append(keys, k)
+			}
+			return true
+		})
+	default:
+		for k := range s.data {
+			if _, ok := s.lookup(k); ok && globMatch(pattern, k) {
+				keys = append(keys, k)
+			}
 		}
-		keys = append(keys, k)
 	}
 	return keys
 }
@@ -122,7 +270,7 @@ func (s *Store) Keys() []string {
 func (s *Store) DumpAll() map[string]string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	now := time.Now()
+	now := s.clock.Now()
 	all := make(map[string]string)
 	for k, v := range s.data {
 		if exp, ok := s.expires[k]; ok && now.After(exp) {
@@ -135,72 +283,43 @@ func (s *Store) DumpAll() map[string]string {
 	return all
 }
 
-// TTL returns the remaining time to live of a key in seconds. OR:
+// TTL returns the remaining time to live of a key in seconds, rounded to the
+// nearest second as Redis does. OR:
 // -2 means that the key does not exist.
 // -1 means that the key exists but has no expiry set.
 func (s *Store) TTL(key string) int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	_, exists := s.data[key]
-	if !exists {
-		return -2
+	ms := s.PTTL(key)
+	if ms < 0 {
+		return int(ms)
 	}
-	exp, hasExp := s.expires[key]
-	if !hasExp {
-		return -1
-	}
-	ttl := int(time.Until(exp).Seconds())
-	if ttl < 0 {
-		return -2
-	}
-	return ttl
+	return int((ms + 500) / 1000)
 }
 
 // Incr increments a key's integer value by 1, setting it to 0 if it doesn't exist.
 func (s *Store) Incr(key string) (int, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	val, ok := s.data[key]
-	var n int
-	var err error
-	if ok {
-		if val.Type != StringType {
-			return 0, errors.New("value is not a string")
-		}
-		n, err = strconv.Atoi(val.Str)
-		if err != nil {
-			return 0, errors.New("value is not an integer")
-		}
-	} else {
-		n = 0
-	}
-	n++
-	s.data[key] = &Value{Type: StringType, Str: strconv.Itoa(n)}
-	delete(s.expires, key)
-	return n, nil
+	return s.incrBy(key, 1)
 }
 
 // Decr decrements a key's integer value by 1, setting it to 0 if it doesn't exist.
 func (s *Store) Decr(key string) (int, error) {
+	return s.incrBy(key, -1)
+}
+
+func (s *Store) incrBy(key string, delta int) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	val, ok := s.data[key]
-	var n int
-	var err error
-	if ok {
-		if val.Type != StringType {
-			return 0, errors.New("value is not a string")
-		}
-		n, err = strconv.Atoi(val.Str)
-		if err != nil {
-			return 0, errors.New("value is not an integer")
+	val, err := s.typed(key, StringType)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	if val != nil {
+		if n, err = strconv.Atoi(val.Str); err != nil {
+			return 0, ErrNotInteger
 		}
-	} else {
-		n = 0
 	}
-	n--
-	s.data[key] = &Value{Type: StringType, Str: strconv.Itoa(n)}
-	delete(s.expires, key)
+	n += delta
+	s.setValue(key, &Value{Type: StringType, Str: strconv.Itoa(n)})
 	return n, nil
 }
 
@@ -212,8 +331,7 @@ func (s *Store) MSet(keysValues ...string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	for i := 0; i < len(keysValues); i += 2 {
-		s.data[keysValues[i]] = &Value{Type: StringType, Str: keysValues[i+1]}
-		delete(s.expires, keysValues[i]) // Clear expiry on update
+		s.setValue(keysValues[i], &Value{Type: StringType, Str: keysValues[i+1]})
 	}
 	return nil
 }
@@ -223,7 +341,7 @@ func (s *Store) MGet(keys ...string) []string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	values := make([]string, len(keys))
-	now := time.Now()
+	now := s.clock.Now()
 	for i, key := range keys {
 		if exp, ok := s.expires[key]; ok && now.After(exp) {
 			values[i] = ""
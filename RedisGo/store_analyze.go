@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sort"
+)
+
+// Key analysis walks the keyspace with SCAN cursors, one batch under the read
+// lock at a time, so writers get in between batches. Sizes are estimated with
+// the same sampling as MEMORY USAGE and frequencies come from the LFU
+// counters, which are kept whatever the eviction policy.
+
+const (
+	analyzeBatch      = 100
+	analyzeDefaultTop = 5
+)
+
+// KeyStat describes one key in a KeyAnalysis.
+type KeyStat struct {
+	Key       string
+	Type      string
+	Elements  int // bytes for strings, entries for everything else
+	Bytes     int64
+	Frequency uint8
+}
+
+// TypeSummary aggregates the keys of one type.
+type TypeSummary struct {
+	Type     string
+	Keys     int
+	Elements int
+	Bytes    int64
+	Biggest  []KeyStat // most elements first
+	Heaviest []KeyStat // most bytes first
+}
+
+// KeyAnalysis is the result of AnalyzeKeys.
+type KeyAnalysis struct {
+	Scanned int
+	Types   []TypeSummary // by type name
+	Hottest []KeyStat     // highest LFU counter first
+}
+
+// AnalyzeKeys reports the top keys matching match (all if empty) by element
+// count and memory for each type, and the most frequently accessed keys.
+func (s *Store) AnalyzeKeys(match string, top int) KeyAnalysis {
+	if top <= 0 {
+		top = analyzeDefaultTop
+	}
+	var result KeyAnalysis
+	byType := make(map[string]*TypeSummary)
+	var cursor uint64
+	for {
+		next, keys := s.Scan(cursor, match, analyzeBatch, "")
+		for _, st := range s.keyStats(keys) {
+			result.Scanned++
+			sum, ok := byType[st.Type]
+			if !ok {
+				sum = &TypeSummary{Type: st.Type}
+				byType[st.Type] = sum
+			}
+			sum.Keys++
+			sum.Elements += st.Elements
+			sum.Bytes += st.Bytes
+			sum.Biggest = insertTop(sum.Biggest, st, top, func(a, b KeyStat) bool { return a.Elements > b.Elements })
+			sum.Heaviest = insertTop(sum.Heaviest, st, top, func(a, b KeyStat) bool { return a.Bytes > b.Bytes })
+			result.Hottest = insertTop(result.Hottest, st, top, func(a, b KeyStat) bool { return a.Frequency > b.Frequency })
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	for _, sum := range byType {
+		result.Types = append(result.Types, *sum)
+	}
+	sort.Slice(result.Types, func(i, j int) bool { return result.Types[i].Type < result.Types[j].Type })
+	return result
+}
+
+// keyStats describes keys that still exist, without counting as an access.
+func (s *Store) keyStats(keys []string) []KeyStat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := s.clock.Now()
+	stats := make([]KeyStat, 0, len(keys))
+	for _, key := range keys {
+		v, ok := s.lookup(key)
+		if !ok {
+			continue
+		}
+		stats = append(stats, KeyStat{
+			Key:       key,
+			Type:      v.Type.String(),
+			Elements:  valueLength(v),
+			Bytes:     keyOverhead + int64(len(key)) + estimateValueSize(v, memoryUsageSamples),
+			Frequency: v.access.frequency(now),
+		})
+	}
+	return stats
+}
+
+// insertTop adds st to list, which holds at most n entries ordered by better.
+func insertTop(list []KeyStat, st KeyStat, n int, better func(a, b KeyStat) bool) []KeyStat {
+	i := sort.Search(len(list), func(i int) bool { return better(st, list[i]) })
+	if i >= n {
+		return list
+	}
+	list = append(list, KeyStat{})
+	copy(list[i+1:], list[i:])
+	list[i] = st
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// valueLength is the size of v in its own units: bytes of a string, items in
+// a filter or sketch, samples in a time series and entries otherwise.
+func valueLength(v *Value) int {
+	switch v.Type {
+	case StringType:
+		return len(v.Str)
+	case ListType:
+		return len(v.List)
+	case SetType:
+		return len(v.Set)
+	case HashType:
+		return len(v.Hash)
+	case ZSetType:
+		return len(v.ZSet)
+	case JSONType:
+		switch doc := v.JSON.(type) {
+		case map[string]interface{}:
+			return len(doc)
+		case *[]interface{}:
+			return len(*doc)
+		}
+		return 1
+	case BloomType:
+		n := 0
+		for _, l := range v.Bloom.Filters {
+			n += int(l.Count)
+		}
+		return n
+	case CuckooType:
+		return int(v.Cuckoo.Inserted - v.Cuckoo.Deleted)
+	case CMSType:
+		return int(v.CMS.Count)
+	case TopKType:
+		return len(v.TopK.Top)
+	case TimeSeriesType:
+		return len(v.TimeSeries.Samples)
+	case VectorSetType:
+		return len(v.Vectors.Elements)
+	}
+	return 0
+}
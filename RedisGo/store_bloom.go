@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// Defaults used when BF.ADD creates a filter implicitly.
+const (
+	bloomDefaultErrorRate = 0.01
+	bloomDefaultCapacity  = 100
+	bloomDefaultExpansion = 2
+	// Each new sub-filter gets a tighter error rate so the compound rate stays bounded.
+	bloomTighteningRatio = 0.5
+)
+
+// Limits on BF.RESERVE arguments. A single sub-filter has at most
+// bloomMaxBits bits (512 MiB).
+const (
+	bloomMaxBits      = 1 << 32
+	bloomMaxExpansion = 32768
+)
+
+// BloomFilter is a scalable Bloom filter: a chain of sub-filters, each larger
+// than the last. Items are only ever added to the newest one.
+type BloomFilter struct {
+	ErrorRate  float64
+	Expansion  int
+	NonScaling bool
+	Filters    []*BloomLayer
+}
+
+// BloomLayer is a single fixed-size Bloom filter.
+type BloomLayer struct {
+	Bits      []uint64
+	NumBits   uint64
+	Hashes    int
+	Capacity  uint64
+	Count     uint64
+	ErrorRate float64
+}
+
+// BloomInfo summarises a filter for BF.INFO.
+type BloomInfo struct {
+	Capacity  uint64
+	Size      int
+	Filters   int
+	Items     uint64
+	Expansion int
+	FillRatio float64
+}
+
+func newBloomFilter(errorRate float64, capacity uint64, expansion int, nonScaling bool) *BloomFilter {
+	bf := &BloomFilter{ErrorRate: errorRate, Expansion: expansion, NonScaling: nonScaling}
+	bf.Filters = append(bf.Filters, newBloomLayer(errorRate, capacity, bloomBits(errorRate, capacity)))
+	return bf
+}
+
+// bloomBits returns the optimal size m = -n*ln(p) / ln(2)^2 of a sub-filter
+// for capacity items at errorRate, or 0 if it would exceed bloomMaxBits.
+func bloomBits(errorRate float64, capacity uint64) uint64 {
+	m := math.Ceil(-float64(capacity) * math.Log(errorRate) / (math.Ln2 * math.Ln2))
+	if capacity == 0 || !(m <= bloomMaxBits) {
+		return 0
+	}
+	return max(uint64(m), 64)
+}
+
+func newBloomLayer(errorRate float64, capacity, m uint64) *BloomLayer {
+	// Optimal hash count: k = (m/n)*ln(2).
+	k := int(math.Ceil(float64(m) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &BloomLayer{
+		Bits:      make([]uint64, (m+63)/64),
+		NumBits:   m,
+		Hashes:    k,
+		Capacity:  capacity,
+		ErrorRate: errorRate,
+	}
+}
+
+// bloomHashes returns the two base hashes used for double hashing.
+func bloomHashes(item string) (uint64, uint64) {
+	h := fnv.New128a()
+	h.Write([]byte(item))
+	sum := h.Sum(nil)
+	var h1, h2 uint64
+	for i := 0; i < 8; i++ {
+		h1 = h1<<8 | uint64(sum[i])
+		h2 = h2<<8 | uint64(sum[8+i])
+	}
+	return h1, h2 | 1
+}
+
+func (l *BloomLayer) test(h1, h2 uint64) bool {
+	for i := 0; i < l.Hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % l.NumBits
+		if l.Bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *BloomLayer) add(h1, h2 uint64) {
+	for i := 0; i < l.Hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % l.NumBits
+		l.Bits[bit/64] |= 1 << (bit % 64)
+	}
+	l.Count++
+}
+
+// Add inserts item and reports whether it was new (not already possibly present).
+func (bf *BloomFilter) Add(item string) (bool, error) {
+	h1, h2 := bloomHashes(item)
+	if bf.test(h1, h2) {
+		return false, nil
+	}
+	last := bf.Filters[len(bf.Filters)-1]
+	if last.Count >= last.Capacity {
+		if bf.NonScaling {
+			return false, errors.New("non scaling filter is full")
+		}
+		hi, capacity := bits.Mul64(last.Capacity, uint64(bf.Expansion))
+		errorRate := last.ErrorRate * bloomTighteningRatio
+		m := bloomBits(errorRate, capacity)
+		if hi != 0 || m == 0 {
+			return false, errors.New("filter is full and can't be scaled further")
+		}
+		last = newBloomLayer(errorRate, capacity, m)
+		bf.Filters = append(bf.Filters, last)
+	}
+	last.add(h1, h2)
+	return true, nil
+}
+
+// Exists reports whether item may have been added.
+func (bf *BloomFilter) Exists(item string) bool {
+	h1, h2 := bloomHashes(item)
+	return bf.test(h1, h2)
+}
+
+func (bf *BloomFilter) test(h1, h2 uint64) bool {
+	for _, l := range bf.Filters {
+		if l.test(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// Info reports capacity, size and fill ratio across all sub-filters.
+func (bf *BloomFilter) Info() BloomInfo {
+	info := BloomInfo{Filters: len(bf.Filters), Expansion: bf.Expansion}
+	var set, total uint64
+	for _, l := range bf.Filters {
+		info.Capacity += l.Capacity
+		info.Items += l.Count
+		info.Size += len(l.Bits) * 8
+		total += l.NumBits
+		for _, w := range l.Bits {
+			set += uint64(bits.OnesCount64(w))
+		}
+	}
+	if total > 0 {
+		info.FillRatio = float64(set) / float64(total)
+	}
+	return info
+}
+
+// bloom returns the Bloom filter at key, or nil if the key doesn't exist.
+func (s *Store) bloom(key string) (*BloomFilter, error) {
+	val, err := s.typed(key, BloomType)
+	if val == nil {
+		return nil, err
+	}
+	return val.Bloom, nil
+}
+
+// BFReserve creates an empty Bloom filter. It fails if key already exists.
+func (s *Store) BFReserve(key string, errorRate float64, capacity uint64, expansion int, nonScaling bool) error {
+	if errorRate <= 0 || errorRate >= 1 {
+		return errors.New("(0 < error rate range < 1)")
+	}
+	if capacity == 0 {
+		return errors.New("(capacity should be larger than 0)")
+	}
+	if expansion < 1 || expansion > bloomMaxExpansion {
+		return errors.New("expansion should be between 1 and 32768")
+	}
+	if bloomBits(errorRate, capacity) == 0 {
+		return errors.New("capacity is too large for this error rate")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.lookup(key); ok {
+		return errors.New("item exists")
+	}
+	s.setValue(key, &Value{Type: BloomType, Bloom: newBloomFilter(errorRate, capacity, expansion, nonScaling)})
+	return nil
+}
+
+// BFAdd adds items, creating a default filter if needed. Each result is true if
+// that item was newly added.
+func (s *Store) BFAdd(key string, items ...string) ([]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bf, err := s.bloom(key)
+	if err != nil {
+		return nil, err
+	}
+	if bf == nil {
+		bf = newBloomFilter(bloomDefaultErrorRate, bloomDefaultCapacity, bloomDefaultExpansion, false)
+		s.setValue(key, &Value{Type: BloomType, Bloom: bf})
+	}
+	added := make([]bool, len(items))
+	for i, item := range items {
+		if added[i], err = bf.Add(item); err != nil {
+			return nil, err
+		}
+	}
+	return added, nil
+}
+
+// BFExists reports for each item whether it may be in the filter.
+func (s *Store) BFExists(key string, items ...string) ([]bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bf, err := s.bloom(key)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]bool, len(items))
+	if bf == nil {
+		return found, nil
+	}
+	for i, item := range items {
+		found[i] = bf.Exists(item)
+	}
+	return found, nil
+}
+
+// BFInfo describes the filter at key.
+func (s *Store) BFInfo(key string) (BloomInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bf, err := s.bloom(key)
+	if err != nil {
+		return BloomInfo{}, err
+	}
+	if bf == nil {
+		return BloomInfo{}, errors.New("not found")
+	}
+	return bf.Info(), nil
+}
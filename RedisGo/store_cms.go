@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+)
+
+var errCMSMergeOverflow = errors.New("CMS: MERGE overflow")
+
+// cmsMaxCounters bounds width*depth of a sketch (512 MiB of counters).
+const cmsMaxCounters = 1 << 26
+
+// CountMinSketch estimates item frequencies in fixed memory. Each of Depth rows
+// has Width counters; an item's estimate is the minimum of its counters, so it
+// can over-count but never under-count.
+type CountMinSketch struct {
+	Width    int
+	Depth    int
+	Count    uint64
+	Counters []uint64
+}
+
+func newCountMinSketch(width, depth int) *CountMinSketch {
+	return &CountMinSketch{Width: width, Depth: depth, Counters: make([]uint64, width*depth)}
+}
+
+func (c *CountMinSketch) cell(row int, h1, h2 uint64) int {
+	return row*c.Width + int((h1+uint64(row)*h2)%uint64(c.Width))
+}
+
+// IncrBy adds n to item and returns its new estimate.
+func (c *CountMinSketch) IncrBy(item string, n uint64) uint64 {
+	h1, h2 := bloomHashes(item)
+	min := uint64(math.MaxUint64)
+	for row := 0; row < c.Depth; row++ {
+		i := c.cell(row, h1, h2)
+		c.Counters[i] += n
+		if c.Counters[i] < min {
+			min = c.Counters[i]
+		}
+	}
+	c.Count += n
+	return min
+}
+
+// Query returns the estimated count of item.
+func (c *CountMinSketch) Query(item string) uint64 {
+	h1, h2 := bloomHashes(item)
+	min := uint64(math.MaxUint64)
+	for row := 0; row < c.Depth; row++ {
+		if v := c.Counters[c.cell(row, h1, h2)]; v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// cms returns the sketch at key, or nil if the key doesn't exist.
+func (s *Store) cms(key string) (*CountMinSketch, error) {
+	val, err := s.typed(key, CMSType)
+	if val == nil {
+		return nil, err
+	}
+	return val.CMS, nil
+}
+
+// CMSInitByDim creates an empty sketch with the given dimensions.
+func (s *Store) CMSInitByDim(key string, width, depth int) error {
+	if width < 1 || depth < 1 {
+		return errors.New("width and depth must be positive")
+	}
+	if width > cmsMaxCounters/depth {
+		return errors.New("CMS: width and depth are too large")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.lookup(key); ok {
+		return errors.New("CMS: key already exists")
+	}
+	s.setValue(key, &Value{Type: CMSType, CMS: newCountMinSketch(width, depth)})
+	return nil
+}
+
+// CMSInitByProb creates a sketch whose estimates exceed the true count by at
+// most errorRate of the total with the given probability of failure.
+func (s *Store) CMSInitByProb(key string, errorRate, probability float64) error {
+	if errorRate <= 0 || errorRate >= 1 || probability <= 0 || probability >= 1 {
+		return errors.New("error and probability must be between 0 and 1")
+	}
+	width := math.Ceil(2 / errorRate)
+	depth := math.Ceil(math.Log10(probability) / math.Log10(0.5))
+	if width*depth > cmsMaxCounters {
+		return errors.New("CMS: width and depth are too large")
+	}
+	return s.CMSInitByDim(key, int(width), int(depth))
+}
+
+// CMSIncrBy increments each item by its count and returns the new estimates.
+func (s *Store) CMSIncrBy(key string, items []string, counts []uint64) ([]uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.cms(key)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errors.New("CMS: key does not exist")
+	}
+	out := make([]uint64, len(items))
+	for i, item := range items {
+		out[i] = c.IncrBy(item, counts[i])
+	}
+	return out, nil
+}
+
+// CMSQuery returns the estimated count of each item.
+func (s *Store) CMSQuery(key string, items ...string) ([]uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, err := s.cms(key)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errors.New("CMS: key does not exist")
+	}
+	out := make([]uint64, len(items))
+	for i, item := range items {
+		out[i] = c.Query(item)
+	}
+	return out, nil
+}
+
+// CMSMerge overwrites dest with the weighted sum of the source sketches. All
+// sketches, including dest, must already exist with identical dimensions.
+func (s *Store) CMSMerge(dest string, sources []string, weights []uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, err := s.cms(dest)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return errors.New("CMS: key does not exist")
+	}
+	srcs := make([]*CountMinSketch, len(sources))
+	for i, key := range sources {
+		c, err := s.cms(key)
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			return errors.New("CMS: key does not exist")
+		}
+		if c.Width != d.Width || c.Depth != d.Depth {
+			return errors.New("CMS: width/depth is not equal")
+		}
+		srcs[i] = c
+	}
+	// Sum into a fresh buffer so dest may also appear among the sources, and
+	// stays as it was if a weighted count overflows.
+	merged := make([]uint64, len(d.Counters))
+	var total uint64
+	var ok bool
+	for i, c := range srcs {
+		for j, v := range c.Counters {
+			if merged[j], ok = addWeighted(merged[j], v, weights[i]); !ok {
+				return errCMSMergeOverflow
+			}
+		}
+		if total, ok = addWeighted(total, c.Count, weights[i]); !ok {
+			return errCMSMergeOverflow
+		}
+	}
+	d.Counters = merged
+	d.Count = total
+	return nil
+}
+
+// addWeighted returns sum + v*weight, or false if that does not fit in a
+// uint64.
+func addWeighted(sum, v, weight uint64) (uint64, bool) {
+	hi, lo := bits.Mul64(v, weight)
+	sum, carry := bits.Add64(sum, lo, 0)
+	return sum, hi == 0 && carry == 0
+}
+
+// CMSInfo returns the sketch's width, depth and total count.
+func (s *Store) CMSInfo(key string) (int, int, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, err := s.cms(key)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if c == nil {
+		return 0, 0, 0, errors.New("CMS: key does not exist")
+	}
+	return c.Width, c.Depth, c.Count, nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+)
+
+// Defaults used when CF.ADD creates a filter implicitly.
+const (
+	cuckooDefaultCapacity      = 1024
+	cuckooDefaultBucketSize    = 2
+	cuckooDefaultMaxIterations = 20
+	cuckooDefaultExpansion     = 1
+)
+
+// Limits on CF.RESERVE arguments. A single table holds at most
+// cuckooMaxSlots fingerprints (512 MiB).
+const (
+	cuckooMaxSlots      = 1 << 29
+	cuckooMaxBucketSize = 255
+	cuckooMaxIterations = 65535
+	cuckooMaxExpansion  = 32768
+)
+
+var errCuckooFull = errors.New("Filter is full")
+
+// CuckooFilter is a chain of cuckoo hash tables storing 8-bit fingerprints.
+// Unlike a Bloom filter it supports deletion. When the newest table can't take
+// another item a larger one is appended.
+type CuckooFilter struct {
+	BucketSize    int
+	MaxIterations int
+	Expansion     int
+	Inserted      uint64
+	Deleted       uint64
+	Filters       []*CuckooLayer
+}
+
+// CuckooLayer is one table; fingerprint 0 marks an empty slot.
+type CuckooLayer struct {
+	NumBuckets uint64
+	Slots      []uint8
+}
+
+// CuckooInfo summarises a filter for CF.INFO.
+type CuckooInfo struct {
+	Size          int
+	Buckets       uint64
+	Filters       int
+	Inserted      uint64
+	Deleted       uint64
+	BucketSize    int
+	Expansion     int
+	MaxIterations int
+}
+
+func newCuckooFilter(capacity uint64, bucketSize, maxIterations, expansion int) *CuckooFilter {
+	cf := &CuckooFilter{
+		BucketSize:    bucketSize,
+		MaxIterations: maxIterations,
+		Expansion:     expansion,
+	}
+	cf.Filters = append(cf.Filters, newCuckooLayer(cuckooBuckets(capacity, bucketSize), bucketSize))
+	return cf
+}
+
+// cuckooBuckets returns the number of buckets for a table holding capacity
+// items, or 0 if it would exceed cuckooMaxSlots. Bucket counts are powers of
+// two so the alternate index is a cheap XOR.
+func cuckooBuckets(capacity uint64, bucketSize int) uint64 {
+	if capacity == 0 || capacity > cuckooMaxSlots || bucketSize < 1 {
+		return 0
+	}
+	want := (capacity + uint64(bucketSize) - 1) / uint64(bucketSize)
+	n := uint64(1)
+	for n < want {
+		n <<= 1
+	}
+	if n > cuckooMaxSlots/uint64(bucketSize) {
+		return 0
+	}
+	return n
+}
+
+func newCuckooLayer(numBuckets uint64, bucketSize int) *CuckooLayer {
+	return &CuckooLayer{NumBuckets: numBuckets, Slots: make([]uint8, numBuckets*uint64(bucketSize))}
+}
+
+// cuckooHash returns an item's fingerprint and primary hash.
+func cuckooHash(item string) (uint8, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(item))
+	sum := h.Sum64()
+	fp := uint8(sum >> 56)
+	if fp == 0 {
+		fp = 1
+	}
+	return fp, sum
+}
+
+func (l *CuckooLayer) index(hash uint64) uint64 {
+	return hash & (l.NumBuckets - 1)
+}
+
+func (l *CuckooLayer) altIndex(i uint64, fp uint8) uint64 {
+	return (i ^ (uint64(fp) * 0x5bd1e995)) & (l.NumBuckets - 1)
+}
+
+func (l *CuckooLayer) bucket(i uint64, bucketSize int) []uint8 {
+	start := i * uint64(bucketSize)
+	return l.Slots[start : start+uint64(bucketSize)]
+}
+
+func (l *CuckooLayer) count(fp uint8, hash uint64, bucketSize int) int {
+	i1 := l.index(hash)
+	i2 := l.altIndex(i1, fp)
+	n := 0
+	for _, slot := range l.bucket(i1, bucketSize) {
+		if slot == fp {
+			n++
+		}
+	}
+	if i2 != i1 {
+		for _, slot := range l.bucket(i2, bucketSize) {
+			if slot == fp {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (l *CuckooLayer) remove(fp uint8, hash uint64, bucketSize int) bool {
+	i1 := l.index(hash)
+	for _, i := range []uint64{i1, l.altIndex(i1, fp)} {
+		b := l.bucket(i, bucketSize)
+		for j := range b {
+			if b[j] == fp {
+				b[j] = 0
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (l *CuckooLayer) insertFree(i uint64, fp uint8, bucketSize int) bool {
+	b := l.bucket(i, bucketSize)
+	for j := range b {
+		if b[j] == 0 {
+			b[j] = fp
+			return true
+		}
+	}
+	return false
+}
+
+// insert places fp, relocating existing fingerprints up to maxIterations times.
+// On failure every relocation is undone so the table is left unchanged.
+func (l *CuckooLayer) insert(fp uint8, hash uint64, bucketSize, maxIterations int) bool {
+	i1 := l.index(hash)
+	i2 := l.altIndex(i1, fp)
+	if l.insertFree(i1, fp, bucketSize) || l.insertFree(i2, fp, bucketSize) {
+		return true
+	}
+	type kick struct {
+		slot uint64
+		prev uint8
+	}
+	var path []kick
+	i := i1
+	if rand.Intn(2) == 1 {
+		i = i2
+	}
+	for n := 0; n < maxIterations; n++ {
+		slot := i*uint64(bucketSize) + uint64(rand.Intn(bucketSize))
+		path = append(path, kick{slot: slot, prev: l.Slots[slot]})
+		fp, l.Slots[slot] = l.Slots[slot], fp
+		i = l.altIndex(i, fp)
+		if l.insertFree(i, fp, bucketSize) {
+			return true
+		}
+	}
+	for k := len(path) - 1; k >= 0; k-- {
+		l.Slots[path[k].slot] = path[k].prev
+	}
+	return false
+}
+
+// Add inserts item; duplicates are allowed. It fails with errCuckooFull if
+// the newest table is full and a larger one would exceed cuckooMaxSlots.
+func (cf *CuckooFilter) Add(item string) error {
+	fp, hash := cuckooHash(item)
+	last := cf.Filters[len(cf.Filters)-1]
+	if !last.insert(fp, hash, cf.BucketSize, cf.MaxIterations) {
+		// Table sizes are bounded by cuckooMaxSlots and expansion by
+		// cuckooMaxExpansion, so the product fits in a uint64.
+		capacity := uint64(len(last.Slots)) * uint64(cf.Expansion)
+		n := cuckooBuckets(capacity, cf.BucketSize)
+		if n == 0 {
+			return errCuckooFull
+		}
+		next := newCuckooLayer(n, cf.BucketSize)
+		if !next.insert(fp, hash, cf.BucketSize, cf.MaxIterations) {
+			return errCuckooFull
+		}
+		cf.Filters = append(cf.Filters, next)
+	}
+	cf.Inserted++
+	return nil
+}
+
+// Count returns how many times item's fingerprint appears across all tables.
+// It may over-count because of fingerprint collisions.
+func (cf *CuckooFilter) Count(item string) int {
+	fp, hash := cuckooHash(item)
+	n := 0
+	for _, l := range cf.Filters {
+		n += l.count(fp, hash, cf.BucketSize)
+	}
+	return n
+}
+
+// Delete removes one occurrence of item, newest table first.
+func (cf *CuckooFilter) Delete(item string) bool {
+	fp, hash := cuckooHash(item)
+	for i := len(cf.Filters) - 1; i >= 0; i-- {
+		if cf.Filters[i].remove(fp, hash, cf.BucketSize) {
+			cf.Inserted--
+			cf.Deleted++
+			return true
+		}
+	}
+	return false
+}
+
+// Info describes the filter for CF.INFO.
+func (cf *CuckooFilter) Info() CuckooInfo {
+	info := CuckooInfo{
+		Filters:       len(cf.Filters),
+		Inserted:      cf.Inserted,
+		Deleted:       cf.Deleted,
+		BucketSize:    cf.BucketSize,
+		Expansion:     cf.Expansion,
+		MaxIterations: cf.MaxIterations,
+	}
+	for _, l := range cf.Filters {
+		info.Size += len(l.Slots)
+		info.Buckets += l.NumBuckets
+	}
+	return info
+}
+
+// cuckoo returns the cuckoo filter at key, or nil if the key doesn't exist.
+func (s *Store) cuckoo(key string) (*CuckooFilter, error) {
+	val, err := s.typed(key, CuckooType)
+	if val == nil {
+		return nil, err
+	}
+	return val.Cuckoo, nil
+}
+
+// CFReserve creates an empty cuckoo filter. It fails if key already exists.
+func (s *Store) CFReserve(key string, capacity uint64, bucketSize, maxIterations, expansion int) error {
+	if capacity == 0 {
+		return errors.New("(capacity should be larger than 0)")
+	}
+	if bucketSize < 1 || bucketSize > cuckooMaxBucketSize {
+		return errors.New("bucket size should be between 1 and 255")
+	}
+	if maxIterations < 1 || maxIterations > cuckooMaxIterations {
+		return errors.New("max iterations should be between 1 and 65535")
+	}
+	if expansion < 1 || expansion > cuckooMaxExpansion {
+		return errors.New("expansion should be between 1 and 32768")
+	}
+	if cuckooBuckets(capacity, bucketSize) == 0 {
+		return errors.New("capacity is too large")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.lookup(key); ok {
+		return errors.New("item exists")
+	}
+	s.setValue(key, &Value{Type: CuckooType, Cuckoo: newCuckooFilter(capacity, bucketSize, maxIterations, expansion)})
+	return nil
+}
+
+// CFAdd adds item, creating a default filter if needed. With nx the item is
+// only added if it isn't already (possibly) present; the result reports whether
+// it was added.
+func (s *Store) CFAdd(key, item string, nx bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cf, err := s.cuckoo(key)
+	if err != nil {
+		return false, err
+	}
+	if cf == nil {
+		cf = newCuckooFilter(cuckooDefaultCapacity, cuckooDefaultBucketSize, cuckooDefaultMaxIterations, cuckooDefaultExpansion)
+		s.setValue(key, &Value{Type: CuckooType, Cuckoo: cf})
+	}
+	if nx && cf.Count(item) > 0 {
+		return false, nil
+	}
+	if err := cf.Add(item); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CFExists reports for each item whether it may be in the filter.
+func (s *Store) CFExists(key string, items ...string) ([]bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cf, err := s.cuckoo(key)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]bool, len(items))
+	if cf == nil {
+		return found, nil
+	}
+	for i, item := range items {
+		found[i] = cf.Count(item) > 0
+	}
+	return found, nil
+}
+
+// CFCount returns the approximate number of times item was added.
+func (s *Store) CFCount(key, item string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cf, err := s.cuckoo(key)
+	if err != nil || cf == nil {
+		return 0, err
+	}
+	return cf.Count(item), nil
+}
+
+// CFDel removes one occurrence of item.
+func (s *Store) CFDel(key, item string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cf, err := s.cuckoo(key)
+	if err != nil {
+		return false, err
+	}
+	if cf == nil {
+		return false, errors.New("not found")
+	}
+	return cf.Delete(item), nil
+}
+
+// CFInfo describes the filter at key.
+func (s *Store) CFInfo(key string) (CuckooInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cf, err := s.cuckoo(key)
+	if err != nil {
+		return CuckooInfo{}, err
+	}
+	if cf == nil {
+		return CuckooInfo{}, errors.New("not found")
+	}
+	return cf.Info(), nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ExpireCond restricts when an EXPIRE-family command may change an expiry. The
+// zero value always applies; flags may be combined (XX with GT or LT).
+type ExpireCond uint8
+
+const (
+	ExpireNX ExpireCond = 1 << iota // only if the key has no expiry
+	ExpireXX                        // only if the key has an expiry
+	ExpireGT                        // only if the new expiry is later than the current one
+	ExpireLT                        // only if the new expiry is earlier than the current one
+)
+
+// PExpireAt sets key to expire at the given Unix time in milliseconds, subject
+// to cond. A key without an expiry counts as expiring never, so GT fails on it
+// and LT succeeds. A time that has already passed deletes the key at once.
+// It reports whether the expiry was applied.
+func (s *Store) PExpireAt(key string, atMs int64, cond ExpireCond) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.lookup(key); !ok {
+		return false
+	}
+	at := time.UnixMilli(atMs)
+	cur, has := s.expires[key]
+	switch {
+	case cond&ExpireNX != 0 && has,
+		cond&ExpireXX != 0 && !has,
+		cond&ExpireGT != 0 && (!has || !at.After(cur)),
+		cond&ExpireLT != 0 && has && !at.Before(cur):
+		return false
+	}
+	if !at.After(s.clock.Now()) {
+		s.deleteKey(key)
+		return true
+	}
+	s.setExpiry(key, at)
+	return true
+}
+
+// PExpire sets key to expire ms milliseconds from now, subject to cond.
+func (s *Store) PExpire(key string, ms int64, cond ExpireCond) bool {
+	return s.PExpireAt(key, s.clock.Now().UnixMilli()+ms, cond)
+}
+
+// PTTL returns the remaining time to live of key in milliseconds, -1 if it has
+// no expiry or -2 if it does not exist.
+func (s *Store) PTTL(key string) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.lookup(key); !ok {
+		return -2
+	}
+	exp, has := s.expires[key]
+	if !has {
+		return -1
+	}
+	if ms := exp.Sub(s.clock.Now()).Milliseconds(); ms >= 0 {
+		return ms
+	}
+	return -2
+}
+
+// PExpireTime returns the Unix time in milliseconds at which key expires, -1 if
+// it has no expiry or -2 if it does not exist.
+func (s *Store) PExpireTime(key string) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.lookup(key); !ok {
+		return -2
+	}
+	exp, has := s.expires[key]
+	if !has {
+		return -1
+	}
+	return exp.UnixMilli()
+}
+
+// Persist removes key's expiry. It reports whether there was one to remove.
+func (s *Store) Persist(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.lookup(key); !ok {
+		return false
+	}
+	if _, has := s.expires[key]; !has {
+		return false
+	}
+	s.clearExpiry(key)
+	return true
+}
+
+// Active expiry follows Redis: every tick, sample a few volatile keys and
+// delete the expired ones, repeating while a large share of the sample was
+// expired and the cycle's time budget lasts. The write lock is only held for
+// one sample at a time. The budget is measured in real time, not on the
+// store's clock.
+const (
+	activeExpireInterval    = 100 * time.Millisecond
+	activeExpireBudget      = 25 * time.Millisecond
+	activeExpireKeysPerLoop = 20
+	activeExpireAcceptStale = 25 // percent
+	lazyExpireQueue         = 1024
+)
+
+// ExpiryStats reports on expiration for INFO.
+type ExpiryStats struct {
+	ExpiredKeys    uint64  // keys deleted because their TTL passed
+	StalePerc      float64 // running estimate of expired keys among volatile ones
+	TimeCapReached uint64  // cycles that stopped on the time budget
+	CycleTime      time.Duration
+	VolatileKeys   int
+}
+
+// ExpiryStats returns a snapshot of the expiry statistics.
+func (s *Store) ExpiryStats() ExpiryStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats := s.expiryStats
+	stats.VolatileKeys = len(s.volatile)
+	return stats
+}
+
+// setExpiry sets key's expiry time. Callers must hold s.mu.
+func (s *Store) setExpiry(key string, at time.Time) {
+	if _, ok := s.volatilePos[key]; !ok {
+		s.volatilePos[key] = len(s.volatile)
+		s.volatile = append(s.volatile, key)
+	}
+	s.expires[key] = at
+}
+
+// clearExpiry removes key's expiry, if any. Callers must hold s.mu.
+func (s *Store) clearExpiry(key string) {
+	i, ok := s.volatilePos[key]
+	if !ok {
+		return
+	}
+	last := len(s.volatile) - 1
+	s.volatile[i] = s.volatile[last]
+	s.volatilePos[s.volatile[i]] = i
+	s.volatile = s.volatile[:last]
+	delete(s.volatilePos, key)
+	delete(s.expires, key)
+}
+
+// expireIfNeeded deletes key if its expiry has passed. Callers must hold the
+// write lock.
+func (s *Store) expireIfNeeded(key string, now time.Time) bool {
+	if exp, ok := s.expires[key]; ok && now.After(exp) {
+		s.deleteKey(key)
+		s.expiryStats.ExpiredKeys++
+		return true
+	}
+	return false
+}
+
+// expiryLoop runs in the background to remove expired keys: those readers
+// found expired, and those found by the periodic active cycle.
+func (s *Store) expiryLoop() {
+	ticker := time.NewTicker(activeExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case key := <-s.lazyExpired:
+			s.mu.Lock()
+			s.expireIfNeeded(key, s.clock.Now())
+			s.mu.Unlock()
+		case <-ticker.C:
+			s.activeExpireCycle()
+		}
+	}
+}
+
+func (s *Store) activeExpireCycle() {
+	start := time.Now()
+	var sampled, expired int
+	for {
+		s.mu.Lock()
+		n := min(activeExpireKeysPerLoop, len(s.volatile))
+		if n == 0 {
+			s.mu.Unlock()
+			break
+		}
+		now := s.clock.Now()
+		batchExpired := 0
+		for i := 0; i < n && len(s.volatile) > 0; i++ {
+			if s.expireIfNeeded(s.volatile[rand.Intn(len(s.volatile))], now) {
+				batchExpired++
+			}
+		}
+		s.mu.Unlock()
+		sampled += n
+		expired += batchExpired
+		if batchExpired*100 <= n*activeExpireAcceptStale {
+			break
+		}
+		if time.Since(start) > activeExpireBudget {
+			s.mu.Lock()
+			s.expiryStats.TimeCapReached++
+			s.mu.Unlock()
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expiryStats.CycleTime += time.Since(start)
+	if sampled > 0 {
+		current := float64(expired) / float64(sampled)
+		s.expiryStats.StalePerc = current*0.05 + s.expiryStats.StalePerc*0.95
+	}
+}
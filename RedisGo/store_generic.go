@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Exists counts how many of keys exist. A key named twice is counted twice.
+func (s *Store) Exists(keys ...string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, k := range keys {
+		if _, ok := s.lookup(k); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// Type returns the type name of the value at key, or "none".
+func (s *Store) Type(key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, ok := s.lookup(key)
+	if !ok {
+		return "none"
+	}
+	return val.Type.String()
+}
+
+// Touch counts how many of keys exist. It exists for Redis compatibility; it
+// does not change the values.
+func (s *Store) Touch(keys ...string) int {
+	return s.Exists(keys...)
+}
+
+// DBSize returns the number of keys, including expired keys not yet reclaimed.
+func (s *Store) DBSize() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.data)
+}
+
+// RandomKey returns a random non-expired key.
+func (s *Store) RandomKey() (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	// Map iteration starts at a random position.
+	for k := range s.data {
+		if _, ok := s.lookup(k); ok {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// Rename moves the value and expiry at src to dst, replacing dst unless nx is
+// set. It reports false if nx is set and dst exists.
+func (s *Store) Rename(src, dst string, nx bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.lookup(src)
+	if !ok {
+		return false, errors.New("no such key")
+	}
+	if src == dst {
+		return !nx, nil
+	}
+	if _, exists := s.lookup(dst); exists && nx {
+		return false, nil
+	}
+	exp, hasExp := s.expires[src]
+	s.deleteKey(src)
+	s.deleteKey(dst)
+	s.setValue(dst, val)
+	if hasExp {
+		s.setExpiry(dst, exp)
+	}
+	if val.Type == TimeSeriesType {
+		s.renameSeriesLinks(src, dst, val.TimeSeries)
+	}
+	return true, nil
+}
+
+// renameSeriesLinks points compaction rules that mention src at dst instead.
+func (s *Store) renameSeriesLinks(src, dst string, ts *TimeSeries) {
+	if ts.SourceKey != "" {
+		if parent, ok := s.data[ts.SourceKey]; ok && parent.Type == TimeSeriesType {
+			for _, rule := range parent.TimeSeries.Rules {
+				if rule.DestKey == src {
+					rule.DestKey = dst
+				}
+			}
+		}
+	}
+	for _, rule := range ts.Rules {
+		if child, ok := s.data[rule.DestKey]; ok && child.Type == TimeSeriesType {
+			child.TimeSeries.SourceKey = dst
+		}
+	}
+}
+
+// Copy stores a deep copy of src, with its expiry, at dst. Unless replace is
+// set it does nothing if dst exists. It reports whether the copy was made.
+func (s *Store) Copy(src, dst string, replace bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.lookup(src)
+	if !ok {
+		return false, nil
+	}
+	if src == dst {
+		return false, errors.New("source and destination objects are the same")
+	}
+	if _, exists := s.lookup(dst); exists && !replace {
+		return false, nil
+	}
+	exp, hasExp := s.expires[src]
+	s.setValue(dst, val.clone())
+	if hasExp {
+		s.setExpiry(dst, exp)
+	}
+	return true, nil
+}
+
+// clone returns a deep copy of v that shares no mutable state with it.
+// Compaction rules are not copied: they belong to the original series.
+func (v *Value) clone() *Value {
+	c := &Value{Type: v.Type, Str: v.Str}
+	switch v.Type {
+	case ListType:
+		c.List = append([]string(nil), v.List...)
+	case SetType:
+		c.Set = make(map[string]struct{}, len(v.Set))
+		for m := range v.Set {
+			c.Set[m] = struct{}{}
+		}
+	case HashType:
+		c.Hash = make(map[string]string, len(v.Hash))
+		for f, val := range v.Hash {
+			c.Hash[f] = val
+		}
+	case ZSetType:
+		c.ZSet = append([]ZSetEntry(nil), v.ZSet...)
+		c.ZSetMap = make(map[string]*ZSetEntry, len(c.ZSet))
+		zsetMapSync(c.ZSet, c.ZSetMap)
+	case JSONType:
+		c.JSON = cloneJSON(v.JSON)
+	case BloomType:
+		bf := *v.Bloom
+		bf.Filters = make([]*BloomLayer, len(v.Bloom.Filters))
+		for i, l := range v.Bloom.Filters {
+			layer := *l
+			layer.Bits = append([]uint64(nil), l.Bits...)
+			bf.Filters[i] = &layer
+		}
+		c.Bloom = &bf
+	case CuckooType:
+		cf := *v.Cuckoo
+		cf.Filters = make([]*CuckooLayer, len(v.Cuckoo.Filters))
+		for i, l := range v.Cuckoo.Filters {
+			layer := *l
+			layer.Slots = append([]uint8(nil), l.Slots...)
+			cf.Filters[i] = &layer
+		}
+		c.Cuckoo = &cf
+	case CMSType:
+		cms := *v.CMS
+		cms.Counters = append([]uint64(nil), v.CMS.Counters...)
+		c.CMS = &cms
+	case TopKType:
+		tk := *v.TopK
+		tk.Buckets = append([]TopKBucket(nil), v.TopK.Buckets...)
+		tk.Top = append([]TopKItem(nil), v.TopK.Top...)
+		c.TopK = &tk
+	case TimeSeriesType:
+		ts := *v.TimeSeries
+		ts.Labels = make(map[string]string, len(v.TimeSeries.Labels))
+		for k, l := range v.TimeSeries.Labels {
+			ts.Labels[k] = l
+		}
+		ts.Samples = append([]Sample(nil), v.TimeSeries.Samples...)
+		ts.Rules = nil
+		ts.SourceKey = ""
+		c.TimeSeries = &ts
+	case VectorSetType:
+		vs := newVectorSet(v.Vectors.Dim, v.Vectors.Metric, v.Vectors.M, v.Vectors.EFConstruction)
+		for name, el := range v.Vectors.Elements {
+			cp := &VectorElement{Vector: append([]float32(nil), el.Vector...)}
+			cp.setAttrs(el.Attrs)
+			vs.Elements[name] = cp
+		}
+		if v.Vectors.graph != nil {
+			vs.buildGraph()
+		}
+		c.Vectors = vs
+	}
+	return c
+}
+
+// Move moves key, with its expiry, to the database dst unless it already
+// exists there. It reports whether the key was moved.
+func (s *Store) Move(key string, dst *Store) (bool, error) {
+	if s == dst {
+		return false, errors.New("source and destination objects are the same")
+	}
+	// Lock in creation order so two opposite MOVEs cannot deadlock.
+	first, second := s, dst
+	if first.id > second.id {
+		first, second = second, first
+	}
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	second.mu.Lock()
+	defer second.mu.Unlock()
+
+	val, ok := s.lookup(key)
+	if !ok {
+		return false, nil
+	}
+	if _, exists := dst.lookup(key); exists {
+		return false, nil
+	}
+	exp, hasExp := s.expires[key]
+	if val.Type == TimeSeriesType {
+		// Compaction rules only link series within one database.
+		s.unlinkSeries(key, val.TimeSeries)
+	}
+	s.deleteKey(key)
+	dst.deleteKey(key)
+	dst.setValue(key, val)
+	if hasExp {
+		dst.setExpiry(key, exp)
+	}
+	return true, nil
+}
+
+// unlinkSeries removes the compaction rules between key and other series.
+func (s *Store) unlinkSeries(key string, ts *TimeSeries) {
+	if parent, ok := s.data[ts.SourceKey]; ok && parent.Type == TimeSeriesType {
+		rules := parent.TimeSeries.Rules[:0]
+		for _, rule := range parent.TimeSeries.Rules {
+			if rule.DestKey != key {
+				rules = append(rules, rule)
+			}
+		}
+		parent.TimeSeries.Rules = rules
+	}
+	for _, rule := range ts.Rules {
+		if child, ok := s.data[rule.DestKey]; ok && child.Type == TimeSeriesType {
+			child.TimeSeries.SourceKey = ""
+		}
+	}
+	ts.SourceKey = ""
+	ts.Rules = nil
+}
+
+// Flush removes every key, keeping search index definitions. The contents are
+// dropped at once and left to the garbage collector to reclaim.
+func (s *Store) Flush() {
+	s.mu.Lock()
+	s.addMemory(-s.usedMemory)
+	s.keysMemory = 0
+	s.data = make(map[string]*Value)
+	s.expires = make(map[string]time.Time)
+	s.volatile = nil
+	s.volatilePos = make(map[string]int)
+	s.keyIndex = newKeyBuckets()
+	s.sortedKeys = newKeySkiplist()
+	s.indexedHashes = make(map[string]map[string]string)
+	for name, idx := range s.indexes {
+		s.indexes[name] = newSearchIndex(idx.name, idx.prefixes, idx.fields)
+	}
+	s.evictionPool = nil
+	s.mu.Unlock()
+}
@@ -1,61 +1,67 @@
 package main
 
-import (
-	"errors"
-)
-
 // HSet sets field in the hash stored at key to value.
 // Returns 1 if field is a new field in the hash, 0 if field existed and was updated.
-func (s *Store) HSet(key, field, value string) int {
+func (s *Store) HSet(key, field, value string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	v, _ := s.getOrInitHash(key)
+	v, err := s.getOrInitHash(key)
+	if err != nil {
+		return 0, err
+	}
 	_, exists := v.Hash[field]
 	v.Hash[field] = value
+	s.updateIndexes(key)
 	if exists {
-		return 0 // overwritten
+		return 0, nil // overwritten
 	}
-	return 1 // new field
+	v.members.add(field)
+	return 1, nil // new field
 }
 
 // HGet gets the value of a field in the hash stored at key.
-func (s *Store) HGet(key, field string) (string, bool) {
+func (s *Store) HGet(key, field string) (string, bool, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	val, ok := s.data[key]
-	if !ok || val.Type != HashType {
-		return "", false
+	val, err := s.typed(key, HashType)
+	if val == nil {
+		return "", false, err
 	}
 	v, ok := val.Hash[field]
-	return v, ok
+	return v, ok, nil
 }
 
 // HDel removes fields from the hash stored at key.
 // Returns the number of fields that were removed.
-func (s *Store) HDel(key string, fields ...string) int {
+func (s *Store) HDel(key string, fields ...string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	val, ok := s.data[key]
-	if !ok || val.Type != HashType {
-		return 0
+	val, err := s.typed(key, HashType)
+	if val == nil {
+		return 0, err
 	}
 	deleted := 0
 	for _, field := range fields {
 		if _, present := val.Hash[field]; present {
 			delete(val.Hash, field)
+			val.members.remove(field)
 			deleted++
 		}
 	}
-	return deleted
+	if deleted > 0 {
+		s.updateIndexes(key)
+	}
+	return deleted, nil
 }
 
-// HGetAll gets all field-value pairs in the hash stored at key.
+// HGetAll gets all field-value pairs in the hash stored at key, or none if the
+// key doesn't exist.
 func (s *Store) HGetAll(key string) (map[string]string, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	val, ok := s.data[key]
-	if !ok || val.Type != HashType {
-		return nil, errors.New("no such key or not a hash")
+	val, err := s.typed(key, HashType)
+	if val == nil {
+		return nil, err
 	}
 	// Return a copy to avoid race conditions.
 	out := make(map[string]string, len(val.Hash))
@@ -66,12 +72,12 @@ func (s *Store) HGetAll(key string) (map[string]string, error) {
 }
 
 // getOrInitHash gets or initializes a hash value at key.
-func (s *Store) getOrInitHash(key string) (*Value, bool) {
-	val, ok := s.data[key]
-	if ok && val.Type == HashType {
-		return val, true
+func (s *Store) getOrInitHash(key string) (*Value, error) {
+	val, err := s.typed(key, HashType)
+	if val != nil || err != nil {
+		return val, err
 	}
 	newHash := &Value{Type: HashType, Hash: make(map[string]string)}
-	s.data[key] = newHash
-	return newHash, false
+	s.setValue(key, newHash)
+	return newHash, nil
 }
@@ -0,0 +1,704 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JSON documents are kept parsed. Objects are map[string]interface{}, arrays are
+// *[]interface{} (so they can grow in place), numbers are json.Number and the
+// remaining scalars are string, bool and nil.
+
+type jsonSegKind int
+
+const (
+	segKey jsonSegKind = iota
+	segIndex
+	segWildcard
+	segRecursive // "..": applies the next segment to every descendant
+)
+
+type jsonSeg struct {
+	kind  jsonSegKind
+	key   string
+	index int
+}
+
+// jsonPath is a parsed path. Paths starting with '$' are JSONPath and may match
+// many values; anything else is a legacy path that must resolve to exactly one.
+type jsonPath struct {
+	raw    string
+	legacy bool
+	segs   []jsonSeg
+}
+
+// jsonRef points at one matched value so it can be replaced or removed.
+type jsonRef struct {
+	parent interface{} // map[string]interface{}, *[]interface{}, or nil for the root
+	key    string
+	index  int
+	value  interface{}
+}
+
+func parseJSONPath(path string) (*jsonPath, error) {
+	p := &jsonPath{raw: path}
+	if path == "" {
+		return nil, errors.New("empty JSON path")
+	}
+	i := 0
+	if path[0] == '$' {
+		i = 1
+	} else {
+		p.legacy = true
+		if path[0] != '.' && path[0] != '[' {
+			path = "." + path
+		}
+		if path == "." {
+			return p, nil
+		}
+	}
+	for i < len(path) {
+		switch path[i] {
+		case '.':
+			i++
+			recursive := false
+			if i < len(path) && path[i] == '.' {
+				recursive = true
+				i++
+			}
+			if recursive {
+				p.segs = append(p.segs, jsonSeg{kind: segRecursive})
+				if i < len(path) && path[i] == '[' {
+					continue
+				}
+			}
+			start := i
+			for i < len(path) && path[i] != '.' && path[i] != '[' {
+				i++
+			}
+			name := path[start:i]
+			if name == "" {
+				return nil, errors.New("invalid JSON path: " + p.raw)
+			}
+			if name == "*" {
+				p.segs = append(p.segs, jsonSeg{kind: segWildcard})
+			} else {
+				p.segs = append(p.segs, jsonSeg{kind: segKey, key: name})
+			}
+		case '[':
+			i++
+			if i >= len(path) {
+				return nil, errors.New("invalid JSON path: " + p.raw)
+			}
+			if q := path[i]; q == '\'' || q == '"' {
+				i++
+				var sb strings.Builder
+				for i < len(path) && path[i] != q {
+					if path[i] == '\\' && i+1 < len(path) {
+						i++
+					}
+					sb.WriteByte(path[i])
+					i++
+				}
+				if i+1 >= len(path) || path[i+1] != ']' {
+					return nil, errors.New("invalid JSON path: " + p.raw)
+				}
+				i += 2
+				p.segs = append(p.segs, jsonSeg{kind: segKey, key: sb.String()})
+				continue
+			}
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, errors.New("invalid JSON path: " + p.raw)
+			}
+			inner := strings.TrimSpace(path[i : i+end])
+			i += end + 1
+			if inner == "*" {
+				p.segs = append(p.segs, jsonSeg{kind: segWildcard})
+				continue
+			}
+			n, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, errors.New("invalid JSON path: " + p.raw)
+			}
+			p.segs = append(p.segs, jsonSeg{kind: segIndex, index: n})
+		default:
+			return nil, errors.New("invalid JSON path: " + p.raw)
+		}
+	}
+	if n := len(p.segs); n > 0 && p.segs[n-1].kind == segRecursive {
+		return nil, errors.New("invalid JSON path: " + p.raw)
+	}
+	return p, nil
+}
+
+// parseJSONValue parses a JSON text into the in-memory document representation.
+func parseJSONValue(raw string) (interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, errors.New("invalid JSON: " + err.Error())
+	}
+	if dec.More() {
+		return nil, errors.New("invalid JSON: trailing data")
+	}
+	return toJSONTree(v), nil
+}
+
+// toJSONTree swaps decoded slices for slice pointers so arrays can be mutated in place.
+func toJSONTree(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			t[k] = toJSONTree(child)
+		}
+		return t
+	case []interface{}:
+		for i, child := range t {
+			t[i] = toJSONTree(child)
+		}
+		return &t
+	default:
+		return v
+	}
+}
+
+// marshalJSON serializes a document node without HTML escaping.
+func marshalJSON(v interface{}) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "null"
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// jsonTypeName reports the RedisJSON type name of a document node.
+func jsonTypeName(v interface{}) string {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case *[]interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if strings.ContainsAny(string(t), ".eE") {
+			return "number"
+		}
+		return "integer"
+	default:
+		return "null"
+	}
+}
+
+// match resolves the path against root and returns a reference to every hit.
+func (p *jsonPath) match(root interface{}) []jsonRef {
+	refs := []jsonRef{{value: root}}
+	for i := 0; i < len(p.segs); i++ {
+		seg := p.segs[i]
+		if seg.kind == segRecursive {
+			i++
+			var all []jsonRef
+			for _, r := range refs {
+				all = appendDescendants(all, r)
+			}
+			refs = all
+			seg = p.segs[i]
+		}
+		var next []jsonRef
+		for _, r := range refs {
+			next = appendChildren(next, r.value, seg)
+		}
+		refs = next
+	}
+	return refs
+}
+
+// appendDescendants appends r and every node below it in document order.
+func appendDescendants(out []jsonRef, r jsonRef) []jsonRef {
+	out = append(out, r)
+	switch t := r.value.(type) {
+	case map[string]interface{}:
+		for _, k := range sortedJSONKeys(t) {
+			out = appendDescendants(out, jsonRef{parent: t, key: k, value: t[k]})
+		}
+	case *[]interface{}:
+		for i, child := range *t {
+			out = appendDescendants(out, jsonRef{parent: t, index: i, value: child})
+		}
+	}
+	return out
+}
+
+// appendChildren appends the children of node selected by a single segment.
+func appendChildren(out []jsonRef, node interface{}, seg jsonSeg) []jsonRef {
+	switch t := node.(type) {
+	case map[string]interface{}:
+		switch seg.kind {
+		case segKey:
+			if child, ok := t[seg.key]; ok {
+				out = append(out, jsonRef{parent: t, key: seg.key, value: child})
+			}
+		case segWildcard:
+			for _, k := range sortedJSONKeys(t) {
+				out = append(out, jsonRef{parent: t, key: k, value: t[k]})
+			}
+		}
+	case *[]interface{}:
+		switch seg.kind {
+		case segIndex:
+			idx := seg.index
+			if idx < 0 {
+				idx += len(*t)
+			}
+			if idx >= 0 && idx < len(*t) {
+				out = append(out, jsonRef{parent: t, index: idx, value: (*t)[idx]})
+			}
+		case segWildcard:
+			for i, child := range *t {
+				out = append(out, jsonRef{parent: t, index: i, value: child})
+			}
+		}
+	}
+	return out
+}
+
+func sortedJSONKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// set replaces the referenced value, or the document root when the ref has no parent.
+func (r jsonRef) set(doc *Value, v interface{}) {
+	switch p := r.parent.(type) {
+	case map[string]interface{}:
+		p[r.key] = v
+	case *[]interface{}:
+		(*p)[r.index] = v
+	default:
+		doc.JSON = v
+	}
+}
+
+// removeJSONRefs deletes the referenced values. Array elements are removed from the
+// highest index down so earlier removals don't shift later ones.
+func removeJSONRefs(refs []jsonRef) int {
+	sort.SliceStable(refs, func(i, j int) bool { return refs[i].index > refs[j].index })
+	removed := 0
+	for _, r := range refs {
+		switch p := r.parent.(type) {
+		case map[string]interface{}:
+			if _, ok := p[r.key]; ok {
+				delete(p, r.key)
+				removed++
+			}
+		case *[]interface{}:
+			if r.index < len(*p) {
+				*p = append((*p)[:r.index], (*p)[r.index+1:]...)
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// errJSONNoKey is returned by JSON operations that need an existing document.
+var errJSONNoKey = errors.New("could not perform this operation on a key that doesn't exist")
+
+// jsonDoc returns the JSON document at key, or nil if the key doesn't exist.
+func (s *Store) jsonDoc(key string) (*Value, error) {
+	return s.typed(key, JSONType)
+}
+
+// resolveJSON looks up key and evaluates path. Legacy paths must match something.
+func (s *Store) resolveJSON(key, path string) (*Value, *jsonPath, []jsonRef, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	doc, err := s.jsonDoc(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if doc == nil {
+		return nil, nil, nil, errJSONNoKey
+	}
+	refs := p.match(doc.JSON)
+	if p.legacy && len(refs) == 0 {
+		return nil, nil, nil, errors.New("Path '" + path + "' does not exist")
+	}
+	return doc, p, refs, nil
+}
+
+// JSONSet stores raw JSON at path. A new key can only be created at the root.
+// With nx the path must not exist yet, with xx it must. Returns false if the
+// condition or the path prevented the write.
+func (s *Store) JSONSet(key, path, raw string, nx, xx bool) (bool, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return false, err
+	}
+	v, err := parseJSONValue(raw)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, err := s.jsonDoc(key)
+	if err != nil {
+		return false, err
+	}
+	if doc == nil {
+		if len(p.segs) != 0 {
+			return false, errors.New("new objects must be created at the root")
+		}
+		if xx {
+			return false, nil
+		}
+		s.setValue(key, &Value{Type: JSONType, JSON: v})
+		return true, nil
+	}
+	if len(p.segs) == 0 {
+		if nx {
+			return false, nil
+		}
+		doc.JSON = v
+		return true, nil
+	}
+
+	refs := p.match(doc.JSON)
+	if len(refs) > 0 {
+		if nx {
+			return false, nil
+		}
+		for _, r := range refs {
+			r.set(doc, cloneJSON(v))
+		}
+		return true, nil
+	}
+	// Nothing matched: a trailing key can still be added to existing parent objects.
+	last := p.segs[len(p.segs)-1]
+	if xx || last.kind != segKey {
+		return false, nil
+	}
+	parent := &jsonPath{raw: p.raw, legacy: p.legacy, segs: p.segs[:len(p.segs)-1]}
+	created := false
+	for _, r := range parent.match(doc.JSON) {
+		if obj, ok := r.value.(map[string]interface{}); ok {
+			obj[last.key] = cloneJSON(v)
+			created = true
+		}
+	}
+	if !created && p.legacy {
+		return false, errors.New("Path '" + path + "' does not exist")
+	}
+	return created, nil
+}
+
+// JSONGet returns the serialized values at each path. With a single path the
+// result is the value itself (legacy) or an array of matches (JSONPath); with
+// several paths it is an object keyed by path. ok is false if key is missing.
+func (s *Store) JSONGet(key string, paths ...string) (string, bool, error) {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	doc, err := s.jsonDoc(key)
+	if err != nil || doc == nil {
+		return "", false, err
+	}
+	results := make(map[string]interface{}, len(paths))
+	for _, path := range paths {
+		p, err := parseJSONPath(path)
+		if err != nil {
+			return "", false, err
+		}
+		refs := p.match(doc.JSON)
+		if p.legacy {
+			if len(refs) == 0 {
+				return "", false, errors.New("Path '" + path + "' does not exist")
+			}
+			results[path] = refs[0].value
+			continue
+		}
+		matches := make([]interface{}, len(refs))
+		for i, r := range refs {
+			matches[i] = r.value
+		}
+		results[path] = matches
+	}
+	if len(paths) == 1 {
+		return marshalJSON(results[paths[0]]), true, nil
+	}
+	return marshalJSON(results), true, nil
+}
+
+// JSONDel removes the values at path and returns how many were removed.
+// Deleting the root removes the key.
+func (s *Store) JSONDel(key, path string) (int, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, err := s.jsonDoc(key)
+	if err != nil || doc == nil {
+		return 0, err
+	}
+	if len(p.segs) == 0 {
+		s.deleteKey(key)
+		return 1, nil
+	}
+	return removeJSONRefs(p.match(doc.JSON)), nil
+}
+
+// JSONPathType returns the type name of each value at path.
+func (s *Store) JSONPathType(key, path string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, _, refs, err := s.resolveJSON(key, path)
+	if err != nil {
+		return nil, err
+	}
+	types := make([]string, len(refs))
+	for i, r := range refs {
+		types[i] = jsonTypeName(r.value)
+	}
+	return types, nil
+}
+
+// JSONNumIncrBy adds by to every number at path. The result holds the new value
+// of each match, or nil where the match was not a number.
+func (s *Store) JSONNumIncrBy(key, path, by string) ([]interface{}, error) {
+	delta, err := parseJSONValue(by)
+	if err != nil {
+		return nil, err
+	}
+	inc, ok := delta.(json.Number)
+	if !ok {
+		return nil, errors.New("increment is not a number")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, p, refs, err := s.resolveJSON(key, path)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]interface{}, len(refs))
+	for i, r := range refs {
+		n, ok := r.value.(json.Number)
+		if !ok {
+			if p.legacy {
+				return nil, errors.New("wrong type of path value - expected a number but found " + jsonTypeName(r.value))
+			}
+			continue
+		}
+		sum, err := addJSONNumbers(n, inc)
+		if err != nil {
+			return nil, err
+		}
+		r.set(doc, sum)
+		out[i] = sum
+	}
+	return out, nil
+}
+
+// addJSONNumbers adds two numbers, staying integral when both are integers.
+func addJSONNumbers(a, b json.Number) (json.Number, error) {
+	ai, errA := a.Int64()
+	bi, errB := b.Int64()
+	if errA == nil && errB == nil {
+		sum := ai + bi
+		if (sum > ai) == (bi > 0) {
+			return json.Number(strconv.FormatInt(sum, 10)), nil
+		}
+	}
+	af, _ := a.Float64()
+	bf, _ := b.Float64()
+	sum := af + bf
+	if math.IsInf(sum, 0) || math.IsNaN(sum) {
+		return "", errors.New("result is not a finite number")
+	}
+	return json.Number(strconv.FormatFloat(sum, 'f', -1, 64)), nil
+}
+
+// JSONArrAppend appends values to every array at path. The result holds the new
+// length of each match, or nil where the match was not an array.
+func (s *Store) JSONArrAppend(key, path string, raws ...string) ([]*int, error) {
+	return s.jsonArrInsert(key, path, 0, true, raws)
+}
+
+// JSONArrInsert inserts values before index in every array at path. Negative
+// indexes count from the end of the array.
+func (s *Store) JSONArrInsert(key, path string, index int, raws ...string) ([]*int, error) {
+	return s.jsonArrInsert(key, path, index, false, raws)
+}
+
+func (s *Store) jsonArrInsert(key, path string, index int, atEnd bool, raws []string) ([]*int, error) {
+	values := make([]interface{}, len(raws))
+	for i, raw := range raws {
+		v, err := parseJSONValue(raw)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, p, refs, err := s.resolveJSON(key, path)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*int, len(refs))
+	for i, r := range refs {
+		arr, ok := r.value.(*[]interface{})
+		if !ok {
+			if p.legacy {
+				return nil, errors.New("wrong type of path value - expected an array but found " + jsonTypeName(r.value))
+			}
+			continue
+		}
+		pos := index
+		if atEnd {
+			pos = len(*arr)
+		} else if pos < 0 {
+			pos += len(*arr)
+		}
+		if pos < 0 || pos > len(*arr) {
+			return nil, errors.New("index out of bounds")
+		}
+		inserted := make([]interface{}, len(values))
+		for j, v := range values {
+			inserted[j] = cloneJSON(v)
+		}
+		grown := make([]interface{}, 0, len(*arr)+len(inserted))
+		grown = append(grown, (*arr)[:pos]...)
+		grown = append(grown, inserted...)
+		grown = append(grown, (*arr)[pos:]...)
+		*arr = grown
+		n := len(grown)
+		out[i] = &n
+	}
+	return out, nil
+}
+
+// JSONArrLen returns the length of every array at path (nil for non-arrays).
+func (s *Store) JSONArrLen(key, path string) ([]*int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, p, refs, err := s.resolveJSON(key, path)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*int, len(refs))
+	for i, r := range refs {
+		arr, ok := r.value.(*[]interface{})
+		if !ok {
+			if p.legacy {
+				return nil, errors.New("wrong type of path value - expected an array but found " + jsonTypeName(r.value))
+			}
+			continue
+		}
+		n := len(*arr)
+		out[i] = &n
+	}
+	return out, nil
+}
+
+// JSONArrPop removes and returns the element at index from every array at path.
+// Entries are nil where the match was not an array or the array was empty.
+func (s *Store) JSONArrPop(key, path string, index int) ([]*string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, p, refs, err := s.resolveJSON(key, path)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*string, len(refs))
+	for i, r := range refs {
+		arr, ok := r.value.(*[]interface{})
+		if !ok {
+			if p.legacy {
+				return nil, errors.New("wrong type of path value - expected an array but found " + jsonTypeName(r.value))
+			}
+			continue
+		}
+		if len(*arr) == 0 {
+			continue
+		}
+		pos := index
+		if pos < 0 {
+			pos += len(*arr)
+		}
+		// Out-of-range indexes are clamped, as in RedisJSON.
+		if pos < 0 {
+			pos = 0
+		}
+		if pos >= len(*arr) {
+			pos = len(*arr) - 1
+		}
+		popped := marshalJSON((*arr)[pos])
+		*arr = append((*arr)[:pos], (*arr)[pos+1:]...)
+		out[i] = &popped
+	}
+	return out, nil
+}
+
+// JSONObjKeys returns the sorted keys of every object at path (nil for non-objects).
+func (s *Store) JSONObjKeys(key, path string) ([][]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, p, refs, err := s.resolveJSON(key, path)
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]string, len(refs))
+	for i, r := range refs {
+		obj, ok := r.value.(map[string]interface{})
+		if !ok {
+			if p.legacy {
+				return nil, errors.New("wrong type of path value - expected an object but found " + jsonTypeName(r.value))
+			}
+			continue
+		}
+		out[i] = sortedJSONKeys(obj)
+	}
+	return out, nil
+}
+
+// cloneJSON deep-copies a document node so one parsed value can be stored at
+// several paths without aliasing.
+func cloneJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, child := range t {
+			m[k] = cloneJSON(child)
+		}
+		return m
+	case *[]interface{}:
+		arr := make([]interface{}, len(*t))
+		for i, child := range *t {
+			arr[i] = cloneJSON(child)
+		}
+		return &arr
+	default:
+		return v
+	}
+}
@@ -1,50 +1,55 @@
 package main
 
-import (
-	"errors"
-)
-
-func (s *Store) LPush(key string, values ...string) int {
+// LPush prepends values to the list at key, creating it if needed, and
+// returns the new length.
+func (s *Store) LPush(key string, values ...string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	v, _ := s.getOrInitList(key)
+	v, err := s.getOrInitList(key)
+	if err != nil {
+		return 0, err
+	}
 	for i := 0; i < len(values); i++ {
 		v.List = append([]string{values[i]}, v.List...)
 	}
-	return len(v.List)
+	return len(v.List), nil
 }
 
-func (s *Store) RPop(key string) (string, error) {
+// RPop removes and returns the last item of the list at key. It reports false
+// if the key doesn't exist or the list is empty.
+func (s *Store) RPop(key string) (string, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	val, ok := s.data[key]
-	if !ok || val.Type != ListType || len(val.List) == 0 {
-		return "", errors.New("no such key or not a list or list empty")
+	val, err := s.typed(key, ListType)
+	if val == nil || len(val.List) == 0 {
+		return "", false, err
 	}
 	item := val.List[len(val.List)-1]
 	val.List = val.List[:len(val.List)-1]
-	return item, nil
+	return item, true, nil
 }
 
-func (s *Store) LLen(key string) int {
+func (s *Store) LLen(key string) (int, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	val, ok := s.data[key]
-	if !ok || val.Type != ListType {
-		return 0
+	val, err := s.typed(key, ListType)
+	if val == nil {
+		return 0, err
 	}
-	return len(val.List)
+	return len(val.List), nil
 }
 
-func (s *Store) getOrInitList(key string) (*Value, bool) {
-	val, ok := s.data[key]
-	if ok && val.Type == ListType {
-		return val, true
+// getOrInitList returns the list at key, creating an empty one if the key
+// doesn't exist.
+func (s *Store) getOrInitList(key string) (*Value, error) {
+	val, err := s.typed(key, ListType)
+	if val != nil || err != nil {
+		return val, err
 	}
 	newList := &Value{Type: ListType, List: []string{}}
-	s.data[key] = newList
-	return newList, false
+	s.setValue(key, newList)
+	return newList, nil
 }
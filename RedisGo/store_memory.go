@@ -0,0 +1,633 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Memory usage is an estimate: each key costs a fixed overhead plus the
+// length of its name, and each value the lengths of its strings plus a fixed
+// overhead per element. Large collections are sampled and the result scaled
+// up, as Redis does for MEMORY USAGE.
+const (
+	keyOverhead        = 96 // map entry, *Value header and keyspace index entries
+	stringOverhead     = 16 // string header
+	elemOverhead       = 48 // per-entry cost of a map slot or list element
+	accountSamples     = 16 // elements sampled when re-estimating after a write
+	memoryUsageSamples = 5  // default SAMPLES of MEMORY USAGE
+)
+
+// EvictionPolicy chooses which keys FreeMemory removes when the store is over
+// its memory limit.
+type EvictionPolicy int
+
+const (
+	NoEviction EvictionPolicy = iota
+	AllKeysLRU
+	AllKeysLFU
+	AllKeysRandom
+	VolatileLRU
+	VolatileLFU
+	VolatileRandom
+	VolatileTTL
+)
+
+var evictionPolicyNames = map[EvictionPolicy]string{
+	NoEviction:     "noeviction",
+	AllKeysLRU:     "allkeys-lru",
+	AllKeysLFU:     "allkeys-lfu",
+	AllKeysRandom:  "allkeys-random",
+	VolatileLRU:    "volatile-lru",
+	VolatileLFU:    "volatile-lfu",
+	VolatileRandom: "volatile-random",
+	VolatileTTL:    "volatile-ttl",
+}
+
+func (p EvictionPolicy) String() string {
+	return evictionPolicyNames[p]
+}
+
+// ParseEvictionPolicy looks up a policy by its maxmemory-policy name.
+func ParseEvictionPolicy(name string) (EvictionPolicy, bool) {
+	for p, n := range evictionPolicyNames {
+		if n == name {
+			return p, true
+		}
+	}
+	return NoEviction, false
+}
+
+// volatile reports whether the policy only evicts keys with an expiry.
+func (p EvictionPolicy) volatile() bool {
+	return p >= VolatileLRU
+}
+
+// ErrOOM is returned by FreeMemory when it cannot get under the limit.
+var ErrOOM = &Error{"OOM", "command not allowed when used memory > 'maxmemory'."}
+
+// memoryAccount holds the memory limit and usage totals. The databases of a
+// server share one, so maxmemory bounds their combined size.
+type memoryAccount struct {
+	mu      sync.Mutex
+	used    int64
+	peak    int64
+	max     int64
+	policy  EvictionPolicy
+	evicted uint64
+}
+
+func (m *memoryAccount) add(delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.used += delta
+	m.peak = max(m.peak, m.used)
+}
+
+// overLimit returns the eviction policy and whether usage exceeds the limit.
+func (m *memoryAccount) overLimit() (EvictionPolicy, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.policy, m.max > 0 && m.used > m.max
+}
+
+// MemoryStats reports on memory use for INFO and MEMORY STATS. Used, Peak,
+// Max, Policy and EvictedKeys cover all databases sharing the limit; the rest
+// cover this database.
+type MemoryStats struct {
+	Used        int64
+	Peak        int64
+	Max         int64 // 0 means no limit
+	Policy      EvictionPolicy
+	EvictedKeys uint64
+	DBUsed      int64
+	Keys        int
+	KeysBytes   int64 // the part of DBUsed spent on keys rather than values
+}
+
+// SetMaxMemory sets the memory limit in bytes (0 for none) and the policy
+// used to stay under it.
+func (s *Store) SetMaxMemory(bytes int64, policy EvictionPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.memory.mu.Lock()
+	s.memory.max = bytes
+	s.memory.policy = policy
+	s.memory.mu.Unlock()
+	s.evictionPool = s.evictionPool[:0]
+}
+
+// MemoryStats returns a snapshot of the memory statistics.
+func (s *Store) MemoryStats() MemoryStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.memory.mu.Lock()
+	defer s.memory.mu.Unlock()
+	return MemoryStats{
+		Used:        s.memory.used,
+		Peak:        s.memory.peak,
+		Max:         s.memory.max,
+		Policy:      s.memory.policy,
+		EvictedKeys: s.memory.evicted,
+		DBUsed:      s.usedMemory,
+		Keys:        len(s.data),
+		KeysBytes:   s.keysMemory,
+	}
+}
+
+// ResetStats clears the counters INFO reports for this database, as CONFIG
+// RESETSTAT does: expired and evicted keys, active expiry cycles and peak
+// memory, which restarts from current usage.
+func (s *Store) ResetStats() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expiryStats = ExpiryStats{}
+	s.memory.mu.Lock()
+	defer s.memory.mu.Unlock()
+	s.memory.evicted = 0
+	s.memory.peak = s.memory.used
+}
+
+// LFU counters follow Redis: a key starts at lfuInitVal, each access bumps the
+// counter with a probability that shrinks as it grows, and it loses one per
+// lfuDecayTime without accesses.
+const (
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuDecayTime = time.Minute
+)
+
+// accessInfo is the approximate LRU and LFU data kept for each key. Readers
+// update it under the read lock, hence the atomics.
+type accessInfo struct {
+	last atomic.Int64  // last access on the store clock, Unix ms
+	lfu  atomic.Uint64 // time of the last decrement in lfuDecayTime units << 8 | counter
+}
+
+func (a *accessInfo) init(now time.Time) {
+	a.last.Store(now.UnixMilli())
+	a.lfu.Store(lfuPeriod(now)<<8 | lfuInitVal)
+}
+
+// touch records an access at now.
+func (a *accessInfo) touch(now time.Time) {
+	a.last.Store(now.UnixMilli())
+	counter := a.frequency(now)
+	if counter < 255 {
+		base := math.Max(float64(counter)-lfuInitVal, 0)
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			counter++
+		}
+	}
+	a.lfu.Store(lfuPeriod(now)<<8 | uint64(counter))
+}
+
+// idle returns how long ago the key was last accessed.
+func (a *accessInfo) idle(now time.Time) time.Duration {
+	return now.Sub(time.UnixMilli(a.last.Load()))
+}
+
+// frequency returns the LFU counter after decaying it to now.
+func (a *accessInfo) frequency(now time.Time) uint8 {
+	packed := a.lfu.Load()
+	counter := packed & 0xff
+	if period, last := lfuPeriod(now), packed>>8; period > last {
+		counter -= min(counter, period-last)
+	}
+	return uint8(counter)
+}
+
+func lfuPeriod(t time.Time) uint64 {
+	return uint64(t.UnixMilli() / lfuDecayTime.Milliseconds())
+}
+
+// RecordAccess notes that a command read or wrote keys, refreshing their LRU
+// and LFU data. Commands modify values in place, so after a write the sizes
+// of the keys are estimated again.
+func (s *Store) RecordAccess(write bool, keys ...string) {
+	if write {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	} else {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	}
+	now := s.clock.Now()
+	for _, key := range keys {
+		v, ok := s.data[key]
+		if !ok {
+			continue
+		}
+		v.access.touch(now)
+		if write {
+			s.accountValue(v)
+		}
+	}
+}
+
+// accountValue re-estimates v's size and updates the total. Callers must hold
+// the write lock.
+func (s *Store) accountValue(v *Value) {
+	size := estimateValueSize(v, accountSamples)
+	s.addMemory(size - v.size)
+	v.size = size
+}
+
+// accountKey adds (or with sign -1 removes) key and its value to the totals.
+// Callers must hold the write lock.
+func (s *Store) accountKey(key string, v *Value, sign int64) {
+	overhead := keyOverhead + int64(len(key))
+	s.keysMemory += sign * overhead
+	s.addMemory(sign * (overhead + v.size))
+}
+
+func (s *Store) addMemory(delta int64) {
+	s.usedMemory += delta
+	s.memory.add(delta)
+}
+
+// MemoryUsage estimates the bytes used by key and its value, sampling at most
+// samples elements of each container (all of them if samples is 0).
+func (s *Store) MemoryUsage(key string, samples int) (int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.lookup(key)
+	if !ok {
+		return 0, false
+	}
+	return keyOverhead + int64(len(key)) + estimateValueSize(v, samples), true
+}
+
+// ObjectInfo describes how a value is held, for OBJECT.
+type ObjectInfo struct {
+	Encoding  string
+	Idle      time.Duration // since the last access
+	Frequency uint8         // logarithmic LFU counter
+	RefCount  int
+}
+
+// Object returns the encoding and access data of key without counting as an
+// access.
+func (s *Store) Object(key string) (ObjectInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.lookup(key)
+	if !ok {
+		return ObjectInfo{}, false
+	}
+	now := s.clock.Now()
+	return ObjectInfo{
+		Encoding:  objectEncoding(v),
+		Idle:      v.access.idle(now),
+		Frequency: v.access.frequency(now),
+		RefCount:  1,
+	}, true
+}
+
+// Thresholds under which Redis keeps a collection in a compact encoding.
+const (
+	compactMaxEntries = 128
+	compactMaxValue   = 64
+	intsetMaxEntries  = 512
+	embstrMaxLen      = 44
+)
+
+// objectEncoding names the encoding Redis would use for v. Values here are
+// always plain Go structures; the name tells clients what shape they have.
+func objectEncoding(v *Value) string {
+	switch v.Type {
+	case StringType:
+		if _, err := strconv.ParseInt(v.Str, 10, 64); err == nil {
+			return "int"
+		}
+		if len(v.Str) <= embstrMaxLen {
+			return "embstr"
+		}
+		return "raw"
+	case ListType:
+		if compactStrings(len(v.List), func(yield func(string) bool) {
+			for _, e := range v.List {
+				if !yield(e) {
+					return
+				}
+			}
+		}) {
+			return "listpack"
+		}
+		return "quicklist"
+	case SetType:
+		if len(v.Set) <= intsetMaxEntries && allInts(v.Set) {
+			return "intset"
+		}
+		if compactStrings(len(v.Set), func(yield func(string) bool) {
+			for m := range v.Set {
+				if !yield(m) {
+					return
+				}
+			}
+		}) {
+			return "listpack"
+		}
+		return "hashtable"
+	case HashType:
+		if compactStrings(len(v.Hash), func(yield func(string) bool) {
+			for f, val := range v.Hash {
+				if !yield(f) || !yield(val) {
+					return
+				}
+			}
+		}) {
+			return "listpack"
+		}
+		return "hashtable"
+	case ZSetType:
+		if compactStrings(len(v.ZSet), func(yield func(string) bool) {
+			for _, e := range v.ZSet {
+				if !yield(e.Member) {
+					return
+				}
+			}
+		}) {
+			return "listpack"
+		}
+		return "skiplist"
+	}
+	// Module types report raw in Redis too.
+	return "raw"
+}
+
+// compactStrings reports whether a collection of n entries whose strings are
+// produced by iterate fits a listpack.
+func compactStrings(n int, iterate func(yield func(string) bool)) bool {
+	if n > compactMaxEntries {
+		return false
+	}
+	fits := true
+	iterate(func(s string) bool {
+		fits = len(s) <= compactMaxValue
+		return fits
+	})
+	return fits
+}
+
+func allInts(set map[string]struct{}) bool {
+	for m := range set {
+		if _, err := strconv.ParseInt(m, 10, 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// FreeMemory evicts keys from this database according to the policy until
+// memory use is within the limit. It returns ErrOOM if the policy is
+// noeviction or it runs out of keys it may evict.
+func (s *Store) FreeMemory() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		policy, over := s.memory.overLimit()
+		if !over {
+			return nil
+		}
+		key, ok := s.evictionCandidate(policy)
+		if !ok {
+			return ErrOOM
+		}
+		s.deleteKey(key)
+		s.memory.mu.Lock()
+		s.memory.evicted++
+		s.memory.mu.Unlock()
+	}
+}
+
+// Approximate LRU, LFU and TTL eviction follow Redis: sample a few keys, keep
+// the best candidates seen so far in a small pool, and evict the best one
+// that still exists.
+const (
+	evictionSamples  = 5
+	evictionPoolSize = 16
+)
+
+type evictionEntry struct {
+	key   string
+	score int64 // higher is a better candidate
+}
+
+// evictionCandidate picks the next key to evict. Callers must hold s.mu.
+func (s *Store) evictionCandidate(policy EvictionPolicy) (string, bool) {
+	switch policy {
+	case NoEviction:
+		return "", false
+	case AllKeysRandom, VolatileRandom:
+		keys := s.sampleKeys(1, policy.volatile())
+		if len(keys) == 0 {
+			return "", false
+		}
+		return keys[0], true
+	}
+	now := s.clock.Now()
+	for _, key := range s.sampleKeys(evictionSamples, policy.volatile()) {
+		v := s.data[key]
+		var score int64
+		switch policy {
+		case AllKeysLRU, VolatileLRU:
+			score = v.access.idle(now).Milliseconds()
+		case AllKeysLFU, VolatileLFU:
+			score = 255 - int64(v.access.frequency(now))
+		case VolatileTTL:
+			score = -s.expires[key].UnixMilli()
+		}
+		s.addEvictionCandidate(evictionEntry{key, score})
+	}
+	// Take the best entry that is still eligible; the pool can hold keys
+	// that were deleted, or lost their expiry, since they were sampled.
+	for len(s.evictionPool) > 0 {
+		last := len(s.evictionPool) - 1
+		e := s.evictionPool[last]
+		s.evictionPool = s.evictionPool[:last]
+		if _, ok := s.data[e.key]; !ok {
+			continue
+		}
+		if _, ok := s.expires[e.key]; policy.volatile() && !ok {
+			continue
+		}
+		return e.key, true
+	}
+	return "", false
+}
+
+// addEvictionCandidate inserts e into the pool, which is kept sorted by
+// ascending score, dropping the worst entry when full.
+func (s *Store) addEvictionCandidate(e evictionEntry) {
+	for i, old := range s.evictionPool {
+		if old.key == e.key {
+			s.evictionPool = append(s.evictionPool[:i], s.evictionPool[i+1:]...)
+			break
+		}
+	}
+	if len(s.evictionPool) == evictionPoolSize {
+		if e.score <= s.evictionPool[0].score {
+			return
+		}
+		s.evictionPool = s.evictionPool[1:]
+	}
+	i := sort.Search(len(s.evictionPool), func(i int) bool { return s.evictionPool[i].score > e.score })
+	s.evictionPool = append(s.evictionPool, evictionEntry{})
+	copy(s.evictionPool[i+1:], s.evictionPool[i:])
+	s.evictionPool[i] = e
+}
+
+// sampleKeys returns up to n keys picked at random, only from keys with an
+// expiry if volatile is set. Callers must hold s.mu.
+func (s *Store) sampleKeys(n int, volatile bool) []string {
+	var keys []string
+	if volatile {
+		if len(s.volatile) <= n {
+			return append(keys, s.volatile...)
+		}
+		for i := 0; i < n; i++ {
+			keys = append(keys, s.volatile[rand.Intn(len(s.volatile))])
+		}
+		return keys
+	}
+	// Map iteration starts at a random position.
+	for k := range s.data {
+		if len(keys) == n {
+			break
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// estimateValueSize estimates the memory held by v, sampling at most samples
+// elements of a collection; samples <= 0 visits every element.
+func estimateValueSize(v *Value, samples int) int64 {
+	size := stringOverhead + int64(len(v.Str))
+	switch v.Type {
+	case ListType:
+		size += sampledSize(len(v.List), samples, func(visit func(int64) bool) {
+			// Spread the samples over the list.
+			step := 1
+			if samples > 0 && len(v.List) > samples {
+				step = len(v.List) / samples
+			}
+			for i := 0; i < len(v.List); i += step {
+				if !visit(elemOverhead + int64(len(v.List[i]))) {
+					return
+				}
+			}
+		})
+	case SetType:
+		size += sampledSize(len(v.Set), samples, func(visit func(int64) bool) {
+			for m := range v.Set {
+				if !visit(elemOverhead + int64(len(m))) {
+					return
+				}
+			}
+		})
+	case HashType:
+		size += sampledSize(len(v.Hash), samples, func(visit func(int64) bool) {
+			for f, val := range v.Hash {
+				if !visit(elemOverhead + int64(len(f)+len(val))) {
+					return
+				}
+			}
+		})
+	case ZSetType:
+		// Each member is in both the sorted slice and the lookup map.
+		size += sampledSize(len(v.ZSet), samples, func(visit func(int64) bool) {
+			for _, e := range v.ZSet {
+				if !visit(2*elemOverhead + int64(len(e.Member))) {
+					return
+				}
+			}
+		})
+	case JSONType:
+		size += jsonSize(v.JSON, samples)
+	case BloomType:
+		for _, l := range v.Bloom.Filters {
+			size += elemOverhead + 8*int64(len(l.Bits))
+		}
+	case CuckooType:
+		for _, l := range v.Cuckoo.Filters {
+			size += elemOverhead + int64(len(l.Slots))
+		}
+	case CMSType:
+		size += 8 * int64(len(v.CMS.Counters))
+	case TopKType:
+		size += 16 * int64(len(v.TopK.Buckets))
+		for _, it := range v.TopK.Top {
+			size += elemOverhead + int64(len(it.Item))
+		}
+	case TimeSeriesType:
+		ts := v.TimeSeries
+		size += 16*int64(len(ts.Samples)) + elemOverhead*int64(len(ts.Rules))
+		for l, val := range ts.Labels {
+			size += elemOverhead + int64(len(l)+len(val))
+		}
+	case VectorSetType:
+		vs := v.Vectors
+		// Vector, graph links on the lower layers and the map entries.
+		perElem := 4*int64(vs.Dim) + 8*3*int64(vs.M) + 2*elemOverhead
+		size += sampledSize(len(vs.Elements), samples, func(visit func(int64) bool) {
+			for name, el := range vs.Elements {
+				if !visit(perElem + int64(len(name)+len(el.Attrs))) {
+					return
+				}
+			}
+		})
+	}
+	return size
+}
+
+// sampledSize sums the sizes passed to visit by iterate, stopping after
+// samples of them and scaling the sum up to n elements.
+func sampledSize(n, samples int, iterate func(visit func(int64) bool)) int64 {
+	var sum int64
+	seen := 0
+	iterate(func(size int64) bool {
+		sum += size
+		seen++
+		return samples <= 0 || seen < samples
+	})
+	if seen == 0 {
+		return 0
+	}
+	return sum * int64(n) / int64(seen)
+}
+
+// jsonSize estimates the memory held by a decoded JSON value, sampling at
+// most samples children of each object or array.
+func jsonSize(v interface{}, samples int) int64 {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return elemOverhead + sampledSize(len(v), samples, func(visit func(int64) bool) {
+			for k, child := range v {
+				if !visit(elemOverhead + int64(len(k)) + jsonSize(child, samples)) {
+					return
+				}
+			}
+		})
+	case *[]interface{}:
+		return stringOverhead + sampledSize(len(*v), samples, func(visit func(int64) bool) {
+			for _, child := range *v {
+				if !visit(jsonSize(child, samples)) {
+					return
+				}
+			}
+		})
+	case string:
+		return stringOverhead + int64(len(v))
+	case json.Number:
+		return stringOverhead + int64(len(v))
+	default:
+		return stringOverhead
+	}
+}
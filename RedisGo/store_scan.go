@@ -0,0 +1,237 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/bits"
+	"sort"
+	"strconv"
+)
+
+// Cursors used by SCAN, SSCAN, HSCAN and ZSCAN are positions in "scan order":
+// the order of each element's 64-bit hash with its bits reversed. This is the
+// order in which Redis' reverse-binary cursor visits hash table buckets, and it
+// does not depend on the table size. Everything before the cursor has been
+// returned, so an element present for the whole scan is seen at least once no
+// matter how the collection grows, shrinks or is rehashed between calls.
+
+const scanDefaultCount = 10
+
+// scanPosition returns the scan-order position of s.
+func scanPosition(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return bits.Reverse64(h.Sum64())
+}
+
+// matchPattern reports whether s matches a Redis glob pattern; an empty pattern
+// matches everything.
+func matchPattern(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	return globMatch(pattern, s)
+}
+
+// keyBuckets indexes the keyspace, or the members of a collection, by hash so
+// SCAN can resume from a cursor without visiting every key. Bucket b holds keys
+// whose hash has b in its low bits, i.e. whose scan position starts with b
+// reversed; walking buckets in reversed-index order therefore walks scan
+// order. Keys sharing a position share a bucket, so a batch never splits them.
+type keyBuckets struct {
+	bits    uint
+	buckets [][]string
+	count   int
+}
+
+const keyBucketsMinBits = 4
+
+func newKeyBuckets() *keyBuckets {
+	return &keyBuckets{bits: keyBucketsMinBits, buckets: make([][]string, 1<<keyBucketsMinBits)}
+}
+
+func (kb *keyBuckets) bucketOf(pos uint64) uint64 {
+	return bits.Reverse64(pos) & (1<<kb.bits - 1)
+}
+
+func (kb *keyBuckets) add(key string) {
+	b := kb.bucketOf(scanPosition(key))
+	for _, k := range kb.buckets[b] {
+		if k == key {
+			return
+		}
+	}
+	kb.buckets[b] = append(kb.buckets[b], key)
+	kb.count++
+	if kb.count > len(kb.buckets) {
+		kb.resize(kb.bits + 1)
+	}
+}
+
+func (kb *keyBuckets) remove(key string) {
+	b := kb.bucketOf(scanPosition(key))
+	for i, k := range kb.buckets[b] {
+		if k == key {
+			last := len(kb.buckets[b]) - 1
+			kb.buckets[b][i] = kb.buckets[b][last]
+			kb.buckets[b] = kb.buckets[b][:last]
+			kb.count--
+			if kb.bits > keyBucketsMinBits && kb.count < len(kb.buckets)/8 {
+				kb.resize(kb.bits - 1)
+			}
+			return
+		}
+	}
+}
+
+func (kb *keyBuckets) resize(n uint) {
+	old := kb.buckets
+	kb.bits = n
+	kb.buckets = make([][]string, 1<<n)
+	for _, bucket := range old {
+		for _, k := range bucket {
+			b := kb.bucketOf(scanPosition(k))
+			kb.buckets[b] = append(kb.buckets[b], k)
+		}
+	}
+}
+
+// scan visits keys in scan order starting at cursor until count keys have
+// been examined, and returns the next cursor (0 when the scan is complete).
+// Keys sharing a position are never split across calls.
+func (kb *keyBuckets) scan(cursor uint64, count int, fn func(key string)) uint64 {
+	type entry struct {
+		pos uint64
+		key string
+	}
+	shift := 64 - kb.bits
+	examined := 0
+	var pending []entry
+	for {
+		prefix := cursor >> shift
+		pending = pending[:0]
+		for _, k := range kb.buckets[bits.Reverse64(prefix)>>shift] {
+			// The cursor may fall inside a bucket.
+			if pos := scanPosition(k); pos >= cursor {
+				pending = append(pending, entry{pos, k})
+			}
+		}
+		sort.Slice(pending, func(i, j int) bool { return pending[i].pos < pending[j].pos })
+		for i, e := range pending {
+			// examined < count on entering a bucket, so i > 0 here.
+			if examined >= count && e.pos != pending[i-1].pos {
+				return e.pos
+			}
+			fn(e.key)
+			examined++
+		}
+		if prefix == 1<<kb.bits-1 {
+			return 0
+		}
+		cursor = (prefix + 1) << shift
+		if examined >= count {
+			return cursor
+		}
+	}
+}
+
+// indexMembers builds the scan index of a set, hash or sorted set that has
+// none yet. setValue calls it for every value it stores; the commands that
+// add or remove members keep the index current from then on.
+func (v *Value) indexMembers() {
+	if v.members != nil {
+		return
+	}
+	switch v.Type {
+	case SetType:
+		v.members = newKeyBuckets()
+		for m := range v.Set {
+			v.members.add(m)
+		}
+	case HashType:
+		v.members = newKeyBuckets()
+		for f := range v.Hash {
+			v.members.add(f)
+		}
+	case ZSetType:
+		v.members = newKeyBuckets()
+		for _, e := range v.ZSet {
+			v.members.add(e.Member)
+		}
+	}
+}
+
+func scanCount(count int) int {
+	if count <= 0 {
+		return scanDefaultCount
+	}
+	return count
+}
+
+// Scan returns one batch of keys from cursor onwards. match and typ (a TYPE
+// name such as "hash") filter the batch after it is chosen, so a batch may be
+// empty even though the scan is not finished.
+func (s *Store) Scan(cursor uint64, match string, count int, typ string) (uint64, []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []string
+	next := s.keyIndex.scan(cursor, scanCount(count), func(key string) {
+		val, ok := s.lookup(key)
+		if !ok || (typ != "" && val.Type.String() != typ) || !matchPattern(match, key) {
+			return
+		}
+		keys = append(keys, key)
+	})
+	return next, keys
+}
+
+// SScan returns one batch of set members.
+func (s *Store) SScan(key string, cursor uint64, match string, count int) (uint64, []string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, err := s.typed(key, SetType)
+	if val == nil {
+		return 0, nil, err
+	}
+	var out []string
+	next := val.members.scan(cursor, scanCount(count), func(m string) {
+		if matchPattern(match, m) {
+			out = append(out, m)
+		}
+	})
+	return next, out, nil
+}
+
+// HScan returns one batch of hash fields as alternating field, value pairs.
+func (s *Store) HScan(key string, cursor uint64, match string, count int) (uint64, []string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, err := s.typed(key, HashType)
+	if val == nil {
+		return 0, nil, err
+	}
+	var out []string
+	next := val.members.scan(cursor, scanCount(count), func(f string) {
+		if matchPattern(match, f) {
+			out = append(out, f, val.Hash[f])
+		}
+	})
+	return next, out, nil
+}
+
+// ZScan returns one batch of sorted set members as alternating member, score
+// pairs.
+func (s *Store) ZScan(key string, cursor uint64, match string, count int) (uint64, []string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, err := s.typed(key, ZSetType)
+	if val == nil {
+		return 0, nil, err
+	}
+	var out []string
+	next := val.members.scan(cursor, scanCount(count), func(m string) {
+		if matchPattern(match, m) {
+			out = append(out, m, strconv.FormatFloat(val.ZSetMap[m].Score, 'f', -1, 64))
+		}
+	})
+	return next, out, nil
+}
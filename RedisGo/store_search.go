@@ -0,0 +1,913 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Field types supported in an index schema.
+const (
+	searchText    = "TEXT"
+	searchTag     = "TAG"
+	searchNumeric = "NUMERIC"
+)
+
+// SearchField describes one hash field covered by an index.
+type SearchField struct {
+	Name      string
+	Type      string
+	Sortable  bool
+	Separator string // TAG only
+}
+
+// SearchQuery is a parsed FT.SEARCH request.
+type SearchQuery struct {
+	Query     string
+	SortBy    string
+	Desc      bool
+	Offset    int
+	Limit     int
+	NoContent bool
+	Return    []string
+}
+
+// SearchDoc is one hit. Fields alternate name, value.
+type SearchDoc struct {
+	Key    string
+	Fields []string
+}
+
+// SearchIndexInfo describes an index for FT.INFO.
+type SearchIndexInfo struct {
+	Name     string
+	Prefixes []string
+	Fields   []SearchField
+	NumDocs  int
+}
+
+type keySet map[string]struct{}
+
+type numericEntry struct {
+	value float64
+	key   string
+}
+
+// searchIndex is an inverted index over hashes whose key starts with one of
+// prefixes. It is maintained by Store.updateIndexes whenever such a key changes.
+type searchIndex struct {
+	name     string
+	prefixes []string
+	fields   []SearchField
+	docs     keySet
+	terms    map[string]map[string]keySet // TEXT field -> term -> keys
+	tags     map[string]map[string]keySet // TAG field -> tag -> keys
+	numbers  map[string][]numericEntry    // NUMERIC field -> entries sorted by value, then key
+}
+
+func newSearchIndex(name string, prefixes []string, fields []SearchField) *searchIndex {
+	idx := &searchIndex{
+		name:     name,
+		prefixes: prefixes,
+		fields:   fields,
+		docs:     keySet{},
+		terms:    map[string]map[string]keySet{},
+		tags:     map[string]map[string]keySet{},
+		numbers:  map[string][]numericEntry{},
+	}
+	for _, f := range fields {
+		switch f.Type {
+		case searchText:
+			idx.terms[f.Name] = map[string]keySet{}
+		case searchTag:
+			idx.tags[f.Name] = map[string]keySet{}
+		}
+	}
+	return idx
+}
+
+func (idx *searchIndex) field(name string) (SearchField, bool) {
+	for _, f := range idx.fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return SearchField{}, false
+}
+
+func (idx *searchIndex) covers(key string) bool {
+	if len(idx.prefixes) == 0 {
+		return true
+	}
+	for _, p := range idx.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenize splits text into lower-case alphanumeric terms.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func splitTags(value, sep string) []string {
+	var tags []string
+	for _, t := range strings.Split(value, sep) {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+func addToSet(m map[string]keySet, term, key string) {
+	set, ok := m[term]
+	if !ok {
+		set = keySet{}
+		m[term] = set
+	}
+	set[key] = struct{}{}
+}
+
+func removeFromSet(m map[string]keySet, term, key string) {
+	if set, ok := m[term]; ok {
+		delete(set, key)
+		if len(set) == 0 {
+			delete(m, term)
+		}
+	}
+}
+
+// searchNumber returns the position of (n, key) in entries, or where it
+// would be inserted.
+func searchNumber(entries []numericEntry, n float64, key string) int {
+	return sort.Search(len(entries), func(i int) bool {
+		e := entries[i]
+		return e.value > n || e.value == n && e.key >= key
+	})
+}
+
+// addField indexes value v of field f under key.
+func (idx *searchIndex) addField(key string, f SearchField, v string) {
+	switch f.Type {
+	case searchText:
+		for _, term := range tokenize(v) {
+			addToSet(idx.terms[f.Name], term, key)
+		}
+	case searchTag:
+		for _, tag := range splitTags(v, f.Separator) {
+			addToSet(idx.tags[f.Name], tag, key)
+		}
+	case searchNumeric:
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(n) {
+			return
+		}
+		entries := idx.numbers[f.Name]
+		i := searchNumber(entries, n, key)
+		entries = append(entries, numericEntry{})
+		copy(entries[i+1:], entries[i:])
+		entries[i] = numericEntry{value: n, key: key}
+		idx.numbers[f.Name] = entries
+	}
+}
+
+// removeField drops the entries addField made for value v of field f.
+func (idx *searchIndex) removeField(key string, f SearchField, v string) {
+	switch f.Type {
+	case searchText:
+		for _, term := range tokenize(v) {
+			removeFromSet(idx.terms[f.Name], term, key)
+		}
+	case searchTag:
+		for _, tag := range splitTags(v, f.Separator) {
+			removeFromSet(idx.tags[f.Name], tag, key)
+		}
+	case searchNumeric:
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(n) {
+			return
+		}
+		entries := idx.numbers[f.Name]
+		if i := searchNumber(entries, n, key); i < len(entries) && entries[i].key == key {
+			idx.numbers[f.Name] = append(entries[:i], entries[i+1:]...)
+		}
+	}
+}
+
+// update re-indexes key, whose indexed fields were old and now are hash (nil
+// once key is no longer a hash). Only fields whose value changed are touched.
+func (idx *searchIndex) update(key string, old, hash map[string]string) {
+	if _, ok := idx.docs[key]; !ok {
+		old = nil // not indexed here yet, e.g. by a new FT.CREATE
+	}
+	if hash == nil {
+		delete(idx.docs, key)
+	} else {
+		idx.docs[key] = struct{}{}
+	}
+	for _, f := range idx.fields {
+		was, hadOld := old[f.Name]
+		is, hasNew := hash[f.Name]
+		if hadOld == hasNew && was == is {
+			continue
+		}
+		if hadOld {
+			idx.removeField(key, f, was)
+		}
+		if hasNew {
+			idx.addField(key, f, is)
+		}
+	}
+}
+
+// updateIndexes re-indexes key in every index covering it. The previous
+// values of the indexed fields are kept in indexedHashes so changed ones can
+// be found and their stale entries removed. Callers must hold s.mu.
+func (s *Store) updateIndexes(key string) {
+	if len(s.indexes) == 0 {
+		return
+	}
+	var hash map[string]string
+	if val, ok := s.data[key]; ok && val.Type == HashType {
+		hash = val.Hash
+	}
+	old := s.indexedHashes[key]
+	covered := false
+	for _, idx := range s.indexes {
+		if idx.covers(key) {
+			idx.update(key, old, hash)
+			covered = true
+		}
+	}
+	if !covered {
+		return
+	}
+	if hash == nil {
+		delete(s.indexedHashes, key)
+		return
+	}
+	if old == nil {
+		old = map[string]string{}
+		s.indexedHashes[key] = old
+	}
+	for _, idx := range s.indexes {
+		if !idx.covers(key) {
+			continue
+		}
+		for _, f := range idx.fields {
+			if v, ok := hash[f.Name]; ok {
+				old[f.Name] = v
+			} else {
+				delete(old, f.Name)
+			}
+		}
+	}
+}
+
+// FTCreate declares an index over hashes with the given key prefixes and
+// indexes the matching keys that already exist.
+func (s *Store) FTCreate(name string, prefixes []string, fields []SearchField) error {
+	if len(fields) == 0 {
+		return errors.New("no fields in schema")
+	}
+	seen := map[string]bool{}
+	for i, f := range fields {
+		if seen[f.Name] {
+			return errors.New("Duplicate field in schema - " + f.Name)
+		}
+		seen[f.Name] = true
+		if f.Type == searchTag && f.Separator == "" {
+			fields[i].Separator = ","
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.indexes[name]; ok {
+		return errors.New("Index already exists")
+	}
+	idx := newSearchIndex(name, prefixes, fields)
+	s.indexes[name] = idx
+	for key := range s.data {
+		if idx.covers(key) {
+			s.updateIndexes(key)
+		}
+	}
+	return nil
+}
+
+// FTDropIndex removes an index; with deleteDocs the indexed keys are deleted too.
+func (s *Store) FTDropIndex(name string, deleteDocs bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx, ok := s.indexes[name]
+	if !ok {
+		return errors.New("Unknown Index name")
+	}
+	delete(s.indexes, name)
+	if deleteDocs {
+		for key := range idx.docs {
+			s.deleteKey(key)
+		}
+	}
+	s.pruneIndexedHashes()
+	return nil
+}
+
+// pruneIndexedHashes forgets snapshots of keys no index covers any more.
+func (s *Store) pruneIndexedHashes() {
+	for key := range s.indexedHashes {
+		covered := false
+		for _, idx := range s.indexes {
+			if idx.covers(key) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			delete(s.indexedHashes, key)
+		}
+	}
+}
+
+// FTList returns the names of all indexes.
+func (s *Store) FTList() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.indexes))
+	for name := range s.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FTInfo describes an index.
+func (s *Store) FTInfo(name string) (SearchIndexInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	idx, ok := s.indexes[name]
+	if !ok {
+		return SearchIndexInfo{}, errors.New("Unknown Index name")
+	}
+	return SearchIndexInfo{Name: idx.name, Prefixes: idx.prefixes, Fields: idx.fields, NumDocs: len(idx.docs)}, nil
+}
+
+// FTSearch runs a query against an index and returns the total number of
+// matches plus the requested page of documents.
+func (s *Store) FTSearch(name string, q SearchQuery) (int, []SearchDoc, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	idx, ok := s.indexes[name]
+	if !ok {
+		return 0, nil, errors.New("Unknown Index name")
+	}
+	node, err := parseSearchQuery(q.Query)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := node.check(idx); err != nil {
+		return 0, nil, err
+	}
+	hits := node.eval(idx)
+	keys := make([]string, 0, len(hits))
+	for k := range hits {
+		// Expired keys stay indexed until they are deleted. The read lock
+		// keeps the live ones in s.data until we return.
+		if _, ok := s.lookup(k); ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if q.SortBy != "" {
+		f, ok := idx.field(q.SortBy)
+		if !ok {
+			return 0, nil, errors.New("Property `" + q.SortBy + "` not loaded nor in schema")
+		}
+		s.sortSearchHits(keys, f, q.Desc)
+	}
+
+	total := len(keys)
+	start := q.Offset
+	if start > total {
+		start = total
+	}
+	end := start + q.Limit
+	if end > total {
+		end = total
+	}
+	docs := make([]SearchDoc, 0, end-start)
+	for _, key := range keys[start:end] {
+		doc := SearchDoc{Key: key}
+		if !q.NoContent {
+			hash := s.data[key].Hash
+			names := q.Return
+			if len(names) == 0 {
+				names = make([]string, 0, len(hash))
+				for f := range hash {
+					names = append(names, f)
+				}
+				sort.Strings(names)
+			}
+			for _, f := range names {
+				if v, ok := hash[f]; ok {
+					doc.Fields = append(doc.Fields, f, v)
+				}
+			}
+		}
+		docs = append(docs, doc)
+	}
+	return total, docs, nil
+}
+
+// sortSearchHits orders keys by a field. Numeric fields compare as numbers;
+// keys missing the field sort last either way.
+func (s *Store) sortSearchHits(keys []string, f SearchField, desc bool) {
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, aok := s.data[keys[i]].Hash[f.Name]
+		b, bok := s.data[keys[j]].Hash[f.Name]
+		if !aok || !bok {
+			return aok && !bok
+		}
+		if f.Type == searchNumeric {
+			x, errA := strconv.ParseFloat(a, 64)
+			y, errB := strconv.ParseFloat(b, 64)
+			if errA == nil && errB == nil {
+				if desc {
+					return x > y
+				}
+				return x < y
+			}
+		}
+		if desc {
+			return strings.ToLower(a) > strings.ToLower(b)
+		}
+		return strings.ToLower(a) < strings.ToLower(b)
+	})
+}
+
+// ---------- Query language ----------
+//
+// The supported subset of the RediSearch syntax:
+//
+//	hello world          documents containing both terms in any TEXT field
+//	hello | world        either term
+//	-hello               documents without the term
+//	hel*                 prefix match
+//	@title:hello         term in one field; @title:(a|b) for alternatives
+//	@tags:{red | blue}   TAG match
+//	@price:[10 (20]      NUMERIC range, "(" is exclusive, -inf/+inf allowed
+//	*                    every document
+
+type searchNode interface {
+	eval(idx *searchIndex) keySet
+	check(idx *searchIndex) error
+}
+
+type allNode struct{}
+
+type termNode struct {
+	field  string // empty means every TEXT field
+	term   string
+	prefix bool
+}
+
+type tagNode struct {
+	field string
+	tags  []string
+}
+
+type numericNode struct {
+	field            string
+	min, max         float64
+	minExcl, maxExcl bool
+}
+
+type andNode struct{ children []searchNode }
+type orNode struct{ children []searchNode }
+type notNode struct{ child searchNode }
+
+func (allNode) eval(idx *searchIndex) keySet {
+	out := make(keySet, len(idx.docs))
+	for k := range idx.docs {
+		out[k] = struct{}{}
+	}
+	return out
+}
+
+func (n termNode) eval(idx *searchIndex) keySet {
+	out := keySet{}
+	for field, terms := range idx.terms {
+		if n.field != "" && field != n.field {
+			continue
+		}
+		if !n.prefix {
+			for k := range terms[n.term] {
+				out[k] = struct{}{}
+			}
+			continue
+		}
+		for term, keys := range terms {
+			if strings.HasPrefix(term, n.term) {
+				for k := range keys {
+					out[k] = struct{}{}
+				}
+			}
+		}
+	}
+	return out
+}
+
+func (n tagNode) eval(idx *searchIndex) keySet {
+	out := keySet{}
+	for _, tag := range n.tags {
+		for k := range idx.tags[n.field][tag] {
+			out[k] = struct{}{}
+		}
+	}
+	return out
+}
+
+func (n numericNode) eval(idx *searchIndex) keySet {
+	out := keySet{}
+	entries := idx.numbers[n.field]
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].value >= n.min })
+	for ; i < len(entries); i++ {
+		v := entries[i].value
+		if v > n.max || (n.maxExcl && v == n.max) {
+			break
+		}
+		if n.minExcl && v == n.min {
+			continue
+		}
+		out[entries[i].key] = struct{}{}
+	}
+	return out
+}
+
+func (n andNode) eval(idx *searchIndex) keySet {
+	out := n.children[0].eval(idx)
+	for _, c := range n.children[1:] {
+		next := c.eval(idx)
+		for k := range out {
+			if _, ok := next[k]; !ok {
+				delete(out, k)
+			}
+		}
+	}
+	return out
+}
+
+func (n orNode) eval(idx *searchIndex) keySet {
+	out := keySet{}
+	for _, c := range n.children {
+		for k := range c.eval(idx) {
+			out[k] = struct{}{}
+		}
+	}
+	return out
+}
+
+func (n notNode) eval(idx *searchIndex) keySet {
+	out := allNode{}.eval(idx)
+	for k := range n.child.eval(idx) {
+		delete(out, k)
+	}
+	return out
+}
+
+func (allNode) check(*searchIndex) error { return nil }
+
+func checkFieldType(idx *searchIndex, name, want string) error {
+	f, ok := idx.field(name)
+	if !ok {
+		return errors.New("Unknown field `" + name + "`")
+	}
+	if f.Type != want {
+		return errors.New("field `" + name + "` is not a " + want + " field")
+	}
+	return nil
+}
+
+func (n termNode) check(idx *searchIndex) error {
+	if n.field == "" {
+		return nil
+	}
+	return checkFieldType(idx, n.field, searchText)
+}
+
+func (n tagNode) check(idx *searchIndex) error { return checkFieldType(idx, n.field, searchTag) }
+
+func (n numericNode) check(idx *searchIndex) error {
+	return checkFieldType(idx, n.field, searchNumeric)
+}
+
+func (n andNode) check(idx *searchIndex) error { return checkAll(idx, n.children) }
+func (n orNode) check(idx *searchIndex) error  { return checkAll(idx, n.children) }
+func (n notNode) check(idx *searchIndex) error { return n.child.check(idx) }
+
+func checkAll(idx *searchIndex, nodes []searchNode) error {
+	for _, c := range nodes {
+		if err := c.check(idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type queryParser struct {
+	s   string
+	pos int
+}
+
+func parseSearchQuery(q string) (searchNode, error) {
+	p := &queryParser{s: q}
+	node, err := p.parseUnion()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return nil, errors.New("Syntax error at offset " + strconv.Itoa(p.pos) + " near " + p.s[p.pos:])
+	}
+	return node, nil
+}
+
+func (p *queryParser) skipSpace() {
+	for p.pos < len(p.s) && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *queryParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *queryParser) parseUnion() (searchNode, error) {
+	first, err := p.parseIntersect()
+	if err != nil {
+		return nil, err
+	}
+	children := []searchNode{first}
+	for p.peek() == '|' {
+		p.pos++
+		next, err := p.parseIntersect()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, next)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return orNode{children}, nil
+}
+
+func (p *queryParser) parseIntersect() (searchNode, error) {
+	var children []searchNode
+	for {
+		c := p.peek()
+		if c == 0 || c == '|' || c == ')' {
+			break
+		}
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+	switch len(children) {
+	case 0:
+		return nil, errors.New("Syntax error: empty query")
+	case 1:
+		return children[0], nil
+	}
+	return andNode{children}, nil
+}
+
+func (p *queryParser) parseUnary() (searchNode, error) {
+	if p.peek() == '-' {
+		p.pos++
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{child}, nil
+	}
+	return p.parseAtom()
+}
+
+func (p *queryParser) parseAtom() (searchNode, error) {
+	switch p.peek() {
+	case '(':
+		p.pos++
+		node, err := p.parseUnion()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, errors.New("Syntax error: missing ')'")
+		}
+		p.pos++
+		return node, nil
+	case '@':
+		return p.parseField()
+	case '*':
+		p.pos++
+		return allNode{}, nil
+	case '"':
+		p.pos++
+		end := strings.IndexByte(p.s[p.pos:], '"')
+		if end < 0 {
+			return nil, errors.New("Syntax error: unterminated phrase")
+		}
+		phrase := p.s[p.pos : p.pos+end]
+		p.pos += end + 1
+		return termsNode("", phrase)
+	}
+	word := p.readWord()
+	if word == "" {
+		return nil, errors.New("Syntax error at offset " + strconv.Itoa(p.pos))
+	}
+	return termsNode("", word)
+}
+
+// termsNode tokenizes text like the indexer and intersects the resulting terms.
+// A trailing '*' makes the last term a prefix match.
+func termsNode(field, text string) (searchNode, error) {
+	prefix := strings.HasSuffix(text, "*")
+	terms := tokenize(strings.TrimSuffix(text, "*"))
+	if len(terms) == 0 {
+		return nil, errors.New("Syntax error: empty term")
+	}
+	nodes := make([]searchNode, len(terms))
+	for i, t := range terms {
+		nodes[i] = termNode{field: field, term: t, prefix: prefix && i == len(terms)-1}
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return andNode{nodes}, nil
+}
+
+// readWord reads an unquoted term, honouring backslash escapes.
+func (p *queryParser) readWord() string {
+	var sb strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if c == '\\' && p.pos+1 < len(p.s) {
+			sb.WriteByte(p.s[p.pos+1])
+			p.pos += 2
+			continue
+		}
+		if unicode.IsSpace(rune(c)) || strings.IndexByte("()|{}[]@\"", c) >= 0 {
+			break
+		}
+		sb.WriteByte(c)
+		p.pos++
+	}
+	return sb.String()
+}
+
+func (p *queryParser) parseField() (searchNode, error) {
+	p.pos++ // '@'
+	colon := strings.IndexByte(p.s[p.pos:], ':')
+	if colon <= 0 {
+		return nil, errors.New("Syntax error: expected @field:")
+	}
+	field := p.s[p.pos : p.pos+colon]
+	p.pos += colon + 1
+	switch p.peek() {
+	case '{':
+		p.pos++
+		end := p.closing('}')
+		if end < 0 {
+			return nil, errors.New("Syntax error: missing '}'")
+		}
+		body := p.s[p.pos:end]
+		p.pos = end + 1
+		var tags []string
+		for _, t := range strings.Split(body, "|") {
+			t = strings.ToLower(strings.TrimSpace(unescapeQuery(t)))
+			if t != "" {
+				tags = append(tags, t)
+			}
+		}
+		if len(tags) == 0 {
+			return nil, errors.New("Syntax error: empty tag list")
+		}
+		return tagNode{field: field, tags: tags}, nil
+	case '[':
+		p.pos++
+		end := strings.IndexByte(p.s[p.pos:], ']')
+		if end < 0 {
+			return nil, errors.New("Syntax error: missing ']'")
+		}
+		bounds := strings.Fields(p.s[p.pos : p.pos+end])
+		p.pos += end + 1
+		if len(bounds) != 2 {
+			return nil, errors.New("Syntax error: numeric range needs min and max")
+		}
+		n := numericNode{field: field}
+		var err error
+		if n.min, n.minExcl, err = parseRangeBound(bounds[0]); err != nil {
+			return nil, err
+		}
+		if n.max, n.maxExcl, err = parseRangeBound(bounds[1]); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case '(':
+		p.pos++
+		node, err := p.parseUnion()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, errors.New("Syntax error: missing ')'")
+		}
+		p.pos++
+		return scopeToField(node, field), nil
+	}
+	word := p.readWord()
+	if word == "" {
+		return nil, errors.New("Syntax error: expected a value for @" + field)
+	}
+	return termsNode(field, word)
+}
+
+// closing finds the next unescaped c.
+func (p *queryParser) closing(c byte) int {
+	for i := p.pos; i < len(p.s); i++ {
+		if p.s[i] == '\\' {
+			i++
+			continue
+		}
+		if p.s[i] == c {
+			return i
+		}
+	}
+	return -1
+}
+
+func unescapeQuery(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// scopeToField restricts every bare term inside node to field.
+func scopeToField(node searchNode, field string) searchNode {
+	switch n := node.(type) {
+	case termNode:
+		if n.field == "" {
+			n.field = field
+		}
+		return n
+	case andNode:
+		for i, c := range n.children {
+			n.children[i] = scopeToField(c, field)
+		}
+		return n
+	case orNode:
+		for i, c := range n.children {
+			n.children[i] = scopeToField(c, field)
+		}
+		return n
+	case notNode:
+		return notNode{scopeToField(n.child, field)}
+	}
+	return node
+}
+
+func parseRangeBound(s string) (float64, bool, error) {
+	excl := strings.HasPrefix(s, "(")
+	s = strings.TrimPrefix(s, "(")
+	switch strings.ToLower(s) {
+	case "-inf":
+		return math.Inf(-1), excl, nil
+	case "inf", "+inf":
+		return math.Inf(1), excl, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false, errors.New("Syntax error: bad numeric range bound " + s)
+	}
+	return v, excl, nil
+}
@@ -1,52 +1,53 @@
 package main
 
-import (
-	"errors"
-)
-
 // SAdd adds one or more members to a set.
 // Returns the number of new elements actually added (not previously present).
-func (s *Store) SAdd(key string, members ...string) int {
+func (s *Store) SAdd(key string, members ...string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	v, _ := s.getOrInitSet(key)
+	v, err := s.getOrInitSet(key)
+	if err != nil {
+		return 0, err
+	}
 	added := 0
 	for _, m := range members {
 		if _, exists := v.Set[m]; !exists {
 			v.Set[m] = struct{}{}
+			v.members.add(m)
 			added++
 		}
 	}
-	return added
+	return added, nil
 }
 
 // SRem removes one or more members from the set.
 // Returns the number of members actually removed.
-func (s *Store) SRem(key string, members ...string) int {
+func (s *Store) SRem(key string, members ...string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	val, ok := s.data[key]
-	if !ok || val.Type != SetType {
-		return 0
+	val, err := s.typed(key, SetType)
+	if val == nil {
+		return 0, err
 	}
 	removed := 0
 	for _, m := range members {
 		if _, exists := val.Set[m]; exists {
 			delete(val.Set, m)
+			val.members.remove(m)
 			removed++
 		}
 	}
-	return removed
+	return removed, nil
 }
 
-// SMembers returns a slice of all members in the set.
-// If key doesn't exist or isn't a set, returns an error.
+// SMembers returns a slice of all members in the set, or none if the key
+// doesn't exist.
 func (s *Store) SMembers(key string) ([]string, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	val, ok := s.data[key]
-	if !ok || val.Type != SetType {
-		return nil, errors.New("no such key or not a set")
+	val, err := s.typed(key, SetType)
+	if val == nil {
+		return nil, err
 	}
 	members := make([]string, 0, len(val.Set))
 	for m := range val.Set {
@@ -55,13 +56,13 @@ func (s *Store) SMembers(key string) ([]string, error) {
 	return members, nil
 }
 
-// getOrInitSet retrieves a set for a key, or creates one if missing/wrong type.
-func (s *Store) getOrInitSet(key string) (*Value, bool) {
-	val, ok := s.data[key]
-	if ok && val.Type == SetType {
-		return val, true
+// getOrInitSet retrieves a set for a key, or creates one if missing.
+func (s *Store) getOrInitSet(key string) (*Value, error) {
+	val, err := s.typed(key, SetType)
+	if val != nil || err != nil {
+		return val, err
 	}
 	newSet := &Value{Type: SetType, Set: make(map[string]struct{})}
-	s.data[key] = newSet
-	return newSet, false
+	s.setValue(key, newSet)
+	return newSet, nil
 }
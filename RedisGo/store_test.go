@@ -1,6 +1,30 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -8,7 +32,7 @@ import (
 func TestSetAndGet(t *testing.T) {
 	store := NewStore()
 	store.Set("foo", "bar")
-	val, ok := store.Get("foo")
+	val, ok, _ := store.Get("foo")
 	if !ok || val != "bar" {
 		t.Fatalf("expected to get bar, got %v (ok=%v)", val, ok)
 	}
@@ -21,21 +45,22 @@ func TestDel(t *testing.T) {
 	if !deleted {
 		t.Fatal("expected to delete key foo")
 	}
-	_, ok := store.Get("foo")
+	_, ok, _ := store.Get("foo")
 	if ok {
 		t.Fatal("expected key foo to be deleted")
 	}
 }
 
 func TestExpire(t *testing.T) {
-	store := NewStore()
+	clock := NewFakeClock(time.Now())
+	store := NewStoreWithClock(clock)
 	store.Set("foo", "bar")
 	ok := store.Expire("foo", 1)
 	if !ok {
 		t.Fatal("expected to set expiry")
 	}
-	time.Sleep(2 * time.Second)
-	val, has := store.Get("foo")
+	clock.Advance(2 * time.Second)
+	val, has, _ := store.Get("foo")
 	if has {
 		t.Fatalf("expected foo to expire, got value: %v", val)
 	}
@@ -45,7 +70,7 @@ func TestKeys(t *testing.T) {
 	store := NewStore()
 	store.Set("a", "1")
 	store.Set("b", "2")
-	keys := store.Keys()
+	keys := store.Keys("*")
 	if len(keys) != 2 {
 		t.Fatalf("expected 2 keys, got %d", len(keys))
 	}
@@ -56,6 +81,42 @@ func TestKeys(t *testing.T) {
 	}
 }
 
+func TestKeysPattern(t *testing.T) {
+	store := NewStore()
+	for _, k := range []string{"user:1", "user:2", "user:10", "users", "admin:1", "h*llo", "hello"} {
+		store.Set(k, "v")
+	}
+	cases := map[string]string{
+		"user:?":    "user:1,user:2",
+		"user:*":    "user:1,user:10,user:2",
+		"*:1":       "admin:1,user:1",
+		"user[s:]*": "user:1,user:10,user:2,users",
+		"user:[^1]": "user:2",
+		"[a-b]*":    "admin:1",
+		"h\\*llo":   "h*llo",
+		"hello":     "hello",
+		"nope*":     "",
+	}
+	for pattern, want := range cases {
+		keys := store.Keys(pattern)
+		sort.Strings(keys)
+		if got := strings.Join(keys, ","); got != want {
+			t.Fatalf("Keys(%q): expected %q, got %q", pattern, want, got)
+		}
+	}
+	store.Del("user:10")
+	if keys := store.Keys("user:1*"); len(keys) != 1 {
+		t.Fatalf("expected deleted key to leave the prefix index, got %v", keys)
+	}
+
+	if !globMatch("*a*a*a*a*a*a*a*b", strings.Repeat("a", 64)+"b") || globMatch("*a*a*a*a*a*a*a*b", strings.Repeat("a", 64)) {
+		t.Fatal("unexpected result for many-star pattern")
+	}
+	if !globMatch("a[\\]]b", "a]b") || !globMatch("x\\", "x\\") {
+		t.Fatal("expected escapes to match literally")
+	}
+}
+
 func TestDumpAll(t *testing.T) {
 	store := NewStore()
 	store.Set("x", "alpha")
@@ -70,22 +131,25 @@ func TestDumpAll(t *testing.T) {
 }
 
 func TestExpireDoesNotAffectOtherKeys(t *testing.T) {
-	store := NewStore()
+	clock := NewFakeClock(time.Now())
+	store := NewStoreWithClock(clock)
 	store.Set("foo", "bar")
 	store.Set("baz", "qux")
 	store.Expire("foo", 1)
-	time.Sleep(2 * time.Second)
-	_, ok := store.Get("foo")
+	clock.Advance(2 * time.Second)
+	_, ok, _ := store.Get("foo")
 	if ok {
 		t.Fatal("expected foo to be expired")
 	}
-	val, ok := store.Get("baz")
+	val, ok, _ := store.Get("baz")
 	if !ok || val != "qux" {
 		t.Fatal("expected baz to still exist")
 	}
 }
+
 func TestTTL(t *testing.T) {
-	store := NewStore()
+	clock := NewFakeClock(time.Now())
+	store := NewStoreWithClock(clock)
 	if ttl := store.TTL("foo"); ttl != -2 {
 		t.Fatalf("expected -2 for non-existent key, got %d", ttl)
 	}
@@ -98,7 +162,7 @@ func TestTTL(t *testing.T) {
 	if ttl <= 0 {
 		t.Fatalf("expected >0 for key with expiry, got %d", ttl)
 	}
-	time.Sleep(2 * time.Second)
+	clock.Advance(2 * time.Second)
 	if ttl := store.TTL("foo"); ttl != -2 {
 		t.Fatalf("expected -2 for expired key, got %d", ttl)
 	}
@@ -145,34 +209,33 @@ func TestListOps(t *testing.T) {
 	store := NewStore()
 
 	// Test LPUSH + LLEN
-	if n := store.LPush("mylist", "a"); n != 1 {
+	if n, _ := store.LPush("mylist", "a"); n != 1 {
 		t.Fatalf("expected 1, got %d", n)
 	}
-	if n := store.LPush("mylist", "b", "c"); n != 3 {
+	if n, _ := store.LPush("mylist", "b", "c"); n != 3 {
 		t.Fatalf("expected 3 after multi-LPUSH, got %d", n)
 	}
-	if l := store.LLen("mylist"); l != 3 {
+	if l, _ := store.LLen("mylist"); l != 3 {
 		t.Fatalf("expected 3, got %d", l)
 	}
 
 	// Test RPOP order
-	v, err := store.RPop("mylist")
-	if err != nil || v != "a" {
+	v, ok, err := store.RPop("mylist")
+	if err != nil || !ok || v != "a" {
 		t.Fatalf("expected 'a', got '%s' (err=%v)", v, err)
 	}
-	v, err = store.RPop("mylist")
-	if err != nil || v != "b" {
+	v, ok, err = store.RPop("mylist")
+	if err != nil || !ok || v != "b" {
 		t.Fatalf("expected 'b', got '%s' (err=%v)", v, err)
 	}
-	v, err = store.RPop("mylist")
-	if err != nil || v != "c" {
+	v, ok, err = store.RPop("mylist")
+	if err != nil || !ok || v != "c" {
 		t.Fatalf("expected 'c', got '%s' (err=%v)", v, err)
 	}
 
 	// Empty pop
-	_, err = store.RPop("mylist")
-	if err == nil {
-		t.Fatal("expected error on empty list")
+	if _, ok, err = store.RPop("mylist"); ok || err != nil {
+		t.Fatalf("expected nothing to pop from an empty list, got ok=%v err=%v", ok, err)
 	}
 }
 
@@ -180,17 +243,17 @@ func TestSetOps(t *testing.T) {
 	store := NewStore()
 
 	// SAdd single member
-	added := store.SAdd("myset", "a")
+	added, _ := store.SAdd("myset", "a")
 	if added != 1 {
 		t.Fatalf("expected 1 added, got %d", added)
 	}
 	// SAdd duplicate member does not add again
-	added = store.SAdd("myset", "a")
+	added, _ = store.SAdd("myset", "a")
 	if added != 0 {
 		t.Fatalf("expected 0 added (duplicate), got %d", added)
 	}
 	// SAdd multiple members, including a duplicate
-	added = store.SAdd("myset", "b", "c", "a")
+	added, _ = store.SAdd("myset", "b", "c", "a")
 	if added != 2 {
 		t.Fatalf("expected 2 added, got %d", added)
 	}
@@ -211,7 +274,7 @@ func TestSetOps(t *testing.T) {
 	}
 
 	// SRem removes members
-	removed := store.SRem("myset", "a", "d") // 'a' exists, 'd' does not
+	removed, _ := store.SRem("myset", "a", "d") // 'a' exists, 'd' does not
 	if removed != 1 {
 		t.Fatalf("expected 1 removed, got %d", removed)
 	}
@@ -221,21 +284,20 @@ func TestSetOps(t *testing.T) {
 		t.Fatalf("expected 2 members after SRem, got %d: %v", len(members), members)
 	}
 
-	// SAdd on key with wrong type creates a new set
+	// SAdd on key with wrong type fails and keeps the value
 	store.Set("notaset", "hello")
-	added = store.SAdd("notaset", "x")
-	if added != 1 {
-		t.Fatalf("expected 1 added for new set, got %d", added)
+	if _, err := store.SAdd("notaset", "x"); err != ErrWrongType {
+		t.Fatalf("expected WRONGTYPE adding to a string, got %v", err)
 	}
-	val, ok := store.Get("notaset")
-	if ok && val == "hello" {
-		t.Fatalf("SAdd should overwrite previous string value")
+	val, ok, _ := store.Get("notaset")
+	if !ok || val != "hello" {
+		t.Fatalf("SAdd should not overwrite the string value")
 	}
 
-	// SMembers error on non-existing set
-	_, err = store.SMembers("doesnotexist")
-	if err == nil {
-		t.Fatalf("expected error on non-existent set key")
+	// SMembers on non-existing set is empty
+	members, err = store.SMembers("doesnotexist")
+	if err != nil || len(members) != 0 {
+		t.Fatalf("expected no members for a non-existent key, got %v (err=%v)", members, err)
 	}
 }
 
@@ -243,22 +305,22 @@ func TestHashOps(t *testing.T) {
 	store := NewStore()
 
 	// HSET new field
-	n := store.HSet("h", "foo", "bar")
+	n, _ := store.HSet("h", "foo", "bar")
 	if n != 1 {
 		t.Fatalf("expected 1 for new field, got %d", n)
 	}
 	// HSET existing field (overwrite)
-	n = store.HSet("h", "foo", "baz")
+	n, _ = store.HSet("h", "foo", "baz")
 	if n != 0 {
 		t.Fatalf("expected 0 for overwrite, got %d", n)
 	}
 	// HGET
-	v, ok := store.HGet("h", "foo")
+	v, ok, _ := store.HGet("h", "foo")
 	if !ok || v != "baz" {
 		t.Fatalf("expected baz, got %q", v)
 	}
 	// HDEL
-	del := store.HDel("h", "foo")
+	del, _ := store.HDel("h", "foo")
 	if del != 1 {
 		t.Fatalf("expected 1 deleted, got %d", del)
 	}
@@ -275,18 +337,18 @@ func TestZSetOps(t *testing.T) {
 	store := NewStore()
 
 	// ZAdd: Add new members
-	added := store.ZAdd("myzset", 0.5, "a")
+	added, _ := store.ZAdd("myzset", 0.5, "a")
 	if added != 1 {
 		t.Fatalf("expected 1 (new member), got %d", added)
 	}
-	added = store.ZAdd("myzset", 1.2, "b")
-	added2 := store.ZAdd("myzset", 2.1, "c")
+	added, _ = store.ZAdd("myzset", 1.2, "b")
+	added2, _ := store.ZAdd("myzset", 2.1, "c")
 	if added != 1 || added2 != 1 {
 		t.Fatalf("expected 1 for new members, got %d %d", added, added2)
 	}
 
 	// ZAdd: Update existing member's score
-	added = store.ZAdd("myzset", 3.3, "a")
+	added, _ = store.ZAdd("myzset", 3.3, "a")
 	if added != 0 {
 		t.Fatalf("expected 0 (existing member updated), got %d", added)
 	}
@@ -319,7 +381,7 @@ func TestZSetOps(t *testing.T) {
 	}
 
 	// ZRem: Remove member
-	removed := store.ZRem("myzset", "b")
+	removed, _ := store.ZRem("myzset", "b")
 	if removed != 1 {
 		t.Fatalf("expected 1 removed, got %d", removed)
 	}
@@ -335,15 +397,15 @@ func TestZSetOps(t *testing.T) {
 	}
 
 	// ZRem: Remove non-existent
-	removed = store.ZRem("myzset", "x")
+	removed, _ = store.ZRem("myzset", "x")
 	if removed != 0 {
 		t.Fatalf("expected 0 removed for non-existent, got %d", removed)
 	}
 
 	// ZRange: Empty/non-existent key
 	members, err = store.ZRange("nozset", 0, -1)
-	if err == nil {
-		t.Fatal("expected error for non-existent zset")
+	if err != nil || len(members) != 0 {
+		t.Fatalf("expected no members for non-existent zset, got %v (err=%v)", members, err)
 	}
 	members, err = store.ZRange("myzset", 5, 10)
 	if err != nil {
@@ -353,3 +415,2207 @@ func TestZSetOps(t *testing.T) {
 		t.Fatalf("expected 0 members for out-of-range, got %d", len(members))
 	}
 }
+
+func TestJSONOps(t *testing.T) {
+	store := NewStore()
+
+	// JSON.SET must start at the root for a new key
+	if _, err := store.JSONSet("doc", "$.a", "1", false, false); err == nil {
+		t.Fatal("expected error creating a new key below the root")
+	}
+	ok, err := store.JSONSet("doc", "$", `{"name":"redis","n":1,"tags":["a"],"nested":{"n":2.5}}`, false, false)
+	if err != nil || !ok {
+		t.Fatalf("JSONSet root failed: ok=%v err=%v", ok, err)
+	}
+
+	// Legacy path returns a single value, JSONPath returns all matches
+	got, _, err := store.JSONGet("doc", ".name")
+	if err != nil || got != `"redis"` {
+		t.Fatalf("expected \"redis\", got %s (err=%v)", got, err)
+	}
+	got, _, _ = store.JSONGet("doc", "$..n")
+	if got != `[1,2.5]` {
+		t.Fatalf("expected [1,2.5] for recursive path, got %s", got)
+	}
+
+	// Setting a missing key under an existing object creates it; NX/XX are honoured
+	if ok, _ := store.JSONSet("doc", "$.extra", `true`, false, true); ok {
+		t.Fatal("XX should not create a missing path")
+	}
+	if ok, _ := store.JSONSet("doc", "$.extra", `true`, true, false); !ok {
+		t.Fatal("NX should create a missing path")
+	}
+	if ok, _ := store.JSONSet("doc", "$.extra", `false`, true, false); ok {
+		t.Fatal("NX should not overwrite an existing path")
+	}
+
+	// NUMINCRBY keeps integers integral and reports nil for non-numbers
+	res, err := store.JSONNumIncrBy("doc", "$.n", "2")
+	if err != nil || marshalJSON(res) != `[3]` {
+		t.Fatalf("expected [3], got %v (err=%v)", res, err)
+	}
+	res, _ = store.JSONNumIncrBy("doc", "$.*", "1")
+	if marshalJSON(res) != `[null,4,null,null,null]` {
+		t.Fatalf("unexpected wildcard incr result: %s", marshalJSON(res))
+	}
+	if _, err := store.JSONNumIncrBy("doc", ".name", "1"); err == nil {
+		t.Fatal("expected error incrementing a string via legacy path")
+	}
+
+	// Array append / insert / pop
+	lens, err := store.JSONArrAppend("doc", ".tags", `"c"`)
+	if err != nil || *lens[0] != 2 {
+		t.Fatalf("expected length 2 after append, got %v (err=%v)", lens, err)
+	}
+	store.JSONArrInsert("doc", ".tags", 1, `"b"`)
+	got, _, _ = store.JSONGet("doc", ".tags")
+	if got != `["a","b","c"]` {
+		t.Fatalf("expected [\"a\",\"b\",\"c\"], got %s", got)
+	}
+	popped, err := store.JSONArrPop("doc", "$.tags", 0)
+	if err != nil || *popped[0] != `"a"` {
+		t.Fatalf("expected to pop \"a\", got %v (err=%v)", popped, err)
+	}
+
+	// Object keys are sorted
+	keys, _ := store.JSONObjKeys("doc", ".")
+	want := []string{"extra", "n", "name", "nested", "tags"}
+	if len(keys[0]) != len(want) {
+		t.Fatalf("expected keys %v, got %v", want, keys[0])
+	}
+	for i := range want {
+		if keys[0][i] != want[i] {
+			t.Fatalf("expected keys %v, got %v", want, keys[0])
+		}
+	}
+
+	// Delete a sub-path, then the whole document
+	if n, _ := store.JSONDel("doc", "$.nested"); n != 1 {
+		t.Fatalf("expected 1 deleted, got %d", n)
+	}
+	if n, _ := store.JSONDel("doc", "$"); n != 1 {
+		t.Fatalf("expected root delete to remove the key, got %d", n)
+	}
+	if _, ok, _ := store.JSONGet("doc"); ok {
+		t.Fatal("expected doc to be gone")
+	}
+
+	// JSON commands never clobber other types
+	store.Set("plain", "x")
+	if _, err := store.JSONSet("plain", "$", `{}`, false, false); err == nil {
+		t.Fatal("expected error setting JSON over a string key")
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	store := NewStore()
+	if err := store.BFReserve("bf", 0.01, 100, 2, false); err != nil {
+		t.Fatalf("BFReserve failed: %v", err)
+	}
+	if err := store.BFReserve("bf", 0.01, 100, 2, false); err == nil {
+		t.Fatal("expected error reserving an existing key")
+	}
+
+	// Adding well past the initial capacity should scale to more sub-filters
+	// without losing any inserted item.
+	items := make([]string, 1000)
+	for i := range items {
+		items[i] = "item" + strconv.Itoa(i)
+	}
+	store.BFAdd("bf", items...)
+	found, _ := store.BFExists("bf", items...)
+	for i, ok := range found {
+		if !ok {
+			t.Fatalf("expected %s to exist (no false negatives)", items[i])
+		}
+	}
+	info, _ := store.BFInfo("bf")
+	// A few adds may be reported as already present (false positives).
+	if info.Filters < 2 || info.Items < 950 || info.FillRatio <= 0 {
+		t.Fatalf("unexpected info after scaling: %+v", info)
+	}
+
+	// False positives should stay in the neighbourhood of the error rate.
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if ok, _ := store.BFExists("bf", "other"+strconv.Itoa(i)); ok[0] {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Fatalf("too many false positives: %d/10000", falsePositives)
+	}
+
+	// Non-scaling filters refuse items once full.
+	store.BFReserve("small", 0.01, 2, 2, true)
+	if _, err := store.BFAdd("small", "a", "b", "c"); err == nil {
+		t.Fatal("expected error adding to a full non-scaling filter")
+	}
+}
+
+func TestBloomFilterLimits(t *testing.T) {
+	store := NewStore()
+	if err := store.BFReserve("huge", 0.01, math.MaxUint64, 2, false); err == nil {
+		t.Fatal("expected error reserving a filter larger than the limit")
+	}
+	if err := store.BFReserve("huge", 1e-300, 1<<30, 2, false); err == nil {
+		t.Fatal("expected error reserving a filter with a tiny error rate")
+	}
+	if err := store.BFReserve("wide", 0.01, 100, bloomMaxExpansion+1, false); err == nil {
+		t.Fatal("expected error reserving a filter with too large an expansion")
+	}
+	if store.Exists("huge", "wide") != 0 {
+		t.Fatal("rejected filters should not be created")
+	}
+
+	// Scaling stops, with an error, once the next sub-filter would be too big.
+	if err := store.BFReserve("bf", 0.01, 1, bloomMaxExpansion, false); err != nil {
+		t.Fatalf("BFReserve failed: %v", err)
+	}
+	var err error
+	for i := 0; i < 100000 && err == nil; i++ {
+		_, err = store.BFAdd("bf", "item"+strconv.Itoa(i))
+	}
+	if err == nil {
+		t.Fatal("expected error once the filter can't scale further")
+	}
+	if info, _ := store.BFInfo("bf"); info.Filters != 2 {
+		t.Fatalf("expected 2 sub-filters, got %+v", info)
+	}
+}
+
+func TestCuckooFilter(t *testing.T) {
+	store := NewStore()
+	if err := store.CFReserve("cf", 64, 2, 20, 1); err != nil {
+		t.Fatalf("CFReserve failed: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		store.CFAdd("cf", "item"+strconv.Itoa(i), false)
+	}
+	info, _ := store.CFInfo("cf")
+	if info.Filters < 2 || info.Inserted != 500 {
+		t.Fatalf("expected the filter to grow, got %+v", info)
+	}
+	for i := 0; i < 500; i++ {
+		if found, _ := store.CFExists("cf", "item"+strconv.Itoa(i)); !found[0] {
+			t.Fatalf("expected item%d to exist", i)
+		}
+	}
+
+	// ADDNX skips items already present; deletion removes one occurrence.
+	if added, _ := store.CFAdd("cf", "item1", true); added {
+		t.Fatal("ADDNX should not add an existing item")
+	}
+	store.CFAdd("cf", "dup", false)
+	store.CFAdd("cf", "dup", false)
+	if n, _ := store.CFCount("cf", "dup"); n < 2 {
+		t.Fatalf("expected count >= 2, got %d", n)
+	}
+	if deleted, _ := store.CFDel("cf", "dup"); !deleted {
+		t.Fatal("expected CFDel to remove an occurrence")
+	}
+	store.CFDel("cf", "dup")
+	if found, _ := store.CFExists("cf", "dup"); found[0] {
+		t.Fatal("expected dup to be gone after deleting both occurrences")
+	}
+
+	// Filters never clobber other types.
+	store.Set("plain", "x")
+	if _, err := store.CFAdd("plain", "a", false); err == nil {
+		t.Fatal("expected error adding to a string key")
+	}
+}
+
+func TestCuckooFilterLimits(t *testing.T) {
+	store := NewStore()
+	for _, args := range []struct {
+		capacity                          uint64
+		bucketSize, iterations, expansion int
+	}{
+		{9223372036854775813, 2, 20, 1}, // capacity*bucketSize used to wrap to 0
+		{cuckooMaxSlots + 1, 1, 20, 1},
+		{1024, cuckooMaxBucketSize + 1, 20, 1},
+		{1024, 2, cuckooMaxIterations + 1, 1},
+		{1024, 2, 20, cuckooMaxExpansion + 1},
+	} {
+		if err := store.CFReserve("cf", args.capacity, args.bucketSize, args.iterations, args.expansion); err == nil {
+			t.Fatalf("expected error reserving %+v", args)
+		}
+	}
+	if _, err := store.CFAdd("cf", "a", false); err != nil {
+		t.Fatalf("CFAdd after rejected reserves failed: %v", err)
+	}
+
+	// A full table that can't grow any further reports it instead of
+	// counting the item.
+	cf := &CuckooFilter{BucketSize: 1, MaxIterations: 1, Expansion: cuckooMaxExpansion}
+	full := newCuckooLayer(cuckooMaxSlots/cuckooMaxExpansion*2, 1)
+	for i := range full.Slots {
+		full.Slots[i] = 1
+	}
+	cf.Filters = []*CuckooLayer{full}
+	if err := cf.Add("item"); err != errCuckooFull {
+		t.Fatalf("expected errCuckooFull, got %v", err)
+	}
+	if cf.Inserted != 0 || len(cf.Filters) != 1 {
+		t.Fatalf("a failed add should change nothing, got %+v", cf.Info())
+	}
+}
+
+func TestCountMinSketch(t *testing.T) {
+	store := NewStore()
+	if err := store.CMSInitByDim("a", 2000, 5); err != nil {
+		t.Fatalf("CMSInitByDim failed: %v", err)
+	}
+	store.CMSInitByProb("b", 0.001, 0.01)
+	if err := store.CMSInitByDim("a", 10, 2); err == nil {
+		t.Fatal("expected error re-initialising an existing key")
+	}
+
+	counts, err := store.CMSIncrBy("a", []string{"x", "y"}, []uint64{5, 3})
+	if err != nil || counts[0] < 5 || counts[1] < 3 {
+		t.Fatalf("unexpected INCRBY result %v (err=%v)", counts, err)
+	}
+	store.CMSIncrBy("a", []string{"x"}, []uint64{2})
+	got, _ := store.CMSQuery("a", "x", "y", "missing")
+	if got[0] != 7 || got[1] != 3 || got[2] != 0 {
+		t.Fatalf("expected [7 3 0], got %v", got)
+	}
+
+	// Merge requires identical dimensions and applies weights.
+	if err := store.CMSMerge("b", []string{"a"}, []uint64{1}); err == nil {
+		t.Fatal("expected error merging sketches with different dimensions")
+	}
+	store.CMSInitByDim("c", 2000, 5)
+	store.CMSIncrBy("c", []string{"x"}, []uint64{1})
+	if err := store.CMSMerge("c", []string{"a", "c"}, []uint64{2, 1}); err != nil {
+		t.Fatalf("CMSMerge failed: %v", err)
+	}
+	got, _ = store.CMSQuery("c", "x")
+	if got[0] != 15 {
+		t.Fatalf("expected weighted merge count 15, got %d", got[0])
+	}
+	if _, _, total, _ := store.CMSInfo("c"); total != 21 {
+		t.Fatalf("expected total count 21, got %d", total)
+	}
+
+	// Weighted counts that overflow are refused and leave dest unchanged,
+	// whether the product or the sum is too large.
+	if err := store.CMSMerge("c", []string{"a"}, []uint64{math.MaxUint64 - 1}); err == nil {
+		t.Fatal("expected an overflowing weight to be an error")
+	}
+	if err := store.CMSMerge("c", []string{"c", "c"}, []uint64{1, math.MaxUint64 / 15}); err == nil {
+		t.Fatal("expected an overflowing sum to be an error")
+	}
+	got, _ = store.CMSQuery("c", "x")
+	if _, _, total, _ := store.CMSInfo("c"); got[0] != 15 || total != 21 {
+		t.Fatalf("expected a failed merge to change nothing, got count %d, total %d", got[0], total)
+	}
+}
+
+func TestTopK(t *testing.T) {
+	store := NewStore()
+	if err := store.TopKReserve("tk", 3, 50, 5, 0.9); err != nil {
+		t.Fatalf("TopKReserve failed: %v", err)
+	}
+	// Heavy hitters with distinct frequencies plus a long tail of noise.
+	for i, item := range []string{"hot", "warm", "mild"} {
+		store.TopKIncrBy("tk", []string{item}, []uint64{uint64(300 - i*100)})
+	}
+	for i := 0; i < 200; i++ {
+		store.TopKIncrBy("tk", []string{"noise" + strconv.Itoa(i)}, []uint64{1})
+	}
+	list, err := store.TopKList("tk")
+	if err != nil || len(list) != 3 {
+		t.Fatalf("expected 3 items, got %v (err=%v)", list, err)
+	}
+	for i, want := range []string{"hot", "warm", "mild"} {
+		if list[i].Item != want {
+			t.Fatalf("expected %s at position %d, got %v", want, i, list)
+		}
+	}
+	found, _ := store.TopKQuery("tk", "hot", "noise1")
+	if !found[0] || found[1] {
+		t.Fatalf("expected hot in top-k and noise1 not, got %v", found)
+	}
+
+	// Pushing a new item above the minimum expels the weakest entry.
+	expelled, _ := store.TopKIncrBy("tk", []string{"rising"}, []uint64{250})
+	if expelled[0] == nil || *expelled[0] != "mild" {
+		t.Fatalf("expected mild to be expelled, got %v", expelled[0])
+	}
+}
+
+func TestSketchLimits(t *testing.T) {
+	store := NewStore()
+	if err := store.CMSInitByDim("cms", math.MaxInt, 2); err == nil {
+		t.Fatal("expected error initialising a sketch larger than the limit")
+	}
+	if err := store.CMSInitByProb("cms", 1e-300, 0.01); err == nil {
+		t.Fatal("expected error initialising a sketch with a tiny error rate")
+	}
+	if err := store.TopKReserve("topk", 10, 1<<20, 1<<20, 0.9); err == nil {
+		t.Fatal("expected error reserving a Top-K larger than the limit")
+	}
+
+	// Increments above the limit are rejected before touching the buckets.
+	store.TopKReserve("topk", 2, 8, 7, 0.9)
+	if _, err := store.TopKIncrBy("topk", []string{"a"}, []uint64{topkMaxIncrement + 1}); err == nil {
+		t.Fatal("expected error for an increment above the limit")
+	}
+	if counts, _ := store.TopKCount("topk", "a"); counts[0] != 0 {
+		t.Fatalf("expected a rejected increment to change nothing, got %d", counts[0])
+	}
+	if _, err := store.TopKIncrBy("topk", []string{"a"}, []uint64{topkMaxIncrement}); err != nil {
+		t.Fatalf("TopKIncrBy at the limit failed: %v", err)
+	}
+}
+
+func TestTimeSeries(t *testing.T) {
+	store := NewStore()
+	if err := store.TSCreate("temp", TSOptions{Retention: 100, Labels: map[string]string{"room": "kitchen"}}); err != nil {
+		t.Fatalf("TSCreate failed: %v", err)
+	}
+	for i := int64(0); i < 10; i++ {
+		if _, err := store.TSAdd("temp", 1000+i*10, float64(i), TSOptions{}, ""); err != nil {
+			t.Fatalf("TSAdd failed: %v", err)
+		}
+	}
+
+	// BLOCK is the default duplicate policy; ON_DUPLICATE overrides it.
+	if _, err := store.TSAdd("temp", 1090, 42, TSOptions{}, ""); err == nil {
+		t.Fatal("expected duplicate timestamp to be rejected")
+	}
+	store.TSAdd("temp", 1090, 1, TSOptions{}, tsPolicySum)
+	if smp, _, _ := store.TSGet("temp"); smp.Timestamp != 1090 || smp.Value != 10 {
+		t.Fatalf("expected latest sample 1090=10, got %+v", smp)
+	}
+
+	// Retention trims samples older than 100ms before the newest one.
+	samples, _ := store.TSRange("temp", 0, 2000, nil, 0, false)
+	if len(samples) != 10 {
+		t.Fatalf("expected 10 samples, got %d", len(samples))
+	}
+	store.TSAdd("temp", 1150, 0, TSOptions{}, "")
+	samples, _ = store.TSRange("temp", 0, 2000, nil, 0, false)
+	if samples[0].Timestamp != 1050 {
+		t.Fatalf("expected retention to drop samples before 1050, first is %d", samples[0].Timestamp)
+	}
+	if _, err := store.TSAdd("temp", 1000, 1, TSOptions{}, ""); err == nil {
+		t.Fatal("expected error adding a sample older than retention")
+	}
+
+	// Bucketed aggregation and reverse order with COUNT.
+	store.TSCreate("agg", TSOptions{})
+	for i := int64(0); i < 6; i++ {
+		store.TSAdd("agg", i*10, float64(i), TSOptions{}, "")
+	}
+	samples, _ = store.TSRange("agg", 0, 100, &TSAggregation{Type: "sum", BucketDuration: 20}, 0, false)
+	want := []Sample{{0, 1}, {20, 5}, {40, 9}}
+	if len(samples) != len(want) {
+		t.Fatalf("expected %v, got %v", want, samples)
+	}
+	for i := range want {
+		if samples[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, samples)
+		}
+	}
+	samples, _ = store.TSRange("agg", 0, 100, &TSAggregation{Type: "avg", BucketDuration: 20}, 1, true)
+	if len(samples) != 1 || samples[0] != (Sample{40, 4.5}) {
+		t.Fatalf("expected [{40 4.5}], got %v", samples)
+	}
+
+	// Compaction rules write each finished bucket into the destination.
+	store.TSCreate("raw", TSOptions{Labels: map[string]string{"room": "hall"}})
+	store.TSCreate("raw:max", TSOptions{})
+	if err := store.TSCreateRule("raw", "raw:max", TSAggregation{Type: "max", BucketDuration: 100}); err != nil {
+		t.Fatalf("TSCreateRule failed: %v", err)
+	}
+	if err := store.TSCreateRule("raw:max", "agg", TSAggregation{Type: "max", BucketDuration: 100}); err == nil {
+		t.Fatal("expected chained compaction rules to be rejected")
+	}
+	for _, smp := range []Sample{{0, 3}, {50, 7}, {120, 1}, {250, 2}} {
+		store.TSAdd("raw", smp.Timestamp, smp.Value, TSOptions{}, "")
+	}
+	samples, _ = store.TSRange("raw:max", 0, 1000, nil, 0, false)
+	if len(samples) != 2 || samples[0] != (Sample{0, 7}) || samples[1] != (Sample{100, 1}) {
+		t.Fatalf("expected compacted [{0 7} {100 1}], got %v", samples)
+	}
+
+	// Label filters select series across keys.
+	room, _ := ParseTSFilter("room=(kitchen,hall)")
+	results, err := store.TSMRange(0, 2000, []TSFilter{room}, nil, 0, false)
+	if err != nil || len(results) != 2 || results[0].Key != "raw" || results[1].Key != "temp" {
+		t.Fatalf("expected raw and temp to match, got %v (err=%v)", results, err)
+	}
+	notHall, _ := ParseTSFilter("room!=hall")
+	keys, _ := store.TSQueryIndex([]TSFilter{room, notHall})
+	if len(keys) != 1 || keys[0] != "temp" {
+		t.Fatalf("expected only temp, got %v", keys)
+	}
+	if _, err := store.TSQueryIndex([]TSFilter{notHall}); err == nil {
+		t.Fatal("expected error without a positive matcher")
+	}
+}
+
+func TestTimeSeriesRuleDestinationGone(t *testing.T) {
+	store := NewStore()
+	store.TSCreate("raw", TSOptions{})
+	store.TSCreate("raw:max", TSOptions{})
+	store.TSCreateRule("raw", "raw:max", TSAggregation{Type: "max", BucketDuration: 100})
+	store.TSAdd("raw", 0, 1, TSOptions{}, "")
+	before := store.MemoryStats().Used
+	store.TSAdd("raw", 100, 2, TSOptions{}, "")
+	// Closing the bucket grows the destination, which is accounted for.
+	if used := store.MemoryStats().Used; used != before+16 {
+		t.Fatalf("expected the compacted sample to add 16 bytes, got %d", used-before)
+	}
+
+	// Replacing the destination drops the rule instead of the buckets.
+	store.Del("raw:max")
+	store.TSCreate("raw:max", TSOptions{})
+	if info, _, _ := store.TSInfo("raw"); len(info.Rules) != 0 {
+		t.Fatalf("expected TS.INFO to leave out the dead rule, got %v", info.Rules)
+	}
+	store.TSAdd("raw", 200, 3, TSOptions{}, "")
+	if samples, _ := store.TSRange("raw:max", 0, 1000, nil, 0, false); len(samples) != 0 {
+		t.Fatalf("expected the new series to stay empty, got %v", samples)
+	}
+	if err := store.TSCreateRule("raw", "raw:max", TSAggregation{Type: "max", BucketDuration: 100}); err != nil {
+		t.Fatalf("expected the rule to be gone so it can be created again, got %v", err)
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	store := NewStore()
+	store.HSet("user:1", "name", "Alice Smith")
+	store.HSet("user:1", "email", "alice@example.com")
+	store.HSet("user:1", "age", "31")
+	store.HSet("user:1", "tags", "admin,staff")
+	store.HSet("other:1", "name", "Alice Elsewhere")
+
+	fields := []SearchField{
+		{Name: "name", Type: searchText, Sortable: true},
+		{Name: "email", Type: searchTag},
+		{Name: "age", Type: searchNumeric, Sortable: true},
+		{Name: "tags", Type: searchTag},
+	}
+	if err := store.FTCreate("users", []string{"user:"}, fields); err != nil {
+		t.Fatalf("FTCreate failed: %v", err)
+	}
+	if err := store.FTCreate("users", nil, fields); err == nil {
+		t.Fatal("expected duplicate index to be rejected")
+	}
+	// Keys written after the index exists are picked up too.
+	store.HSet("user:2", "name", "Bob Smith")
+	store.HSet("user:2", "age", "25")
+	store.HSet("user:2", "tags", "staff")
+	store.HSet("user:3", "name", "Carol Jones")
+	store.HSet("user:3", "age", "40")
+
+	search := func(query string, q SearchQuery) []string {
+		t.Helper()
+		q.Query = query
+		if q.Limit == 0 {
+			q.Limit = 10
+		}
+		total, docs, err := store.FTSearch("users", q)
+		if err != nil {
+			t.Fatalf("FTSearch(%q) failed: %v", query, err)
+		}
+		keys := make([]string, len(docs))
+		for i, d := range docs {
+			keys[i] = d.Key
+		}
+		if q.Offset == 0 && total != len(keys) && q.Limit >= total {
+			t.Fatalf("FTSearch(%q): total %d but %d docs", query, total, len(keys))
+		}
+		return keys
+	}
+	check := func(got []string, want ...string) {
+		t.Helper()
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+
+	check(search("smith", SearchQuery{}), "user:1", "user:2")
+	check(search("@name:alice", SearchQuery{}), "user:1")
+	check(search("smith -bob", SearchQuery{}), "user:1")
+	check(search("bob | carol", SearchQuery{}), "user:2", "user:3")
+	check(search("car*", SearchQuery{}), "user:3")
+	check(search("@email:{alice\\@example\\.com}", SearchQuery{}), "user:1")
+	check(search("@tags:{staff}", SearchQuery{}), "user:1", "user:2")
+	check(search("@age:[30 +inf]", SearchQuery{}), "user:1", "user:3")
+	check(search("@age:[(25 (40]", SearchQuery{}), "user:1")
+	check(search("*", SearchQuery{SortBy: "age", Desc: true}), "user:3", "user:1", "user:2")
+	check(search("*", SearchQuery{SortBy: "age", Offset: 1, Limit: 1}), "user:1")
+
+	if _, _, err := store.FTSearch("users", SearchQuery{Query: "@age:{x}", Limit: 10}); err == nil {
+		t.Fatal("expected error for TAG query on a NUMERIC field")
+	}
+
+	// Updates and deletes keep the index current.
+	store.HSet("user:2", "name", "Robert Brown")
+	check(search("smith", SearchQuery{}), "user:1")
+	check(search("robert", SearchQuery{}), "user:2")
+	store.HDel("user:1", "tags")
+	check(search("@tags:{staff}", SearchQuery{}), "user:2")
+	store.Del("user:3")
+	check(search("@age:[0 100]", SearchQuery{}), "user:1", "user:2")
+	store.Set("user:2", "not a hash")
+	check(search("*", SearchQuery{}), "user:1")
+
+	_, docs, _ := store.FTSearch("users", SearchQuery{Query: "alice", Limit: 10, Return: []string{"age"}})
+	if len(docs) != 1 || strings.Join(docs[0].Fields, ",") != "age,31" {
+		t.Fatalf("expected RETURN to project age only, got %v", docs)
+	}
+
+	if err := store.FTDropIndex("users", true); err != nil {
+		t.Fatalf("FTDropIndex failed: %v", err)
+	}
+	if _, ok, _ := store.HGet("user:1", "name"); ok {
+		t.Fatal("expected DD to delete indexed documents")
+	}
+	if _, ok, _ := store.HGet("other:1", "name"); !ok {
+		t.Fatal("expected keys outside the prefix to survive")
+	}
+}
+
+func TestSearchIndexUpdates(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	store := NewStoreWithClock(clock)
+	store.FTCreate("idx", []string{"doc:"}, []SearchField{
+		{Name: "title", Type: searchText},
+		{Name: "score", Type: searchNumeric},
+	})
+	for i := 0; i < 5; i++ {
+		key := "doc:" + strconv.Itoa(i)
+		store.HSet(key, "title", "hello")
+		store.HSet(key, "score", "7") // equal values, told apart by key
+		store.HSet(key, "body", strconv.Itoa(i))
+	}
+	store.HSet("doc:nan", "score", "NaN")
+	idx := store.indexes["idx"]
+	if n := len(idx.numbers["score"]); n != 5 {
+		t.Fatalf("expected 5 numeric entries, got %d", n)
+	}
+
+	// Changing one entry among equal values moves exactly that one.
+	store.HSet("doc:3", "score", "9")
+	store.HDel("doc:1", "score")
+	entries := idx.numbers["score"]
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.key+"="+strconv.FormatFloat(e.value, 'f', -1, 64))
+	}
+	if strings.Join(got, ",") != "doc:0=7,doc:2=7,doc:4=7,doc:3=9" {
+		t.Fatalf("unexpected numeric entries %v", got)
+	}
+	// Only indexed fields are remembered between updates.
+	if snap := store.indexedHashes["doc:0"]; len(snap) != 2 || snap["body"] != "" {
+		t.Fatalf("expected only the indexed fields in the snapshot, got %v", snap)
+	}
+
+	// Expired documents are not returned even before they are deleted.
+	store.Expire("doc:2", 1)
+	clock.Advance(2 * time.Second)
+	total, docs, err := store.FTSearch("idx", SearchQuery{Query: "@score:[7 7]", Limit: 10})
+	if err != nil || total != 2 || len(docs) != 2 || docs[0].Key != "doc:0" || docs[1].Key != "doc:4" {
+		t.Fatalf("expected doc:0 and doc:4, got %d %v (err=%v)", total, docs, err)
+	}
+}
+
+func TestVectorSet(t *testing.T) {
+	store := NewStore()
+	store.VAdd("items", "east", []float32{1, 0}, "", 0, 0, `{"year": 1990, "genre": "drama"}`)
+	store.VAdd("items", "north", []float32{0, 1}, "", 0, 0, `{"year": 2005, "genre": "comedy"}`)
+	store.VAdd("items", "northeast", []float32{1, 1}, "", 0, 0, `{"year": 2010, "genre": "drama"}`)
+	if _, err := store.VAdd("items", "bad", []float32{1, 2, 3}, "", 0, 0, ""); err == nil {
+		t.Fatal("expected dimension mismatch error")
+	}
+
+	matches, err := store.VSim("items", VSimOptions{Vector: []float32{2, 0.1}, Count: 2})
+	if err != nil || len(matches) != 2 || matches[0].Element != "east" || matches[1].Element != "northeast" {
+		t.Fatalf("expected [east northeast], got %v (err=%v)", matches, err)
+	}
+	if matches[0].Score < 0.99 {
+		t.Fatalf("expected cosine similarity near 1, got %v", matches[0].Score)
+	}
+	matches, _ = store.VSim("items", VSimOptions{Element: "east", Filter: `.genre == "drama" and .year > 2000`})
+	if len(matches) != 1 || matches[0].Element != "northeast" {
+		t.Fatalf("expected filter to keep only northeast, got %v", matches)
+	}
+
+	// L2 and inner product order differently from cosine for unnormalised vectors.
+	store.VAdd("l2", "near", []float32{1, 1}, vectorL2, 0, 0, "")
+	store.VAdd("l2", "far", []float32{10, 10}, vectorL2, 0, 0, "")
+	matches, _ = store.VSim("l2", VSimOptions{Vector: []float32{0, 0}})
+	if matches[0].Element != "near" || matches[1].Score < 14 || matches[1].Score > 14.2 {
+		t.Fatalf("expected near first and far at distance ~14.14, got %v", matches)
+	}
+	store.VAdd("ip", "near", []float32{1, 1}, vectorIP, 0, 0, "")
+	store.VAdd("ip", "far", []float32{10, 10}, vectorIP, 0, 0, "")
+	if matches, _ = store.VSim("ip", VSimOptions{Vector: []float32{1, 1}}); matches[0].Element != "far" || matches[0].Score != 20 {
+		t.Fatalf("expected far first with score 20, got %v", matches)
+	}
+
+	// Past the brute-force limit an HNSW graph answers queries; its results
+	// should closely match an exact scan.
+	rng := rand.New(rand.NewSource(1))
+	randomVec := func() []float32 {
+		v := make([]float32, 16)
+		for i := range v {
+			v[i] = rng.Float32()*2 - 1
+		}
+		return v
+	}
+	for i := 0; i < 2*vectorBruteForceLimit; i++ {
+		store.VAdd("big", "e"+strconv.Itoa(i), randomVec(), "", 0, 0, `{"n": `+strconv.Itoa(i)+`}`)
+	}
+	if info, _ := store.VInfo("big"); !info.HNSW {
+		t.Fatal("expected an HNSW index for a large set")
+	}
+	hits, total := 0, 0
+	for q := 0; q < 20; q++ {
+		query := randomVec()
+		approx, _ := store.VSim("big", VSimOptions{Vector: query, Count: 10})
+		exact, _ := store.VSim("big", VSimOptions{Vector: query, Count: 10, Exact: true})
+		want := map[string]bool{}
+		for _, m := range exact {
+			want[m.Element] = true
+		}
+		for _, m := range approx {
+			if want[m.Element] {
+				hits++
+			}
+		}
+		total += len(exact)
+	}
+	if recall := float64(hits) / float64(total); recall < 0.9 {
+		t.Fatalf("expected HNSW recall >= 0.9, got %.2f", recall)
+	}
+	matches, _ = store.VSim("big", VSimOptions{Vector: randomVec(), Count: 5, Filter: ".n < 3"})
+	if len(matches) != 3 {
+		t.Fatalf("expected selective filter to return 3 matches, got %v", matches)
+	}
+
+	for i := 0; i < 2*vectorBruteForceLimit; i += 2 {
+		store.VRem("big", "e"+strconv.Itoa(i))
+	}
+	if n, _ := store.VCard("big"); n != vectorBruteForceLimit {
+		t.Fatalf("expected %d elements after removals, got %d", vectorBruteForceLimit, n)
+	}
+	matches, _ = store.VSim("big", VSimOptions{Element: "e1", Count: 1})
+	if len(matches) != 1 || matches[0].Element != "e1" {
+		t.Fatalf("expected e1 to be its own nearest neighbour, got %v", matches)
+	}
+}
+
+func TestScan(t *testing.T) {
+	store := NewStore()
+	for i := 0; i < 500; i++ {
+		store.Set("key:"+strconv.Itoa(i), "v")
+	}
+	store.HSet("h", "f", "v")
+
+	// Keys present for the whole scan must be returned even while the keyspace
+	// grows and shrinks (forcing rehashes) between calls.
+	seen := map[string]bool{}
+	cursor, calls := uint64(0), 0
+	for {
+		next, keys := store.Scan(cursor, "", 20, "")
+		for _, k := range keys {
+			seen[k] = true
+		}
+		calls++
+		if calls == 5 {
+			for i := 0; i < 2000; i++ {
+				store.Set("tmp:"+strconv.Itoa(i), "v")
+			}
+		}
+		if calls == 10 {
+			for i := 0; i < 2000; i++ {
+				store.Del("tmp:" + strconv.Itoa(i))
+			}
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	for i := 0; i < 500; i++ {
+		if !seen["key:"+strconv.Itoa(i)] {
+			t.Fatalf("key:%d was never returned", i)
+		}
+	}
+	if calls < 10 {
+		t.Fatalf("expected the scan to take several calls, took %d", calls)
+	}
+
+	var hashes []string
+	for cursor = 0; ; {
+		next, keys := store.Scan(cursor, "", 100, "hash")
+		hashes = append(hashes, keys...)
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	if len(hashes) != 1 || hashes[0] != "h" {
+		t.Fatalf("expected TYPE hash to return only h, got %v", hashes)
+	}
+
+	// Container scans page through members with the same guarantee.
+	for i := 0; i < 100; i++ {
+		store.SAdd("set", "m"+strconv.Itoa(i))
+	}
+	members := map[string]bool{}
+	for cursor = 0; ; {
+		next, batch, err := store.SScan("set", cursor, "", 7)
+		if err != nil {
+			t.Fatalf("SScan failed: %v", err)
+		}
+		if len(batch) > 7 {
+			t.Fatalf("expected at most 7 members per call, got %d", len(batch))
+		}
+		for _, m := range batch {
+			members[m] = true
+		}
+		store.SRem("set", "m0")
+		store.SAdd("set", "extra"+strconv.FormatUint(next, 10))
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	for i := 1; i < 100; i++ {
+		if !members["m"+strconv.Itoa(i)] {
+			t.Fatalf("member m%d was never returned", i)
+		}
+	}
+
+	store.ZAdd("z", 1.5, "a")
+	store.ZAdd("z", 2, "b")
+	next, pairs, _ := store.ZScan("z", 0, "a", 10)
+	if next != 0 || len(pairs) != 2 || pairs[0] != "a" || pairs[1] != "1.5" {
+		t.Fatalf("expected [a 1.5], got %v (cursor %d)", pairs, next)
+	}
+	if _, _, err := store.HScan("z", 0, "", 10); err == nil {
+		t.Fatal("expected HSCAN on a sorted set to fail")
+	}
+}
+
+func TestScanIndexFollowsWrites(t *testing.T) {
+	store := NewStore()
+	for i := 0; i < 50; i++ {
+		store.HSet("h", "f"+strconv.Itoa(i), "v")
+		store.ZAdd("z", float64(i), "m"+strconv.Itoa(i))
+	}
+	store.HDel("h", "f0", "f1")
+	store.ZRem("z", "m0")
+	store.ZAdd("z", 99, "m1") // a score change is not a new member
+	store.Copy("h", "h2", false)
+	store.Rename("z", "z2", false)
+
+	scanAll := func(scan func(cursor uint64) (uint64, []string, error)) map[string]bool {
+		t.Helper()
+		seen := map[string]bool{}
+		for cursor := uint64(0); ; {
+			next, pairs, err := scan(cursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < len(pairs); i += 2 {
+				if seen[pairs[i]] {
+					t.Fatalf("%s returned twice", pairs[i])
+				}
+				seen[pairs[i]] = true
+			}
+			if cursor = next; cursor == 0 {
+				return seen
+			}
+		}
+	}
+	fields := scanAll(func(c uint64) (uint64, []string, error) { return store.HScan("h2", c, "", 5) })
+	if len(fields) != 48 || fields["f0"] || fields["f1"] {
+		t.Fatalf("expected the 48 remaining fields, got %d", len(fields))
+	}
+	members := scanAll(func(c uint64) (uint64, []string, error) { return store.ZScan("z2", c, "", 5) })
+	if len(members) != 49 || members["m0"] || !members["m1"] {
+		t.Fatalf("expected the 49 remaining members, got %d", len(members))
+	}
+}
+
+func TestGenericKeyCommands(t *testing.T) {
+	store := NewStore()
+	store.Set("s", "v")
+	store.SAdd("set", "a", "b")
+	store.JSONSet("doc", "$", `{"a":[1,2]}`, false, false)
+	store.BFAdd("bf", "x")
+
+	if n := store.Exists("s", "s", "missing"); n != 2 {
+		t.Fatalf("expected EXISTS to count duplicates, got %d", n)
+	}
+	for key, want := range map[string]string{"s": "string", "set": "set", "doc": "ReJSON-RL", "bf": "MBbloom--", "missing": "none"} {
+		if got := store.Type(key); got != want {
+			t.Fatalf("TYPE %s: expected %s, got %s", key, want, got)
+		}
+	}
+	if n := store.DBSize(); n != 4 {
+		t.Fatalf("expected DBSIZE 4, got %d", n)
+	}
+
+	// RENAME carries the expiry along.
+	store.Expire("s", 100)
+	if _, err := store.Rename("s", "s2", false); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if v, ok, _ := store.Get("s2"); !ok || v != "v" || store.TTL("s2") < 99 || store.Exists("s") != 0 {
+		t.Fatalf("expected s2=v with TTL, got %q ttl=%d", v, store.TTL("s2"))
+	}
+	if ok, _ := store.Rename("set", "s2", true); ok {
+		t.Fatal("expected RENAMENX onto an existing key to fail")
+	}
+	if _, err := store.Rename("missing", "x", false); err == nil {
+		t.Fatal("expected RENAME of a missing key to fail")
+	}
+
+	// COPY deep-copies containers, so the copies evolve independently.
+	store.Copy("set", "set2", false)
+	store.SAdd("set2", "c")
+	if m, _ := store.SMembers("set"); len(m) != 2 {
+		t.Fatalf("expected original set untouched, got %v", m)
+	}
+	store.Copy("doc", "doc2", false)
+	store.JSONArrAppend("doc2", "$.a", "3")
+	if doc, _, _ := store.JSONGet("doc"); doc != `{"a":[1,2]}` {
+		t.Fatalf("expected original document untouched, got %s", doc)
+	}
+	store.Copy("bf", "bf2", false)
+	store.BFAdd("bf2", "y")
+	if found, _ := store.BFExists("bf", "y"); found[0] {
+		t.Fatal("expected copied Bloom filter not to share bits")
+	}
+	if ok, _ := store.Copy("set", "set2", false); ok {
+		t.Fatal("expected COPY without REPLACE onto an existing key to fail")
+	}
+	if ok, _ := store.Copy("s2", "set2", true); !ok || store.Type("set2") != "string" || store.TTL("set2") < 99 {
+		t.Fatal("expected COPY REPLACE to overwrite set2 with the string and its TTL")
+	}
+
+	if k, ok := store.RandomKey(); !ok || store.Exists(k) != 1 {
+		t.Fatalf("expected RANDOMKEY to return an existing key, got %q", k)
+	}
+}
+
+func TestExpireFamily(t *testing.T) {
+	// Expiry times have millisecond resolution, so start on a whole millisecond.
+	clock := NewFakeClock(time.UnixMilli(time.Now().UnixMilli()))
+	store := NewStoreWithClock(clock)
+	store.Set("k", "v")
+	if !store.PExpire("k", 1500, 0) {
+		t.Fatal("PExpire failed")
+	}
+	if ms := store.PTTL("k"); ms != 1500 {
+		t.Fatalf("expected PTTL 1500, got %d", ms)
+	}
+	if ttl := store.TTL("k"); ttl != 2 {
+		t.Fatalf("expected TTL to round 1.5s up to 2, got %d", ttl)
+	}
+	clock.Advance(1001 * time.Millisecond)
+	if ttl := store.TTL("k"); ttl != 0 {
+		t.Fatalf("expected TTL to round 0.499s down to 0, got %d", ttl)
+	}
+
+	// NX/XX/GT/LT conditions.
+	if store.PExpire("k", 10000, ExpireNX) {
+		t.Fatal("expected NX to fail on a key with an expiry")
+	}
+	if !store.PExpire("k", 10000, ExpireGT) || store.PExpire("k", 5000, ExpireGT) {
+		t.Fatal("expected GT to only extend the expiry")
+	}
+	if !store.PExpire("k", 5000, ExpireLT|ExpireXX) {
+		t.Fatal("expected XX LT to shorten an existing expiry")
+	}
+	store.Set("p", "v")
+	if store.PExpire("p", 1000, ExpireGT) || store.PExpire("p", 1000, ExpireXX) {
+		t.Fatal("expected GT and XX to fail on a persistent key")
+	}
+	if !store.PExpire("p", 1000, ExpireLT) {
+		t.Fatal("expected LT to succeed on a persistent key")
+	}
+
+	// Absolute times, PERSIST and EXPIRETIME.
+	at := clock.Now().Add(time.Hour).UnixMilli()
+	store.PExpireAt("k", at, 0)
+	if got := store.PExpireTime("k"); got != at {
+		t.Fatalf("expected PEXPIRETIME %d, got %d", at, got)
+	}
+	if !store.Persist("k") || store.Persist("k") || store.PExpireTime("k") != -1 {
+		t.Fatal("expected PERSIST to remove the expiry exactly once")
+	}
+	if store.PExpireTime("missing") != -2 || store.PTTL("missing") != -2 {
+		t.Fatal("expected -2 for a missing key")
+	}
+
+	// Past or negative expiry deletes the key immediately.
+	if !store.PExpireAt("k", clock.Now().Add(-time.Second).UnixMilli(), 0) || store.Exists("k") != 0 {
+		t.Fatal("expected a past timestamp to delete the key")
+	}
+	if !store.Expire("p", -1) || store.Exists("p") != 0 {
+		t.Fatal("expected a negative EXPIRE to delete the key")
+	}
+}
+
+func TestActiveExpiry(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	store := NewStoreWithClock(clock)
+	for i := 0; i < 1000; i++ {
+		store.Set("tmp:"+strconv.Itoa(i), "v")
+		store.PExpire("tmp:"+strconv.Itoa(i), 20, 0)
+		store.Set("keep:"+strconv.Itoa(i), "v")
+	}
+	store.Set("long", "v")
+	store.Expire("long", 100)
+	if st := store.ExpiryStats(); st.VolatileKeys != 1001 {
+		t.Fatalf("expected 1001 volatile keys, got %d", st.VolatileKeys)
+	}
+
+	// Expired keys are reclaimed by sampling, without anyone reading them.
+	clock.Advance(time.Second)
+	for i := 0; i < 100 && store.DBSize() > 1001; i++ {
+		store.activeExpireCycle()
+	}
+	if n := store.DBSize(); n != 1001 {
+		t.Fatalf("expected expired keys to be reclaimed, %d keys left", n)
+	}
+	st := store.ExpiryStats()
+	if st.ExpiredKeys != 1000 || st.VolatileKeys != 1 {
+		t.Fatalf("expected 1000 expired and 1 volatile key, got %+v", st)
+	}
+	if store.TTL("long") <= 0 {
+		t.Fatal("expected the unexpired key to keep its TTL")
+	}
+}
+
+func TestMemoryAccounting(t *testing.T) {
+	store := NewStore()
+	if used := store.MemoryStats().Used; used != 0 {
+		t.Fatalf("expected an empty store to use 0 bytes, got %d", used)
+	}
+	store.Set("a", strings.Repeat("x", 1000))
+	small := store.MemoryStats().Used
+	if small < 1000 {
+		t.Fatalf("expected at least 1000 bytes, got %d", small)
+	}
+	for i := 0; i < 100; i++ {
+		store.LPush("list", strings.Repeat("y", 100))
+	}
+	store.RecordAccess(true, "list")
+	if used := store.MemoryStats().Used; used < small+10000 {
+		t.Fatalf("expected the list to add at least 10000 bytes, got %d", used-small)
+	}
+	store.Rename("list", "l", false)
+	store.Del("l")
+	store.Del("a")
+	if used := store.MemoryStats().Used; used != 0 {
+		t.Fatalf("expected 0 bytes after deleting everything, got %d", used)
+	}
+}
+
+func TestEvictionLRU(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	store := NewStoreWithClock(clock)
+	store.SetMaxMemory(0, AllKeysLRU)
+	for i := 0; i < 50; i++ {
+		store.Set("cold:"+strconv.Itoa(i), "v")
+	}
+	clock.Advance(time.Hour)
+	for i := 0; i < 50; i++ {
+		store.Set("hot:"+strconv.Itoa(i), "v")
+	}
+	store.SetMaxMemory(store.MemoryStats().Used*6/10, AllKeysLRU)
+	if err := store.FreeMemory(); err != nil {
+		t.Fatal(err)
+	}
+	mem := store.MemoryStats()
+	if mem.Used > mem.Max || mem.EvictedKeys == 0 {
+		t.Fatalf("expected eviction to get under the limit, got %+v", mem)
+	}
+	hot := 0
+	for i := 0; i < 50; i++ {
+		hot += store.Exists("hot:" + strconv.Itoa(i))
+	}
+	// Sampling is approximate: a hot key can go when no cold one was sampled.
+	if hot < 40 {
+		t.Fatalf("expected recently used keys to survive, only %d of 50 did", hot)
+	}
+}
+
+func TestEvictionLFU(t *testing.T) {
+	store := NewStore()
+	for i := 0; i < 100; i++ {
+		store.Set("k"+strconv.Itoa(i), "v")
+	}
+	for n := 0; n < 100; n++ {
+		for i := 0; i < 10; i++ {
+			store.RecordAccess(false, "k"+strconv.Itoa(i))
+		}
+	}
+	store.SetMaxMemory(store.MemoryStats().Used/2, AllKeysLFU)
+	if err := store.FreeMemory(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if store.Exists("k"+strconv.Itoa(i)) == 0 {
+			t.Fatalf("expected frequently used key k%d to survive", i)
+		}
+	}
+}
+
+func TestEvictionVolatileTTLAndNoEviction(t *testing.T) {
+	store := NewStore()
+	store.Set("persistent", "v")
+	store.Set("soon", "v")
+	store.Expire("soon", 10)
+	store.Set("later", "v")
+	store.Expire("later", 1000)
+
+	store.SetMaxMemory(1, NoEviction)
+	if err := store.FreeMemory(); err != ErrOOM {
+		t.Fatalf("expected ErrOOM under noeviction, got %v", err)
+	}
+	if store.DBSize() != 3 {
+		t.Fatal("expected noeviction to keep every key")
+	}
+
+	store.SetMaxMemory(store.MemoryStats().Used-1, VolatileTTL)
+	if err := store.FreeMemory(); err != nil {
+		t.Fatal(err)
+	}
+	if store.Exists("soon") != 0 || store.Exists("later") != 1 {
+		t.Fatal("expected volatile-ttl to evict the key closest to expiring")
+	}
+
+	// Only keys with an expiry may go, so this runs out of candidates.
+	store.SetMaxMemory(1, VolatileLRU)
+	if err := store.FreeMemory(); err != ErrOOM {
+		t.Fatalf("expected ErrOOM once no volatile keys are left, got %v", err)
+	}
+	if store.Exists("persistent") != 1 {
+		t.Fatal("expected volatile-lru to keep keys without an expiry")
+	}
+}
+
+func TestObjectEncoding(t *testing.T) {
+	store := NewStore()
+	store.Set("int", "12345")
+	store.Set("short", "hello")
+	store.Set("long", strings.Repeat("x", 100))
+	store.SAdd("ints", "1", "2", "3")
+	store.SAdd("words", "a", "b")
+	store.HSet("h", "f", "v")
+	store.HSet("bigh", "f", strings.Repeat("v", 100))
+	store.ZAdd("z", 1, "m")
+	store.LPush("l", "a")
+	store.JSONSet("j", "$", `{"a":1}`, false, false)
+	for i := 0; i < 200; i++ {
+		store.LPush("biglist", "x")
+	}
+	want := map[string]string{
+		"int": "int", "short": "embstr", "long": "raw", "ints": "intset", "words": "listpack",
+		"h": "listpack", "bigh": "hashtable", "z": "listpack", "l": "listpack",
+		"biglist": "quicklist", "j": "raw",
+	}
+	for key, enc := range want {
+		info, ok := store.Object(key)
+		if !ok || info.Encoding != enc {
+			t.Errorf("expected %s to be encoded as %s, got %q", key, enc, info.Encoding)
+		}
+	}
+	if _, ok := store.Object("missing"); ok {
+		t.Fatal("expected no object info for a missing key")
+	}
+}
+
+func TestObjectIdleTimeAndFrequency(t *testing.T) {
+	// Start on a whole minute so 90s crosses exactly one LFU decay period.
+	clock := NewFakeClock(time.Unix(1700000040, 0))
+	store := NewStoreWithClock(clock)
+	store.Set("k", "v")
+	clock.Advance(90 * time.Second)
+	info, _ := store.Object("k")
+	if info.Idle != 90*time.Second || info.Frequency != lfuInitVal-1 {
+		t.Fatalf("expected 90s idle and a decayed counter, got %+v", info)
+	}
+	// Reading the object data is not itself an access.
+	if info, _ = store.Object("k"); info.Idle != 90*time.Second {
+		t.Fatalf("expected OBJECT not to reset the idle time, got %v", info.Idle)
+	}
+	for i := 0; i < 1000; i++ {
+		store.RecordAccess(false, "k")
+	}
+	info, _ = store.Object("k")
+	if info.Idle != 0 || info.Frequency <= lfuInitVal {
+		t.Fatalf("expected accesses to reset idle time and raise the counter, got %+v", info)
+	}
+	if info.RefCount != 1 {
+		t.Fatalf("expected refcount 1, got %d", info.RefCount)
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	store := NewStore()
+	for i := 0; i < 1000; i++ {
+		store.HSet("h", "field:"+strconv.Itoa(i), "value")
+	}
+	exact, ok := store.MemoryUsage("h", 0)
+	if !ok || exact < int64(1000*len("field:000value")) {
+		t.Fatalf("expected the hash to use at least its contents, got %d", exact)
+	}
+	sampled, _ := store.MemoryUsage("h", 5)
+	if sampled < exact*9/10 || sampled > exact*11/10 {
+		t.Fatalf("expected a sampled estimate near %d, got %d", exact, sampled)
+	}
+
+	// Nested containers are sampled too.
+	store.JSONSet("doc", "$", `{"items":[`+strings.TrimSuffix(strings.Repeat(`{"name":"abcdefgh"},`, 500), ",")+`]}`, false, false)
+	exact, _ = store.MemoryUsage("doc", 0)
+	sampled, _ = store.MemoryUsage("doc", 5)
+	if exact < int64(500*len("abcdefgh")) || sampled != exact {
+		t.Fatalf("expected equal estimates for uniform items, got %d and %d", exact, sampled)
+	}
+	if _, ok := store.MemoryUsage("missing", 5); ok {
+		t.Fatal("expected no usage for a missing key")
+	}
+
+	stats := store.MemoryStats()
+	if stats.Keys != 2 || stats.KeysBytes <= 0 || stats.Peak < stats.Used {
+		t.Fatalf("unexpected memory stats %+v", stats)
+	}
+	store.Del("h")
+	if after := store.MemoryStats(); after.Peak != stats.Peak || after.Used >= stats.Used {
+		t.Fatalf("expected usage to drop and the peak to stay, got %+v", after)
+	}
+}
+
+func TestAnalyzeKeys(t *testing.T) {
+	store := NewStore()
+	for i := 0; i < 300; i++ {
+		store.Set("s:"+strconv.Itoa(i), "v")
+	}
+	store.Set("s:big", strings.Repeat("x", 5000))
+	for i := 0; i < 1000; i++ {
+		store.HSet("h:big", strconv.Itoa(i), "v")
+	}
+	store.HSet("h:wide", "f", strings.Repeat("x", 10000))
+	store.HSet("h:small", "f", "v")
+	for i := 0; i < 500; i++ {
+		store.RecordAccess(false, "s:7")
+	}
+
+	a := store.AnalyzeKeys("", 2)
+	if a.Scanned != 304 || len(a.Types) != 2 {
+		t.Fatalf("expected 304 keys of 2 types, got %d keys and %d types", a.Scanned, len(a.Types))
+	}
+	hash, str := a.Types[0], a.Types[1]
+	if hash.Type != "hash" || hash.Keys != 3 || hash.Elements != 1002 {
+		t.Fatalf("unexpected hash summary %+v", hash)
+	}
+	if len(hash.Biggest) != 2 || hash.Biggest[0].Key != "h:big" || hash.Biggest[1].Elements != 1 {
+		t.Fatalf("expected h:big to have the most fields, got %+v", hash.Biggest)
+	}
+	if hash.Heaviest[0].Key != "h:big" || hash.Heaviest[1].Key != "h:wide" {
+		t.Fatalf("expected h:big then h:wide by memory, got %+v", hash.Heaviest)
+	}
+	if str.Biggest[0].Key != "s:big" || str.Biggest[0].Elements != 5000 {
+		t.Fatalf("expected s:big to be the biggest string, got %+v", str.Biggest)
+	}
+	if len(a.Hottest) != 2 || a.Hottest[0].Key != "s:7" {
+		t.Fatalf("expected s:7 to be the hottest key, got %+v", a.Hottest)
+	}
+
+	if a = store.AnalyzeKeys("h:*", 5); a.Scanned != 3 {
+		t.Fatalf("expected MATCH to limit the analysis to 3 keys, got %d", a.Scanned)
+	}
+}
+
+func TestMoveBetweenDatabases(t *testing.T) {
+	db0 := NewStore()
+	db1 := db0.newSibling()
+	db0.Set("k", "v")
+	db0.Expire("k", 100)
+	db0.Set("taken", "0")
+	db1.Set("taken", "1")
+
+	if ok, _ := db0.Move("k", db1); !ok {
+		t.Fatal("expected MOVE to succeed")
+	}
+	if db0.Exists("k") != 0 || db1.TTL("k") <= 0 {
+		t.Fatal("expected the key to move with its expiry")
+	}
+	if v, _, _ := db1.Get("k"); v != "v" {
+		t.Fatalf("expected the value to move, got %q", v)
+	}
+	if ok, _ := db0.Move("taken", db1); ok {
+		t.Fatal("expected MOVE to refuse an existing destination key")
+	}
+	if ok, _ := db0.Move("missing", db1); ok {
+		t.Fatal("expected MOVE of a missing key to fail")
+	}
+	if _, err := db0.Move("taken", db0); err == nil {
+		t.Fatal("expected MOVE into the same database to fail")
+	}
+
+	// Opposite moves lock in the same order and cannot deadlock.
+	done := make(chan bool)
+	for i := 0; i < 2; i++ {
+		go func(src, dst *Store) {
+			for j := 0; j < 1000; j++ {
+				src.Move("x", dst)
+			}
+			done <- true
+		}([]*Store{db0, db1}[i], []*Store{db1, db0}[i])
+	}
+	<-done
+	<-done
+
+	// Moving a series detaches its compaction rules.
+	db0.TSCreate("raw", TSOptions{})
+	db0.TSCreate("raw:max", TSOptions{})
+	db0.TSCreateRule("raw", "raw:max", TSAggregation{Type: "max", BucketDuration: 100})
+	db0.Move("raw:max", db1)
+	if info, _, _ := db0.TSInfo("raw"); len(info.Rules) != 0 {
+		t.Fatalf("expected the rule to the moved series to be removed, got %+v", info.Rules)
+	}
+}
+
+func TestFlushAndSharedMemoryLimit(t *testing.T) {
+	db0 := NewStore()
+	db1 := db0.newSibling()
+	db0.Set("a", "1")
+	db1.Set("b", "2")
+	db1.Expire("b", 100)
+	if db0.MemoryStats().Used != db1.MemoryStats().Used {
+		t.Fatal("expected databases to share memory totals")
+	}
+
+	// The limit bounds both databases together.
+	db0.SetMaxMemory(db0.MemoryStats().Used-1, AllKeysLRU)
+	if err := db1.FreeMemory(); err != nil || db1.DBSize() != 0 || db0.DBSize() != 1 {
+		t.Fatalf("expected db1 to evict its key, got err %v", err)
+	}
+	db0.SetMaxMemory(0, NoEviction)
+
+	fields := []SearchField{{Name: "name", Type: searchText}}
+	db0.FTCreate("idx", []string{"user:"}, fields)
+	db0.HSet("user:1", "name", "ann")
+	db0.Flush()
+	if db0.DBSize() != 0 || len(db0.Keys("*")) != 0 || db0.ExpiryStats().VolatileKeys != 0 {
+		t.Fatal("expected FLUSHDB to remove every key")
+	}
+	if mem := db0.MemoryStats(); mem.DBUsed != 0 || mem.Used != 0 {
+		t.Fatalf("expected no memory in use after flushing, got %+v", mem)
+	}
+	if total, _, err := db0.FTSearch("idx", SearchQuery{Query: "*"}); err != nil || total != 0 {
+		t.Fatalf("expected the index to survive empty, got %d, %v", total, err)
+	}
+	db0.HSet("user:2", "name", "bob")
+	if total, _, _ := db0.FTSearch("idx", SearchQuery{Query: "bob"}); total != 1 {
+		t.Fatal("expected the index to keep indexing after a flush")
+	}
+}
+
+func TestServerFreeMemoryUnderLimit(t *testing.T) {
+	srv := NewServer(NewStore(), DefaultConfig())
+	db := srv.database(3)
+	db.Set("k", "v")
+
+	// Under the limit no database is locked, so a held lock can't stall
+	// every write command.
+	db.mu.Lock()
+	done := make(chan error, 1)
+	go func() { done <- srv.freeMemory() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		db.mu.Unlock()
+		t.Fatal("freeMemory waited for a database lock without a memory limit")
+	}
+	db.mu.Unlock()
+
+	db.SetMaxMemory(1, AllKeysLRU)
+	if err := srv.freeMemory(); err != nil || db.DBSize() != 0 {
+		t.Fatalf("expected the key to be evicted over the limit, got %v", err)
+	}
+}
+
+func TestReplyEncoding(t *testing.T) {
+	pairs := respMap([]Reply{respBulk("f"), respDouble(1.5)})
+	cases := []struct {
+		reply Reply
+		resp2 string
+		resp3 string
+	}{
+		{respNullBulk(), "$-1\r\n", "_\r\n"},
+		{pairs, "*2\r\n$1\r\nf\r\n$3\r\n1.5\r\n", "%1\r\n$1\r\nf\r\n,1.5\r\n"},
+		{respSet([]string{"a"}), "*1\r\n$1\r\na\r\n", "~1\r\n$1\r\na\r\n"},
+		{respBool(true), ":1\r\n", "#t\r\n"},
+		{respDouble(math.Inf(-1)), "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{respVerbatim("x"), "$1\r\nx\r\n", "=5\r\ntxt:x\r\n"},
+		{respErrorCode("NOPROTO", "bad"), "-NOPROTO bad\r\n", "-NOPROTO bad\r\n"},
+	}
+	for _, c := range cases {
+		if got := string(encodeReply(c.reply, 2)); got != c.resp2 {
+			t.Errorf("RESP2 encoding of %#v: got %q, want %q", c.reply, got, c.resp2)
+		}
+		if got := string(encodeReply(c.reply, 3)); got != c.resp3 {
+			t.Errorf("RESP3 encoding of %#v: got %q, want %q", c.reply, got, c.resp3)
+		}
+		parsed, err := parseReply(bufio.NewReader(strings.NewReader(c.resp3)))
+		if err != nil || !reflect.DeepEqual(parsed, c.reply) {
+			t.Errorf("parsing %q: got %#v, %v", c.resp3, parsed, err)
+		}
+	}
+}
+
+func TestZScore(t *testing.T) {
+	store := NewStore()
+	store.ZAdd("z", 2.5, "a")
+	if score, ok, _ := store.ZScore("z", "a"); !ok || score != 2.5 {
+		t.Fatalf("expected 2.5, got %v (ok=%v)", score, ok)
+	}
+	if _, ok, _ := store.ZScore("z", "b"); ok {
+		t.Fatal("expected no score for a missing member")
+	}
+	store.Set("s", "v")
+	if _, _, err := store.ZScore("s", "a"); err != ErrWrongType {
+		t.Fatalf("expected WRONGTYPE for a string key, got %v", err)
+	}
+}
+
+// serveLoopback serves srv on a loopback port until the test ends and
+// returns its address, along with a channel that receives Serve's result.
+func serveLoopback(tb testing.TB, ctx context.Context, srv *Server) (string, <-chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	done, stopped := make(chan error, 1), make(chan struct{})
+	go func() {
+		done <- srv.Serve(ctx, ln)
+		close(stopped)
+	}()
+	tb.Cleanup(func() {
+		srv.Shutdown(shutdownNoSave)
+		<-stopped
+	})
+	return ln.Addr().String(), done
+}
+
+// benchmarkServer serves a fresh server on a loopback port and returns a
+// connection to it.
+func benchmarkServer(b *testing.B) net.Conn {
+	addr, _ := serveLoopback(b, context.Background(), NewServer(NewStore(), DefaultConfig()))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// benchmarkPipeline sends b.N commands in batches of depth, as
+// redis-benchmark -P does, reading every reply of a batch before the next.
+func benchmarkPipeline(b *testing.B, depth int, args ...string) {
+	conn := benchmarkServer(b)
+	reader := bufio.NewReader(conn)
+	req := encodeReply(respArray(args), 2)
+	batch := make([]byte, 0, len(req)*depth)
+	for i := 0; i < depth; i++ {
+		batch = append(batch, req...)
+	}
+	b.SetBytes(int64(len(req)))
+	b.ResetTimer()
+	for sent := 0; sent < b.N; sent += depth {
+		n := min(depth, b.N-sent)
+		if _, err := conn.Write(batch[:n*len(req)]); err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if r, err := parseReply(reader); err != nil {
+				b.Fatal(err)
+			} else if e, ok := r.(errorReply); ok {
+				b.Fatal(string(e))
+			}
+		}
+	}
+}
+
+func BenchmarkPing(b *testing.B)             { benchmarkPipeline(b, 1, "PING") }
+func BenchmarkPingPipelined(b *testing.B)    { benchmarkPipeline(b, 16, "PING") }
+func BenchmarkSet(b *testing.B)              { benchmarkPipeline(b, 1, "SET", "key:000000000042", "xxx") }
+func BenchmarkSetPipelined(b *testing.B)     { benchmarkPipeline(b, 16, "SET", "key:000000000042", "xxx") }
+func BenchmarkGet(b *testing.B)              { benchmarkPipeline(b, 1, "GET", "key:000000000042") }
+func BenchmarkGetPipelined(b *testing.B)     { benchmarkPipeline(b, 16, "GET", "key:000000000042") }
+func BenchmarkIncrPipelined(b *testing.B)    { benchmarkPipeline(b, 16, "INCR", "counter") }
+func BenchmarkHGetAllPipelined(b *testing.B) { benchmarkPipeline(b, 16, "HGETALL", "myhash") }
+
+func BenchmarkReplyEncoding(b *testing.B) {
+	reply := respRawArray([]Reply{respInt(1718000000000), respBulk("value"), respNullBulk(), respDouble(0.5)})
+	buf := make([]byte, 0, 128)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = reply.appendRESP(buf[:0], 3)
+	}
+}
+
+func TestParseRESPLimits(t *testing.T) {
+	limits := protoLimits{maxBulkLen: 4, maxMultibulk: 2}
+	cases := []struct {
+		in   string
+		want []string
+		err  bool
+	}{
+		{in: "*2\r\n$3\r\nGET\r\n$4\r\nk\x00\r\n\r\n", want: []string{"GET", "k\x00\r\n"}},
+		{in: "*0\r\n"},
+		{in: "*-1\r\n"},
+		{in: "*3\r\n", err: true},                // too many arguments
+		{in: "*1\r\n$5\r\nhello\r\n", err: true}, // bulk too long
+		{in: "*1\r\n$-1\r\n", err: true},         // null bulk in a request
+		{in: "*01\r\n$1\r\na\r\n", err: true},    // leading zero
+		{in: "*1\n$1\r\na\r\n", err: true},       // bare \n
+		{in: "*1\r\n$1\r\nab\r\n", err: true},    // payload longer than declared
+		{in: "*1\r\n+OK\r\n", err: true},         // not a bulk string
+		{in: "*1\r\n$99999999999999999999\r\n", err: true},
+	}
+	for _, c := range cases {
+		got, err := parseRESP(bufio.NewReader(strings.NewReader(c.in)), limits)
+		if (err != nil) != c.err || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseRESP(%q) = %q, %v", c.in, got, err)
+		}
+	}
+}
+
+func TestParseRESPLargeDeclaredLength(t *testing.T) {
+	// A client declaring the largest allowed argument and then stalling must
+	// not get the whole length allocated.
+	in := "*1\r\n$" + strconv.FormatInt(defaultProtoLimits.maxBulkLen, 10) + "\r\nshort"
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := parseRESP(bufio.NewReader(strings.NewReader(in)), defaultProtoLimits)
+	runtime.ReadMemStats(&after)
+	if err == nil {
+		t.Fatal("expected an error for a truncated argument")
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Fatalf("parsing allocated %d bytes for a 5-byte argument", n)
+	}
+
+	// Arguments longer than the preallocation still arrive whole.
+	long := strings.Repeat("x", 3*bulkPrealloc+1)
+	got, err := parseRESP(bufio.NewReader(strings.NewReader("*1\r\n$"+strconv.Itoa(len(long))+"\r\n"+long+"\r\n")), defaultProtoLimits)
+	if err != nil || len(got) != 1 || got[0] != long {
+		t.Fatalf("expected the long argument back, got %d arguments, %v", len(got), err)
+	}
+}
+
+func TestParseRESPAllocs(t *testing.T) {
+	// One allocation for the argument slice and one per argument.
+	req := []byte("*3\r\n$3\r\nSET\r\n$16\r\nkey:000000000042\r\n$100\r\n" + strings.Repeat("x", 100) + "\r\n")
+	src := bytes.NewReader(req)
+	reader := bufio.NewReader(src)
+	allocs := testing.AllocsPerRun(100, func() {
+		src.Reset(req)
+		reader.Reset(src)
+		if _, err := parseRESP(reader, defaultProtoLimits); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 4 {
+		t.Fatalf("parsing a 3-argument request took %v allocations, want 4", allocs)
+	}
+}
+
+func BenchmarkParseRESP(b *testing.B) {
+	req := []byte("*3\r\n$3\r\nSET\r\n$16\r\nkey:000000000042\r\n$1024\r\n" + strings.Repeat("x", 1024) + "\r\n")
+	src := bytes.NewReader(req)
+	reader := bufio.NewReader(src)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(req)))
+	for i := 0; i < b.N; i++ {
+		src.Reset(req)
+		reader.Reset(src)
+		if _, err := parseRESP(reader, defaultProtoLimits); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func FuzzParseRESP(f *testing.F) {
+	for _, seed := range []string{
+		"*1\r\n$4\r\nPING\r\n",
+		"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n",
+		"*2\r\n$3\r\nGET\r\n$3\r\n\r\n\x00\r\n",
+		"*0\r\n", "*-1\r\n", "*1\r\n$-1\r\n", "*2\r\n$1\r\na\r\n",
+		"*1\r\n$1000\r\nx\r\n", "*100000\r\n", "*1\r\n$1\r\nab\r\n", "*1\n$1\na\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	limits := protoLimits{maxBulkLen: 64, maxMultibulk: 16}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		src := bytes.NewReader(data)
+		reader := bufio.NewReader(src)
+		parts, err := parseRESP(reader, limits)
+		if err != nil || len(parts) == 0 {
+			return
+		}
+		// Only canonical requests parse, so encoding the arguments again
+		// must reproduce exactly the bytes that were consumed.
+		consumed := len(data) - src.Len() - reader.Buffered()
+		if enc := encodeReply(respArray(parts), 2); !bytes.Equal(enc, data[:consumed]) {
+			t.Fatalf("parsed %q from %q, which encodes as %q", parts, data[:consumed], enc)
+		}
+	})
+}
+
+func TestSplitInlineArgs(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []string
+		err  bool
+	}{
+		{in: "SET greeting \"hello world\"\r\n", want: []string{"SET", "greeting", "hello world"}},
+		{in: "  GET   k  ", want: []string{"GET", "k"}},
+		{in: "\r\n"},
+		{in: `SET k "a\"b\\c\n\x41\x4a\xzz"`, want: []string{"SET", "k", "a\"b\\c\nAJxzz"}},
+		{in: `SET k 'it\'s "raw" \n'`, want: []string{"SET", "k", `it's "raw" \n`}},
+		{in: `SET k ""`, want: []string{"SET", "k", ""}},
+		{in: `SET pre"fix ed"`, want: []string{"SET", "prefix ed"}},
+		{in: `SET k "open`, err: true},
+		{in: `SET k 'open`, err: true},
+		{in: `SET k "a"b`, err: true},
+		{in: `SET k 'a'b`, err: true},
+	}
+	for _, c := range cases {
+		got, err := splitInlineArgs(c.in)
+		if (err != nil) != c.err || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("splitInlineArgs(%q) = %q, %v", c.in, got, err)
+		}
+	}
+}
+
+func TestWrongTypeLeavesValue(t *testing.T) {
+	store := NewStore()
+	store.HSet("h", "f", "v")
+	store.LPush("l", "a")
+	store.BFAdd("bf", "x")
+
+	checks := map[string]error{}
+	_, _, checks["GET"] = store.Get("l")
+	_, checks["INCR"] = store.Incr("h")
+	_, checks["LPUSH"] = store.LPush("h", "x")
+	_, _, checks["RPOP"] = store.RPop("h")
+	_, checks["LLEN"] = store.LLen("h")
+	_, checks["SADD"] = store.SAdd("l", "x")
+	_, checks["SMEMBERS"] = store.SMembers("h")
+	_, checks["HSET"] = store.HSet("l", "f", "v")
+	_, _, checks["HGET"] = store.HGet("l", "f")
+	_, checks["HGETALL"] = store.HGetAll("l")
+	_, checks["ZADD"] = store.ZAdd("h", 1, "m")
+	_, checks["ZRANGE"] = store.ZRange("h", 0, -1)
+	_, _, checks["HSCAN"] = store.HScan("l", 0, "", 10)
+	_, checks["BF.ADD"] = store.BFAdd("h", "x")
+	_, checks["JSON.SET"] = store.JSONSet("bf", "$", "1", false, false)
+	for cmd, err := range checks {
+		if err != ErrWrongType {
+			t.Errorf("%s on the wrong type: expected WRONGTYPE, got %v", cmd, err)
+		}
+	}
+	if all, _ := store.HGetAll("h"); all["f"] != "v" || len(all) != 1 {
+		t.Fatalf("expected the hash to be untouched, got %v", all)
+	}
+	if n, _ := store.LLen("l"); n != 1 {
+		t.Fatalf("expected the list to be untouched, got length %d", n)
+	}
+
+	store.Set("n", "abc")
+	if _, err := store.Incr("n"); err != ErrNotInteger {
+		t.Fatalf("expected a not-an-integer error, got %v", err)
+	}
+	got := string(encodeReply(respErrorFrom(ErrWrongType), 2))
+	if got != "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n" {
+		t.Fatalf("unexpected WRONGTYPE reply %q", got)
+	}
+	if got := string(encodeReply(respErrorFrom(errors.New("boom")), 2)); got != "-ERR boom\r\n" {
+		t.Fatalf("expected other errors to get ERR, got %q", got)
+	}
+}
+
+func TestConfigFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	orig := "# test config\nport 7000\nsave 900 1\n\nmaxmemory 2mb\nsave 60 100\nunknown-to-rewrite yes\n"
+	if err := os.WriteFile(path, []byte(orig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	if err := LoadConfigFile(path, &cfg); err == nil {
+		t.Fatal("expected an unknown parameter to be an error")
+	}
+	orig = strings.Replace(orig, "unknown-to-rewrite yes\n", "", 1)
+	os.WriteFile(path, []byte(orig), 0o644)
+	cfg = DefaultConfig()
+	if err := LoadConfigFile(path, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 7000 || cfg.MaxMemory != 2<<20 || !reflect.DeepEqual(cfg.Save, []SaveRule{{900, 1}, {60, 100}}) {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+
+	srv := NewServer(NewStore(), cfg)
+	if err := srv.setConfig([]string{"timeout", "30", "maxmemory-policy", "allkeys-lru"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.setConfig([]string{"timeout", "5", "port", "7001"}); err == nil || srv.config().Timeout != 30*time.Second {
+		t.Fatalf("expected an immutable parameter to fail the whole CONFIG SET, got %v", err)
+	}
+	if err := srv.setConfig([]string{"maxmemory", "lots"}); err == nil {
+		t.Fatal("expected an invalid value to be an error")
+	}
+	for _, v := range []string{"9999999999gb", "99999999999999999999"} {
+		if err := srv.setConfig([]string{"maxmemory", v}); err == nil || !strings.Contains(err.Error(), "out of range") {
+			t.Fatalf("expected maxmemory %s to be out of range, got %v", v, err)
+		}
+	}
+	if mem := srv.database(0).MemoryStats(); mem.Max != 2<<20 || mem.Policy != AllKeysLRU {
+		t.Fatalf("expected the memory limit to be applied, got %+v", mem)
+	}
+	srv.setConfig([]string{"save", ""})
+
+	if err := RewriteConfigFile(path, srv.config()); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	want := "# test config\nport 7000\nsave \"\"\n\nmaxmemory 2097152\n" +
+		"# Generated by CONFIG REWRITE\ntimeout 30\nmaxmemory-policy allkeys-lru\n"
+	if string(data) != want {
+		t.Fatalf("rewritten config:\n%s\nwant:\n%s", data, want)
+	}
+	reloaded := DefaultConfig()
+	if err := LoadConfigFile(path, &reloaded); err != nil || !reflect.DeepEqual(reloaded, srv.config()) {
+		t.Fatalf("expected the rewritten file to load the same config, got %+v (err=%v)", reloaded, err)
+	}
+}
+
+func TestDebugAdvanceClock(t *testing.T) {
+	advance := func(store *Store, setting, ms string) string {
+		t.Helper()
+		cfg := DefaultConfig()
+		cfg.DebugCommand = setting
+		addr, _ := serveLoopback(t, context.Background(), NewServer(store, cfg))
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write(encodeReply(respArray([]string{"DEBUG", "ADVANCE-CLOCK", ms}), 2))
+		r, err := parseReply(bufio.NewReader(conn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(encodeReply(r, 2))
+	}
+
+	store := NewStore()
+	before := store.Now()
+	if got := advance(store, "no", "60000"); !strings.Contains(got, "not allowed") {
+		t.Fatalf("expected the real clock to be protected by default, got %q", got)
+	}
+	if store.Now().Sub(before) > time.Minute/2 {
+		t.Fatal("the clock moved although the command was refused")
+	}
+	if got := advance(store, "local", "60000"); got != "+OK\r\n" {
+		t.Fatalf("expected a loopback client to be allowed with local, got %q", got)
+	}
+	if got := advance(store, "yes", "9300000000000"); !strings.Contains(got, "out of range") {
+		t.Fatalf("expected an overflowing duration to be refused, got %q", got)
+	}
+	// Each advance fits on its own but together they would wrap the offset.
+	if got := advance(store, "yes", "5000000000000"); got != "+OK\r\n" {
+		t.Fatalf("expected a large advance to be allowed, got %q", got)
+	}
+	moved := store.Now()
+	if got := advance(store, "yes", "5000000000000"); !strings.Contains(got, "out of range") {
+		t.Fatalf("expected an advance wrapping the offset to be refused, got %q", got)
+	}
+	if store.Now().Before(moved) {
+		t.Fatal("the clock went backwards")
+	}
+	if got := advance(NewStoreWithClock(NewFakeClock(time.Now())), "no", "1000"); got != "+OK\r\n" {
+		t.Fatalf("expected a fake clock to be adjustable, got %q", got)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	ask := func(t *testing.T, conn net.Conn, reader *bufio.Reader, args ...string) Reply {
+		t.Helper()
+		if _, err := conn.Write(encodeReply(respArray(args), 2)); err != nil {
+			t.Fatal(err)
+		}
+		r, err := parseReply(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	waitServe := func(t *testing.T, done <-chan error) {
+		t.Helper()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Serve returned %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Serve did not return")
+		}
+	}
+	expectClosed := func(t *testing.T, reader *bufio.Reader) {
+		t.Helper()
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Fatalf("expected the server to close the connection, got %v", err)
+		}
+	}
+
+	t.Run("context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		addr, done := serveLoopback(t, ctx, NewServer(NewStore(), DefaultConfig()))
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if r := ask(t, conn, reader, "SET", "k", "v"); !reflect.DeepEqual(r, respSimple("OK")) {
+			t.Fatalf("SET: got %#v", r)
+		}
+		cancel()
+		waitServe(t, done)
+		expectClosed(t, reader)
+		if _, err := net.Dial("tcp", addr); err == nil {
+			t.Fatal("still accepting connections after shutdown")
+		}
+	})
+
+	t.Run("command", func(t *testing.T) {
+		addr, done := serveLoopback(t, context.Background(), NewServer(NewStore(), DefaultConfig()))
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		other, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+		reader, otherReader := bufio.NewReader(conn), bufio.NewReader(other)
+		if r := ask(t, other, otherReader, "PING"); !reflect.DeepEqual(r, respSimple("PONG")) {
+			t.Fatalf("PING: got %#v", r)
+		}
+
+		for _, args := range [][]string{{"SHUTDOWN", "ABORT"}, {"SHUTDOWN", "SAVE", "NOSAVE"}, {"SHUTDOWN", "NOW"}} {
+			if r := ask(t, conn, reader, args...); reflect.TypeOf(r) != reflect.TypeOf(respError("")) {
+				t.Fatalf("%v: expected an error, got %#v", args, r)
+			}
+		}
+
+		// Replies to commands pipelined ahead of SHUTDOWN still arrive.
+		if _, err := conn.Write(encodeReply(respArray([]string{"SET", "k", "v"}), 2)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(encodeReply(respArray([]string{"SHUTDOWN", "NOSAVE"}), 2)); err != nil {
+			t.Fatal(err)
+		}
+		if r, err := parseReply(reader); err != nil || !reflect.DeepEqual(r, respSimple("OK")) {
+			t.Fatalf("SET before SHUTDOWN: got %#v, %v", r, err)
+		}
+		waitServe(t, done)
+		expectClosed(t, reader)
+		expectClosed(t, otherReader)
+	})
+}
+
+func TestACLRules(t *testing.T) {
+	acl := newACL()
+	if err := acl.setUser("alice", []string{"on", ">secret", "~cache:*", "%R~shared:*", "+@read", "+set", "-@dangerous", "+config|get"}); err != nil {
+		t.Fatal(err)
+	}
+	u := acl.user("alice")
+	for _, tc := range []struct {
+		cmd, sub string
+		want     bool
+	}{
+		{"GET", "", true}, {"HGETALL", "", true}, {"SET", "", true}, {"DEL", "", false},
+		{"KEYS", "", false}, {"CONFIG", "GET", true}, {"CONFIG", "SET", false}, {"FLUSHALL", "", false},
+	} {
+		if got := u.canRun(tc.cmd, tc.sub); got != tc.want {
+			t.Errorf("canRun(%s %s) = %v, want %v", tc.cmd, tc.sub, got, tc.want)
+		}
+	}
+	for _, tc := range []struct {
+		key  string
+		perm keyPerm
+		want bool
+	}{
+		{"cache:1", keyWrite, true}, {"shared:1", keyRead, true}, {"shared:1", keyWrite, false}, {"other", keyRead, false},
+	} {
+		if got := u.canAccessKey(tc.key, tc.perm); got != tc.want {
+			t.Errorf("canAccessKey(%s, %d) = %v, want %v", tc.key, tc.perm, got, tc.want)
+		}
+	}
+	if !u.checkPassword("secret") || u.checkPassword("wrong") {
+		t.Fatal("password check failed")
+	}
+	if want := "on #" + hashPassword("secret") + " ~cache:* %R~shared:* resetchannels -@all +@read +set -@dangerous +config|get"; u.rules() != want {
+		t.Fatalf("rules:\n got %q\nwant %q", u.rules(), want)
+	}
+
+	// A bad rule leaves the user as it was.
+	if err := acl.setUser("alice", []string{"off", "+nosuchcommand"}); err == nil {
+		t.Fatal("expected an error for an unknown command")
+	}
+	if !acl.user("alice").enabled {
+		t.Fatal("failed SETUSER changed the user")
+	}
+	if _, err := acl.deleteUsers([]string{"default"}); err == nil {
+		t.Fatal("expected the default user to be undeletable")
+	}
+
+	// Users round-trip through an ACL file.
+	path := filepath.Join(t.TempDir(), "users.acl")
+	if err := acl.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newACL()
+	if err := loaded.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"default", "alice"} {
+		if got, want := loaded.user(name).rules(), acl.user(name).rules(); got != want {
+			t.Errorf("%s after load: got %q, want %q", name, got, want)
+		}
+	}
+
+	acl.setRequirePass("hunter2")
+	if !acl.authRequired() || !acl.user("default").checkPassword("hunter2") {
+		t.Fatal("requirepass did not protect the default user")
+	}
+}
+
+func TestACLOverConnection(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RequirePass = "adminpass"
+	srv := NewServer(NewStore(), cfg)
+	addr, _ := serveLoopback(t, context.Background(), srv)
+	dial := func() (net.Conn, func(args ...string) string) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		reader := bufio.NewReader(conn)
+		return conn, func(args ...string) string {
+			t.Helper()
+			if _, err := conn.Write(encodeReply(respArray(args), 2)); err != nil {
+				t.Fatal(err)
+			}
+			r, err := parseReply(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(encodeReply(r, 2))
+		}
+	}
+
+	_, admin := dial()
+	if got := admin("GET", "k"); !strings.HasPrefix(got, "-NOAUTH") {
+		t.Fatalf("GET before AUTH: %q", got)
+	}
+	if got := admin("AUTH", "wrong"); !strings.HasPrefix(got, "-WRONGPASS") {
+		t.Fatalf("AUTH with a wrong password: %q", got)
+	}
+	if got := admin("AUTH", "adminpass"); got != "+OK\r\n" {
+		t.Fatalf("AUTH: %q", got)
+	}
+	if got := admin("ACL", "SETUSER", "app", "on", ">apppass", "~app:*", "+@all", "-@dangerous"); got != "+OK\r\n" {
+		t.Fatalf("ACL SETUSER: %q", got)
+	}
+
+	appConn, app := dial()
+	if got := app("HELLO", "3", "AUTH", "app", "apppass"); !strings.HasPrefix(got, "*14") {
+		t.Fatalf("HELLO AUTH: %q", got)
+	}
+	if got := app("ACL", "WHOAMI"); got != "$3\r\napp\r\n" {
+		t.Fatalf("ACL WHOAMI: %q", got)
+	}
+	if got := app("SET", "app:1", "v"); got != "+OK\r\n" {
+		t.Fatalf("SET in the allowed keys: %q", got)
+	}
+	for _, args := range [][]string{{"SET", "other", "v"}, {"SET", "other", "v"}, {"DUMPALL"}} {
+		if got := app(args...); !strings.HasPrefix(got, "-NOPERM") {
+			t.Fatalf("%v: %q", args, got)
+		}
+	}
+
+	if got := admin("ACL", "LOG", "1"); !strings.Contains(got, "$7\r\ndumpall\r\n") {
+		t.Fatalf("ACL LOG 1: %q", got)
+	}
+	entries := srv.acl.logEntries(10)
+	if len(entries) != 3 || entries[1].reason != "key" || entries[1].object != "other" || entries[1].count != 2 {
+		t.Fatalf("ACL LOG entries: %+v", entries)
+	}
+	if entries[2].reason != "auth" || entries[2].username != "default" {
+		t.Fatalf("failed AUTH entry: %+v", entries[2])
+	}
+
+	// Deleting a user disconnects its clients.
+	if got := admin("ACL", "DELUSER", "app"); got != ":1\r\n" {
+		t.Fatalf("ACL DELUSER: %q", got)
+	}
+	if _, err := appConn.Write(encodeReply(respArray([]string{"PING"}), 2)); err != nil {
+		t.Fatal(err)
+	}
+	appConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := appConn.Read(make([]byte, 64)); err != io.EOF {
+		t.Fatalf("expected a deleted user's client to be disconnected, read %d bytes, %v", n, err)
+	}
+}
+
+// writeTestCert writes a certificate for a new key, signed by parent or
+// self-signed as a CA if parent is nil, to name.crt and name.key in dir.
+func writeTestCert(t *testing.T, dir, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (string, string, *x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert, key
+}
+
+func TestACLKeyPermissions(t *testing.T) {
+	srv := NewServer(NewStore(), DefaultConfig())
+	addr, _ := serveLoopback(t, context.Background(), srv)
+	login := func(user string) func(args ...string) string {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		reader := bufio.NewReader(conn)
+		send := func(args ...string) string {
+			t.Helper()
+			if _, err := conn.Write(encodeReply(respArray(args), 2)); err != nil {
+				t.Fatal(err)
+			}
+			r, err := parseReply(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(encodeReply(r, 2))
+		}
+		if user != "" {
+			if got := send("AUTH", user, "pass"); got != "+OK\r\n" {
+				t.Fatalf("AUTH %s: %q", user, got)
+			}
+		}
+		return send
+	}
+	admin := login("")
+	for _, setup := range [][]string{
+		{"ACL", "SETUSER", "app", "on", ">pass", "~app:*", "+@all"},
+		{"ACL", "SETUSER", "reader", "on", ">pass", "%R~*", "+@all"},
+		{"ACL", "SETUSER", "mover", "on", ">pass", "%R~src:*", "~dst:*", "+@all"},
+		{"HSET", "secret:1", "name", "hidden"},
+		{"FT.CREATE", "idx", "ON", "HASH", "PREFIX", "1", "secret:", "SCHEMA", "name", "TEXT"},
+		{"TS.CREATE", "secret:ts", "LABELS", "kind", "secret"},
+		{"SET", "src:1", "v"},
+		{"CMS.INITBYDIM", "secret:cms", "10", "5"},
+		{"CMS.INITBYDIM", "src:cms", "10", "5"},
+		{"CMS.INITBYDIM", "dst:cms", "10", "5"},
+	} {
+		if got := admin(setup...); strings.HasPrefix(got, "-") {
+			t.Fatalf("%v: %q", setup, got)
+		}
+	}
+
+	// Commands that read keys without naming them need every key.
+	anyKey := [][]string{
+		{"DUMPALL"}, {"ANALYZE"}, {"FT.SEARCH", "idx", "*"},
+		{"TS.MRANGE", "-", "+", "FILTER", "kind=secret"},
+		{"TS.MREVRANGE", "-", "+", "FILTER", "kind=secret"},
+		{"TS.QUERYINDEX", "kind=secret"},
+	}
+	app, reader := login("app"), login("reader")
+	for _, args := range anyKey {
+		if got := app(args...); !strings.HasPrefix(got, "-NOPERM") {
+			t.Fatalf("%v as app: %q", args, got)
+		}
+		if got := reader(args...); strings.HasPrefix(got, "-") {
+			t.Fatalf("%v as reader: %q", args, got)
+		}
+	}
+	if got := reader("FT.DROPINDEX", "idx", "DD"); !strings.HasPrefix(got, "-NOPERM") {
+		t.Fatalf("FT.DROPINDEX DD with read-only keys: %q", got)
+	}
+
+	// COPY reads its source; RENAME also deletes it, so needs write too.
+	mover := login("mover")
+	if got := mover("COPY", "src:1", "dst:1"); got != ":1\r\n" {
+		t.Fatalf("COPY from a readable source: %q", got)
+	}
+	if got := mover("COPY", "dst:1", "src:2"); !strings.HasPrefix(got, "-NOPERM") {
+		t.Fatalf("COPY into a read-only key: %q", got)
+	}
+	if got := mover("RENAME", "src:1", "dst:2"); !strings.HasPrefix(got, "-NOPERM") {
+		t.Fatalf("RENAME of a read-only key: %q", got)
+	}
+	if got := mover("RENAME", "dst:1", "dst:2"); got != "+OK\r\n" {
+		t.Fatalf("RENAME within writable keys: %q", got)
+	}
+
+	// CMS.MERGE reads every source it is given.
+	if got := mover("CMS.MERGE", "dst:cms", "2", "src:cms", "secret:cms"); !strings.HasPrefix(got, "-NOPERM") {
+		t.Fatalf("CMS.MERGE from an unreadable source: %q", got)
+	}
+	if got := mover("CMS.MERGE", "dst:cms", "1", "src:cms"); got != "+OK\r\n" {
+		t.Fatalf("CMS.MERGE from a readable source: %q", got)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	_, _, ca, caKey := writeTestCert(t, dir, "ca", 1, nil, nil)
+	certFile, keyFile, _, _ := writeTestCert(t, dir, "server", 2, ca, caKey)
+	clientCert, clientKey, _, _ := writeTestCert(t, dir, "client", 3, ca, caKey)
+	caFile := filepath.Join(dir, "ca.crt")
+
+	cfg := DefaultConfig()
+	cfg.TLSPort = 1 // only checked for being set; the test serves its own listener
+	cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSCACertFile = certFile, keyFile, caFile
+	srv := NewServer(NewStore(), cfg)
+	if err := srv.tlsConfig.reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(context.Background(), srv.tlsListener(ln)) }()
+	t.Cleanup(func() {
+		srv.Shutdown(shutdownNoSave)
+		<-done
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	pair, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withCert := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{pair}}
+	// ping returns the serial number of the certificate the server presented.
+	ping := func(conf *tls.Config) (int64, error) {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), conf)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(encodeReply(respArray([]string{"PING"}), 2)); err != nil {
+			return 0, err
+		}
+		r, err := parseReply(bufio.NewReader(conn))
+		if err != nil {
+			return 0, err
+		}
+		if r != respSimple("PONG") {
+			return 0, fmt.Errorf("PING: got %#v", r)
+		}
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+	}
+
+	if serial, err := ping(withCert); err != nil || serial != 2 {
+		t.Fatalf("PING with a client certificate: serial %d, %v", serial, err)
+	}
+	if _, err := ping(&tls.Config{RootCAs: roots}); err == nil {
+		t.Fatal("a client without a certificate was let in")
+	}
+	tls12 := withCert.Clone()
+	tls12.MaxVersion = tls.VersionTLS12
+	if _, err := ping(tls12); err != nil {
+		t.Fatalf("TLS 1.2 client: %v", err)
+	}
+	if err := srv.setConfig([]string{"tls-protocols", "TLSv1.3"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ping(tls12); err == nil {
+		t.Fatal("TLS 1.2 client let in after tls-protocols TLSv1.3")
+	}
+
+	// A rewritten certificate is picked up by the next client.
+	writeTestCert(t, dir, "server", 4, ca, caKey)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	if serial, err := ping(withCert); err != nil || serial != 4 {
+		t.Fatalf("PING after rotating the certificate: serial %d, %v", serial, err)
+	}
+
+	// A certificate that does not load leaves the previous one in use.
+	if err := srv.setConfig([]string{"tls-cert-file", filepath.Join(dir, "missing.crt")}); err == nil {
+		t.Fatal("CONFIG SET accepted a missing certificate")
+	}
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if serial, err := ping(withCert); err != nil || serial != 4 {
+		t.Fatalf("PING after a bad rewrite: serial %d, %v", serial, err)
+	}
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Duplicate policies decide what TS.ADD does when a sample already exists at
+// the same timestamp.
+const (
+	tsPolicyBlock = "BLOCK"
+	tsPolicyFirst = "FIRST"
+	tsPolicyLast  = "LAST"
+	tsPolicyMin   = "MIN"
+	tsPolicyMax   = "MAX"
+	tsPolicySum   = "SUM"
+)
+
+// TimeSeries holds samples ordered by timestamp (milliseconds).
+type TimeSeries struct {
+	Retention       int64 // ms, 0 keeps samples forever
+	DuplicatePolicy string
+	Labels          map[string]string
+	Samples         []Sample
+	Rules           []*CompactionRule
+	SourceKey       string // set on series written by a compaction rule
+}
+
+// Sample is a single data point.
+type Sample struct {
+	Timestamp int64
+	Value     float64
+}
+
+// CompactionRule downsamples every new sample of a series into DestKey.
+// Bucket holds the aggregate of the bucket currently being filled.
+type CompactionRule struct {
+	DestKey        string
+	Aggregation    string
+	BucketDuration int64
+	BucketStart    int64
+	Bucket         *Aggregator
+}
+
+// TSOptions configure a series when it is created.
+type TSOptions struct {
+	Retention       int64
+	DuplicatePolicy string
+	Labels          map[string]string
+}
+
+// TSAggregation requests bucketed aggregation in range queries.
+type TSAggregation struct {
+	Type           string
+	BucketDuration int64
+}
+
+// TSFilter is one label matcher of TS.MRANGE/TS.QUERYINDEX FILTER.
+type TSFilter struct {
+	Label  string
+	Values []string // empty means "label absent" (or "present" when Negate)
+	Negate bool
+}
+
+// TSSeriesResult is one series matched by a multi-series query.
+type TSSeriesResult struct {
+	Key     string
+	Labels  map[string]string
+	Samples []Sample
+}
+
+// Aggregator accumulates the samples of one bucket.
+type Aggregator struct {
+	Count       int64
+	Sum         float64
+	Min         float64
+	Max         float64
+	First       float64
+	Last        float64
+	SumSquares  float64
+	HasSamples  bool
+	Aggregation string
+}
+
+var tsAggregations = map[string]bool{
+	"avg": true, "sum": true, "min": true, "max": true, "count": true,
+	"first": true, "last": true, "range": true, "std.p": true, "var.p": true,
+}
+
+// validTSAggregation normalises and checks an aggregation name.
+func validTSAggregation(name string) (string, bool) {
+	name = strings.ToLower(name)
+	return name, tsAggregations[name]
+}
+
+func validTSPolicy(policy string) (string, bool) {
+	policy = strings.ToUpper(policy)
+	switch policy {
+	case tsPolicyBlock, tsPolicyFirst, tsPolicyLast, tsPolicyMin, tsPolicyMax, tsPolicySum:
+		return policy, true
+	}
+	return policy, false
+}
+
+func (a *Aggregator) add(v float64) {
+	if !a.HasSamples {
+		a.Min, a.Max, a.First = v, v, v
+		a.HasSamples = true
+	}
+	a.Count++
+	a.Sum += v
+	a.SumSquares += v * v
+	a.Min = math.Min(a.Min, v)
+	a.Max = math.Max(a.Max, v)
+	a.Last = v
+}
+
+func (a *Aggregator) result() float64 {
+	switch a.Aggregation {
+	case "avg":
+		return a.Sum / float64(a.Count)
+	case "sum":
+		return a.Sum
+	case "min":
+		return a.Min
+	case "max":
+		return a.Max
+	case "count":
+		return float64(a.Count)
+	case "first":
+		return a.First
+	case "last":
+		return a.Last
+	case "range":
+		return a.Max - a.Min
+	case "var.p", "std.p":
+		mean := a.Sum / float64(a.Count)
+		variance := a.SumSquares/float64(a.Count) - mean*mean
+		if variance < 0 {
+			variance = 0
+		}
+		if a.Aggregation == "std.p" {
+			return math.Sqrt(variance)
+		}
+		return variance
+	}
+	return 0
+}
+
+// bucketStart aligns ts to the start of its bucket.
+func bucketStart(ts, duration int64) int64 {
+	return ts - ((ts%duration)+duration)%duration
+}
+
+// aggregateSamples folds samples (in either order) into one sample per bucket.
+func aggregateSamples(samples []Sample, agg *TSAggregation) []Sample {
+	var out []Sample
+	var cur *Aggregator
+	var start int64
+	for _, smp := range samples {
+		b := bucketStart(smp.Timestamp, agg.BucketDuration)
+		if cur != nil && b != start {
+			out = append(out, Sample{Timestamp: start, Value: cur.result()})
+			cur = nil
+		}
+		if cur == nil {
+			cur = &Aggregator{Aggregation: agg.Type}
+			start = b
+		}
+		cur.add(smp.Value)
+	}
+	if cur != nil {
+		out = append(out, Sample{Timestamp: start, Value: cur.result()})
+	}
+	return out
+}
+
+// insert adds a sample, applying the duplicate policy. It returns false if the
+// policy rejected the sample.
+func (ts *TimeSeries) insert(smp Sample, policy string) bool {
+	i := sort.Search(len(ts.Samples), func(i int) bool { return ts.Samples[i].Timestamp >= smp.Timestamp })
+	if i < len(ts.Samples) && ts.Samples[i].Timestamp == smp.Timestamp {
+		old := &ts.Samples[i].Value
+		switch policy {
+		case tsPolicyFirst:
+		case tsPolicyLast:
+			*old = smp.Value
+		case tsPolicyMin:
+			*old = math.Min(*old, smp.Value)
+		case tsPolicyMax:
+			*old = math.Max(*old, smp.Value)
+		case tsPolicySum:
+			*old += smp.Value
+		default:
+			return false
+		}
+		return true
+	}
+	ts.Samples = append(ts.Samples, Sample{})
+	copy(ts.Samples[i+1:], ts.Samples[i:])
+	ts.Samples[i] = smp
+	return true
+}
+
+// trim drops samples that fell out of the retention window.
+func (ts *TimeSeries) trim() {
+	if ts.Retention <= 0 || len(ts.Samples) == 0 {
+		return
+	}
+	cutoff := ts.Samples[len(ts.Samples)-1].Timestamp - ts.Retention
+	i := sort.Search(len(ts.Samples), func(i int) bool { return ts.Samples[i].Timestamp >= cutoff })
+	if i > 0 {
+		ts.Samples = append(ts.Samples[:0:0], ts.Samples[i:]...)
+	}
+}
+
+// window returns the samples with from <= timestamp <= to.
+func (ts *TimeSeries) window(from, to int64) []Sample {
+	lo := sort.Search(len(ts.Samples), func(i int) bool { return ts.Samples[i].Timestamp >= from })
+	hi := sort.Search(len(ts.Samples), func(i int) bool { return ts.Samples[i].Timestamp > to })
+	if lo >= hi {
+		return nil
+	}
+	return ts.Samples[lo:hi]
+}
+
+// timeSeries returns the series at key, or nil if the key doesn't exist.
+func (s *Store) timeSeries(key string) (*TimeSeries, error) {
+	val, err := s.typed(key, TimeSeriesType)
+	if val == nil {
+		return nil, err
+	}
+	return val.TimeSeries, nil
+}
+
+func (s *Store) existingTimeSeries(key string) (*TimeSeries, error) {
+	ts, err := s.timeSeries(key)
+	if err == nil && ts == nil {
+		err = errors.New("TSDB: the key does not exist")
+	}
+	return ts, err
+}
+
+func newTimeSeries(opts TSOptions) *TimeSeries {
+	ts := &TimeSeries{Retention: opts.Retention, DuplicatePolicy: opts.DuplicatePolicy, Labels: opts.Labels}
+	if ts.DuplicatePolicy == "" {
+		ts.DuplicatePolicy = tsPolicyBlock
+	}
+	if ts.Labels == nil {
+		ts.Labels = map[string]string{}
+	}
+	return ts
+}
+
+// TSCreate creates an empty series.
+func (s *Store) TSCreate(key string, opts TSOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.lookup(key); ok {
+		return errors.New("TSDB: key already exists")
+	}
+	s.setValue(key, &Value{Type: TimeSeriesType, TimeSeries: newTimeSeries(opts)})
+	return nil
+}
+
+// TSAdd appends a sample, creating the series with opts if needed. A negative
+// timestamp means "now". onDuplicate overrides the series' duplicate policy
+// when non-empty. Returns the timestamp that was stored.
+func (s *Store) TSAdd(key string, timestamp int64, value float64, opts TSOptions, onDuplicate string) (int64, error) {
+	if timestamp < 0 {
+		timestamp = s.clock.Now().UnixMilli()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts, err := s.timeSeries(key)
+	if err != nil {
+		return 0, err
+	}
+	if ts == nil {
+		ts = newTimeSeries(opts)
+		s.setValue(key, &Value{Type: TimeSeriesType, TimeSeries: ts})
+	}
+	if err := s.tsAddLocked(key, ts, Sample{Timestamp: timestamp, Value: value}, onDuplicate); err != nil {
+		return 0, err
+	}
+	return timestamp, nil
+}
+
+// TSMAdd appends one sample to each of several existing series. A negative
+// timestamp means "now". Each entry fails independently.
+func (s *Store) TSMAdd(keys []string, samples []Sample) []error {
+	now := s.clock.Now().UnixMilli()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		ts, err := s.existingTimeSeries(key)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if samples[i].Timestamp < 0 {
+			samples[i].Timestamp = now
+		}
+		errs[i] = s.tsAddLocked(key, ts, samples[i], "")
+	}
+	return errs
+}
+
+// tsAddLocked inserts a sample into the series at key and feeds it to the
+// series' compaction rules.
+func (s *Store) tsAddLocked(key string, ts *TimeSeries, smp Sample, onDuplicate string) error {
+	if n := len(ts.Samples); ts.Retention > 0 && n > 0 && smp.Timestamp < ts.Samples[n-1].Timestamp-ts.Retention {
+		return errors.New("TSDB: Timestamp is older than retention")
+	}
+	policy := ts.DuplicatePolicy
+	if onDuplicate != "" {
+		policy = onDuplicate
+	}
+	if !ts.insert(smp, policy) {
+		return errors.New("TSDB: Error at upsert, update is not supported when DUPLICATE_POLICY is set to BLOCK mode")
+	}
+	ts.trim()
+	rules := ts.Rules[:0]
+	for _, rule := range ts.Rules {
+		// A destination that was deleted or replaced ends the rule, as in Redis.
+		if dest := s.ruleDest(key, rule); dest != nil {
+			s.compact(rule, dest, smp)
+			rules = append(rules, rule)
+		}
+	}
+	clear(ts.Rules[len(rules):])
+	ts.Rules = rules
+	return nil
+}
+
+// ruleDest returns the value holding the destination series of the rule on
+// src, or nil if that series is gone or is no longer written by src.
+// Callers must hold s.mu.
+func (s *Store) ruleDest(src string, rule *CompactionRule) *Value {
+	v, ok := s.lookup(rule.DestKey)
+	if !ok || v.Type != TimeSeriesType || v.TimeSeries.SourceKey != src {
+		return nil
+	}
+	return v
+}
+
+// compact adds a sample to a rule's open bucket. When a sample lands in a later
+// bucket, the finished bucket is written to the destination series. Samples for
+// buckets that were already closed are ignored.
+func (s *Store) compact(rule *CompactionRule, dest *Value, smp Sample) {
+	b := bucketStart(smp.Timestamp, rule.BucketDuration)
+	if rule.Bucket != nil && b < rule.BucketStart {
+		return
+	}
+	if rule.Bucket != nil && b > rule.BucketStart {
+		dest.TimeSeries.insert(Sample{Timestamp: rule.BucketStart, Value: rule.Bucket.result()}, tsPolicyLast)
+		dest.TimeSeries.trim()
+		s.accountValue(dest)
+		rule.Bucket = nil
+	}
+	if rule.Bucket == nil {
+		rule.Bucket = &Aggregator{Aggregation: rule.Aggregation}
+		rule.BucketStart = b
+	}
+	rule.Bucket.add(smp.Value)
+}
+
+// TSGet returns the latest sample, if any.
+func (s *Store) TSGet(key string) (Sample, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ts, err := s.existingTimeSeries(key)
+	if err != nil || len(ts.Samples) == 0 {
+		return Sample{}, false, err
+	}
+	return ts.Samples[len(ts.Samples)-1], true, nil
+}
+
+// TSRange returns samples between from and to inclusive, optionally aggregated
+// into buckets, newest first when reverse is set. count limits the number of
+// returned samples when positive.
+func (s *Store) TSRange(key string, from, to int64, agg *TSAggregation, count int, reverse bool) ([]Sample, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ts, err := s.existingTimeSeries(key)
+	if err != nil {
+		return nil, err
+	}
+	return rangeSamples(ts, from, to, agg, count, reverse), nil
+}
+
+func rangeSamples(ts *TimeSeries, from, to int64, agg *TSAggregation, count int, reverse bool) []Sample {
+	window := ts.window(from, to)
+	out := make([]Sample, len(window))
+	copy(out, window)
+	if agg != nil {
+		out = aggregateSamples(out, agg)
+	}
+	if reverse {
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+	}
+	if count > 0 && len(out) > count {
+		out = out[:count]
+	}
+	return out
+}
+
+// TSDel removes samples between from and to inclusive and returns how many were removed.
+func (s *Store) TSDel(key string, from, to int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts, err := s.existingTimeSeries(key)
+	if err != nil {
+		return 0, err
+	}
+	lo := sort.Search(len(ts.Samples), func(i int) bool { return ts.Samples[i].Timestamp >= from })
+	hi := sort.Search(len(ts.Samples), func(i int) bool { return ts.Samples[i].Timestamp > to })
+	if lo >= hi {
+		return 0, nil
+	}
+	ts.Samples = append(ts.Samples[:lo], ts.Samples[hi:]...)
+	return hi - lo, nil
+}
+
+// TSCreateRule downsamples src into dest. Both series must exist, and rules
+// can't be chained: dest may not have rules of its own or already be a target.
+func (s *Store) TSCreateRule(src, dest string, agg TSAggregation) error {
+	if src == dest {
+		return errors.New("TSDB: the source key and destination key should be different")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srcTS, err := s.existingTimeSeries(src)
+	if err != nil {
+		return err
+	}
+	destTS, err := s.existingTimeSeries(dest)
+	if err != nil {
+		return err
+	}
+	if srcTS.SourceKey != "" || destTS.SourceKey != "" || len(destTS.Rules) > 0 {
+		return errors.New("TSDB: the destination key already has a src rule")
+	}
+	srcTS.Rules = append(srcTS.Rules, &CompactionRule{DestKey: dest, Aggregation: agg.Type, BucketDuration: agg.BucketDuration})
+	destTS.SourceKey = src
+	return nil
+}
+
+// TSDeleteRule removes the rule from src to dest.
+func (s *Store) TSDeleteRule(src, dest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srcTS, err := s.existingTimeSeries(src)
+	if err != nil {
+		return err
+	}
+	for i, rule := range srcTS.Rules {
+		if rule.DestKey == dest {
+			srcTS.Rules = append(srcTS.Rules[:i], srcTS.Rules[i+1:]...)
+			if destTS, _ := s.timeSeries(dest); destTS != nil {
+				destTS.SourceKey = ""
+			}
+			return nil
+		}
+	}
+	return errors.New("TSDB: compaction rule does not exist")
+}
+
+// ParseTSFilter parses one FILTER expression: label=value, label!=value,
+// label=(v1,v2), label!=(v1,v2), label= (absent) or label!= (present).
+func ParseTSFilter(expr string) (TSFilter, error) {
+	eq := strings.IndexByte(expr, '=')
+	if eq <= 0 {
+		return TSFilter{}, errors.New("TSDB: failed parsing labels")
+	}
+	f := TSFilter{Label: expr[:eq]}
+	if strings.HasSuffix(f.Label, "!") {
+		f.Negate = true
+		f.Label = strings.TrimSuffix(f.Label, "!")
+	}
+	value := expr[eq+1:]
+	if strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")") {
+		f.Values = strings.Split(value[1:len(value)-1], ",")
+	} else if value != "" {
+		f.Values = []string{value}
+	}
+	return f, nil
+}
+
+func (f TSFilter) matches(labels map[string]string) bool {
+	v, ok := labels[f.Label]
+	if len(f.Values) == 0 {
+		// label= means the label is absent; label!= means it is present.
+		return ok == f.Negate
+	}
+	hit := false
+	if ok {
+		for _, want := range f.Values {
+			if v == want {
+				hit = true
+				break
+			}
+		}
+	}
+	return hit != f.Negate
+}
+
+// matchTSFilters returns the sorted keys of series whose labels satisfy every
+// filter. At least one filter must be a positive label=value matcher.
+func (s *Store) matchTSFilters(filters []TSFilter) ([]string, error) {
+	positive := false
+	for _, f := range filters {
+		if !f.Negate && len(f.Values) > 0 {
+			positive = true
+		}
+	}
+	if !positive {
+		return nil, errors.New("TSDB: please provide at least one matcher")
+	}
+	var keys []string
+	for k := range s.data {
+		ts, err := s.timeSeries(k)
+		if err != nil || ts == nil {
+			continue
+		}
+		ok := true
+		for _, f := range filters {
+			if !f.matches(ts.Labels) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// TSQueryIndex returns the keys of series matching the filters.
+func (s *Store) TSQueryIndex(filters []TSFilter) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.matchTSFilters(filters)
+}
+
+// TSMRange runs a range query over every series matching the filters.
+func (s *Store) TSMRange(from, to int64, filters []TSFilter, agg *TSAggregation, count int, reverse bool) ([]TSSeriesResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys, err := s.matchTSFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]TSSeriesResult, len(keys))
+	for i, k := range keys {
+		ts := s.data[k].TimeSeries
+		out[i] = TSSeriesResult{Key: k, Labels: ts.Labels, Samples: rangeSamples(ts, from, to, agg, count, reverse)}
+	}
+	return out, nil
+}
+
+// TSInfo returns a snapshot of the series metadata (samples are not copied).
+func (s *Store) TSInfo(key string) (TimeSeries, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ts, err := s.existingTimeSeries(key)
+	if err != nil {
+		return TimeSeries{}, 0, err
+	}
+	info := *ts
+	info.Samples = nil
+	if n := len(ts.Samples); n > 0 {
+		info.Samples = []Sample{ts.Samples[0], ts.Samples[n-1]}
+	}
+	// Rules whose destination is gone are dropped by the next TS.ADD; they
+	// are already left out here.
+	info.Rules = nil
+	for _, r := range ts.Rules {
+		if s.ruleDest(key, r) != nil {
+			rule := *r
+			info.Rules = append(info.Rules, &rule)
+		}
+	}
+	return info, len(ts.Samples), nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Defaults for TOPK.RESERVE when only k is given.
+const (
+	topkDefaultWidth = 8
+	topkDefaultDepth = 7
+	topkDefaultDecay = 0.9
+)
+
+// Limits on TOPK.RESERVE dimensions (width*depth buckets, 256 MiB) and on a
+// single TOPK.INCRBY increment, which decays colliding buckets one unit at a
+// time. RedisBloom caps increments the same way.
+const (
+	topkMaxBuckets   = 1 << 24
+	topkMaxIncrement = 100000
+)
+
+// TopK tracks the K most frequent items with the HeavyKeeper algorithm: a
+// Depth x Width grid of fingerprint/counter buckets where colliding items decay
+// each other's counts, plus the current top list.
+type TopK struct {
+	K       int
+	Width   int
+	Depth   int
+	Decay   float64
+	Buckets []TopKBucket
+	Top     []TopKItem
+}
+
+// TopKBucket holds the fingerprint of the item currently owning the bucket.
+type TopKBucket struct {
+	Fingerprint uint32
+	Count       uint64
+}
+
+// TopKItem is one entry of the top list.
+type TopKItem struct {
+	Item  string
+	Count uint64
+}
+
+func newTopK(k, width, depth int, decay float64) *TopK {
+	return &TopK{K: k, Width: width, Depth: depth, Decay: decay, Buckets: make([]TopKBucket, width*depth)}
+}
+
+func topkFingerprint(item string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(item))
+	return h.Sum32()
+}
+
+// IncrBy adds n to item. If that pushes item into the top list and another item
+// falls out, the expelled item is returned.
+func (t *TopK) IncrBy(item string, n uint64) (string, bool) {
+	fp := topkFingerprint(item)
+	h1, h2 := bloomHashes(item)
+	var maxCount uint64
+	for row := 0; row < t.Depth; row++ {
+		b := &t.Buckets[row*t.Width+int((h1+uint64(row)*h2)%uint64(t.Width))]
+		switch {
+		case b.Count == 0:
+			b.Fingerprint = fp
+			b.Count = n
+		case b.Fingerprint == fp:
+			b.Count += n
+		default:
+			// Each increment decays the resident item with probability decay^count;
+			// once it reaches zero the bucket is taken over.
+			for left := n; left > 0; left-- {
+				if rand.Float64() < math.Pow(t.Decay, float64(b.Count)) {
+					b.Count--
+					if b.Count == 0 {
+						b.Fingerprint = fp
+						b.Count = left
+						break
+					}
+				}
+			}
+		}
+		if b.Fingerprint == fp && b.Count > maxCount {
+			maxCount = b.Count
+		}
+	}
+	return t.updateTop(item, maxCount)
+}
+
+func (t *TopK) updateTop(item string, count uint64) (string, bool) {
+	for i := range t.Top {
+		if t.Top[i].Item == item {
+			t.Top[i].Count = count
+			return "", false
+		}
+	}
+	if count == 0 {
+		return "", false
+	}
+	if len(t.Top) < t.K {
+		t.Top = append(t.Top, TopKItem{Item: item, Count: count})
+		return "", false
+	}
+	min := 0
+	for i := range t.Top {
+		if t.Top[i].Count < t.Top[min].Count {
+			min = i
+		}
+	}
+	if count <= t.Top[min].Count {
+		return "", false
+	}
+	expelled := t.Top[min].Item
+	t.Top[min] = TopKItem{Item: item, Count: count}
+	return expelled, true
+}
+
+// Count returns the HeavyKeeper estimate for item.
+func (t *TopK) Count(item string) uint64 {
+	fp := topkFingerprint(item)
+	h1, h2 := bloomHashes(item)
+	var maxCount uint64
+	for row := 0; row < t.Depth; row++ {
+		b := t.Buckets[row*t.Width+int((h1+uint64(row)*h2)%uint64(t.Width))]
+		if b.Fingerprint == fp && b.Count > maxCount {
+			maxCount = b.Count
+		}
+	}
+	return maxCount
+}
+
+// Contains reports whether item is currently in the top list.
+func (t *TopK) Contains(item string) bool {
+	for _, it := range t.Top {
+		if it.Item == item {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the top list ordered by descending count.
+func (t *TopK) List() []TopKItem {
+	out := make([]TopKItem, len(t.Top))
+	copy(out, t.Top)
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count == out[j].Count {
+			return out[i].Item < out[j].Item
+		}
+		return out[i].Count > out[j].Count
+	})
+	return out
+}
+
+// topk returns the Top-K structure at key, or nil if the key doesn't exist.
+func (s *Store) topk(key string) (*TopK, error) {
+	val, err := s.typed(key, TopKType)
+	if val == nil {
+		return nil, err
+	}
+	return val.TopK, nil
+}
+
+// topkExisting is topk but treats a missing key as an error.
+func (s *Store) topkExisting(key string) (*TopK, error) {
+	t, err := s.topk(key)
+	if err == nil && t == nil {
+		err = errors.New("TopK: key does not exist")
+	}
+	return t, err
+}
+
+// TopKReserve creates an empty Top-K structure.
+func (s *Store) TopKReserve(key string, k, width, depth int, decay float64) error {
+	if k < 1 || width < 1 || depth < 1 {
+		return errors.New("k, width and depth must be positive")
+	}
+	if width > topkMaxBuckets/depth || k > topkMaxBuckets {
+		return errors.New("TopK: width and depth are too large")
+	}
+	if decay <= 0 || decay > 1 {
+		return errors.New("decay must be in (0, 1]")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.lookup(key); ok {
+		return errors.New("TopK: key already exists")
+	}
+	s.setValue(key, &Value{Type: TopKType, TopK: newTopK(k, width, depth, decay)})
+	return nil
+}
+
+// TopKIncrBy increments each item by its count. For every item the result holds
+// the item it expelled from the top list, or nil.
+func (s *Store) TopKIncrBy(key string, items []string, counts []uint64) ([]*string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range counts {
+		if n > topkMaxIncrement {
+			return nil, errors.New("TopK: increment must be an integer less than or equal to 100000")
+		}
+	}
+	t, err := s.topkExisting(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*string, len(items))
+	for i, item := range items {
+		if expelled, ok := t.IncrBy(item, counts[i]); ok {
+			out[i] = &expelled
+		}
+	}
+	return out, nil
+}
+
+// TopKQuery reports for each item whether it is in the top list.
+func (s *Store) TopKQuery(key string, items ...string) ([]bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, err := s.topkExisting(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]bool, len(items))
+	for i, item := range items {
+		out[i] = t.Contains(item)
+	}
+	return out, nil
+}
+
+// TopKCount returns the estimated count of each item.
+func (s *Store) TopKCount(key string, items ...string) ([]uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, err := s.topkExisting(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]uint64, len(items))
+	for i, item := range items {
+		out[i] = t.Count(item)
+	}
+	return out, nil
+}
+
+// TopKList returns the current top items, highest count first.
+func (s *Store) TopKList(key string) ([]TopKItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, err := s.topkExisting(key)
+	if err != nil {
+		return nil, err
+	}
+	return t.List(), nil
+}
+
+// TopKInfo returns the structure's parameters.
+func (s *Store) TopKInfo(key string) (TopK, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, err := s.topkExisting(key)
+	if err != nil {
+		return TopK{}, err
+	}
+	return TopK{K: t.K, Width: t.Width, Depth: t.Depth, Decay: t.Decay}, nil
+}
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Similarity metrics for vector sets.
+const (
+	vectorCosine = "COSINE"
+	vectorL2     = "L2"
+	vectorIP     = "IP"
+)
+
+const (
+	// Sets smaller than this are searched exhaustively; the HNSW graph is only
+	// built once a set grows past it.
+	vectorBruteForceLimit = 1000
+	vectorDefaultM        = 16
+	vectorDefaultEF       = 200
+)
+
+// VectorSet maps members to fixed-dimension float32 vectors. Cosine sets store
+// vectors normalised so similarity is a plain dot product.
+type VectorSet struct {
+	Dim            int
+	Metric         string
+	M              int
+	EFConstruction int
+	Elements       map[string]*VectorElement
+	graph          *hnswGraph
+}
+
+// VectorElement is one member's vector and optional JSON attributes.
+type VectorElement struct {
+	Vector []float32
+	Attrs  string
+	parsed map[string]interface{} // Attrs decoded, for FILTER
+}
+
+func (el *VectorElement) setAttrs(attrs string) {
+	el.Attrs = attrs
+	el.parsed = nil
+	if attrs != "" {
+		json.Unmarshal([]byte(attrs), &el.parsed)
+	}
+}
+
+// VectorMatch is one VSIM result. Score is the cosine similarity, the L2
+// distance or the inner product depending on the set's metric.
+type VectorMatch struct {
+	Element string
+	Score   float64
+}
+
+// VSimOptions controls a similarity query.
+type VSimOptions struct {
+	Vector  []float32 // query vector, or
+	Element string    // the vector of an existing member
+	Count   int
+	EF      int
+	Filter  string
+	Exact   bool // force a brute-force scan
+}
+
+// VectorInfo describes a vector set for VINFO.
+type VectorInfo struct {
+	Dim      int
+	Metric   string
+	Size     int
+	M        int
+	HNSW     bool
+	MaxLevel int
+}
+
+func newVectorSet(dim int, metric string, m, ef int) *VectorSet {
+	return &VectorSet{Dim: dim, Metric: metric, M: m, EFConstruction: ef, Elements: make(map[string]*VectorElement)}
+}
+
+func dotProduct(a, b []float32) float32 {
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+func squaredL2(a, b []float32) float32 {
+	var sum float32
+	for i := range a {
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	return sum
+}
+
+func normalize(v []float32) []float32 {
+	norm := float32(math.Sqrt(float64(dotProduct(v, v))))
+	out := make([]float32, len(v))
+	if norm == 0 {
+		return out
+	}
+	for i, x := range v {
+		out[i] = x / norm
+	}
+	return out
+}
+
+// distance orders candidates: smaller is more similar for every metric.
+func (vs *VectorSet) distance(a, b []float32) float32 {
+	switch vs.Metric {
+	case vectorL2:
+		return squaredL2(a, b)
+	default: // cosine vectors are normalised, so both reduce to a dot product
+		return -dotProduct(a, b)
+	}
+}
+
+// score converts an internal distance to the value reported to clients.
+func (vs *VectorSet) score(dist float32) float64 {
+	if vs.Metric == vectorL2 {
+		return math.Sqrt(float64(dist))
+	}
+	return float64(-dist)
+}
+
+func (vs *VectorSet) prepare(vec []float32) []float32 {
+	if vs.Metric == vectorCosine {
+		return normalize(vec)
+	}
+	out := make([]float32, len(vec))
+	copy(out, vec)
+	return out
+}
+
+func (vs *VectorSet) add(element string, vec []float32) bool {
+	vec = vs.prepare(vec)
+	el, exists := vs.Elements[element]
+	if exists {
+		el.Vector = vec
+	} else {
+		vs.Elements[element] = &VectorElement{Vector: vec}
+	}
+	if vs.graph != nil {
+		vs.graph.Insert(element, vec)
+	} else if len(vs.Elements) >= vectorBruteForceLimit {
+		vs.buildGraph()
+	}
+	return !exists
+}
+
+func (vs *VectorSet) remove(element string) bool {
+	if _, ok := vs.Elements[element]; !ok {
+		return false
+	}
+	delete(vs.Elements, element)
+	if vs.graph != nil {
+		vs.graph.Remove(element)
+	}
+	return true
+}
+
+func (vs *VectorSet) buildGraph() {
+	vs.graph = newHNSWGraph(vs.M, vs.EFConstruction, vs.distance)
+	names := make([]string, 0, len(vs.Elements))
+	for name := range vs.Elements {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		vs.graph.Insert(name, vs.Elements[name].Vector)
+	}
+}
+
+// search returns the count members closest to query that pass accept.
+func (vs *VectorSet) search(query []float32, count, ef int, exact bool, accept func(string) bool) []VectorMatch {
+	var found []hnswCandidate
+	if vs.graph != nil && !exact {
+		var nodeAccept func(*hnswNode) bool
+		if accept != nil {
+			nodeAccept = func(n *hnswNode) bool { return accept(n.id) }
+		}
+		found = vs.graph.Search(query, count, ef, nodeAccept)
+	}
+	// A selective filter can leave the graph walk short of results, so fall
+	// back to a full scan rather than return too few.
+	if found == nil || (len(found) < count && len(found) < len(vs.Elements)) {
+		found = found[:0]
+		for name, el := range vs.Elements {
+			if accept == nil || accept(name) {
+				found = append(found, hnswCandidate{&hnswNode{id: name}, vs.distance(query, el.Vector)})
+			}
+		}
+		sort.Slice(found, func(i, j int) bool {
+			if found[i].dist == found[j].dist {
+				return found[i].node.id < found[j].node.id
+			}
+			return found[i].dist < found[j].dist
+		})
+		if len(found) > count {
+			found = found[:count]
+		}
+	}
+	out := make([]VectorMatch, len(found))
+	for i, c := range found {
+		out[i] = VectorMatch{Element: c.node.id, Score: vs.score(c.dist)}
+	}
+	return out
+}
+
+// vectorSet returns the vector set at key, or nil if the key doesn't exist.
+func (s *Store) vectorSet(key string) (*VectorSet, error) {
+	val, err := s.typed(key, VectorSetType)
+	if val == nil {
+		return nil, err
+	}
+	return val.Vectors, nil
+}
+
+// VAdd stores vec for element, creating the set on first use with the given
+// metric, M and EF (zero means default). It reports whether element was new.
+// attrs, if non-empty, replaces the element's JSON attributes.
+func (s *Store) VAdd(key, element string, vec []float32, metric string, m, ef int, attrs string) (bool, error) {
+	if len(vec) == 0 {
+		return false, errors.New("vector must not be empty")
+	}
+	if attrs != "" && !json.Valid([]byte(attrs)) {
+		return false, errors.New("invalid JSON in attributes")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vs, err := s.vectorSet(key)
+	if err != nil {
+		return false, err
+	}
+	if vs == nil {
+		if metric == "" {
+			metric = vectorCosine
+		}
+		if m <= 0 {
+			m = vectorDefaultM
+		}
+		if ef <= 0 {
+			ef = vectorDefaultEF
+		}
+		vs = newVectorSet(len(vec), metric, m, ef)
+		s.setValue(key, &Value{Type: VectorSetType, Vectors: vs})
+	} else if metric != "" && metric != vs.Metric {
+		return false, errors.New("vector set uses the " + vs.Metric + " metric")
+	}
+	if len(vec) != vs.Dim {
+		return false, errors.New("vector dimension mismatch - got " + strconv.Itoa(len(vec)) + " but set has " + strconv.Itoa(vs.Dim))
+	}
+	added := vs.add(element, vec)
+	if attrs != "" {
+		vs.Elements[element].setAttrs(attrs)
+	}
+	return added, nil
+}
+
+// VRem removes element; the key is deleted with its last element.
+func (s *Store) VRem(key, element string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vs, err := s.vectorSet(key)
+	if err != nil || vs == nil {
+		return false, err
+	}
+	removed := vs.remove(element)
+	if len(vs.Elements) == 0 {
+		s.deleteKey(key)
+	}
+	return removed, nil
+}
+
+// VSim runs a k-nearest-neighbour query, most similar first.
+func (s *Store) VSim(key string, opts VSimOptions) ([]VectorMatch, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	vs, err := s.vectorSet(key)
+	if err != nil || vs == nil {
+		return nil, err
+	}
+	query := opts.Vector
+	if opts.Element != "" {
+		el, ok := vs.Elements[opts.Element]
+		if !ok {
+			return nil, errors.New("element not found in the set")
+		}
+		query = el.Vector
+	} else {
+		if len(query) != vs.Dim {
+			return nil, errors.New("vector dimension mismatch - got " + strconv.Itoa(len(query)) + " but set has " + strconv.Itoa(vs.Dim))
+		}
+		query = vs.prepare(query)
+	}
+	var accept func(string) bool
+	if opts.Filter != "" {
+		expr, err := parseVectorFilter(opts.Filter)
+		if err != nil {
+			return nil, err
+		}
+		accept = func(name string) bool { return expr.match(vs.Elements[name].parsed) }
+	}
+	count := opts.Count
+	if count <= 0 {
+		count = 10
+	}
+	ef := opts.EF
+	if ef <= 0 {
+		ef = max(count, vs.EFConstruction)
+	}
+	return vs.search(query, count, ef, opts.Exact, accept), nil
+}
+
+// VCard returns the number of elements in the set.
+func (s *Store) VCard(key string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	vs, err := s.vectorSet(key)
+	if err != nil || vs == nil {
+		return 0, err
+	}
+	return len(vs.Elements), nil
+}
+
+// VEmb returns the stored vector of element (normalised for cosine sets).
+func (s *Store) VEmb(key, element string) ([]float32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	vs, err := s.vectorSet(key)
+	if err != nil || vs == nil {
+		return nil, err
+	}
+	el, ok := vs.Elements[element]
+	if !ok {
+		return nil, nil
+	}
+	out := make([]float32, len(el.Vector))
+	copy(out, el.Vector)
+	return out, nil
+}
+
+// VSetAttr replaces element's JSON attributes; an empty string clears them.
+func (s *Store) VSetAttr(key, element, attrs string) (bool, error) {
+	if attrs != "" && !json.Valid([]byte(attrs)) {
+		return false, errors.New("invalid JSON in attributes")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vs, err := s.vectorSet(key)
+	if err != nil || vs == nil {
+		return false, err
+	}
+	el, ok := vs.Elements[element]
+	if !ok {
+		return false, nil
+	}
+	el.setAttrs(attrs)
+	return true, nil
+}
+
+// VGetAttr returns element's JSON attributes.
+func (s *Store) VGetAttr(key, element string) (string, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	vs, err := s.vectorSet(key)
+	if err != nil || vs == nil {
+		return "", false, err
+	}
+	el, ok := vs.Elements[element]
+	if !ok || el.Attrs == "" {
+		return "", false, nil
+	}
+	return el.Attrs, true, nil
+}
+
+// VInfo describes the vector set at key.
+func (s *Store) VInfo(key string) (VectorInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	vs, err := s.vectorSet(key)
+	if err != nil {
+		return VectorInfo{}, err
+	}
+	if vs == nil {
+		return VectorInfo{}, errors.New("key does not exist")
+	}
+	info := VectorInfo{Dim: vs.Dim, Metric: vs.Metric, Size: len(vs.Elements), M: vs.M, HNSW: vs.graph != nil}
+	if vs.graph != nil && vs.graph.entry != nil {
+		info.MaxLevel = len(vs.graph.entry.links) - 1
+	}
+	return info, nil
+}
+
+// ---------- Attribute filters ----------
+//
+// FILTER expressions test an element's JSON attributes, e.g.
+//
+//	.year >= 1980 and .genre == "drama"
+//	not (.rating < 3) || .featured
+//
+// Operators: == != < <= > >=, and/&&, or/||, not/!, parentheses. Elements
+// without attributes, or missing a referenced field, never match.
+
+type vectorFilter interface {
+	eval(attrs map[string]interface{}) (interface{}, bool)
+}
+
+type filterExpr struct{ root vectorFilter }
+
+func (f filterExpr) match(attrs map[string]interface{}) bool {
+	if attrs == nil {
+		return false
+	}
+	v, ok := f.root.eval(attrs)
+	return ok && truthy(v)
+}
+
+type filterLiteral struct{ value interface{} }
+type filterField struct{ name string }
+type filterNot struct{ child vectorFilter }
+type filterBinary struct {
+	op          string
+	left, right vectorFilter
+}
+
+func (l filterLiteral) eval(map[string]interface{}) (interface{}, bool) { return l.value, true }
+
+func (f filterField) eval(attrs map[string]interface{}) (interface{}, bool) {
+	v, ok := attrs[f.name]
+	return v, ok
+}
+
+func (n filterNot) eval(attrs map[string]interface{}) (interface{}, bool) {
+	v, ok := n.child.eval(attrs)
+	return ok && !truthy(v), ok
+}
+
+func (b filterBinary) eval(attrs map[string]interface{}) (interface{}, bool) {
+	l, lok := b.left.eval(attrs)
+	switch b.op {
+	case "and":
+		if !lok || !truthy(l) {
+			return false, lok
+		}
+		r, rok := b.right.eval(attrs)
+		return rok && truthy(r), rok
+	case "or":
+		if lok && truthy(l) {
+			return true, true
+		}
+		r, rok := b.right.eval(attrs)
+		return rok && truthy(r), rok
+	}
+	r, rok := b.right.eval(attrs)
+	if !lok || !rok {
+		return false, false
+	}
+	if ln, ok := l.(float64); ok {
+		if rn, ok := r.(float64); ok {
+			return compareOrdered(b.op, ln, rn), true
+		}
+	}
+	if ls, ok := l.(string); ok {
+		if rs, ok := r.(string); ok {
+			return compareOrdered(b.op, ls, rs), true
+		}
+	}
+	switch b.op {
+	case "==":
+		return l == r, true
+	case "!=":
+		return l != r, true
+	}
+	return false, true
+}
+
+func compareOrdered[T float64 | string](op string, a, b T) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case bool:
+		return x
+	case float64:
+		return x != 0
+	case string:
+		return x != ""
+	case nil:
+		return false
+	}
+	return true
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func parseVectorFilter(s string) (filterExpr, error) {
+	tokens, err := tokenizeFilter(s)
+	if err != nil {
+		return filterExpr{}, err
+	}
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return filterExpr{}, err
+	}
+	if p.pos < len(p.tokens) {
+		return filterExpr{}, errors.New("syntax error in FILTER near " + p.tokens[p.pos])
+	}
+	return filterExpr{root}, nil
+}
+
+func tokenizeFilter(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, errors.New("unterminated string in FILTER")
+			}
+			tokens = append(tokens, s[i:i+end+2])
+			i += end + 2
+		case strings.HasPrefix(s[i:], "&&"), strings.HasPrefix(s[i:], "||"),
+			strings.HasPrefix(s[i:], "=="), strings.HasPrefix(s[i:], "!="),
+			strings.HasPrefix(s[i:], "<="), strings.HasPrefix(s[i:], ">="):
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		case strings.IndexByte("()<>!", c) >= 0:
+			tokens = append(tokens, s[i:i+1])
+			i++
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && strings.IndexByte("()<>!=&|\"'", s[j]) < 0 {
+				j++
+			}
+			if j == i {
+				return nil, errors.New("unexpected character in FILTER: " + string(c))
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) parseOr() (vectorFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t == "||" || strings.EqualFold(t, "or"); t = p.peek() {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterBinary{"or", left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (vectorFilter, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t == "&&" || strings.EqualFold(t, "and"); t = p.peek() {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = filterBinary{"and", left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (vectorFilter, error) {
+	if t := p.peek(); t == "!" || strings.EqualFold(t, "not") {
+		p.pos++
+		child, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{child}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (vectorFilter, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.pos++
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return filterBinary{op, left, right}, nil
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseOperand() (vectorFilter, error) {
+	t := p.peek()
+	if t == "" {
+		return nil, errors.New("unexpected end of FILTER")
+	}
+	p.pos++
+	switch {
+	case t == "(":
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing ')' in FILTER")
+		}
+		p.pos++
+		return inner, nil
+	case t[0] == '"' || t[0] == '\'':
+		return filterLiteral{t[1 : len(t)-1]}, nil
+	case t[0] == '.' && len(t) > 1:
+		return filterField{t[1:]}, nil
+	case t == "true" || t == "false":
+		return filterLiteral{t == "true"}, nil
+	case t == "null":
+		return filterLiteral{nil}, nil
+	}
+	n, err := strconv.ParseFloat(t, 64)
+	if err != nil {
+		return nil, errors.New("syntax error in FILTER near " + t)
+	}
+	return filterLiteral{n}, nil
+}
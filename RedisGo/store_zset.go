@@ -1,7 +1,6 @@
 package main
 
 import (
-	"errors"
 	"sort"
 )
 
@@ -18,11 +17,14 @@ func zsetMapSync(zs []ZSetEntry, zm map[string]*ZSetEntry) {
 	}
 }
 
-func (s *Store) ZAdd(key string, score float64, member string) int {
+func (s *Store) ZAdd(key string, score float64, member string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	v, _ := s.getOrInitZSet(key)
+	v, err := s.getOrInitZSet(key)
+	if err != nil {
+		return 0, err
+	}
 	entry, exists := v.ZSetMap[member]
 	if exists {
 		// Update score if changed, then re-sort and resync
@@ -36,11 +38,12 @@ func (s *Store) ZAdd(key string, score float64, member string) int {
 			})
 			zsetMapSync(v.ZSet, v.ZSetMap)
 		}
-		return 0 // not a new member
+		return 0, nil // not a new member
 	}
 	// Add new member
 	newEntry := ZSetEntry{Member: member, Score: score}
 	v.ZSet = append(v.ZSet, newEntry)
+	v.members.add(member)
 	// Resort after insertion and resync pointers
 	sort.Slice(v.ZSet, func(i, j int) bool {
 		if v.ZSet[i].Score == v.ZSet[j].Score {
@@ -49,23 +52,24 @@ func (s *Store) ZAdd(key string, score float64, member string) int {
 		return v.ZSet[i].Score < v.ZSet[j].Score
 	})
 	zsetMapSync(v.ZSet, v.ZSetMap)
-	return 1
+	return 1, nil
 }
 
-func (s *Store) ZRem(key string, member string) int {
+func (s *Store) ZRem(key string, member string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	val, ok := s.data[key]
-	if !ok || val.Type != ZSetType {
-		return 0
+	val, err := s.typed(key, ZSetType)
+	if val == nil {
+		return 0, err
 	}
 	_, exists := val.ZSetMap[member]
 	if !exists {
-		return 0
+		return 0, nil
 	}
 	// Remove from map and slice
 	delete(val.ZSetMap, member)
+	val.members.remove(member)
 	for i, entry := range val.ZSet {
 		if entry.Member == member {
 			val.ZSet = append(val.ZSet[:i], val.ZSet[i+1:]...)
@@ -73,16 +77,31 @@ func (s *Store) ZRem(key string, member string) int {
 		}
 	}
 	zsetMapSync(val.ZSet, val.ZSetMap)
-	return 1
+	return 1, nil
+}
+
+// ZScore returns the score of member in the sorted set at key.
+func (s *Store) ZScore(key, member string) (float64, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, err := s.typed(key, ZSetType)
+	if val == nil {
+		return 0, false, err
+	}
+	entry, ok := val.ZSetMap[member]
+	if !ok {
+		return 0, false, nil
+	}
+	return entry.Score, true, nil
 }
 
 func (s *Store) ZRange(key string, start, stop int) ([]string, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	val, ok := s.data[key]
-	if !ok || val.Type != ZSetType {
-		return nil, errors.New("no such key or not a zset")
+	val, err := s.typed(key, ZSetType)
+	if val == nil {
+		return nil, err
 	}
 	n := len(val.ZSet)
 	if n == 0 {
@@ -111,16 +130,16 @@ func (s *Store) ZRange(key string, start, stop int) ([]string, error) {
 	return res, nil
 }
 
-func (s *Store) getOrInitZSet(key string) (*Value, bool) {
-	val, ok := s.data[key]
-	if ok && val.Type == ZSetType {
-		return val, true
+func (s *Store) getOrInitZSet(key string) (*Value, error) {
+	val, err := s.typed(key, ZSetType)
+	if val != nil || err != nil {
+		return val, err
 	}
 	newZSet := &Value{
 		Type:    ZSetType,
 		ZSet:    []ZSetEntry{},
 		ZSetMap: make(map[string]*ZSetEntry),
 	}
-	s.data[key] = newZSet
-	return newZSet, false
+	s.setValue(key, newZSet)
+	return newZSet, nil
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsProtocols maps the protocol names tls-protocols accepts, as Redis spells
+// them, to their versions.
+var tlsProtocols = map[string]uint16{
+	"tlsv1": tls.VersionTLS10, "tlsv1.1": tls.VersionTLS11,
+	"tlsv1.2": tls.VersionTLS12, "tlsv1.3": tls.VersionTLS13,
+}
+
+// parseTLSProtocols returns the lowest and highest of the space-separated
+// protocol names in s, or TLS 1.2 and 1.3 if s is empty.
+func parseTLSProtocols(s string) (lo, hi uint16, err error) {
+	names := strings.Fields(s)
+	if len(names) == 0 {
+		return tls.VersionTLS12, tls.VersionTLS13, nil
+	}
+	for _, name := range names {
+		v, ok := tlsProtocols[strings.ToLower(name)]
+		if !ok {
+			return 0, 0, fmt.Errorf("unknown TLS protocol '%s'", name)
+		}
+		if lo == 0 || v < lo {
+			lo = v
+		}
+		hi = max(hi, v)
+	}
+	return lo, hi, nil
+}
+
+// parseTLSCiphers looks up the colon-separated cipher suite names in s, in
+// their IANA spelling such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. They
+// apply up to TLS 1.2; TLS 1.3 suites are not configurable. An empty s
+// leaves Go's defaults.
+func parseTLSCiphers(s string) ([]uint16, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ids []uint16
+	for _, name := range strings.Split(s, ":") {
+		id, ok := uint16(0), false
+		for _, c := range tls.CipherSuites() {
+			if c.Name == name {
+				id, ok = c.ID, true
+				break
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite '%s'", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// buildTLSConfig loads the certificates named in c into a server TLS config.
+func buildTLSConfig(c Config) (*tls.Config, error) {
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return nil, errors.New("tls-cert-file and tls-key-file must be set")
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading the TLS certificate: %v", err)
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if c.TLSCACertFile != "" {
+		pem, err := os.ReadFile(c.TLSCACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading the CA certificates: %v", err)
+		}
+		conf.ClientCAs = x509.NewCertPool()
+		if !conf.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("loading the CA certificates: no certificates in %s", c.TLSCACertFile)
+		}
+	}
+	switch c.TLSAuthClients {
+	case "yes":
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		conf.ClientAuth = tls.NoClientCert
+	}
+	if conf.ClientAuth != tls.NoClientCert && conf.ClientCAs == nil {
+		return nil, errors.New("tls-ca-cert-file must be set to verify clients; set tls-auth-clients no to not verify them")
+	}
+	if conf.MinVersion, conf.MaxVersion, err = parseTLSProtocols(c.TLSProtocols); err != nil {
+		return nil, err
+	}
+	if conf.CipherSuites, err = parseTLSCiphers(c.TLSCiphers); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// tlsSource is what a TLS config was built from: the settings and the
+// modification times of the files they name.
+type tlsSource struct {
+	certFile, keyFile, caFile    string
+	authClients, protos, ciphers string
+	certMod, keyMod, caMod       time.Time
+}
+
+func newTLSSource(c Config) tlsSource {
+	modTime := func(path string) time.Time {
+		if fi, err := os.Stat(path); err == nil {
+			return fi.ModTime()
+		}
+		return time.Time{}
+	}
+	return tlsSource{
+		certFile: c.TLSCertFile, keyFile: c.TLSKeyFile, caFile: c.TLSCACertFile,
+		authClients: c.TLSAuthClients, protos: c.TLSProtocols, ciphers: c.TLSCiphers,
+		certMod: modTime(c.TLSCertFile), keyMod: modTime(c.TLSKeyFile), caMod: modTime(c.TLSCACertFile),
+	}
+}
+
+// tlsReloader hands out the TLS config for new connections. It rebuilds it
+// when the settings change or a certificate file is rewritten, so that
+// certificates can be rotated without a restart. Connections already open
+// keep the config they started with.
+type tlsReloader struct {
+	mu      sync.Mutex
+	current *tls.Config
+	source  tlsSource
+	failed  tlsSource // last source that failed to load, not retried until it changes
+}
+
+// reload builds the config for c, replacing the current one if it loads.
+func (r *tlsReloader) reload(c Config) error {
+	src := newTLSSource(c)
+	conf, err := buildTLSConfig(c)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.failed = src
+		return err
+	}
+	r.current, r.source = conf, src
+	return nil
+}
+
+// config returns the config for c, reloading it first if c or the files
+// have changed. If reloading fails the previous config stays in use.
+func (r *tlsReloader) config(c Config) *tls.Config {
+	src := newTLSSource(c)
+	r.mu.Lock()
+	current, stale := r.current, src != r.source && src != r.failed
+	r.mu.Unlock()
+	if !stale {
+		return current
+	}
+	if err := r.reload(c); err != nil {
+		log.Println("Keeping the previous TLS configuration:", err)
+		return current
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// listenTLS listens on tls-port. Every handshake asks tlsConfig for the
+// config, so changes apply to the next client.
+func (s *Server) listenTLS(cfg Config) (net.Listener, error) {
+	if err := s.tlsConfig.reload(cfg); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", cfg.TLSAddr())
+	if err != nil {
+		return nil, err
+	}
+	return s.tlsListener(ln), nil
+}
+
+// tlsListener wraps ln so that the clients it accepts talk TLS.
+func (s *Server) tlsListener(ln net.Listener) net.Listener {
+	return tls.NewListener(ln, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.tlsConfig.config(s.config()), nil
+		},
+	})
+}
@@ -3,12 +3,42 @@ import os
 
 REDIS_HOST = os.environ.get("REDIS_HOST", "localhost")
 REDIS_PORT = int(os.environ.get("REDIS_PORT", 6379))
+# Set when the server has requirepass or ACL users; the username defaults to
+# the default user.
+REDIS_USERNAME = os.environ.get("REDIS_USERNAME", "")
+REDIS_PASSWORD = os.environ.get("REDIS_PASSWORD", "")
 
 print(f"🌟 Connecting to RedisGo at {REDIS_HOST}:{REDIS_PORT}")
 
+def quote(arg) -> str:
+    """Quote an argument for an inline command so spaces, quotes and control
+    characters survive the server's redis-cli style parsing."""
+    out = ['"']
+    for ch in str(arg):
+        if ch in '"\\':
+            out.append('\\' + ch)
+        elif ch == '\n':
+            out.append('\\n')
+        elif ch == '\r':
+            out.append('\\r')
+        elif ch == '\t':
+            out.append('\\t')
+        elif ord(ch) < 32 or ord(ch) == 127:
+            out.append('\\x%02x' % ord(ch))
+        else:
+            out.append(ch)
+    out.append('"')
+    return ''.join(out)
+
 def send_redis_command(cmd: str) -> str:
     with socket.socket(socket.AF_INET, socket.SOCK_STREAM) as s:
         s.connect((REDIS_HOST, REDIS_PORT))
+        if REDIS_PASSWORD:
+            creds = [REDIS_USERNAME, REDIS_PASSWORD] if REDIS_USERNAME else [REDIS_PASSWORD]
+            s.sendall(("AUTH " + " ".join(quote(c) for c in creds) + "\r\n").encode())
+            reply = s.recv(4096).decode()
+            if not reply.startswith("+OK"):
+                return reply
         s.sendall((cmd + "\r\n").encode())
         data = s.recv(4096)
         return data.decode()
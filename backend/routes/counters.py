@@ -1,15 +1,15 @@
 from fastapi import APIRouter, HTTPException
 from models import CounterRequest
-from redis_client import send_redis_command
+from redis_client import quote, send_redis_command
 
 router = APIRouter()
 
 @router.post("/counter")
 def update_counter(req: CounterRequest):
     if req.action == "incr":
-        resp = send_redis_command(f"INCR {req.key}")
+        resp = send_redis_command(f"INCR {quote(req.key)}")
     elif req.action == "decr":
-        resp = send_redis_command(f"DECR {req.key}")
+        resp = send_redis_command(f"DECR {quote(req.key)}")
     else:
         raise HTTPException(status_code=400, detail="Invalid action for counter.")
 
@@ -1,19 +1,19 @@
 from fastapi import APIRouter, HTTPException
 from models import HashSetRequest, HashDelRequest
-from redis_client import send_redis_command
+from redis_client import quote, send_redis_command
 
 router = APIRouter()
 
 @router.post("/hash/set")
 def set_hash_field(req: HashSetRequest):
-    resp = send_redis_command(f"HSET {req.key} {req.field} {req.value}")
+    resp = send_redis_command(f"HSET {quote(req.key)} {quote(req.field)} {quote(req.value)}")
     if resp.startswith(":"):
         return {"created": bool(int(resp[1:].strip()))}
     raise HTTPException(status_code=400, detail=resp)
 
 @router.get("/hash/get")
 def get_hash_field(key: str, field: str):
-    resp = send_redis_command(f"HGET {key} {field}")
+    resp = send_redis_command(f"HGET {quote(key)} {quote(field)}")
     if resp.startswith("$"):
         lines = resp.strip().split('\r\n')
         if len(lines) >= 2:
@@ -24,7 +24,7 @@ def get_hash_field(key: str, field: str):
 
 @router.get("/hash/all")
 def get_hash_all(key: str):
-    resp = send_redis_command(f"HGETALL {key}")
+    resp = send_redis_command(f"HGETALL {quote(key)}")
     if not resp.startswith("*"):
         return {"fields": {}}
     lines = resp.strip().split('\r\n')[1:]
@@ -36,7 +36,7 @@ def get_hash_all(key: str):
 
 @router.post("/hash/del")
 def del_hash_field(req: HashDelRequest):
-    resp = send_redis_command(f"HDEL {req.key} {req.field}")
+    resp = send_redis_command(f"HDEL {quote(req.key)} {quote(req.field)}")
     if resp.startswith(":"):
         return {"deleted": bool(int(resp[1:].strip()))}
     raise HTTPException(status_code=400, detail=resp)
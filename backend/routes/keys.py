@@ -1,14 +1,25 @@
 from fastapi import APIRouter
-from redis_client import send_redis_command
+from redis_client import quote, send_redis_command
 
 router = APIRouter()
 
 @router.get("/keys")
 def get_keys():
-    resp = send_redis_command("KEYS")
+    resp = send_redis_command("KEYS *")
     keys = []
     if resp.startswith("*"):
         lines = resp.strip().split('\r\n')[1:]
         for i in range(1, len(lines), 2):
             keys.append(lines[i])
-    return {"keys": keys}
+    types = {}
+    for key in keys:
+        resp = send_redis_command(f"TYPE {quote(key)}")
+        types[key] = resp[1:].strip() if resp.startswith("+") else "none"
+    return {"keys": keys, "types": types}
+
+@router.get("/keys/type")
+def get_key_type(key: str):
+    resp = send_redis_command(f"TYPE {quote(key)}")
+    if resp.startswith("+"):
+        return {"type": resp[1:].strip()}
+    return {"type": "none"}
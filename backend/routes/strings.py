@@ -1,19 +1,19 @@
 from fastapi import APIRouter, HTTPException
 from models import SetRequest
-from redis_client import send_redis_command
+from redis_client import quote, send_redis_command
 
 router = APIRouter()
 
 @router.post("/set")
 def set_key(req: SetRequest):
-    resp = send_redis_command(f"SET {req.key} {req.value}")
+    resp = send_redis_command(f"SET {quote(req.key)} {quote(req.value)}")
     if "+OK" in resp:
         return {"success": True}
     raise HTTPException(status_code=400, detail=resp)
 
 @router.get("/get/{key}")
 def get_key(key: str):
-    resp = send_redis_command(f"GET {key}")
+    resp = send_redis_command(f"GET {quote(key)}")
     if resp.startswith("$"):
         return {"value": resp.split('\r\n')[1]}
     return {"value": None}